@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	cloud_storage "github.com/rampage644/s3-overlay-proxy/cloud-storage"
+	proxy_config "github.com/rampage644/s3-overlay-proxy/internal/config"
+)
+
+// adminFlagSet returns a flag set for a command talking to the admin API of
+// a running proxy, along with its -admin.url flag.
+func adminFlagSet(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	adminURL := fs.String("admin.url", "http://localhost:9090", "admin API URL of the running proxy")
+	return fs, adminURL
+}
+
+// parseFlags applies environment variables and arguments to fs.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	prefix := envPrefix + flagEnvName("", fs.Name()) + "_"
+	fs.Usage = usageWithEnv(fs, prefix)
+	if err := setFlagsFromEnv(fs, prefix); err != nil {
+		return err
+	}
+	return fs.Parse(args)
+}
+
+// postAdmin POSTs body as JSON to the admin API and decodes the response
+// into out, failing on any non-2xx status.
+func postAdmin(adminURL, path string, body, out interface{}) error {
+	return postAdminAs(adminURL, "", path, body, out)
+}
+
+// postAdminAs is postAdmin passing token, if any, as a bearer token.
+func postAdminAs(adminURL, token, path string, body, out interface{}) error {
+	var payload io.Reader = http.NoBody
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, adminURL+path, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil && resp.StatusCode < 300 {
+			return err
+		}
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	return nil
+}
+
+// runCacheKeysCommand implements warm and purge, which take a bucket and
+// object keys.
+func runCacheKeysCommand(name, path string, args []string) int {
+	fs, adminURL := adminFlagSet(name)
+	bucket := fs.String("bucket", "", "bucket of the objects")
+	var all *bool
+	if name == "purge" {
+		all = fs.Bool("all", false, "purge the whole cache")
+	}
+	if err := parseFlags(fs, args); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return 2
+	}
+
+	req := cloud_storage.CacheKeysRequest{Bucket: *bucket, Keys: fs.Args()}
+	if all != nil {
+		req.All = *all
+	}
+	if !req.All && (req.Bucket == "" || len(req.Keys) == 0) {
+		fmt.Fprintf(os.Stderr, "usage: %s %s -bucket BUCKET KEY...\n", os.Args[0], name)
+		return 2
+	}
+
+	var results []cloud_storage.CacheKeyResult
+	if err := postAdmin(*adminURL, path, req, &results); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return 1
+	}
+
+	exitCode := 0
+	for _, r := range results {
+		if r.Error != "" {
+			fmt.Printf("%s\terror: %s\n", r.Key, r.Error)
+			exitCode = 1
+			continue
+		}
+		fmt.Printf("%s\tok\n", r.Key)
+	}
+	if req.All {
+		fmt.Println("cache purged")
+	}
+	return exitCode
+}
+
+// runWarm implements the warm subcommand.
+func runWarm(args []string) int {
+	return runCacheKeysCommand("warm", "/cache/warm", args)
+}
+
+// runPurge implements the purge subcommand.
+func runPurge(args []string) int {
+	return runCacheKeysCommand("purge", "/cache/purge", args)
+}
+
+// runFlush implements the flush subcommand, waiting for the proxy's pending
+// write-back uploads to complete.
+func runFlush(args []string) int {
+	fs, adminURL := adminFlagSet("flush")
+	timeout := fs.Duration("timeout", 30*time.Second, "how long to wait for pending uploads")
+	if err := parseFlags(fs, args); err != nil {
+		fmt.Fprintln(os.Stderr, "flush:", err)
+		return 2
+	}
+
+	var resp cloud_storage.FlushResponse
+	path := "/cache/flush?timeout=" + url.QueryEscape(timeout.String())
+	if err := postAdmin(*adminURL, path, nil, &resp); err != nil {
+		fmt.Fprintln(os.Stderr, "flush:", err)
+		if resp.Pending > 0 {
+			fmt.Fprintf(os.Stderr, "flush: %d uploads still pending\n", resp.Pending)
+		}
+		return 1
+	}
+	fmt.Println("all write-back uploads completed")
+	return 0
+}
+
+// runExport implements the export subcommand, writing the cache of a
+// running proxy to a tarball, or to an object upstream.
+func runExport(args []string) int {
+	fs, adminURL := adminFlagSet("export")
+	file := fs.String("file", "", "tarball the cache is written to")
+	bucket := fs.String("bucket", "", "bucket of the object the cache is written to, instead of -file")
+	key := fs.String("key", "", "key of the object the cache is written to")
+	if err := parseFlags(fs, args); err != nil {
+		fmt.Fprintln(os.Stderr, "export:", err)
+		return 2
+	}
+	if (*file == "") == (*bucket == "" || *key == "") {
+		fmt.Fprintf(os.Stderr, "usage: %s export -file FILE | -bucket BUCKET -key KEY\n", os.Args[0])
+		return 2
+	}
+
+	if *file == "" {
+		var result cloud_storage.CacheExportResult
+		path := "/cache/export?bucket=" + url.QueryEscape(*bucket) + "&key=" + url.QueryEscape(*key)
+		if err := postAdmin(*adminURL, path, nil, &result); err != nil {
+			fmt.Fprintln(os.Stderr, "export:", err)
+			return 1
+		}
+		fmt.Printf("%d objects exported to %s/%s\n", result.Exported, *bucket, *key)
+		return 0
+	}
+
+	resp, err := http.Get(*adminURL + "/cache/export")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "export:", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		fmt.Fprintf(os.Stderr, "export: %s: %s\n", resp.Status, bytes.TrimSpace(data))
+		return 1
+	}
+	f, err := os.Create(*file)
+	if err == nil {
+		_, err = io.Copy(f, resp.Body)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "export:", err)
+		return 1
+	}
+	fmt.Printf("cache exported to %s\n", *file)
+	return 0
+}
+
+// runImport implements the import subcommand, seeding the cache of a
+// running proxy with a tarball written by export.
+func runImport(args []string) int {
+	fs, adminURL := adminFlagSet("import")
+	file := fs.String("file", "", "tarball the cache is read from")
+	bucket := fs.String("bucket", "", "bucket of the object the cache is read from, instead of -file")
+	key := fs.String("key", "", "key of the object the cache is read from")
+	if err := parseFlags(fs, args); err != nil {
+		fmt.Fprintln(os.Stderr, "import:", err)
+		return 2
+	}
+	if (*file == "") == (*bucket == "" || *key == "") {
+		fmt.Fprintf(os.Stderr, "usage: %s import -file FILE | -bucket BUCKET -key KEY\n", os.Args[0])
+		return 2
+	}
+
+	var result cloud_storage.CacheImportResult
+	if *file == "" {
+		path := "/cache/import?bucket=" + url.QueryEscape(*bucket) + "&key=" + url.QueryEscape(*key)
+		if err := postAdmin(*adminURL, path, nil, &result); err != nil {
+			fmt.Fprintln(os.Stderr, "import:", err)
+			return 1
+		}
+	} else {
+		f, err := os.Open(*file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "import:", err)
+			return 1
+		}
+		defer f.Close()
+		resp, err := http.Post(*adminURL+"/cache/import", "application/x-tar", f)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "import:", err)
+			return 1
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		if err == nil && resp.StatusCode >= 300 {
+			err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data))
+		}
+		if err == nil {
+			err = json.Unmarshal(data, &result)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "import:", err)
+			return 1
+		}
+	}
+	fmt.Printf("%d objects imported, %d skipped\n", result.Imported, result.Skipped)
+	return 0
+}
+
+// runFreeze implements the freeze subcommand, freezing a bucket in a
+// running proxy.
+func runFreeze(args []string) int {
+	return runFreezeCommand("freeze", args)
+}
+
+// runUnfreeze implements the unfreeze subcommand.
+func runUnfreeze(args []string) int {
+	return runFreezeCommand("unfreeze", args)
+}
+
+// runFreezeCommand implements freeze and unfreeze, which take a bucket and
+// the reason, recorded in the proxy's audit log along with the holder of
+// the admin token.
+func runFreezeCommand(name string, args []string) int {
+	fs, adminURL := adminFlagSet(name)
+	bucket := fs.String("bucket", "", "bucket to "+name)
+	var req cloud_storage.FreezeRequest
+	fs.StringVar(&req.Reason, "reason", "", "why, recorded in the audit log")
+	token := fs.String("admin.token", "", "admin token of the proxy, naming who is recorded in the audit log")
+	if err := parseFlags(fs, args); err != nil {
+		fmt.Fprintln(os.Stderr, name+":", err)
+		return 2
+	}
+	if *bucket == "" || req.Reason == "" {
+		fmt.Fprintf(os.Stderr, "usage: %s %s -bucket BUCKET -reason REASON [flags]\n", os.Args[0], name)
+		return 2
+	}
+
+	var freezes map[string]cloud_storage.BucketFreeze
+	if err := postAdminAs(*adminURL, *token, "/buckets/"+url.PathEscape(*bucket)+"/"+name, req, &freezes); err != nil {
+		fmt.Fprintln(os.Stderr, name+":", err)
+		return 1
+	}
+	for b, freeze := range freezes {
+		fmt.Printf("%s\tfrozen since %s by %s: %s\n", b, freeze.Since.Format(time.RFC3339), freeze.By, freeze.Reason)
+	}
+	return 0
+}
+
+// runInventory implements the inventory subcommand, exporting an inventory
+// of a bucket through a running proxy.
+func runInventory(args []string) int {
+	fs, adminURL := adminFlagSet("inventory")
+	var config cloud_storage.InventoryConfig
+	fs.StringVar(&config.Bucket, "bucket", "", "bucket to inventory")
+	fs.StringVar(&config.Prefix, "prefix", "", "only inventory keys starting with prefix")
+	fs.StringVar(&config.Destination, "destination", "", "bucket the inventory is written to")
+	fs.StringVar(&config.DestinationPrefix, "destination-prefix", "", "key prefix of the inventory files")
+	fs.StringVar(&config.ID, "id", "proxy", "inventory configuration ID, part of the file keys")
+	if err := parseFlags(fs, args); err != nil {
+		fmt.Fprintln(os.Stderr, "inventory:", err)
+		return 2
+	}
+	if config.Bucket == "" || config.Destination == "" {
+		fmt.Fprintf(os.Stderr, "usage: %s inventory -bucket BUCKET -destination BUCKET [flags]\n", os.Args[0])
+		return 2
+	}
+
+	var result cloud_storage.InventoryResult
+	if err := postAdmin(*adminURL, "/inventory", config, &result); err != nil {
+		fmt.Fprintln(os.Stderr, "inventory:", err)
+		return 1
+	}
+	fmt.Printf("%d objects in %d files, manifest %s/%s\n", result.Objects, result.Files, config.Destination, result.ManifestKey)
+	return 0
+}
+
+// runValidate implements the validate subcommand, checking a config file
+// without applying it.
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	configFile := fs.String("config.file", "", "config file to validate")
+	if err := parseFlags(fs, args); err != nil {
+		fmt.Fprintln(os.Stderr, "validate:", err)
+		return 2
+	}
+	if *configFile == "" {
+		fmt.Fprintf(os.Stderr, "usage: %s validate -config.file FILE\n", os.Args[0])
+		return 2
+	}
+
+	if _, err := proxy_config.LoadFile(*configFile, &proxy_config.Config{}); err != nil {
+		fmt.Fprintln(os.Stderr, "validate:", err)
+		return 1
+	}
+	fmt.Printf("%s: ok\n", *configFile)
+	return 0
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/prometheus/common/expfmt"
+)
+
+// sizeClass is one entry of the object size distribution.
+type sizeClass struct {
+	size   int64
+	weight int
+}
+
+// parseSize parses sizes such as "512", "4KiB" or "16MiB".
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		factor int64
+	}{
+		{"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+		{"GB", 1e9}, {"MB", 1e6}, {"KB", 1e3}, {"B", 1},
+	}
+	for _, u := range units {
+		if v, ok := strings.CutSuffix(s, u.suffix); ok {
+			n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			return n * u.factor, err
+		}
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// parseSizeDistribution parses "size:weight,..." e.g. "4KiB:70,1MiB:30".
+// The weight is optional and defaults to 1; it must be positive.
+func parseSizeDistribution(s string) ([]sizeClass, error) {
+	var classes []sizeClass
+	for _, part := range strings.Split(s, ",") {
+		sizeStr, weightStr, hasWeight := strings.Cut(strings.TrimSpace(part), ":")
+		size, err := parseSize(sizeStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size %q: %w", sizeStr, err)
+		}
+		weight := 1
+		if hasWeight {
+			if weight, err = strconv.Atoi(weightStr); err != nil {
+				return nil, fmt.Errorf("invalid weight %q: %w", weightStr, err)
+			}
+			if weight <= 0 {
+				return nil, fmt.Errorf("invalid weight %q: must be positive", weightStr)
+			}
+		}
+		classes = append(classes, sizeClass{size: size, weight: weight})
+	}
+	return classes, nil
+}
+
+func pickSize(classes []sizeClass, rnd *rand.Rand) int64 {
+	total := 0
+	for _, c := range classes {
+		total += c.weight
+	}
+	n := rnd.Intn(total)
+	for _, c := range classes {
+		if n < c.weight {
+			return c.size
+		}
+		n -= c.weight
+	}
+	return classes[len(classes)-1].size
+}
+
+// latencies collects per-operation request durations and error counts.
+type latencies struct {
+	mu      sync.Mutex
+	samples map[string][]time.Duration
+	errors  map[string]int
+}
+
+func (l *latencies) record(op string, d time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err != nil {
+		l.errors[op]++
+		return
+	}
+	l.samples[op] = append(l.samples[op], d)
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+// scrapeCacheLookups sums s3proxy_cache_requests_total by result from the
+// proxy's admin metrics endpoint.
+func scrapeCacheLookups(metricsURL string) (map[string]float64, error) {
+	resp, err := http.Get(metricsURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	lookups := map[string]float64{}
+	if family, ok := families["s3proxy_cache_requests_total"]; ok {
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "result" {
+					lookups[label.GetValue()] += m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return lookups, nil
+}
+
+// runBench implements the bench subcommand: it drives a GET/PUT mix against
+// a running proxy and reports latency percentiles and the cache hit rate.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	var (
+		url         = fs.String("url", "http://localhost:8080", "proxy URL")
+		metricsURL  = fs.String("metrics-url", "http://localhost:9090/metrics", "proxy admin metrics URL, used to report cache hit rate (empty disables)")
+		bucket      = fs.String("bucket", "bench", "bucket to run against")
+		prefix      = fs.String("prefix", "bench/", "key prefix of the generated objects")
+		keys        = fs.Int("keys", 100, "number of distinct keys")
+		sizes       = fs.String("sizes", "64KiB", "object size distribution as size:weight pairs, e.g. 4KiB:70,1MiB:25,16MiB:5")
+		putRatio    = fs.Float64("put-ratio", 0.1, "fraction of requests which are PUTs")
+		concurrency = fs.Int("concurrency", 16, "number of concurrent workers")
+		duration    = fs.Duration("duration", 30*time.Second, "how long to run")
+		prepare     = fs.Bool("prepare", true, "upload every key once before starting")
+	)
+	if err := parseFlags(fs, args); err != nil {
+		fmt.Fprintln(os.Stderr, "bench:", err)
+		return 2
+	}
+
+	classes, err := parseSizeDistribution(*sizes)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bench:", err)
+		return 2
+	}
+
+	client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(*url),
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("bench", "bench", ""),
+		Retryer:      aws.NopRetryer{},
+	})
+	key := func(i int) string { return fmt.Sprintf("%s%08d", *prefix, i) }
+	put := func(ctx context.Context, k string, size int64, rnd *rand.Rand) error {
+		body := make([]byte, size)
+		rnd.Read(body)
+		_, err := client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:        bucket,
+			Key:           aws.String(k),
+			Body:          bytes.NewReader(body),
+			ContentLength: size,
+		})
+		return err
+	}
+	get := func(ctx context.Context, k string) error {
+		out, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: bucket, Key: aws.String(k)})
+		if err != nil {
+			return err
+		}
+		defer out.Body.Close()
+		_, err = io.Copy(io.Discard, out.Body)
+		return err
+	}
+
+	ctx := context.Background()
+	if *prepare {
+		fmt.Printf("preparing %d keys...\n", *keys)
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+		for i := 0; i < *keys; i++ {
+			if err := put(ctx, key(i), pickSize(classes, rnd), rnd); err != nil {
+				fmt.Fprintln(os.Stderr, "bench: prepare:", err)
+				return 1
+			}
+		}
+	}
+
+	var before map[string]float64
+	if *metricsURL != "" {
+		if before, err = scrapeCacheLookups(*metricsURL); err != nil {
+			fmt.Fprintln(os.Stderr, "bench: scraping metrics:", err)
+		}
+	}
+
+	results := &latencies{samples: map[string][]time.Duration{}, errors: map[string]int{}}
+	deadline := time.Now().Add(*duration)
+	var wg sync.WaitGroup
+	for w := 0; w < *concurrency; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for time.Now().Before(deadline) {
+				k := key(rnd.Intn(*keys))
+				start := time.Now()
+				if rnd.Float64() < *putRatio {
+					err := put(ctx, k, pickSize(classes, rnd), rnd)
+					results.record("PUT", time.Since(start), err)
+				} else {
+					err := get(ctx, k)
+					results.record("GET", time.Since(start), err)
+				}
+			}
+		}(time.Now().UnixNano() + int64(w))
+	}
+	wg.Wait()
+
+	fmt.Printf("\n%-4s %8s %7s %10s %10s %10s %10s %8s\n", "op", "count", "errors", "p50", "p90", "p99", "max", "req/s")
+	for _, op := range []string{"GET", "PUT"} {
+		samples := results.samples[op]
+		sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+		fmt.Printf("%-4s %8d %7d %10s %10s %10s %10s %8.1f\n", op, len(samples), results.errors[op],
+			percentile(samples, 0.5).Round(time.Microsecond),
+			percentile(samples, 0.9).Round(time.Microsecond),
+			percentile(samples, 0.99).Round(time.Microsecond),
+			percentile(samples, 1).Round(time.Microsecond),
+			float64(len(samples))/duration.Seconds())
+	}
+
+	if before != nil {
+		after, err := scrapeCacheLookups(*metricsURL)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "bench: scraping metrics:", err)
+			return 0
+		}
+		hits, misses := after["hit"]-before["hit"], after["miss"]-before["miss"]
+		if hits+misses > 0 {
+			fmt.Printf("\ncache hit rate: %.1f%% (%.0f hits, %.0f misses)\n", 100*hits/(hits+misses), hits, misses)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,124 @@
+package cloud_storage
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ReadinessCheck reports why the proxy can't serve traffic, or nil if it can.
+type ReadinessCheck func() error
+
+// AdminRoutes mounts the admin endpoints of an optional component.
+type AdminRoutes func(r *mux.Router)
+
+// AdminTokens authenticate the callers of the admin endpoints changing
+// state, such as freezes and the UI, by the bearer token they pass, each
+// token naming its holder for the audit log.
+type AdminTokens struct {
+	tokens map[string]string
+}
+
+// LoadAdminTokens reads tokens from path, one per line as the name of its
+// holder and the token separated by a space. Blank lines and lines
+// starting with # are ignored.
+func LoadAdminTokens(path string) (*AdminTokens, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tokens := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, token, ok := strings.Cut(text, " ")
+		if token = strings.TrimSpace(token); !ok || token == "" {
+			return nil, fmt.Errorf("%s:%d: expected a name and a token", path, line)
+		}
+		if _, ok := tokens[token]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate token", path, line)
+		}
+		tokens[token] = name
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewAdminTokens(tokens), nil
+}
+
+// NewAdminTokens returns the tokens mapped to the names of their holders.
+func NewAdminTokens(tokens map[string]string) *AdminTokens {
+	return &AdminTokens{tokens: tokens}
+}
+
+// Identity returns the name of the holder of the token r carries, as a
+// bearer token or as the password of basic authentication, which browsers
+// prompt for. Without tokens, no request is authenticated.
+func (t *AdminTokens) Identity(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		_, token, ok = r.BasicAuth()
+	}
+	if !ok || t == nil {
+		return "", false
+	}
+	identity, found := "", false
+	for candidate, name := range t.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(candidate)) == 1 {
+			identity, found = name, true
+		}
+	}
+	return identity, found
+}
+
+// authenticate returns the identity of the caller of r, answering 401
+// Unauthorized, with a basic authentication challenge, if it has none.
+func (t *AdminTokens) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	identity, ok := t.Identity(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="s3proxy admin"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}
+	return identity, ok
+}
+
+// MakeAdminHTTPHandler mounts the operational endpoints: Prometheus metrics,
+// liveness and readiness probes, plus the given component routes. It is
+// meant to be served on a listener separate from the S3 API so that its
+// paths never clash with bucket names.
+func MakeAdminHTTPHandler(logger log.Logger, checks []ReadinessCheck, routes ...AdminRoutes) http.Handler {
+	r := mux.NewRouter()
+
+	r.Methods("GET").Path("/metrics").Handler(promhttp.Handler())
+	r.Methods("GET").Path("/healthz").HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	r.Methods("GET").Path("/ready").HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		for _, check := range checks {
+			if err := check(); err != nil {
+				logger.Log("check", "ready", "err", err)
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	for _, mount := range routes {
+		mount(r)
+	}
+
+	return r
+}
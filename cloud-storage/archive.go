@@ -0,0 +1,112 @@
+package cloud_storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/rampage644/s3-overlay-proxy/repository"
+)
+
+// ArchiveRestore is the restore policy of a bucket: GETs of its archived
+// objects restore them for Days, with the retrieval Tier ("Standard" if
+// empty).
+type ArchiveRestore struct {
+	Days int32  `json:"days"`
+	Tier string `json:"tier,omitempty"`
+}
+
+// ValidateArchiveRestore reports the first invalid restore policy.
+func ValidateArchiveRestore(policies map[string]ArchiveRestore) error {
+	for bucket, policy := range policies {
+		if policy.Days <= 0 {
+			return fmt.Errorf("bucket %q: days must be positive", bucket)
+		}
+		switch types.Tier(policy.Tier) {
+		case "", types.TierStandard, types.TierBulk, types.TierExpedited:
+		default:
+			return fmt.Errorf("bucket %q: unknown tier %q", bucket, policy.Tier)
+		}
+	}
+	return nil
+}
+
+// ArchivePolicy holds the restore policies, by upstream bucket.
+type ArchivePolicy struct {
+	mu       sync.RWMutex
+	policies map[string]ArchiveRestore
+}
+
+func NewArchivePolicy(policies map[string]ArchiveRestore) *ArchivePolicy {
+	return &ArchivePolicy{policies: policies}
+}
+
+// SetPolicies replaces all restore policies.
+func (p *ArchivePolicy) SetPolicies(policies map[string]ArchiveRestore) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.policies = policies
+}
+
+func (p *ArchivePolicy) policy(bucket string) (ArchiveRestore, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	policy, ok := p.policies[bucket]
+	return policy, ok
+}
+
+// ArchiveRestoreMiddleware returns an endpoint middleware issuing a
+// RestoreObject request upstream when a GET fails with InvalidObjectState
+// for an archived object of a bucket with a restore policy. The GET still
+// fails; its message tells the client a restore is in progress, which HEAD
+// reports in x-amz-restore.
+func ArchiveRestoreMiddleware(policy *ArchivePolicy, storage repository.ObjectStorage, logger log.Logger) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			response, err := next(ctx, request)
+			req, ok := request.(GetObjectRequest)
+			if !ok {
+				return response, err
+			}
+			resp, ok := response.(APIErrorResponse)
+			if !ok || resp.Code != "InvalidObjectState" {
+				return response, err
+			}
+			restore, ok := policy.policy(req.Bucket)
+			if !ok {
+				return response, err
+			}
+
+			tier := types.Tier(restore.Tier)
+			if tier == "" {
+				tier = types.TierStandard
+			}
+			restoreRequest := &types.RestoreRequest{
+				Days:                 restore.Days,
+				GlacierJobParameters: &types.GlacierJobParameters{Tier: tier},
+			}
+			if resp.StorageClass == string(types.StorageClassIntelligentTiering) {
+				// Objects move back to the frequent access tier rather
+				// than being copied for a number of days.
+				restoreRequest.Days = 0
+			}
+			_, restoreErr := storage.RestoreObject(ctx, &repository.RestoreObjectInput{
+				Bucket:         &req.Bucket,
+				Key:            &req.Key,
+				RestoreRequest: restoreRequest,
+			})
+			var ae smithy.APIError
+			if restoreErr != nil && !(errors.As(restoreErr, &ae) && ae.ErrorCode() == "RestoreAlreadyInProgress") {
+				logger.Log("msg", "restoring archived object failed", "bucket", req.Bucket, "object", req.Key, "err", restoreErr)
+				return response, err
+			}
+			resp.Message = "The object is archived and is being restored; retry once the restore completes"
+			return resp, err
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package cloud_storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+	"github.com/rampage644/s3-overlay-proxy/repository"
+)
+
+// AuthorizationRequest is the body POSTed to the authorization webhook.
+// Principal is the access key whose signature of the request was verified,
+// see SignatureMiddleware, empty if anonymous or unverified.
+type AuthorizationRequest struct {
+	Principal string `json:"principal"`
+	SourceIP  string `json:"sourceIp"`
+	Action    string `json:"action"`
+	Bucket    string `json:"bucket,omitempty"`
+	Key       string `json:"key,omitempty"`
+}
+
+// AuthorizationDecision is the webhook's response.
+type AuthorizationDecision struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// WebhookAuthorizer is a Hook asking an external HTTP service whether to
+// allow each request, so that a central policy service can be used without
+// embedding it. Actions are named after IAM ones: s3:GetObject (also used
+// for HEAD), s3:PutObject, s3:DeleteObject, s3:ListBucket, where Key holds
+// the listing prefix, and s3:ListAllMyBuckets. Bucket listings only include
+// the buckets for which s3:ListBucket is allowed with an empty prefix.
+//
+// The webhook must answer 200 with an AuthorizationDecision; anything else
+// fails the request, unless the authorizer fails open. Decisions are cached
+// for the configured TTL.
+type WebhookAuthorizer struct {
+	NopHook
+
+	url      string
+	client   *http.Client
+	failOpen bool
+
+	cache *ristretto.Cache
+	ttl   time.Duration
+}
+
+// NewWebhookAuthorizer returns an authorizer calling url. Decisions are
+// cached for ttl, 0 disabling caching. If failOpen is set, requests are
+// allowed when the webhook can't be reached or answers with an error.
+func NewWebhookAuthorizer(url string, timeout, ttl time.Duration, failOpen bool) (*WebhookAuthorizer, error) {
+	a := &WebhookAuthorizer{
+		url:      url,
+		client:   &http.Client{Timeout: timeout},
+		failOpen: failOpen,
+		ttl:      ttl,
+	}
+	if ttl > 0 {
+		var err error
+		a.cache, err = ristretto.NewCache(&ristretto.Config{
+			NumCounters: 1e6,
+			MaxCost:     1e5, // decisions
+			BufferItems: 64,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Authorize returns the decision for req, from the cache if possible.
+func (a *WebhookAuthorizer) Authorize(ctx context.Context, req AuthorizationRequest) (AuthorizationDecision, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return AuthorizationDecision{}, err
+	}
+	if a.cache != nil {
+		if decision, ok := a.cache.Get(string(body)); ok {
+			return decision.(AuthorizationDecision), nil
+		}
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", a.url, bytes.NewReader(body))
+	if err != nil {
+		return AuthorizationDecision{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(httpReq)
+	if err != nil {
+		return AuthorizationDecision{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return AuthorizationDecision{}, fmt.Errorf("authorization webhook returned %s", resp.Status)
+	}
+	var decision AuthorizationDecision
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return AuthorizationDecision{}, fmt.Errorf("invalid authorization decision: %w", err)
+	}
+
+	if a.cache != nil {
+		a.cache.SetWithTTL(string(body), decision, 1, a.ttl)
+	}
+	return decision, nil
+}
+
+func (a *WebhookAuthorizer) authorize(ctx context.Context, action, bucket, key string) error {
+	client := ClientFromContext(ctx)
+	principal, _ := verifiedAccessKey(ctx)
+	decision, err := a.Authorize(ctx, AuthorizationRequest{
+		Principal: principal,
+		SourceIP:  client.SourceIP,
+		Action:    action,
+		Bucket:    bucket,
+		Key:       key,
+	})
+	if err != nil {
+		if a.failOpen {
+			return nil
+		}
+		return repository.ErrServiceUnavailable.WithMessage("Authorization is unavailable: " + err.Error())
+	}
+	if !decision.Allow {
+		message := decision.Reason
+		if message == "" {
+			message = "Access Denied"
+		}
+		return repository.ErrAccessDenied.WithMessage(message)
+	}
+	return nil
+}
+
+func (a *WebhookAuthorizer) OnGet(ctx context.Context, req *GetObjectRequest) error {
+	return a.authorize(ctx, "s3:GetObject", req.Bucket, req.Key)
+}
+
+func (a *WebhookAuthorizer) OnHead(ctx context.Context, req *HeadObjectRequest) error {
+	return a.authorize(ctx, "s3:GetObject", req.Bucket, req.Key)
+}
+
+func (a *WebhookAuthorizer) OnPut(ctx context.Context, req *PutObjectRequest) error {
+	return a.authorize(ctx, "s3:PutObject", req.BucketName, req.ObjectKey)
+}
+
+func (a *WebhookAuthorizer) OnDelete(ctx context.Context, req *DeleteObjectRequest) error {
+	return a.authorize(ctx, "s3:DeleteObject", req.BucketName, req.ObjectKey)
+}
+
+func (a *WebhookAuthorizer) OnList(ctx context.Context, req *ListObjectsRequest) error {
+	return a.authorize(ctx, "s3:ListBucket", req.Bucket, req.Prefix)
+}
+
+func (a *WebhookAuthorizer) OnListBuckets(ctx context.Context, _ *ListBucketsRequest) error {
+	return a.authorize(ctx, "s3:ListAllMyBuckets", "", "")
+}
+
+// OnResponse removes the buckets the caller may not list from bucket
+// listings.
+func (a *WebhookAuthorizer) OnResponse(ctx context.Context, request, response interface{}) interface{} {
+	resp, ok := response.(ListBucketsResponse)
+	if _, isListBuckets := request.(ListBucketsRequest); !isListBuckets || !ok {
+		return response
+	}
+	allowed := make([]Bucket, 0, len(resp.Buckets.Buckets))
+	for _, bucket := range resp.Buckets.Buckets {
+		if a.authorize(ctx, "s3:ListBucket", bucket.Name, "") == nil {
+			allowed = append(allowed, bucket)
+		}
+	}
+	resp.Buckets.Buckets = allowed
+	return resp
+}
@@ -0,0 +1,71 @@
+package cloud_storage
+
+import (
+	"sync/atomic"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+// BackgroundPool bounds the background work of the cache: at most workers
+// tasks run at a time. Optional tasks, such as refreshes after range misses,
+// are rejected once queue of them are waiting for a worker; write-back
+// uploads, which were acknowledged already, always wait for one instead and
+// are bounded by the write-back limits.
+type BackgroundPool struct {
+	slots    chan struct{}
+	capacity int64
+	tasks    atomic.Int64
+	rejected metrics.Counter
+}
+
+// NewBackgroundPool returns a pool of workers, counting rejected tasks in
+// rejected, labelled by "task".
+func NewBackgroundPool(workers, queue int, rejected metrics.Counter) *BackgroundPool {
+	return &BackgroundPool{
+		slots:    make(chan struct{}, workers),
+		capacity: int64(workers + queue),
+		rejected: rejected,
+	}
+}
+
+// WithBackgroundPool runs the background work of the cache in p.
+func WithBackgroundPool(p *BackgroundPool) CacheOption {
+	return func(s *CachedCloudStorage) {
+		s.background = p
+	}
+}
+
+// Tasks returns the number of optional tasks running or waiting.
+func (p *BackgroundPool) Tasks() int64 {
+	return p.tasks.Load()
+}
+
+// Go runs the optional task in the background, unless the queue is full.
+// It reports whether the task was accepted. A nil pool runs every task.
+func (p *BackgroundPool) Go(name string, task func()) bool {
+	if p == nil {
+		go task()
+		return true
+	}
+	if p.tasks.Add(1) > p.capacity {
+		p.tasks.Add(-1)
+		p.rejected.With("task", name).Add(1)
+		return false
+	}
+	go func() {
+		defer p.tasks.Add(-1)
+		p.Run(task)
+	}()
+	return true
+}
+
+// Run runs task once a worker is free.
+func (p *BackgroundPool) Run(task func()) {
+	if p == nil {
+		task()
+		return
+	}
+	p.slots <- struct{}{}
+	defer func() { <-p.slots }()
+	task()
+}
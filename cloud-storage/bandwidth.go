@@ -0,0 +1,115 @@
+package cloud_storage
+
+import (
+	"context"
+	"io"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/rampage644/s3-overlay-proxy/repository"
+	"golang.org/x/time/rate"
+)
+
+// bandwidthChunkSize bounds a single throttled read so that it never asks a
+// token bucket for more than its burst.
+const bandwidthChunkSize = 32 << 10 // 32 KiB
+
+// BandwidthLimiter caps the throughput of object bodies, both per client
+// (see ClientIdentity.Key) and per bucket. A request is throttled by both
+// of its buckets, so a single client can't exceed its own share nor starve
+// other clients of the same bucket. Batch requests, see PriorityClass, are
+// also throttled by a bucket shared by all of them.
+type BandwidthLimiter struct {
+	clients *keyedLimiters
+	buckets *keyedLimiters
+	batch   *keyedLimiters
+}
+
+// NewBandwidthLimiter returns a limiter with the given caps in bytes per
+// second. A zero cap disables the corresponding limit.
+func NewBandwidthLimiter(clientBytesPerSec, bucketBytesPerSec, batchBytesPerSec int64) *BandwidthLimiter {
+	return &BandwidthLimiter{
+		clients: newKeyedLimiters(bandwidthLimit(clientBytesPerSec)),
+		buckets: newKeyedLimiters(bandwidthLimit(bucketBytesPerSec)),
+		batch:   newKeyedLimiters(bandwidthLimit(batchBytesPerSec)),
+	}
+}
+
+func bandwidthLimit(bytesPerSec int64) (rate.Limit, int) {
+	if bytesPerSec <= 0 {
+		return rate.Inf, bandwidthChunkSize
+	}
+	return rate.Limit(bytesPerSec), int(max(bytesPerSec, bandwidthChunkSize))
+}
+
+// SetLimits changes the caps of every client and bucket, and of batch
+// requests.
+func (l *BandwidthLimiter) SetLimits(clientBytesPerSec, bucketBytesPerSec, batchBytesPerSec int64) {
+	l.clients.setLimit(bandwidthLimit(clientBytesPerSec))
+	l.buckets.setLimit(bandwidthLimit(bucketBytesPerSec))
+	l.batch.setLimit(bandwidthLimit(batchBytesPerSec))
+}
+
+// Reader wraps r so that reads from it are throttled by the limits of the
+// given client and bucket.
+func (l *BandwidthLimiter) Reader(ctx context.Context, r io.ReadCloser, client ClientIdentity, bucket string) io.ReadCloser {
+	var limiters []*rate.Limiter
+	if !l.clients.unlimited() {
+		limiters = append(limiters, l.clients.get(client.Key()))
+	}
+	if !l.buckets.unlimited() {
+		limiters = append(limiters, l.buckets.get(bucket))
+	}
+	if !l.batch.unlimited() && repository.PriorityFromContext(ctx) == repository.PriorityBatch {
+		limiters = append(limiters, l.batch.get(""))
+	}
+	if len(limiters) == 0 {
+		return r
+	}
+	return &throttledReader{ctx: ctx, ReadCloser: r, limiters: limiters}
+}
+
+type throttledReader struct {
+	io.ReadCloser
+	ctx      context.Context
+	limiters []*rate.Limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > bandwidthChunkSize {
+		p = p[:bandwidthChunkSize]
+	}
+	n, err := t.ReadCloser.Read(p)
+	for _, l := range t.limiters {
+		if werr := l.WaitN(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// BandwidthMiddleware returns an endpoint middleware that throttles uploaded
+// object bodies with ingress and downloaded ones with egress. Either limiter
+// may be nil.
+func BandwidthMiddleware(ingress, egress *BandwidthLimiter) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			client := ClientFromContext(ctx)
+			if req, ok := request.(PutObjectRequest); ok && ingress != nil {
+				req.ObjectBody = ingress.Reader(ctx, req.ObjectBody, client, req.BucketName)
+				request = req
+			}
+			if req, ok := request.(UploadPartRequest); ok && ingress != nil {
+				req.Body = ingress.Reader(ctx, req.Body, client, req.Bucket)
+				request = req
+			}
+
+			response, err := next(ctx, request)
+
+			if resp, ok := response.(GetObjectResponse); ok && egress != nil {
+				resp.Body = egress.Reader(ctx, resp.Body, client, request.(GetObjectRequest).Bucket)
+				response = resp
+			}
+			return response, err
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package cloud_storage
+
+import (
+	"context"
+	"encoding/base64"
+	"sort"
+	"strings"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// maxBuckets is the largest page of bucket listings, and the default one.
+const maxBuckets = 10000
+
+// paginateBuckets answers ListBuckets requests with the page of the buckets
+// matching their prefix after their continuation token, which is the last
+// bucket name of the previous page. The pinned SDK can't pass the paging
+// parameters upstream, so the full listing is paged here, after the other
+// middlewares have added, renamed or removed buckets.
+func paginateBuckets(next endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req, ok := request.(ListBucketsRequest)
+		if !ok {
+			return next(ctx, request)
+		}
+		after := ""
+		if req.ContinuationToken != "" {
+			token, err := base64.RawURLEncoding.DecodeString(req.ContinuationToken)
+			if err != nil || len(token) == 0 {
+				return APIErrorResponse{Code: "InvalidArgument", Message: "The continuation token provided is incorrect"}, nil
+			}
+			after = string(token)
+		}
+		limit := req.MaxBuckets
+		if limit == 0 {
+			limit = maxBuckets
+		}
+
+		response, err := next(ctx, req)
+		resp, ok := response.(ListBucketsResponse)
+		if err != nil || !ok {
+			return response, err
+		}
+		buckets := resp.Buckets.Buckets
+		sort.Slice(buckets, func(i, j int) bool { return buckets[i].Name < buckets[j].Name })
+		page := make([]Bucket, 0, min(len(buckets), limit))
+		for _, bucket := range buckets {
+			if !strings.HasPrefix(bucket.Name, req.Prefix) || bucket.Name <= after {
+				continue
+			}
+			if len(page) == limit {
+				resp.ContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(page[len(page)-1].Name))
+				break
+			}
+			page = append(page, bucket)
+		}
+		resp.Buckets.Buckets = page
+		resp.Prefix = req.Prefix
+		return resp, nil
+	}
+}
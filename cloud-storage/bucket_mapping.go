@@ -0,0 +1,128 @@
+package cloud_storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// BucketMapping translates client-facing bucket names into upstream ones.
+// Buckets without a mapping are passed through unchanged.
+type BucketMapping struct {
+	mu       sync.RWMutex
+	mappings map[string]string
+}
+
+func NewBucketMapping(mappings map[string]string) *BucketMapping {
+	return &BucketMapping{mappings: mappings}
+}
+
+// Set replaces all mappings.
+func (m *BucketMapping) Set(mappings map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mappings = mappings
+}
+
+// Upstream returns the upstream name of bucket.
+func (m *BucketMapping) Upstream(bucket string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if upstream, ok := m.mappings[bucket]; ok {
+		return upstream
+	}
+	return bucket
+}
+
+// withAliases adds to buckets the client-facing names mapped to the buckets
+// listed, with their creation date.
+func (m *BucketMapping) withAliases(buckets []Bucket) []Bucket {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.mappings) == 0 {
+		return buckets
+	}
+	listed := make(map[string]Bucket, len(buckets))
+	for _, bucket := range buckets {
+		listed[bucket.Name] = bucket
+	}
+	for alias, upstream := range m.mappings {
+		if _, ok := listed[alias]; ok {
+			continue
+		}
+		if bucket, ok := listed[upstream]; ok {
+			buckets = append(buckets, Bucket{Name: alias, CreationDate: bucket.CreationDate})
+		}
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Name < buckets[j].Name })
+	return buckets
+}
+
+// BucketMappingMiddleware returns an endpoint middleware which rewrites the
+// bucket of object requests according to mapping. Bucket listings include
+// the mapped names of the buckets listed.
+func BucketMappingMiddleware(mapping *BucketMapping) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			switch req := request.(type) {
+			case GetObjectRequest:
+				req.Bucket = mapping.Upstream(req.Bucket)
+				request = req
+			case HeadObjectRequest:
+				req.Bucket = mapping.Upstream(req.Bucket)
+				request = req
+			case PutObjectRequest:
+				req.BucketName = mapping.Upstream(req.BucketName)
+				request = req
+			case DeleteObjectRequest:
+				req.BucketName = mapping.Upstream(req.BucketName)
+				request = req
+			case CreateMultipartUploadRequest:
+				bucket := req.Bucket
+				req.Bucket = mapping.Upstream(req.Bucket)
+				response, err := next(ctx, req)
+				if resp, ok := response.(CreateMultipartUploadResponse); ok {
+					resp.Bucket = bucket
+					response = resp
+				}
+				return response, err
+			case UploadPartRequest:
+				req.Bucket = mapping.Upstream(req.Bucket)
+				request = req
+			case CompleteMultipartUploadRequest:
+				bucket := req.Bucket
+				req.Bucket = mapping.Upstream(req.Bucket)
+				response, err := next(ctx, req)
+				if resp, ok := response.(CompleteMultipartUploadResponse); ok {
+					resp.Bucket = bucket
+					resp.Location = "/" + bucket + "/" + resp.Key
+					response = resp
+				}
+				return response, err
+			case AbortMultipartUploadRequest:
+				req.Bucket = mapping.Upstream(req.Bucket)
+				request = req
+			case ListObjectsRequest:
+				bucket := req.Bucket
+				req.Bucket = mapping.Upstream(req.Bucket)
+				response, err := next(ctx, req)
+				// Clients expect the listing under the name they asked for.
+				if resp, ok := response.(ListObjectsResponse); ok {
+					resp.Name = bucket
+					response = resp
+				}
+				return response, err
+			case ListBucketsRequest:
+				response, err := next(ctx, req)
+				if resp, ok := response.(ListBucketsResponse); ok {
+					resp.Buckets.Buckets = mapping.withAliases(resp.Buckets.Buckets)
+					response = resp
+				}
+				return response, err
+			}
+			return next(ctx, request)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package cloud_storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/rampage644/s3-overlay-proxy/repository"
+)
+
+// bucketOperations are the operations BucketOperations refer to, named
+// after the S3 API actions.
+var bucketOperations = []string{
+	"GetObject",
+	"HeadObject",
+	"PutObject",
+	"DeleteObject",
+	"ListObjects",
+	"CreateMultipartUpload",
+	"UploadPart",
+	"CompleteMultipartUpload",
+	"AbortMultipartUpload",
+}
+
+// BucketOperations restricts the operations allowed on a bucket, whatever
+// upstream IAM allows: only those in Allow, if not empty, and none of those
+// in Deny. DenyOverwrite denies uploads of keys which exist already, and
+// MinRetentionDays deletes and overwrites of objects last modified fewer
+// days ago, guarding upstreams without Object Lock.
+type BucketOperations struct {
+	Allow            []string `json:"allow,omitempty"`
+	Deny             []string `json:"deny,omitempty"`
+	DenyOverwrite    bool     `json:"denyOverwrite,omitempty"`
+	MinRetentionDays int32    `json:"minRetentionDays,omitempty"`
+}
+
+// ValidateBucketOperations reports the first invalid policy.
+func ValidateBucketOperations(policies map[string]BucketOperations) error {
+	for bucket, policy := range policies {
+		if policy.MinRetentionDays < 0 {
+			return fmt.Errorf("bucket %q: minRetentionDays must not be negative", bucket)
+		}
+		for _, operation := range append(slices.Clip(policy.Allow), policy.Deny...) {
+			if !slices.Contains(bucketOperations, operation) {
+				return fmt.Errorf("bucket %q: unknown operation %q", bucket, operation)
+			}
+		}
+	}
+	return nil
+}
+
+// OperationPolicy holds the operation policies, by upstream bucket, so that
+// they apply whatever name clients use for a bucket.
+type OperationPolicy struct {
+	mu       sync.RWMutex
+	policies map[string]BucketOperations
+	cache    *CachedCloudStorage
+}
+
+func NewOperationPolicy(policies map[string]BucketOperations) *OperationPolicy {
+	return &OperationPolicy{policies: policies}
+}
+
+// SetPolicies replaces all operation policies.
+func (p *OperationPolicy) SetPolicies(policies map[string]BucketOperations) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.policies = policies
+}
+
+// SetCache has the overwrite and retention checks HEAD objects through
+// cache, so that they see the objects written back but not upstream yet.
+func (p *OperationPolicy) SetCache(cache *CachedCloudStorage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cache = cache
+}
+
+// head returns the metadata of key of bucket, from the cache if set,
+// otherwise from storage.
+func (p *OperationPolicy) head(ctx context.Context, storage repository.ObjectStorage, bucket, key string) (*s3.HeadObjectOutput, error) {
+	p.mu.RLock()
+	cache := p.cache
+	p.mu.RUnlock()
+	if cache != nil {
+		return cache.HeadObject(ctx, bucket, key)
+	}
+	return storage.HeadObject(ctx, &repository.HeadObjectInput{Bucket: &bucket, Key: &key})
+}
+
+func (p *OperationPolicy) policy(bucket string) (BucketOperations, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	policy, ok := p.policies[bucket]
+	return policy, ok
+}
+
+// requestOperation returns the bucket and operation of an object or listing
+// request.
+func requestOperation(request interface{}) (bucket, key, operation string, ok bool) {
+	switch req := request.(type) {
+	case GetObjectRequest:
+		return req.Bucket, req.Key, "GetObject", true
+	case HeadObjectRequest:
+		return req.Bucket, req.Key, "HeadObject", true
+	case PutObjectRequest:
+		return req.BucketName, req.ObjectKey, "PutObject", true
+	case DeleteObjectRequest:
+		return req.BucketName, req.ObjectKey, "DeleteObject", true
+	case ListObjectsRequest:
+		return req.Bucket, "", "ListObjects", true
+	case CreateMultipartUploadRequest:
+		return req.Bucket, req.Key, "CreateMultipartUpload", true
+	case UploadPartRequest:
+		return req.Bucket, req.Key, "UploadPart", true
+	case CompleteMultipartUploadRequest:
+		return req.Bucket, req.Key, "CompleteMultipartUpload", true
+	case AbortMultipartUploadRequest:
+		return req.Bucket, req.Key, "AbortMultipartUpload", true
+	}
+	return "", "", "", false
+}
+
+// OperationPolicyMiddleware returns an endpoint middleware denying the
+// operations policy doesn't allow with AccessDenied. Overwrites and the age
+// of objects are found with a HEAD request when uploads start and before
+// deletes, through the cache if set with SetCache, so that objects written
+// back but not upstream yet are seen, otherwise to storage.
+func OperationPolicyMiddleware(policy *OperationPolicy, storage repository.ObjectStorage) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			bucket, key, operation, ok := requestOperation(request)
+			if !ok {
+				return next(ctx, request)
+			}
+			rules, ok := policy.policy(bucket)
+			if !ok {
+				return next(ctx, request)
+			}
+			denied := APIErrorResponse{Code: "AccessDenied", Message: "Access Denied", BucketName: bucket, Key: key}
+			if (len(rules.Allow) > 0 && !slices.Contains(rules.Allow, operation)) || slices.Contains(rules.Deny, operation) {
+				return denied, nil
+			}
+			upload := operation == "PutObject" || operation == "CreateMultipartUpload"
+			if !(rules.DenyOverwrite && upload) && !(rules.MinRetentionDays > 0 && (upload || operation == "DeleteObject")) {
+				return next(ctx, request)
+			}
+			output, err := policy.head(ctx, storage, bucket, key)
+			switch {
+			case errors.Is(err, repository.ErrNoSuchKey):
+				return next(ctx, request)
+			case err != nil:
+				return apiErrorResponse(err), nil
+			case rules.DenyOverwrite && upload:
+				denied.Message = "Overwriting objects is not allowed in this bucket"
+				return denied, nil
+			}
+			retainUntil := aws.ToTime(output.LastModified).AddDate(0, 0, int(rules.MinRetentionDays))
+			if rules.MinRetentionDays > 0 && time.Now().Before(retainUntil) {
+				denied.Message = "The object is retained until " + retainUntil.UTC().Format(time.RFC3339)
+				return denied, nil
+			}
+			return next(ctx, request)
+		}
+	}
+}
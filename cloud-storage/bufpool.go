@@ -0,0 +1,124 @@
+package cloud_storage
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+)
+
+const (
+	// copyBufferSize is the size of buffers used to stream response bodies.
+	copyBufferSize = 32 << 10 // 32 KiB
+
+	// chunkBufferSize is the initial size of the SigV4 chunk decoding buffer,
+	// matching the chunk size used by the AWS SDKs.
+	chunkBufferSize = 64 << 10 // 64 KiB
+
+	// maxPooledBufferSize keeps buffers grown by unusually large chunks or
+	// bodies from being pinned by the pools.
+	maxPooledBufferSize = 1 << 20 // 1 MiB
+)
+
+var (
+	copyBufferPool = sync.Pool{New: func() interface{} {
+		b := make([]byte, copyBufferSize)
+		return &b
+	}}
+	chunkBufferPool = sync.Pool{New: func() interface{} {
+		b := make([]byte, chunkBufferSize)
+		return &b
+	}}
+	bufioReaderPool = sync.Pool{New: func() interface{} {
+		return bufio.NewReader(nil)
+	}}
+	bytesBufferPool = sync.Pool{New: func() interface{} {
+		return new(bytes.Buffer)
+	}}
+)
+
+// copyBuffered is io.Copy with a pooled buffer.
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+func getChunkBuffer() []byte {
+	return *chunkBufferPool.Get().(*[]byte)
+}
+
+func putChunkBuffer(b []byte) {
+	if cap(b) > maxPooledBufferSize {
+		return
+	}
+	b = b[:cap(b)]
+	chunkBufferPool.Put(&b)
+}
+
+func getBufioReader(r io.Reader) *bufio.Reader {
+	br := bufioReaderPool.Get().(*bufio.Reader)
+	br.Reset(r)
+	return br
+}
+
+func putBufioReader(br *bufio.Reader) {
+	br.Reset(nil)
+	bufioReaderPool.Put(br)
+}
+
+// pooledBufferReadCloser serves a pooled bytes.Buffer and returns it to the
+// pool once closed.
+type pooledBufferReadCloser struct {
+	*bytes.Buffer
+	once sync.Once
+}
+
+func (r *pooledBufferReadCloser) Close() error {
+	r.once.Do(func() {
+		if r.Buffer.Cap() <= maxPooledBufferSize {
+			r.Buffer.Reset()
+			bytesBufferPool.Put(r.Buffer)
+		}
+	})
+	return nil
+}
+
+// readPooled reads r to the end into a pooled buffer. It suits bodies which
+// are passed through to the client without being retained.
+func readPooled(r io.Reader) (io.ReadCloser, error) {
+	buf := bytesBufferPool.Get().(*bytes.Buffer)
+	if _, err := buf.ReadFrom(r); err != nil {
+		buf.Reset()
+		bytesBufferPool.Put(buf)
+		return nil, err
+	}
+	return &pooledBufferReadCloser{Buffer: buf}, nil
+}
+
+// readAllSized is io.ReadAll for bodies of a known size: it allocates the
+// result once instead of repeatedly growing it. The result is owned by the
+// caller (e.g. retained by the cache), so it isn't pooled. Bodies shorter
+// than size, cut short by a client which went away, fail with
+// IncompleteBody rather than be cached truncated.
+func readAllSized(r io.Reader, size int64) ([]byte, error) {
+	if size <= 0 {
+		return io.ReadAll(r)
+	}
+
+	buf := make([]byte, size)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, errIncompleteBody(int64(n), size)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The body is longer than announced, keep whatever is left.
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, rest...), nil
+}
@@ -0,0 +1,52 @@
+package cloud_storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rampage644/s3-overlay-proxy/repository"
+)
+
+// accessCheckTTL is how long a principal is known to be allowed to read an
+// object after upstream let it, so that revoked permissions take effect
+// within it.
+const accessCheckTTL = time.Minute
+
+// cachePrincipal returns the principal upstream requests of ctx are made as:
+// the ARN of the tenant's assumed role, or empty for the proxy's own
+// credentials. Cached copies are shared by requests of the same principal
+// only, see authorizeHit.
+func cachePrincipal(ctx context.Context) string {
+	role, _ := repository.AssumedRoleFromContext(ctx)
+	return role.RoleARN
+}
+
+// authorizeHit checks that the principal of ctx may read a cached copy of
+// the object fetched or written as principal. Other principals are allowed
+// once upstream answers a HEAD request of theirs for it, remembered for
+// accessCheckTTL; its error is returned otherwise, so that tenants whose
+// roles can't read an object get the same answer from the cache as from
+// upstream.
+func (s *CachedCloudStorage) authorizeHit(ctx context.Context, operation, bucketName, objectKey, principal string) error {
+	requester := cachePrincipal(ctx)
+	if requester == principal {
+		return nil
+	}
+	cacheKey := fmt.Sprintf("%s/%s", bucketName, objectKey)
+	accessKey := fmt.Sprintf("access/%s/%s", requester, cacheKey)
+	if _, found := s.cache.Get(accessKey); found {
+		return nil
+	}
+	// The object may not be upstream yet.
+	if err := s.waitForUpload(ctx, cacheKey); err != nil {
+		return err
+	}
+	if _, err := s.baseStorage.HeadObject(ctx, bucketName, objectKey); err != nil {
+		s.requests.With("operation", operation, "result", "denied").Add(1)
+		s.logger.Log("msg", "cached copy denied", "method", operation, "key", cacheKey, "principal", requester, "err", err)
+		return err
+	}
+	_ = s.cache.SetWithTTL(accessKey, true, 1, accessCheckTTL)
+	return nil
+}
@@ -0,0 +1,216 @@
+package cloud_storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// CacheKeysRequest selects cache entries for the warm and purge admin
+// endpoints.
+type CacheKeysRequest struct {
+	Bucket string   `json:"bucket"`
+	Keys   []string `json:"keys"`
+
+	// All purges the whole cache; it is ignored by warm.
+	All bool `json:"all,omitempty"`
+}
+
+// CacheKeyResult reports the outcome for a single key.
+type CacheKeyResult struct {
+	Key   string `json:"key"`
+	Error string `json:"error,omitempty"`
+}
+
+// FlushResponse reports the state of write-back uploads after a flush.
+type FlushResponse struct {
+	Pending      int64 `json:"pending"`
+	PendingBytes int64 `json:"pendingBytes"`
+}
+
+// Warm loads an object into the cache, regardless of admission policy.
+func (s *CachedCloudStorage) Warm(ctx context.Context, bucketName, objectKey string) error {
+	object, info, err := s.baseStorage.GetObject(ctx, bucketName, objectKey, "")
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	value, err := io.ReadAll(object)
+	if err != nil {
+		return err
+	}
+	cacheKey := fmt.Sprintf("%s/%s", bucketName, objectKey)
+	_ = s.cache.Set(cacheKey, &cacheEntry{info: info, body: value, fetched: s.clock.Now()}, 1)
+	s.scrubber.record(cacheKey)
+	s.index.record(CacheIndexUpdate{Key: cacheKey, ETag: info.ETag, Size: info.ContentLength})
+	return nil
+}
+
+// Purge evicts an object's body and metadata from the cache.
+func (s *CachedCloudStorage) Purge(bucketName, objectKey string) {
+	cacheKey := fmt.Sprintf("%s/%s", bucketName, objectKey)
+	s.cache.Del(cacheKey)
+	s.cache.Del("head/" + cacheKey)
+	s.cache.Del("tags/" + cacheKey)
+	if s.hotKeys != nil {
+		s.hotKeys.Unpin(cacheKey)
+	}
+	s.index.record(CacheIndexUpdate{Key: cacheKey, Deleted: true})
+}
+
+// PurgeAll empties the cache.
+func (s *CachedCloudStorage) PurgeAll() {
+	s.cache.Clear()
+	if s.hotKeys != nil {
+		s.hotKeys.UnpinAll()
+	}
+}
+
+// Flush waits for pending write-back uploads to complete, returning how
+// many are still pending if ctx is done first.
+func (s *CachedCloudStorage) Flush(ctx context.Context) int64 {
+	done := make(chan struct{})
+	go func() {
+		s.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return 0
+	case <-ctx.Done():
+		return s.pendingCount.Load()
+	}
+}
+
+// PendingUploads lists the cache keys, as "bucket/key", of write-back
+// uploads which haven't completed yet.
+func (s *CachedCloudStorage) PendingUploads() []string {
+	s.uploadsMu.Lock()
+	defer s.uploadsMu.Unlock()
+	keys := make([]string, 0, len(s.uploads))
+	for key := range s.uploads {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CacheStatus describes how an object is held by the cache.
+type CacheStatus struct {
+	Cached        bool `json:"cached"`
+	Pinned        bool `json:"pinned"`
+	UploadPending bool `json:"uploadPending"`
+}
+
+// Status returns the cache status of an object.
+func (s *CachedCloudStorage) Status(bucketName, objectKey string) CacheStatus {
+	cacheKey := fmt.Sprintf("%s/%s", bucketName, objectKey)
+	var status CacheStatus
+	_, status.Cached = s.cache.Get(cacheKey)
+	if s.hotKeys != nil {
+		_, status.Pinned = s.hotKeys.Pinned(cacheKey)
+	}
+	s.uploadsMu.Lock()
+	_, status.UploadPending = s.uploads[cacheKey]
+	s.uploadsMu.Unlock()
+	return status
+}
+
+// AdminRoutes mounts the cache management endpoints:
+//
+//	POST /cache/warm   {"bucket": "b", "keys": ["k1", "k2"]}
+//	POST /cache/purge  {"bucket": "b", "keys": ["k1"]} or {"all": true}
+//	POST /cache/flush[?timeout=30s]
+//	GET  /cache/writes/{id}, see ReceiptRoutes
+//
+// as well as the export and import ones, see ExportRoutes. With peers, the
+// endpoint they read objects from is mounted too, see PeerRoutes, and with
+// a cache index the one standbys follow it on, see IndexRoutes.
+func (s *CachedCloudStorage) AdminRoutes(r *mux.Router) {
+	s.ReceiptRoutes(r)
+	s.ExportRoutes(r)
+	if s.peers != nil {
+		s.PeerRoutes(r)
+	}
+	if s.index != nil {
+		s.IndexRoutes(r)
+	}
+	decode := func(w http.ResponseWriter, r *http.Request) (CacheKeysRequest, bool) {
+		var req CacheKeysRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return req, false
+		}
+		if !req.All && (req.Bucket == "" || len(req.Keys) == 0) {
+			http.Error(w, "bucket and keys are required", http.StatusBadRequest)
+			return req, false
+		}
+		return req, true
+	}
+
+	r.Methods("POST").Path("/cache/warm").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, ok := decode(w, r)
+		if !ok {
+			return
+		}
+		results := make([]CacheKeyResult, len(req.Keys))
+		for i, key := range req.Keys {
+			results[i].Key = key
+			if err := s.Warm(r.Context(), req.Bucket, key); err != nil {
+				results[i].Error = err.Error()
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+
+	r.Methods("POST").Path("/cache/purge").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, ok := decode(w, r)
+		if !ok {
+			return
+		}
+		if req.All {
+			s.PurgeAll()
+		}
+		results := make([]CacheKeyResult, len(req.Keys))
+		for i, key := range req.Keys {
+			results[i].Key = key
+			if s.freezes.Frozen(req.Bucket) {
+				results[i].Error = "bucket is frozen"
+				continue
+			}
+			s.Purge(req.Bucket, key)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+
+	r.Methods("POST").Path("/cache/flush").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := 30 * time.Second
+		if v := r.URL.Query().Get("timeout"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				http.Error(w, "invalid timeout", http.StatusBadRequest)
+				return
+			}
+			timeout = d
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		pending := s.Flush(ctx)
+		w.Header().Set("Content-Type", "application/json")
+		if pending > 0 {
+			w.WriteHeader(http.StatusGatewayTimeout)
+		}
+		json.NewEncoder(w).Encode(FlushResponse{Pending: pending, PendingBytes: s.PendingBytes()})
+	})
+}
@@ -0,0 +1,54 @@
+package cloud_storage
+
+import (
+	"github.com/rampage644/s3-overlay-proxy/repository"
+)
+
+// WriteBackLimits bounds the write-back backlog: the uploads accepted into
+// the cache which haven't reached upstream yet, and the parts of multipart
+// uploads assembled in memory. Once either limit is
+// reached, new writes are no longer absorbed into memory, so that a slow
+// upstream can't exhaust it. A zero limit is unlimited.
+type WriteBackLimits struct {
+	MaxBytes   int64
+	MaxUploads int64
+
+	// Reject fails writes over the limits with SlowDown, for clients to
+	// retry; otherwise they are written through to upstream synchronously.
+	Reject bool
+}
+
+// WithWriteBackLimits applies limits to the write-back backlog.
+func WithWriteBackLimits(limits WriteBackLimits) CacheOption {
+	return func(s *CachedCloudStorage) {
+		s.writeBackLimits = limits
+	}
+}
+
+// errWriteBackSaturated is returned for writes rejected because of the
+// write-back backlog.
+func errWriteBackSaturated() error {
+	return repository.ErrSlowDown
+}
+
+// writeBackSaturated reports whether a write of size more bytes, or of
+// unknown size if negative, would exceed the write-back limits.
+func (s *CachedCloudStorage) writeBackSaturated(size int64) bool {
+	limits := s.writeBackLimits
+	if limits.MaxUploads > 0 && s.pendingCount.Load() >= limits.MaxUploads {
+		return true
+	}
+	if limits.MaxBytes > 0 {
+		if size < 0 {
+			size = 0
+		}
+		return s.pendingBytes.Load()+s.multipartBytes.Load()+size > limits.MaxBytes
+	}
+	return false
+}
+
+// PendingBytes returns the size of the write-back uploads which haven't
+// completed yet.
+func (s *CachedCloudStorage) PendingBytes() int64 {
+	return s.pendingBytes.Load()
+}
@@ -0,0 +1,96 @@
+package cloud_storage
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// ObjectMetadata is the metadata of an object cached for HEAD requests. It
+// is decoupled from the SDK types, and cached serialized, so that cache
+// tiers out of process can hold it.
+type ObjectMetadata struct {
+	ContentLength int64             `json:"l"`
+	ContentType   string            `json:"t,omitempty"`
+	ETag          string            `json:"e,omitempty"`
+	LastModified  time.Time         `json:"m"`
+	StorageClass  string            `json:"s,omitempty"`
+	ArchiveStatus string            `json:"a,omitempty"`
+	Restore       string            `json:"r,omitempty"`
+	Metadata      map[string]string `json:"u,omitempty"`
+
+	// Principal is who the metadata was fetched as, see cachePrincipal.
+	Principal string `json:"p,omitempty"`
+
+	// Cached is when the metadata was fetched.
+	Cached time.Time `json:"c"`
+}
+
+// newObjectMetadata returns the metadata of a HEAD response fetched as
+// principal.
+func newObjectMetadata(output *s3.HeadObjectOutput, principal string) ObjectMetadata {
+	return ObjectMetadata{
+		ContentLength: output.ContentLength,
+		ContentType:   aws.ToString(output.ContentType),
+		ETag:          aws.ToString(output.ETag),
+		LastModified:  aws.ToTime(output.LastModified),
+		StorageClass:  string(output.StorageClass),
+		ArchiveStatus: string(output.ArchiveStatus),
+		Restore:       aws.ToString(output.Restore),
+		Metadata:      output.Metadata,
+		Principal:     principal,
+	}
+}
+
+// output returns m as a HEAD response.
+func (m ObjectMetadata) output() *s3.HeadObjectOutput {
+	output := &s3.HeadObjectOutput{
+		ContentLength: m.ContentLength,
+		StorageClass:  types.StorageClass(m.StorageClass),
+		ArchiveStatus: types.ArchiveStatus(m.ArchiveStatus),
+		Metadata:      m.Metadata,
+	}
+	if m.ContentType != "" {
+		output.ContentType = aws.String(m.ContentType)
+	}
+	if m.ETag != "" {
+		output.ETag = aws.String(m.ETag)
+	}
+	if !m.LastModified.IsZero() {
+		output.LastModified = aws.Time(m.LastModified)
+	}
+	if m.Restore != "" {
+		output.Restore = aws.String(m.Restore)
+	}
+	return output
+}
+
+// MetadataCodec serializes the object metadata held by the cache tiers.
+type MetadataCodec interface {
+	Encode(metadata ObjectMetadata) ([]byte, error)
+	Decode(data []byte) (ObjectMetadata, error)
+}
+
+// JSONMetadataCodec serializes object metadata as JSON with short field
+// names. It is the default codec.
+type JSONMetadataCodec struct{}
+
+func (JSONMetadataCodec) Encode(metadata ObjectMetadata) ([]byte, error) {
+	return json.Marshal(metadata)
+}
+
+func (JSONMetadataCodec) Decode(data []byte) (ObjectMetadata, error) {
+	var metadata ObjectMetadata
+	err := json.Unmarshal(data, &metadata)
+	return metadata, err
+}
+
+// WithMetadataCodec serializes the cached object metadata with codec.
+func WithMetadataCodec(codec MetadataCodec) CacheOption {
+	return func(s *CachedCloudStorage) {
+		s.metadataCodec = codec
+	}
+}
@@ -0,0 +1,41 @@
+package cloud_storage
+
+import (
+	"context"
+	"maps"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// WithUploadDeduplication has uploads which wouldn't change the object
+// upstream, being of the same content, Content-Type and user metadata, be
+// acknowledged without writing them back. It costs a HEAD request upstream
+// per upload, which is well worth it when clients, such as CI systems,
+// upload the same artifacts over and over.
+func WithUploadDeduplication(enabled bool) CacheOption {
+	return func(s *CachedCloudStorage) {
+		s.dedupUploads = enabled
+	}
+}
+
+// duplicate reports whether an upload of a body of etag with headers would
+// leave the object upstream unchanged. Uploads with tags aren't deduplicated,
+// as tags aren't part of HEAD responses, nor are those of keys with writes
+// which haven't reached upstream yet.
+func (s *CachedCloudStorage) duplicate(ctx context.Context, cacheKey, bucketName, objectKey, etag, tagging string, headers UploadHeaders) bool {
+	if !s.dedupUploads || tagging != "" {
+		return false
+	}
+	s.uploadsMu.Lock()
+	_, pending := s.uploads[cacheKey]
+	s.uploadsMu.Unlock()
+	if _, spooled := s.spooledUpload(cacheKey); pending || spooled || s.multipartInProgress(cacheKey) {
+		return false
+	}
+	head, err := s.baseStorage.HeadObject(ctx, bucketName, objectKey)
+	if err != nil || aws.ToString(head.ETag) != etag || aws.ToString(head.ContentType) != headers.contentType() || !maps.Equal(head.Metadata, headers.Metadata) {
+		return false
+	}
+	s.requests.With("operation", "PutObject", "result", "deduplicated").Add(1)
+	return true
+}
@@ -0,0 +1,269 @@
+package cloud_storage
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// cacheExportIndex is the name of the first file of a cache export, listing
+// the objects whose bodies follow, each in a file named after its cache key
+// under cacheExportObjects.
+const (
+	cacheExportIndex   = "index.json"
+	cacheExportObjects = "objects/"
+)
+
+var errNoExportIndex = errors.New("exporting the cache needs its index")
+
+// CacheExportEntry describes an exported object.
+type CacheExportEntry struct {
+	Key             string    `json:"key"`
+	Size            int64     `json:"size"`
+	ETag            string    `json:"etag"`
+	ContentType     string    `json:"contentType,omitempty"`
+	LastModified    time.Time `json:"lastModified"`
+	TagCount        int32     `json:"tagCount,omitempty"`
+	Fetched         time.Time `json:"fetched,omitempty"`
+	Principal       string    `json:"principal,omitempty"`
+	ContentEncoding string    `json:"contentEncoding,omitempty"`
+}
+
+// CacheExportResult reports how many objects an export wrote.
+type CacheExportResult struct {
+	Exported int `json:"exported"`
+}
+
+// CacheImportResult reports what an import did.
+type CacheImportResult struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+}
+
+// keys returns the keys the index last saw cached rather than evicted, in
+// the order they were cached.
+func (i *cacheIndex) keys() []string {
+	page := i.since(0)
+	last := make(map[string]CacheIndexUpdate, len(page.Updates))
+	for _, update := range page.Updates {
+		last[update.Key] = update
+	}
+	var keys []string
+	for _, update := range page.Updates {
+		if last[update.Key].Seq == update.Seq && !update.Deleted {
+			keys = append(keys, update.Key)
+		}
+	}
+	return keys
+}
+
+// Export writes the objects of the cache to w as a tarball, which Import
+// seeds another cache with. The cache can't list its entries, so the ones
+// exported are those its index saw cached, see WithCacheIndex.
+func (s *CachedCloudStorage) Export(w io.Writer) (int, error) {
+	if s.index == nil {
+		return 0, errNoExportIndex
+	}
+	var entries []*cacheEntry
+	var index []CacheExportEntry
+	for _, key := range s.index.keys() {
+		entry, found := s.cachedObject(key)
+		if !found || s.expired(key, entry) {
+			continue
+		}
+		entries = append(entries, entry)
+		index = append(index, CacheExportEntry{
+			Key:             key,
+			Size:            int64(len(entry.body)),
+			ETag:            entry.info.ETag,
+			ContentType:     entry.info.ContentType,
+			LastModified:    entry.info.LastModified,
+			TagCount:        entry.info.TagCount,
+			Fetched:         entry.fetched,
+			Principal:       entry.principal,
+			ContentEncoding: entry.info.ContentEncoding,
+		})
+	}
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return 0, err
+	}
+	tw := tar.NewWriter(w)
+	now := s.clock.Now()
+	if err := writeTarFile(tw, cacheExportIndex, data, now); err != nil {
+		return 0, err
+	}
+	for i, entry := range entries {
+		if err := writeTarFile(tw, cacheExportObjects+index[i].Key, entry.body, now); err != nil {
+			return 0, err
+		}
+	}
+	return len(entries), tw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte, modified time.Time) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), ModTime: modified}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// Import caches the objects of a tarball written by Export. Objects which
+// are cached already or being written back are skipped, as are those whose
+// body doesn't match the index.
+func (s *CachedCloudStorage) Import(r io.Reader) (CacheImportResult, error) {
+	var result CacheImportResult
+	tr := tar.NewReader(r)
+	header, err := tr.Next()
+	if err != nil {
+		return result, err
+	}
+	if header.Name != cacheExportIndex {
+		return result, fmt.Errorf("not a cache export: %s comes first", header.Name)
+	}
+	var index []CacheExportEntry
+	if err := json.NewDecoder(tr).Decode(&index); err != nil {
+		return result, fmt.Errorf("%s: %w", cacheExportIndex, err)
+	}
+	entries := make(map[string]CacheExportEntry, len(index))
+	for _, entry := range index {
+		entries[entry.Key] = entry
+	}
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+		key, ok := strings.CutPrefix(header.Name, cacheExportObjects)
+		exported, listed := entries[key]
+		if !ok || !listed || header.Size != exported.Size {
+			result.Skipped++
+			continue
+		}
+		if _, found := s.cachedObject(key); found || s.uploadPending(key) {
+			result.Skipped++
+			continue
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			return result, err
+		}
+		_ = s.cache.Set(key, &cacheEntry{
+			info: ObjectInfo{
+				ContentLength:   exported.Size,
+				ContentType:     exported.ContentType,
+				ETag:            exported.ETag,
+				LastModified:    exported.LastModified,
+				TagCount:        exported.TagCount,
+				ContentEncoding: exported.ContentEncoding,
+			},
+			body:      body,
+			fetched:   exported.Fetched,
+			principal: exported.Principal,
+		}, 1)
+		s.scrubber.record(key)
+		s.index.record(CacheIndexUpdate{Key: key, ETag: exported.ETag, Size: exported.Size})
+		result.Imported++
+	}
+}
+
+// uploadPending reports whether a write-back upload of cacheKey is pending.
+func (s *CachedCloudStorage) uploadPending(cacheKey string) bool {
+	s.uploadsMu.Lock()
+	defer s.uploadsMu.Unlock()
+	_, pending := s.uploads[cacheKey]
+	return pending
+}
+
+// exportToBucket writes an export to key of bucket upstream, through a
+// temporary file as uploads need their length.
+func (s *CachedCloudStorage) exportToBucket(ctx context.Context, bucketName, objectKey string) (int, error) {
+	f, err := os.CreateTemp(s.spoolConfig.Dir, "s3proxy-export-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	n, err := s.Export(f)
+	if err != nil {
+		return 0, err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, s.baseStorage.PutObject(ctx, bucketName, objectKey, f, size, "", "", "", UploadHeaders{ContentType: "application/x-tar"})
+}
+
+// ExportRoutes mounts the endpoints exporting the cache, as a tarball in
+// the response or to an object upstream, and importing such tarballs:
+//
+//	GET  /cache/export
+//	POST /cache/export?bucket=b&key=k
+//	POST /cache/import                  (tarball in the body)
+//	POST /cache/import?bucket=b&key=k
+func (s *CachedCloudStorage) ExportRoutes(r *mux.Router) {
+	r.Methods("GET").Path("/cache/export").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.index == nil {
+			http.Error(w, errNoExportIndex.Error(), http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-tar")
+		if _, err := s.Export(w); err != nil {
+			s.logger.Log("msg", "exporting the cache failed", "err", err)
+		}
+	})
+
+	r.Methods("POST").Path("/cache/export").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bucket, key := r.URL.Query().Get("bucket"), r.URL.Query().Get("key")
+		if bucket == "" || key == "" {
+			http.Error(w, "bucket and key are required", http.StatusBadRequest)
+			return
+		}
+		n, err := s.exportToBucket(r.Context(), bucket, key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(CacheExportResult{Exported: n})
+	})
+
+	r.Methods("POST").Path("/cache/import").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := io.Reader(r.Body)
+		if bucket, key := r.URL.Query().Get("bucket"), r.URL.Query().Get("key"); bucket != "" || key != "" {
+			object, _, err := s.baseStorage.GetObject(r.Context(), bucket, key, "")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			defer object.Close()
+			body = object
+		}
+		result, err := s.Import(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+}
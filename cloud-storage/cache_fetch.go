@@ -0,0 +1,86 @@
+package cloud_storage
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// WithRefreshLimit limits the background reads of whole objects following
+// range misses to rps per second with burst; the ones over the limit are
+// skipped, the next range miss scheduling them again.
+func WithRefreshLimit(rps float64, burst int) CacheOption {
+	return func(s *CachedCloudStorage) {
+		if rps > 0 {
+			s.refreshLimiter = rate.NewLimiter(rate.Limit(rps), burst)
+		}
+	}
+}
+
+// joinFetch registers a read of the whole object cacheKey from upstream,
+// returning whether the caller leads it, and the channel closed once the
+// leading read completes otherwise.
+func (s *CachedCloudStorage) joinFetch(cacheKey string) (chan struct{}, bool) {
+	s.fetchesMu.Lock()
+	defer s.fetchesMu.Unlock()
+	if done, ok := s.fetches[cacheKey]; ok {
+		return done, false
+	}
+	done := make(chan struct{})
+	s.fetches[cacheKey] = done
+	return done, true
+}
+
+// endFetch completes the read led by the caller of joinFetch, once what it
+// cached is visible to the waiters.
+func (s *CachedCloudStorage) endFetch(cacheKey string, done chan struct{}) {
+	s.cache.Wait()
+	s.fetchesMu.Lock()
+	delete(s.fetches, cacheKey)
+	s.fetchesMu.Unlock()
+	close(done)
+}
+
+// awaitFetch waits for the read of cacheKey in progress, if any, returning
+// the entry it cached. Objects which weren't admitted to the cache are read
+// by every waiter.
+func (s *CachedCloudStorage) awaitFetch(ctx context.Context, cacheKey string) (*cacheEntry, bool, error) {
+	s.fetchesMu.Lock()
+	done, ok := s.fetches[cacheKey]
+	s.fetchesMu.Unlock()
+	if !ok {
+		return nil, false, nil
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+	entry, found := s.cachedObject(cacheKey)
+	if !found || s.expired(cacheKey, entry) {
+		return nil, false, nil
+	}
+	return entry, true, nil
+}
+
+// refresh reads the whole object in the background to cache it after a
+// range miss, unless it is being read already or refreshes are over their
+// limit, or the background pool is full. It is cancelled with the cache's
+// context.
+func (s *CachedCloudStorage) refresh(bucketName, objectKey, cacheKey string) {
+	s.fetchesMu.Lock()
+	_, fetching := s.fetches[cacheKey]
+	s.fetchesMu.Unlock()
+	if fetching || (s.refreshLimiter != nil && !s.refreshLimiter.Allow()) {
+		return
+	}
+	s.background.Go("refresh", func() {
+		start := time.Now()
+		body, _, err := s.GetObject(s.ctx, bucketName, objectKey, "")
+		if err == nil {
+			body.Close()
+		}
+		s.logger.Log("method", "GetObject", "bucket", bucketName, "object", objectKey, "took", time.Since(start), "err", err)
+	})
+}
@@ -0,0 +1,231 @@
+package cloud_storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+
+	"github.com/rampage644/s3-overlay-proxy/repository"
+)
+
+// CacheIndexUpdate is a change of the cache index: Key, as "bucket/key",
+// was cached with ETag and Size, or evicted if Deleted.
+type CacheIndexUpdate struct {
+	Seq     uint64 `json:"seq"`
+	Key     string `json:"key"`
+	ETag    string `json:"etag,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// CacheIndexPage is the response of GET /cache/index: the updates after
+// the requested sequence number, or, with Reset, the updates still held
+// when the requested ones were dropped already. Seq is the sequence number
+// of the last update.
+type CacheIndexPage struct {
+	Seq     uint64             `json:"seq"`
+	Reset   bool               `json:"reset,omitempty"`
+	Updates []CacheIndexUpdate `json:"updates"`
+}
+
+// cacheIndex remembers the last updates of the cache, so that a standby
+// can follow them.
+type cacheIndex struct {
+	mu      sync.Mutex
+	seq     uint64
+	updates []CacheIndexUpdate
+	next    int
+}
+
+// WithCacheIndex has the cache remember its last size updates, served on
+// GET /cache/index for standbys to follow, see CacheStandby.
+func WithCacheIndex(size int) CacheOption {
+	return func(s *CachedCloudStorage) {
+		if size > 0 {
+			s.index = &cacheIndex{updates: make([]CacheIndexUpdate, 0, size)}
+		}
+	}
+}
+
+// record adds an update, replacing the oldest one once the index is full.
+func (i *cacheIndex) record(update CacheIndexUpdate) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.seq++
+	update.Seq = i.seq
+	if len(i.updates) < cap(i.updates) {
+		i.updates = append(i.updates, update)
+		return
+	}
+	i.updates[i.next] = update
+	i.next = (i.next + 1) % len(i.updates)
+}
+
+// since returns the updates after seq, in order.
+func (i *cacheIndex) since(seq uint64) CacheIndexPage {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	page := CacheIndexPage{Seq: i.seq, Updates: []CacheIndexUpdate{}}
+	ordered := append(append([]CacheIndexUpdate(nil), i.updates[i.next:]...), i.updates[:i.next]...)
+	if seq > i.seq || (len(ordered) > 0 && ordered[0].Seq > seq+1) {
+		page.Reset = true
+		seq = 0
+	}
+	for _, update := range ordered {
+		if update.Seq > seq {
+			page.Updates = append(page.Updates, update)
+		}
+	}
+	return page
+}
+
+// IndexRoutes mounts the endpoint standbys follow the cache index on:
+//
+//	GET /cache/index?since=42
+func (s *CachedCloudStorage) IndexRoutes(r *mux.Router) {
+	r.Methods("GET").Path("/cache/index").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var since uint64
+		if v := r.URL.Query().Get("since"); v != "" {
+			var err error
+			if since, err = strconv.ParseUint(v, 10, 64); err != nil {
+				http.Error(w, "invalid since", http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.index.since(since))
+	})
+}
+
+// CacheStandbyConfig configures a warm standby.
+type CacheStandbyConfig struct {
+	// Primary is the admin API URL of the instance followed.
+	Primary string
+
+	// Interval is how often the primary is asked for updates.
+	Interval time.Duration
+}
+
+// CacheStandby keeps a cache warm for failover by following the cache
+// index of a primary instance: objects the primary caches are read from
+// upstream into this cache, unless cached already with the same ETag, and
+// those it evicts are evicted.
+type CacheStandby struct {
+	config CacheStandbyConfig
+	client *http.Client
+	logger log.Logger
+	cache  *CachedCloudStorage
+	seq    uint64
+}
+
+// NewCacheStandby returns a standby, which must be passed to the cache with
+// WithStandby before running.
+func NewCacheStandby(config CacheStandbyConfig, client *http.Client, logger log.Logger) *CacheStandby {
+	return &CacheStandby{config: config, client: client, logger: logger}
+}
+
+// WithStandby has the cache follow a primary with standby.
+func WithStandby(standby *CacheStandby) CacheOption {
+	return func(s *CachedCloudStorage) {
+		standby.cache = s
+	}
+}
+
+// fetch returns the updates of the primary since the last ones applied.
+func (c *CacheStandby) fetch(ctx context.Context) (CacheIndexPage, error) {
+	u := strings.TrimSuffix(c.config.Primary, "/") + "/cache/index?since=" + url.QueryEscape(strconv.FormatUint(c.seq, 10))
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return CacheIndexPage{}, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return CacheIndexPage{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return CacheIndexPage{}, fmt.Errorf("primary %s: %s", c.config.Primary, resp.Status)
+	}
+	var page CacheIndexPage
+	err = json.NewDecoder(resp.Body).Decode(&page)
+	return page, err
+}
+
+// Sync applies the updates of the primary since the last sync.
+func (c *CacheStandby) Sync(ctx context.Context) error {
+	page, err := c.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	if page.Reset {
+		c.logger.Log("msg", "following the primary from its oldest update", "primary", c.config.Primary, "seq", page.Seq)
+	}
+	// Only the last update of every key matters.
+	last := make(map[string]CacheIndexUpdate, len(page.Updates))
+	for _, update := range page.Updates {
+		last[update.Key] = update
+	}
+	var warmed, evicted int
+	for _, update := range page.Updates {
+		if last[update.Key].Seq != update.Seq {
+			continue
+		}
+		bucketName, objectKey, ok := strings.Cut(update.Key, "/")
+		if !ok {
+			continue
+		}
+		if update.Deleted {
+			c.cache.Purge(bucketName, objectKey)
+			evicted++
+			continue
+		}
+		if entry, found := c.cache.cachedObject(update.Key); found && entry.info.ETag == update.ETag {
+			continue
+		}
+		if err := c.cache.Warm(ctx, bucketName, objectKey); err != nil {
+			c.logger.Log("msg", "warming failed", "key", update.Key, "err", err)
+			continue
+		}
+		// Objects written back by the primary may not be upstream yet.
+		if entry, found := c.cache.cachedObject(update.Key); found && entry.info.ETag != update.ETag {
+			c.cache.Purge(bucketName, objectKey)
+			c.logger.Log("msg", "upstream differs from the primary", "key", update.Key, "etag", entry.info.ETag, "primary", update.ETag)
+			continue
+		}
+		warmed++
+	}
+	c.seq = page.Seq
+	if warmed > 0 || evicted > 0 {
+		c.logger.Log("msg", "followed primary", "seq", page.Seq, "warmed", warmed, "evicted", evicted)
+	}
+	return nil
+}
+
+// Run syncs every Interval until ctx is done.
+func (c *CacheStandby) Run(ctx context.Context) {
+	ctx = repository.WithPriority(ctx, repository.PriorityBackground)
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+	for {
+		if err := c.Sync(ctx); err != nil {
+			c.logger.Log("msg", "following primary failed", "primary", c.config.Primary, "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
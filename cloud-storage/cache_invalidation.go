@@ -0,0 +1,193 @@
+package cloud_storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// maxPrefixInvalidations bounds the prefix invalidations the cache
+// remembers. Once exceeded, the whole cache is emptied instead.
+const maxPrefixInvalidations = 1024
+
+// InvalidateRequest is the body of POST /cache/invalidate: keys and key
+// prefixes of Bucket changed upstream behind the proxy's back. S3 event
+// notifications, with Records, are accepted too, so that buckets can
+// notify the proxy of changes through SNS or EventBridge.
+type InvalidateRequest struct {
+	Bucket   string   `json:"bucket,omitempty"`
+	Keys     []string `json:"keys,omitempty"`
+	Prefixes []string `json:"prefixes,omitempty"`
+
+	Records []struct {
+		S3 struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				// Key is URL-encoded, as in form values.
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records,omitempty"`
+}
+
+// InvalidateResult reports an invalidation.
+type InvalidateResult struct {
+	Keys     int `json:"keys"`
+	Prefixes int `json:"prefixes"`
+}
+
+// prefixInvalidation invalidates what was cached of the keys starting with
+// Prefix, a "bucket/prefix" cache key prefix, before At.
+type prefixInvalidation struct {
+	Prefix string
+	At     time.Time
+}
+
+// invalidatePrefix invalidates the objects of bucketName whose keys start
+// with prefix. The cache can't be searched by prefix, so the invalidation
+// is remembered and applied as the objects are looked up.
+func (s *CachedCloudStorage) invalidatePrefix(bucketName, prefix string) {
+	s.invalidationsMu.Lock()
+	defer s.invalidationsMu.Unlock()
+	if len(s.invalidations) == maxPrefixInvalidations {
+		s.logger.Log("msg", "too many prefix invalidations, emptying the cache")
+		s.invalidations = nil
+		s.PurgeAll()
+		return
+	}
+	s.invalidations = append(s.invalidations, prefixInvalidation{Prefix: bucketName + "/" + prefix, At: s.clock.Now()})
+}
+
+// invalidated reports whether cacheKey, cached at cached, was invalidated
+// since. Keys with writes not upstream yet aren't, as the proxy's copy is
+// the latest.
+func (s *CachedCloudStorage) invalidated(cacheKey string, cached time.Time) bool {
+	if s.freezes.frozenKey(cacheKey) {
+		return false
+	}
+	s.invalidationsMu.RLock()
+	matched := false
+	for _, invalidation := range s.invalidations {
+		if strings.HasPrefix(cacheKey, invalidation.Prefix) && !cached.After(invalidation.At) {
+			matched = true
+			break
+		}
+	}
+	s.invalidationsMu.RUnlock()
+	if !matched {
+		return false
+	}
+	s.uploadsMu.Lock()
+	_, pending := s.uploads[cacheKey]
+	s.uploadsMu.Unlock()
+	return !pending
+}
+
+// Invalidate drops what the cache holds of keys and of the keys starting
+// with prefixes in bucketName, which changed upstream, so that they are
+// read from upstream again.
+func (s *CachedCloudStorage) Invalidate(bucketName string, keys, prefixes []string) {
+	if s.freezes.Frozen(bucketName) {
+		s.logger.Log("msg", "skipped invalidation of frozen bucket", "bucket", bucketName)
+		return
+	}
+	for _, key := range keys {
+		s.Purge(bucketName, key)
+	}
+	for _, prefix := range prefixes {
+		s.invalidatePrefix(bucketName, prefix)
+	}
+}
+
+// forget removes the records of keys and of the keys starting with
+// prefixes in bucket.
+func (m *MetadataStore) forget(bucket string, keys, prefixes []string) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		for _, key := range keys {
+			if err := b.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		for _, prefix := range prefixes {
+			c := b.Cursor()
+			for k, _ := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, _ = c.Next() {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// invalidations returns the keys and prefixes of req, by bucket.
+func (req InvalidateRequest) invalidations() (map[string]InvalidateRequest, error) {
+	byBucket := map[string]InvalidateRequest{}
+	if len(req.Keys) > 0 || len(req.Prefixes) > 0 {
+		if req.Bucket == "" {
+			return nil, errors.New("bucket is required")
+		}
+		byBucket[req.Bucket] = InvalidateRequest{Keys: req.Keys, Prefixes: req.Prefixes}
+	}
+	for _, record := range req.Records {
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil || record.S3.Bucket.Name == "" {
+			return nil, fmt.Errorf("invalid record of %q", record.S3.Object.Key)
+		}
+		invalidation := byBucket[record.S3.Bucket.Name]
+		invalidation.Keys = append(invalidation.Keys, key)
+		byBucket[record.S3.Bucket.Name] = invalidation
+	}
+	return byBucket, nil
+}
+
+// InvalidationRoutes mounts the endpoint through which systems writing to
+// upstream directly notify the proxy of their changes, keeping the cache
+// and the metadata store coherent:
+//
+//	POST /cache/invalidate {"bucket": "b", "keys": ["k"], "prefixes": ["p/"]}
+//
+// Buckets are the upstream ones. Every replica must be notified.
+func (p *Proxy) InvalidationRoutes(r *mux.Router) {
+	r.Methods("POST").Path("/cache/invalidate").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req InvalidateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		byBucket, err := req.invalidations()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var result InvalidateResult
+		for bucket, invalidation := range byBucket {
+			if p.Cache != nil {
+				p.Cache.Invalidate(bucket, invalidation.Keys, invalidation.Prefixes)
+			}
+			if p.metadata != nil {
+				if err := p.metadata.forget(bucket, invalidation.Keys, invalidation.Prefixes); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			result.Keys += len(invalidation.Keys)
+			result.Prefixes += len(invalidation.Prefixes)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+}
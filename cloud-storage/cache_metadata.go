@@ -0,0 +1,83 @@
+package cloud_storage
+
+import (
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/dgraph-io/ristretto"
+)
+
+// NewMetadataCache returns a cache of HEAD responses holding at most
+// maxBytes, separate from the budget of cached objects, or nil if maxBytes
+// is 0 and they are kept in the main cache.
+func NewMetadataCache(maxBytes int64) (*ristretto.Cache, error) {
+	if maxBytes <= 0 {
+		return nil, nil
+	}
+	return ristretto.NewCache(&ristretto.Config{
+		NumCounters:        1e6,
+		MaxCost:            maxBytes,
+		BufferItems:        64,
+		Metrics:            true,
+		IgnoreInternalCost: true,
+	})
+}
+
+// WithMetadataCache caches HEAD responses in metadata, if not nil, for ttl,
+// 0 keeping them until evicted.
+func WithMetadataCache(metadata *ristretto.Cache, ttl time.Duration) CacheOption {
+	return func(s *CachedCloudStorage) {
+		s.cache.metadata = metadata
+		s.headTTL = ttl
+	}
+}
+
+// setHead caches the metadata of a HEAD response fetched as principal, for
+// the HEAD TTL or the freshness of cached objects if shorter.
+func (s *CachedCloudStorage) setHead(cacheKey, principal string, output *s3.HeadObjectOutput) {
+	metadata := newObjectMetadata(output, principal)
+	metadata.Cached = s.clock.Now()
+	data, err := s.metadataCodec.Encode(metadata)
+	if err != nil {
+		s.logger.Log("msg", "encoding object metadata failed", "key", cacheKey, "err", err)
+		return
+	}
+	tuning := s.Tuning()
+	ttl := tuning.HeadTTL
+	if maxAge := tuning.MaxAge; maxAge > 0 && (ttl <= 0 || maxAge < ttl) {
+		ttl = maxAge
+	}
+	cost := int64(1)
+	if s.cache.metadata != nil {
+		cost = int64(len(data)) + partitionMetadataCost
+	}
+	if ttl > 0 {
+		_ = s.cache.SetWithTTL(cacheKey, data, cost, ttl)
+		return
+	}
+	_ = s.cache.Set(cacheKey, data, cost)
+}
+
+// cachedHead returns the cached metadata of cacheKey. Entries which can't be
+// decoded, e.g. written with another codec, are missed.
+func (s *CachedCloudStorage) cachedHead(cacheKey string) (ObjectMetadata, bool) {
+	value, found := s.cache.Get(cacheKey)
+	if !found {
+		return ObjectMetadata{}, false
+	}
+	data, ok := value.([]byte)
+	if !ok {
+		return ObjectMetadata{}, false
+	}
+	metadata, err := s.metadataCodec.Decode(data)
+	if err != nil {
+		s.logger.Log("msg", "decoding object metadata failed", "key", cacheKey, "err", err)
+		return ObjectMetadata{}, false
+	}
+	if s.invalidated(strings.TrimPrefix(cacheKey, "head/"), metadata.Cached) {
+		s.cache.Del(cacheKey)
+		return ObjectMetadata{}, false
+	}
+	return metadata, true
+}
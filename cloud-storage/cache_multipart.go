@@ -0,0 +1,476 @@
+package cloud_storage
+
+import (
+	"bytes"
+	"context"
+	md5sum "crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/rampage644/s3-overlay-proxy/repository"
+)
+
+// multipartUploadTTL is how long a multipart upload may stay incomplete
+// before its parts are dropped.
+const multipartUploadTTL = 24 * time.Hour
+
+// multipartSession is a multipart upload assembled in the cache, its parts
+// kept by part number until the upload completes. Parts are kept in memory,
+// counted against the write-back limits, unless larger than the spool
+// threshold or persisted, in which case they are kept in files.
+type multipartSession struct {
+	bucket  string
+	key     string
+	tagging string
+	headers UploadHeaders
+	started time.Time
+	parts   map[int32]multipartPart
+}
+
+// multipartPart is an uploaded part, in memory or in the file at path: a
+// spool file, or the persisted part if uploads are persisted.
+type multipartPart struct {
+	body []byte
+	path string
+	size int64
+	md5  []byte
+}
+
+// readPart reads part partNumber of the multipart upload uploadID of length
+// bytes, or of unknown length if negative, from content.
+func (s *CachedCloudStorage) readPart(uploadID string, partNumber int32, content io.Reader, length int64) (multipartPart, error) {
+	if s.multipartDir != "" {
+		// Persisted parts are written to their files, and kept there only.
+		hash := md5sum.New()
+		path, err := s.persistPart(uploadID, partNumber, io.TeeReader(content, hash))
+		if err != nil {
+			return multipartPart{}, err
+		}
+		stat, err := os.Stat(path)
+		if err != nil {
+			return multipartPart{}, err
+		}
+		return multipartPart{path: path, size: stat.Size(), md5: hash.Sum(nil)}, nil
+	}
+
+	var body []byte
+	var spooled *spooledObject
+	var err error
+	if s.spools(length) {
+		body, spooled, err = s.readOrSpool(content)
+	} else {
+		body, err = readAllSized(content, length)
+	}
+	if err != nil {
+		return multipartPart{}, err
+	}
+	if spooled != nil {
+		sum, _ := hex.DecodeString(trimETag(spooled.info.ETag))
+		return multipartPart{path: spooled.path, size: spooled.info.ContentLength, md5: sum}, nil
+	}
+	s.multipartBytes.Add(int64(len(body)))
+	sum := md5sum.Sum(body)
+	return multipartPart{body: body, size: int64(len(body)), md5: sum[:]}, nil
+}
+
+// open returns a reader of the part.
+func (p multipartPart) open() (io.ReadCloser, error) {
+	if p.path == "" {
+		return io.NopCloser(bytes.NewReader(p.body)), nil
+	}
+	return os.Open(p.path)
+}
+
+// releasePart releases the memory or the spool file of a part which is no
+// longer needed. Persisted parts are removed with their upload.
+func (s *CachedCloudStorage) releasePart(part multipartPart) {
+	s.multipartBytes.Add(-int64(len(part.body)))
+	if part.path != "" && s.multipartDir == "" {
+		if err := os.Remove(part.path); err != nil {
+			s.logger.Log("msg", "removing spool file failed", "path", part.path, "err", err)
+		}
+	}
+}
+
+// releaseParts releases the parts of a session which is no longer in
+// progress.
+func (s *CachedCloudStorage) releaseParts(session *multipartSession) {
+	for _, part := range session.parts {
+		s.releasePart(part)
+	}
+}
+
+func errNoSuchUpload() error {
+	return repository.ErrNoSuchUpload
+}
+
+// session returns the multipart upload uploadID of bucketName/objectKey.
+func (s *CachedCloudStorage) session(bucketName, objectKey, uploadID string) (*multipartSession, error) {
+	s.multipartMu.Lock()
+	defer s.multipartMu.Unlock()
+	session, ok := s.multipart[uploadID]
+	if !ok || session.bucket != bucketName || session.key != objectKey {
+		return nil, errNoSuchUpload()
+	}
+	return session, nil
+}
+
+// multipartInProgress reports whether a multipart upload of cacheKey is in
+// progress through the cache. Until it completes, HEAD answers with the
+// previous version of the object, or NotFound, without caching it.
+func (s *CachedCloudStorage) multipartInProgress(cacheKey string) bool {
+	s.multipartMu.Lock()
+	defer s.multipartMu.Unlock()
+	return s.uploading[cacheKey] > 0
+}
+
+// endMultipart records the end of a multipart upload of cacheKey, with
+// multipartMu held.
+func (s *CachedCloudStorage) endMultipart(cacheKey string) {
+	if s.uploading[cacheKey]--; s.uploading[cacheKey] <= 0 {
+		delete(s.uploading, cacheKey)
+	}
+}
+
+// CreateMultipartUpload starts a multipart upload assembled in the cache;
+// upstream only sees it once completed. Uploads of objects the tag or cache
+// rules never cache go upstream directly.
+func (s *CachedCloudStorage) CreateMultipartUpload(ctx context.Context, bucketName, objectKey, tagging string, headers UploadHeaders) (string, error) {
+	tags, err := ParseTagging(tagging)
+	if err != nil {
+		return "", err
+	}
+	if (s.tagPolicy != nil && s.tagPolicy.action(tags) == CacheNever) ||
+		(s.rulePolicy != nil && s.rulePolicy.action(bucketName, objectKey, headers.contentType(), -1) == CacheNever) {
+		return s.baseStorage.CreateMultipartUpload(ctx, bucketName, objectKey, tagging, headers)
+	}
+
+	uploadID := randomHex(16)
+	now := s.clock.Now()
+	session := &multipartSession{
+		bucket:  bucketName,
+		key:     objectKey,
+		tagging: tagging,
+		headers: headers,
+		started: now,
+		parts:   map[int32]multipartPart{},
+	}
+	if err := s.persistSession(uploadID, session); err != nil {
+		s.dropSession(uploadID)
+		return "", err
+	}
+
+	s.multipartMu.Lock()
+	defer s.multipartMu.Unlock()
+	for id, session := range s.multipart {
+		if now.Sub(session.started) > multipartUploadTTL {
+			delete(s.multipart, id)
+			s.endMultipart(fmt.Sprintf("%s/%s", session.bucket, session.key))
+			s.releaseParts(session)
+			s.dropSession(id)
+		}
+	}
+	s.uploading[fmt.Sprintf("%s/%s", bucketName, objectKey)]++
+	s.multipart[uploadID] = session
+	return uploadID, nil
+}
+
+// UploadPart keeps a part of a multipart upload assembled in the cache.
+// Parts which would be held in memory over the write-back limits fail with
+// SlowDown, as there is no upstream upload to write them through to.
+func (s *CachedCloudStorage) UploadPart(ctx context.Context, bucketName, objectKey, uploadID string, partNumber int32, content io.Reader, length int64, md5 string) (string, error) {
+	session, err := s.session(bucketName, objectKey, uploadID)
+	if err != nil {
+		// Started upstream, see CreateMultipartUpload.
+		return s.baseStorage.UploadPart(ctx, bucketName, objectKey, uploadID, partNumber, content, length, md5)
+	}
+	size := length
+	if s.spools(length) || s.multipartDir != "" {
+		size = 0
+	}
+	if s.writeBackSaturated(size) {
+		return "", errWriteBackSaturated()
+	}
+	part, err := s.readPart(uploadID, partNumber, content, length)
+	if err != nil {
+		return "", err
+	}
+
+	s.multipartMu.Lock()
+	defer s.multipartMu.Unlock()
+	if s.multipart[uploadID] != session {
+		s.releasePart(part)
+		return "", errNoSuchUpload()
+	}
+	if previous, ok := session.parts[partNumber]; ok {
+		s.releasePart(previous)
+	}
+	session.parts[partNumber] = part
+	return `"` + hex.EncodeToString(part.md5) + `"`, nil
+}
+
+// CompleteMultipartUpload assembles the object from the listed parts and
+// caches it under the ETag S3 computes for multipart objects. The object is
+// then written back as a multipart upload with the same parts, so that its
+// ETag upstream is the same. Objects larger than the spool threshold are
+// assembled in a spool file instead, and served from it until written back.
+func (s *CachedCloudStorage) CompleteMultipartUpload(ctx context.Context, bucketName, objectKey, uploadID string, parts []CompletedPart) (string, error) {
+	session, err := s.session(bucketName, objectKey, uploadID)
+	if err != nil {
+		return s.baseStorage.CompleteMultipartUpload(ctx, bucketName, objectKey, uploadID, parts)
+	}
+	// Rejected before the session is consumed, so that the completion can
+	// be retried.
+	if s.writeBackLimits.Reject && s.writeBackSaturated(0) {
+		return "", errWriteBackSaturated()
+	}
+
+	for i := 1; i < len(parts); i++ {
+		if parts[i].PartNumber <= parts[i-1].PartNumber {
+			return "", &smithy.GenericAPIError{Code: "InvalidPartOrder", Message: "The list of parts was not in ascending order. Parts must be ordered by part number."}
+		}
+	}
+
+	s.multipartMu.Lock()
+	selected := make([]multipartPart, 0, len(parts))
+	var validation error
+	for i, part := range parts {
+		uploaded, ok := session.parts[part.PartNumber]
+		if !ok || trimETag(part.ETag) != hex.EncodeToString(uploaded.md5) {
+			validation = &smithy.GenericAPIError{Code: "InvalidPart", Message: "One or more of the specified parts could not be found. The part may not have been uploaded, or the specified entity tag may not match the part's entity tag."}
+			break
+		}
+		if i < len(parts)-1 && uploaded.size < minPartSize {
+			validation = &smithy.GenericAPIError{Code: "EntityTooSmall", Message: "Your proposed upload is smaller than the minimum allowed object size."}
+			break
+		}
+		selected = append(selected, uploaded)
+	}
+	if validation == nil {
+		if s.multipart[uploadID] != session {
+			validation = errNoSuchUpload()
+		} else {
+			delete(s.multipart, uploadID)
+		}
+	}
+	s.multipartMu.Unlock()
+	if validation != nil {
+		return "", validation
+	}
+	cacheKey := fmt.Sprintf("%s/%s", bucketName, objectKey)
+	// Once the new version is cached, or the upload failed.
+	defer func() {
+		s.multipartMu.Lock()
+		s.endMultipart(cacheKey)
+		s.multipartMu.Unlock()
+	}()
+
+	sums := make([][]byte, len(selected))
+	sizes := make([]int64, len(selected))
+	var size int64
+	for i, part := range selected {
+		sums[i] = part.md5
+		sizes[i] = part.size
+		size += part.size
+	}
+	etag := MultipartETag(sums)
+	if s.tagPolicy != nil {
+		tags, _ := ParseTagging(session.tagging)
+		s.cache.SetWithTTL("tags/"+cacheKey, tags, 1, tagCacheTTL)
+	}
+
+	// The parts are assembled once, to a spool file if the object is
+	// larger than the spool threshold, and released.
+	if s.spools(size) {
+		object, err := s.spoolParts(selected)
+		s.releaseParts(session)
+		s.dropSession(uploadID)
+		if err != nil {
+			return "", err
+		}
+		object.principal = cachePrincipal(ctx)
+		object.info.ContentType = session.headers.contentType()
+		object.info.ETag = etag
+		if !s.writeBackLimits.Reject && s.writeBackSaturated(0) {
+			defer os.Remove(object.path)
+			if err := s.waitForUpload(ctx, cacheKey); err != nil {
+				return "", err
+			}
+			s.Purge(bucketName, objectKey)
+			s.forgetSpooled(cacheKey)
+			f, err := os.Open(object.path)
+			if err != nil {
+				return "", err
+			}
+			defer f.Close()
+			return etag, s.uploadParts(ctx, bucketName, objectKey, session.tagging, session.headers, f, sizes, etag)
+		}
+		writeID := s.writeBackSpooled(cacheKey, "CompleteMultipartUpload", bucketName, objectKey, object, func(ctx context.Context, f *os.File) error {
+			return s.uploadParts(ctx, bucketName, objectKey, session.tagging, session.headers, f, sizes, etag)
+		})
+		SetResponseHeader(ctx, WriteIDHeader, writeID)
+		return etag, nil
+	}
+
+	body, err := readParts(selected, size)
+	s.releaseParts(session)
+	s.dropSession(uploadID)
+	if err != nil {
+		return "", err
+	}
+	if !s.writeBackLimits.Reject && s.writeBackSaturated(size) {
+		// The object is in memory already; upload it before acknowledging
+		// rather than adding to the backlog.
+		if err := s.waitForUpload(ctx, cacheKey); err != nil {
+			return "", err
+		}
+		s.Purge(bucketName, objectKey)
+		if err := s.uploadParts(ctx, bucketName, objectKey, session.tagging, session.headers, bytes.NewReader(body), sizes, etag); err != nil {
+			return "", err
+		}
+		// Upstream has the object now; cache it anyway rather than having
+		// the first GET download it again.
+		s.cacheCompleted(cacheKey, cachePrincipal(ctx), session.headers, body, etag)
+		return etag, nil
+	}
+
+	s.cacheCompleted(cacheKey, cachePrincipal(ctx), session.headers, body, etag)
+	writeID := s.writeBack(cacheKey, "CompleteMultipartUpload", bucketName, objectKey, size, func(ctx context.Context) error {
+		return s.uploadParts(ctx, bucketName, objectKey, session.tagging, session.headers, bytes.NewReader(body), sizes, etag)
+	})
+	SetResponseHeader(ctx, WriteIDHeader, writeID)
+	return etag, nil
+}
+
+// readParts reads the size bytes of parts into memory.
+func readParts(parts []multipartPart, size int64) ([]byte, error) {
+	body := make([]byte, 0, size)
+	for _, part := range parts {
+		if part.path == "" {
+			body = append(body, part.body...)
+			continue
+		}
+		f, err := os.Open(part.path)
+		if err != nil {
+			return nil, err
+		}
+		n, err := io.ReadFull(f, body[len(body):len(body)+int(part.size)])
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = body[:len(body)+n]
+	}
+	return body, nil
+}
+
+// spoolParts writes parts to a spool file, returning the spooled object.
+func (s *CachedCloudStorage) spoolParts(parts []multipartPart) (*spooledObject, error) {
+	f, err := os.CreateTemp(s.spoolConfig.Dir, "s3proxy-spool-*")
+	if err != nil {
+		return nil, err
+	}
+	var size int64
+	for _, part := range parts {
+		var r io.ReadCloser
+		if r, err = part.open(); err != nil {
+			break
+		}
+		var n int64
+		n, err = copyBuffered(f, r)
+		r.Close()
+		if size += n; err != nil {
+			break
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &spooledObject{
+		path: f.Name(),
+		info: ObjectInfo{
+			ContentLength: size,
+			LastModified:  s.clock.Now(),
+		},
+	}, nil
+}
+
+// cacheCompleted caches the object assembled from parts, body, under etag,
+// written as principal, readable once it returns.
+func (s *CachedCloudStorage) cacheCompleted(cacheKey, principal string, headers UploadHeaders, body []byte, etag string) {
+	entry := &cacheEntry{
+		info: ObjectInfo{
+			ContentLength: int64(len(body)),
+			ContentType:   headers.contentType(),
+			ETag:          etag,
+			LastModified:  s.clock.Now(),
+		},
+		body:      body,
+		principal: principal,
+	}
+	_ = s.cache.Set(cacheKey, entry, 1)
+	s.cache.Del("head/" + cacheKey)
+	s.scrubber.record(cacheKey)
+	s.index.record(CacheIndexUpdate{Key: cacheKey, ETag: entry.info.ETag, Size: entry.info.ContentLength})
+	s.forgetSpooled(cacheKey)
+	// As for PutObject, the object must be readable once acknowledged.
+	s.cache.Wait()
+	if s.hotKeys != nil {
+		s.hotKeys.Update(cacheKey, entry)
+	}
+}
+
+// uploadParts writes body upstream as a multipart upload of parts of sizes,
+// aborting it on failure.
+func (s *CachedCloudStorage) uploadParts(ctx context.Context, bucketName, objectKey, tagging string, headers UploadHeaders, body io.ReaderAt, sizes []int64, etag string) error {
+	uploadID, err := s.baseStorage.CreateMultipartUpload(ctx, bucketName, objectKey, tagging, headers)
+	if err != nil {
+		return err
+	}
+	completed := make([]CompletedPart, len(sizes))
+	var offset int64
+	for i, size := range sizes {
+		partNumber := int32(i + 1)
+		partETag, err := s.baseStorage.UploadPart(ctx, bucketName, objectKey, uploadID, partNumber, io.NewSectionReader(body, offset, size), size, "")
+		if err != nil {
+			if abortErr := s.baseStorage.AbortMultipartUpload(ctx, bucketName, objectKey, uploadID); abortErr != nil {
+				s.logger.Log("method", "AbortMultipartUpload", "bucket", bucketName, "object", objectKey, "err", abortErr)
+			}
+			return err
+		}
+		completed[i] = CompletedPart{PartNumber: partNumber, ETag: partETag}
+		offset += size
+	}
+	upstreamETag, err := s.baseStorage.CompleteMultipartUpload(ctx, bucketName, objectKey, uploadID, completed)
+	if err != nil {
+		return err
+	}
+	if upstreamETag != etag {
+		// Not an S3 compatible ETag upstream; clients may see both.
+		s.logger.Log("msg", "upstream multipart ETag differs", "bucket", bucketName, "object", objectKey, "etag", etag, "upstream", upstreamETag)
+	}
+	return nil
+}
+
+func (s *CachedCloudStorage) AbortMultipartUpload(ctx context.Context, bucketName, objectKey, uploadID string) error {
+	if _, err := s.session(bucketName, objectKey, uploadID); err != nil {
+		return s.baseStorage.AbortMultipartUpload(ctx, bucketName, objectKey, uploadID)
+	}
+	s.multipartMu.Lock()
+	defer s.multipartMu.Unlock()
+	if session, ok := s.multipart[uploadID]; ok {
+		delete(s.multipart, uploadID)
+		s.endMultipart(fmt.Sprintf("%s/%s", bucketName, objectKey))
+		s.releaseParts(session)
+		s.dropSession(uploadID)
+	}
+	return nil
+}
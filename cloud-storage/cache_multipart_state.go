@@ -0,0 +1,199 @@
+package cloud_storage
+
+import (
+	"bytes"
+	md5sum "crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// multipartStateFile is the file of a persisted multipart upload holding its
+// session, next to a file per part named after its number.
+const multipartStateFile = "upload.json"
+
+// multipartState is the persisted session of a multipart upload.
+type multipartState struct {
+	Bucket  string        `json:"bucket"`
+	Key     string        `json:"key"`
+	Tagging string        `json:"tagging,omitempty"`
+	Headers UploadHeaders `json:"headers"`
+	Started time.Time     `json:"started"`
+}
+
+// WithMultipartDir persists the multipart uploads assembled in the cache in
+// dir, a directory per upload, and resumes those found there, so that
+// clients can go on uploading parts, and complete them, after the proxy
+// restarts.
+func WithMultipartDir(dir string) CacheOption {
+	return func(s *CachedCloudStorage) {
+		s.multipartDir = dir
+		if err := s.restoreMultipart(); err != nil {
+			s.logger.Log("msg", "restoring multipart uploads failed", "dir", dir, "err", err)
+		}
+	}
+}
+
+// persistSession persists the session of the multipart upload uploadID, if
+// uploads are persisted.
+func (s *CachedCloudStorage) persistSession(uploadID string, session *multipartSession) error {
+	if s.multipartDir == "" {
+		return nil
+	}
+	data, err := json.Marshal(multipartState{
+		Bucket:  session.bucket,
+		Key:     session.key,
+		Tagging: session.tagging,
+		Headers: session.headers,
+		Started: session.started,
+	})
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(s.multipartDir, uploadID)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	return writeFileAtomic(dir, multipartStateFile, data)
+}
+
+// persistPart persists part partNumber of the multipart upload uploadID,
+// read from body, returning the path of its file.
+func (s *CachedCloudStorage) persistPart(uploadID string, partNumber int32, body io.Reader) (string, error) {
+	dir := filepath.Join(s.multipartDir, uploadID)
+	name := strconv.Itoa(int(partNumber))
+	if err := writeReaderAtomic(dir, name, body); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// dropSession removes the persisted multipart upload uploadID, once
+// completed, aborted or expired.
+func (s *CachedCloudStorage) dropSession(uploadID string) {
+	if s.multipartDir == "" {
+		return
+	}
+	if err := os.RemoveAll(filepath.Join(s.multipartDir, uploadID)); err != nil {
+		s.logger.Log("msg", "removing multipart upload failed", "uploadId", uploadID, "err", err)
+	}
+}
+
+// restoreMultipart resumes the multipart uploads persisted in the multipart
+// directory. Expired uploads are removed, and unreadable ones skipped.
+func (s *CachedCloudStorage) restoreMultipart() error {
+	if err := os.MkdirAll(s.multipartDir, 0o700); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(s.multipartDir)
+	if err != nil {
+		return err
+	}
+	now := s.clock.Now()
+	s.multipartMu.Lock()
+	defer s.multipartMu.Unlock()
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		uploadID := entry.Name()
+		session, err := loadSession(filepath.Join(s.multipartDir, uploadID))
+		if err != nil {
+			s.logger.Log("msg", "skipping unreadable multipart upload", "uploadId", uploadID, "err", err)
+			continue
+		}
+		if now.Sub(session.started) > multipartUploadTTL {
+			s.dropSession(uploadID)
+			continue
+		}
+		s.multipart[uploadID] = session
+		s.uploading[fmt.Sprintf("%s/%s", session.bucket, session.key)]++
+		s.logger.Log("msg", "resumed multipart upload", "uploadId", uploadID, "bucket", session.bucket, "object", session.key, "parts", len(session.parts))
+	}
+	return nil
+}
+
+// loadSession reads the multipart upload persisted in dir.
+func loadSession(dir string) (*multipartSession, error) {
+	data, err := os.ReadFile(filepath.Join(dir, multipartStateFile))
+	if err != nil {
+		return nil, err
+	}
+	var state multipartState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	session := &multipartSession{
+		bucket:  state.Bucket,
+		key:     state.Key,
+		tagging: state.Tagging,
+		headers: state.Headers,
+		started: state.Started,
+		parts:   map[int32]multipartPart{},
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		// Skips the state file, and temporary files of parts being
+		// written when the proxy stopped.
+		partNumber, err := strconv.ParseInt(entry.Name(), 10, 32)
+		if err != nil {
+			continue
+		}
+		part, err := loadPart(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		session.parts[int32(partNumber)] = part
+	}
+	return session, nil
+}
+
+// loadPart returns the persisted part in the file at path, left on disk.
+func loadPart(path string) (multipartPart, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return multipartPart{}, err
+	}
+	defer f.Close()
+	hash := md5sum.New()
+	n, err := io.Copy(hash, f)
+	if err != nil {
+		return multipartPart{}, err
+	}
+	return multipartPart{path: path, size: n, md5: hash.Sum(nil)}, nil
+}
+
+// writeFileAtomic writes data to the file name in dir through a temporary
+// file, so that it is never seen partially written.
+func writeFileAtomic(dir, name string, data []byte) error {
+	return writeReaderAtomic(dir, name, bytes.NewReader(data))
+}
+
+// writeReaderAtomic is writeFileAtomic for data read from r.
+func writeReaderAtomic(dir, name string, r io.Reader) error {
+	f, err := os.CreateTemp(dir, "."+name+"-*")
+	if err != nil {
+		return err
+	}
+	_, err = copyBuffered(f, r)
+	if syncErr := f.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(dir, name))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,182 @@
+package cloud_storage
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+)
+
+// partitionMetadataCost is the cost charged to a partition for cached
+// metadata, such as HEAD responses and tags, roughly their size in bytes.
+const partitionMetadataCost = 512
+
+// CachePartitions gives buckets caches of their own, each with a budget in
+// bytes, so that a busy bucket can't evict the working set of another.
+// Buckets without a partition share the main cache.
+type CachePartitions struct {
+	budgets    map[string]int64
+	partitions map[string]*ristretto.Cache
+}
+
+// NewCachePartitions returns partitions for the buckets of budgets, which
+// holds their size in bytes.
+func NewCachePartitions(budgets map[string]int64) (*CachePartitions, error) {
+	p := &CachePartitions{budgets: budgets, partitions: make(map[string]*ristretto.Cache, len(budgets))}
+	for bucket, budget := range budgets {
+		cache, err := ristretto.NewCache(&ristretto.Config{
+			NumCounters:        1e5,
+			MaxCost:            budget,
+			BufferItems:        64,
+			Metrics:            true,
+			IgnoreInternalCost: true,
+		})
+		if err != nil {
+			return nil, err
+		}
+		p.partitions[bucket] = cache
+	}
+	return p, nil
+}
+
+// Buckets returns the partitioned buckets.
+func (p *CachePartitions) Buckets() []string {
+	buckets := make([]string, 0, len(p.partitions))
+	for bucket := range p.partitions {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+	return buckets
+}
+
+// Usage returns the bytes used by the partition of bucket and its budget.
+func (p *CachePartitions) Usage(bucket string) (used, budget int64) {
+	cache, ok := p.partitions[bucket]
+	if !ok {
+		return 0, 0
+	}
+	return int64(cache.Metrics.CostAdded() - cache.Metrics.CostEvicted()), p.budgets[bucket]
+}
+
+// WithCachePartitions caches the objects of the partitioned buckets in their
+// partition rather than the main cache.
+func WithCachePartitions(p *CachePartitions) CacheOption {
+	return func(s *CachedCloudStorage) {
+		s.cache.partitions = p.partitions
+	}
+}
+
+// objectCache routes cache keys, "bucket/key" optionally prefixed with
+// "head/" or "tags/", to the metadata cache, the partition of their bucket
+// or the main cache. Bucket lists, prefixed with "buckets/", are kept in the
+// main cache.
+type objectCache struct {
+	*ristretto.Cache
+	partitions map[string]*ristretto.Cache
+	metadata   *ristretto.Cache
+
+	// verify seals cached bodies, see WithContentVerification.
+	verify bool
+
+	// freezes pins the bodies of frozen buckets in pins, out of reach of
+	// evictions, see WithFreezes.
+	freezes *BucketFreezes
+	pinsMu  sync.RWMutex
+	pins    map[string]*cacheEntry
+}
+
+// partition returns the cache of key other than the main one, or nil.
+func (c *objectCache) partition(key string) *ristretto.Cache {
+	if c.metadata != nil && strings.HasPrefix(key, "head/") {
+		return c.metadata
+	}
+	if len(c.partitions) == 0 || strings.HasPrefix(key, "buckets/") {
+		return nil
+	}
+	for _, prefix := range []string{"head/", "tags/"} {
+		if rest, ok := strings.CutPrefix(key, prefix); ok {
+			key = rest
+			break
+		}
+	}
+	bucket, _, _ := strings.Cut(key, "/")
+	return c.partitions[bucket]
+}
+
+// partitionCost is the cost of value in a partition, its size in bytes.
+func partitionCost(value interface{}) int64 {
+	switch value := value.(type) {
+	case *cacheEntry:
+		return int64(len(value.body)) + partitionMetadataCost
+	case []byte:
+		return int64(len(value)) + partitionMetadataCost
+	}
+	return partitionMetadataCost
+}
+
+func (c *objectCache) Get(key string) (interface{}, bool) {
+	if entry, ok := c.pinned(key); ok {
+		return entry, true
+	}
+	var value interface{}
+	var found bool
+	if partition := c.partition(key); partition != nil {
+		value, found = partition.Get(key)
+	} else {
+		value, found = c.Cache.Get(key)
+	}
+	if found {
+		c.pin(key, value)
+	}
+	return value, found
+}
+
+func (c *objectCache) Set(key string, value interface{}, cost int64) bool {
+	if entry, ok := value.(*cacheEntry); ok && c.verify && !entry.sealed {
+		entry.seal()
+	}
+	c.pin(key, value)
+	if partition := c.partition(key); partition != nil {
+		return partition.Set(key, value, partitionCost(value))
+	}
+	return c.Cache.Set(key, value, cost)
+}
+
+func (c *objectCache) SetWithTTL(key string, value interface{}, cost int64, ttl time.Duration) bool {
+	if partition := c.partition(key); partition != nil {
+		return partition.SetWithTTL(key, value, partitionCost(value), ttl)
+	}
+	return c.Cache.SetWithTTL(key, value, cost, ttl)
+}
+
+func (c *objectCache) Del(key string) {
+	c.unpin(key)
+	if partition := c.partition(key); partition != nil {
+		partition.Del(key)
+		return
+	}
+	c.Cache.Del(key)
+}
+
+func (c *objectCache) Wait() {
+	c.Cache.Wait()
+	if c.metadata != nil {
+		c.metadata.Wait()
+	}
+	for _, partition := range c.partitions {
+		partition.Wait()
+	}
+}
+
+// Clear empties the cache, but for the pinned bodies of frozen buckets.
+func (c *objectCache) Clear() {
+	c.Cache.Clear()
+	if c.metadata != nil {
+		c.metadata.Clear()
+	}
+	for _, partition := range c.partitions {
+		partition.Clear()
+	}
+}
@@ -0,0 +1,145 @@
+package cloud_storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/gorilla/mux"
+)
+
+// WithPeers makes the cache one of several replicas sharing their caches:
+// object reads which miss are served by the peer owning the object in ring,
+// which caches it, and only go upstream when the peer can't be reached.
+// Peers are asked over their admin listener with client.
+func WithPeers(ring *PeerRing, client *http.Client) CacheOption {
+	return func(s *CachedCloudStorage) {
+		s.peers = ring
+		s.peerClient = client
+	}
+}
+
+type peerRequestContextKey struct{}
+
+// peerError is the body of peer object responses for failed reads.
+type peerError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// fetchFromPeer reads an object, or a range of it, from peer. S3 errors
+// returned by the peer are returned as such; other errors mean the peer
+// couldn't serve the read.
+func (s *CachedCloudStorage) fetchFromPeer(ctx context.Context, peer, bucketName, objectKey, contentRange string) (io.ReadCloser, ObjectInfo, bool, error) {
+	u := "http://" + peer + "/peer/objects/" + url.PathEscape(bucketName) + "/" + url.PathEscape(objectKey)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, ObjectInfo{}, false, err
+	}
+	if contentRange != "" {
+		req.Header.Set("Range", contentRange)
+	}
+	resp, err := s.peerClient.Do(req)
+	if err != nil {
+		return nil, ObjectInfo{}, false, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		defer resp.Body.Close()
+		var apiErr peerError
+		if resp.StatusCode >= 500 || json.NewDecoder(resp.Body).Decode(&apiErr) != nil || apiErr.Code == "" {
+			return nil, ObjectInfo{}, false, fmt.Errorf("peer %s: %s", peer, resp.Status)
+		}
+		return nil, ObjectInfo{}, true, &smithy.GenericAPIError{Code: apiErr.Code, Message: apiErr.Message}
+	}
+
+	info := ObjectInfo{
+		ContentLength: resp.ContentLength,
+		ContentType:   resp.Header.Get("Content-Type"),
+		ETag:          resp.Header.Get("ETag"),
+		ContentRange:  resp.Header.Get("Content-Range"),
+	}
+	info.ContentEncoding = resp.Header.Get(peerContentEncodingHeader)
+	info.LastModified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	if tagCount, err := strconv.ParseInt(resp.Header.Get("x-amz-tagging-count"), 10, 32); err == nil {
+		info.TagCount = int32(tagCount)
+	}
+	return resp.Body, info, true, nil
+}
+
+// getFromPeer serves a read which missed the cache from the owner of the
+// object, if that is another replica. ok is false if the read should go
+// upstream instead. Peers read as the proxy, so reads of tenants with an
+// assumed role always go upstream.
+func (s *CachedCloudStorage) getFromPeer(ctx context.Context, cacheKey, bucketName, objectKey, contentRange string) (body io.ReadCloser, info ObjectInfo, ok bool, err error) {
+	if s.peers == nil || ctx.Value(peerRequestContextKey{}) != nil || cachePrincipal(ctx) != "" {
+		return nil, ObjectInfo{}, false, nil
+	}
+	owner := s.peers.Owner(cacheKey)
+	if owner == "" {
+		return nil, ObjectInfo{}, false, nil
+	}
+	start := time.Now()
+	body, info, served, err := s.fetchFromPeer(ctx, owner, bucketName, objectKey, contentRange)
+	if !served {
+		s.logger.Log("method", "GetObject", "bucket", bucketName, "object", objectKey, "peer", owner, "took", time.Since(start), "err", err)
+		return nil, ObjectInfo{}, false, nil
+	}
+	return body, info, true, err
+}
+
+// peerContentEncodingHeader carries the Content-Encoding of objects between
+// peers, as the HTTP client would decode bodies sent with Content-Encoding.
+const peerContentEncodingHeader = "x-proxy-content-encoding"
+
+// PeerRoutes mounts the endpoint peers read objects from, which serves them
+// from this replica's cache without asking other peers:
+//
+//	GET /peer/objects/{bucket}/{key}
+func (s *CachedCloudStorage) PeerRoutes(r *mux.Router) {
+	r.Methods("GET").Path("/peer/objects/{bucket}/{object:.+}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bucket, key, err := objectPath(r)
+		if err == nil && (bucket == "" || key == "") {
+			err = errors.New("bucket and key are required")
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx := context.WithValue(r.Context(), peerRequestContextKey{}, true)
+		body, info, err := s.GetObject(ctx, bucket, key, r.Header.Get("Range"))
+		if err != nil {
+			response := apiErrorResponse(err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(response.StatusCode())
+			json.NewEncoder(w).Encode(peerError{Code: response.Code, Message: response.Message})
+			return
+		}
+		defer body.Close()
+
+		header := w.Header()
+		header.Set("Content-Length", strconv.FormatInt(info.ContentLength, 10))
+		header.Set("Content-Type", info.ContentType)
+		header.Set("ETag", info.ETag)
+		if !info.LastModified.IsZero() {
+			header.Set("Last-Modified", info.LastModified.UTC().Format(http.TimeFormat))
+		}
+		if info.TagCount > 0 {
+			header.Set("x-amz-tagging-count", strconv.Itoa(int(info.TagCount)))
+		}
+		if info.ContentEncoding != "" {
+			header.Set(peerContentEncodingHeader, info.ContentEncoding)
+		}
+		if info.ContentRange != "" {
+			header.Set("Content-Range", info.ContentRange)
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		io.Copy(w, body)
+	})
+}
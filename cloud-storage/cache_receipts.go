@@ -0,0 +1,119 @@
+package cloud_storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// WriteIDHeader is the response header carrying the ID of a write
+// acknowledged before being written back upstream.
+const WriteIDHeader = "x-proxy-write-id"
+
+// writeReceiptRetention is how long the outcome of completed write-back
+// uploads can be queried.
+const writeReceiptRetention = time.Hour
+
+// States of a WriteReceipt.
+const (
+	WritePending   = "pending"
+	WriteCommitted = "committed"
+	WriteFailed    = "failed"
+)
+
+// WriteReceipt is the state of a write-back upload: pending, committed once
+// upstream acknowledged it, or failed.
+type WriteReceipt struct {
+	ID        string     `json:"id"`
+	Method    string     `json:"method"`
+	Bucket    string     `json:"bucket"`
+	Key       string     `json:"key"`
+	State     string     `json:"state"`
+	Error     string     `json:"error,omitempty"`
+	Submitted time.Time  `json:"submitted"`
+	Completed *time.Time `json:"completed,omitempty"`
+}
+
+// addReceipt records a pending write-back upload, dropping the receipts of
+// uploads completed longer than writeReceiptRetention ago.
+func (s *CachedCloudStorage) addReceipt(method, bucketName, objectKey string) string {
+	now := s.clock.Now()
+	receipt := &WriteReceipt{
+		ID:        randomHex(16),
+		Method:    method,
+		Bucket:    bucketName,
+		Key:       objectKey,
+		State:     WritePending,
+		Submitted: now,
+	}
+	s.receiptsMu.Lock()
+	defer s.receiptsMu.Unlock()
+	for id, r := range s.receipts {
+		if r.Completed != nil && now.Sub(*r.Completed) > writeReceiptRetention {
+			delete(s.receipts, id)
+		}
+	}
+	s.receipts[receipt.ID] = receipt
+	return receipt.ID
+}
+
+// completeReceipt records the outcome of a write-back upload.
+func (s *CachedCloudStorage) completeReceipt(id string, err error) {
+	now := s.clock.Now()
+	s.receiptsMu.Lock()
+	defer s.receiptsMu.Unlock()
+	receipt, ok := s.receipts[id]
+	if !ok {
+		return
+	}
+	receipt.State = WriteCommitted
+	if err != nil {
+		receipt.State, receipt.Error = WriteFailed, err.Error()
+	}
+	receipt.Completed = &now
+}
+
+// Receipt returns the receipt of the write-back upload id.
+func (s *CachedCloudStorage) Receipt(id string) (WriteReceipt, bool) {
+	s.receiptsMu.Lock()
+	defer s.receiptsMu.Unlock()
+	receipt, ok := s.receipts[id]
+	if !ok {
+		return WriteReceipt{}, false
+	}
+	return *receipt, true
+}
+
+// waitForWrite waits for the pending write-back uploads of key of bucket,
+// if any, to reach upstream, returning the error of the one acknowledged
+// with write ID id if it failed.
+func (s *CachedCloudStorage) waitForWrite(ctx context.Context, bucketName, objectKey, id string) error {
+	if err := s.waitForUpload(ctx, fmt.Sprintf("%s/%s", bucketName, objectKey)); err != nil {
+		return err
+	}
+	if receipt, ok := s.Receipt(id); ok && receipt.State == WriteFailed {
+		return errors.New(receipt.Error)
+	}
+	return nil
+}
+
+// ReceiptRoutes mounts GET /cache/writes/{id} returning the WriteReceipt of
+// a write acknowledged with an x-proxy-write-id header, so that clients can
+// poll until it is committed upstream. Receipts of completed writes are
+// kept for an hour.
+func (s *CachedCloudStorage) ReceiptRoutes(r *mux.Router) {
+	r.Methods("GET").Path("/cache/writes/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receipt, ok := s.Receipt(mux.Vars(r)["id"])
+		if !ok {
+			http.Error(w, "unknown write", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(receipt)
+	})
+}
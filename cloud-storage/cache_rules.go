@@ -0,0 +1,145 @@
+package cloud_storage
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CacheRule decides whether objects of Bucket, or of every bucket if empty,
+// whose keys match the glob Key and whose Content-Types match the glob
+// ContentType, any if empty, are cached. In globs, * matches any sequence
+// of characters, slashes included, and ? any single one. Action, if set,
+// applies as for tag rules; otherwise objects are cached as usual up to
+// MaxSize bytes, 0 disabling the limit. For example, Key "*.parquet" with
+// MaxSize 1 GiB caches Parquet files up to 1 GiB, and Key "*.tmp" with
+// Action "never" never caches temporary files.
+type CacheRule struct {
+	Bucket      string         `json:"bucket,omitempty"`
+	Key         string         `json:"key,omitempty"`
+	ContentType string         `json:"contentType,omitempty"`
+	MaxSize     int64          `json:"maxSize,omitempty"`
+	Action      CacheTagAction `json:"action,omitempty"`
+}
+
+// cacheRule is a CacheRule with its globs compiled.
+type cacheRule struct {
+	CacheRule
+	key         *regexp.Regexp
+	contentType *regexp.Regexp
+}
+
+// compileGlob compiles a glob of CacheRule into an anchored regular
+// expression, nil matching anything if glob is empty.
+func compileGlob(glob string) *regexp.Regexp {
+	if glob == "" {
+		return nil
+	}
+	var expr strings.Builder
+	expr.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String())
+}
+
+// ValidateCacheRules reports the first invalid rule.
+func ValidateCacheRules(rules []CacheRule) error {
+	for i, rule := range rules {
+		if rule.Action != "" && rule.Action != CacheNever && rule.Action != CacheAlways {
+			return fmt.Errorf("rule %d: unknown action %q", i, rule.Action)
+		}
+		if rule.MaxSize < 0 {
+			return fmt.Errorf("rule %d: maxSize must not be negative", i)
+		}
+	}
+	return nil
+}
+
+// CacheRulePolicy holds the cache rules, letting operators control caching
+// by key, Content-Type and size.
+type CacheRulePolicy struct {
+	mu    sync.RWMutex
+	rules []cacheRule
+}
+
+func NewCacheRulePolicy(rules []CacheRule) *CacheRulePolicy {
+	p := &CacheRulePolicy{}
+	p.SetRules(rules)
+	return p
+}
+
+// SetRules replaces the cache rules.
+func (p *CacheRulePolicy) SetRules(rules []CacheRule) {
+	compiled := make([]cacheRule, len(rules))
+	for i, rule := range rules {
+		compiled[i] = cacheRule{CacheRule: rule, key: compileGlob(rule.Key), contentType: compileGlob(rule.ContentType)}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rules = compiled
+}
+
+// action returns the action of the first rule matching the object key of
+// bucketName with contentType, "" if unknown, and size bytes, negative if
+// unknown: CacheNever for objects larger than its MaxSize, or "" if no rule
+// matches.
+func (p *CacheRulePolicy) action(bucketName, objectKey, contentType string, size int64) CacheTagAction {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, rule := range p.rules {
+		if rule.Bucket != "" && rule.Bucket != bucketName {
+			continue
+		}
+		if rule.key != nil && !rule.key.MatchString(objectKey) {
+			continue
+		}
+		if rule.contentType != nil && !rule.contentType.MatchString(contentType) {
+			continue
+		}
+		if rule.MaxSize > 0 && size > rule.MaxSize {
+			return CacheNever
+		}
+		return rule.Action
+	}
+	return ""
+}
+
+// WithCacheRulePolicy lets cache rules decide whether objects are cached.
+// Rules are evaluated before tag rules, which only apply to objects the cache
+// rules have no action for.
+func WithCacheRulePolicy(p *CacheRulePolicy) CacheOption {
+	return func(s *CachedCloudStorage) {
+		s.rulePolicy = p
+	}
+}
+
+// cacheAction returns the action of the cache rules, or else the tag rules,
+// for an object read from upstream, or a byte range of it.
+func (s *CachedCloudStorage) cacheAction(ctx context.Context, bucketName, objectKey string, info ObjectInfo) CacheTagAction {
+	if s.rulePolicy != nil {
+		size := info.ContentLength
+		if info.ContentRange != "" {
+			// "bytes 0-99/1234", the size being "*" if unknown.
+			_, total, _ := strings.Cut(info.ContentRange, "/")
+			if size, _ = strconv.ParseInt(total, 10, 64); size == 0 {
+				size = -1
+			}
+		}
+		if action := s.rulePolicy.action(bucketName, objectKey, info.ContentType, size); action != "" {
+			return action
+		}
+	}
+	return s.tagAction(ctx, bucketName, objectKey, info.TagCount)
+}
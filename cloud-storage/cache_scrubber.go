@@ -0,0 +1,170 @@
+package cloud_storage
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"github.com/rampage644/s3-overlay-proxy/repository"
+)
+
+// ScrubberConfig configures cache verification.
+type ScrubberConfig struct {
+	// SampleSize is the number of recently cached keys remembered to be
+	// picked from.
+	SampleSize int
+
+	// Batch keys are verified every Interval.
+	Batch    int
+	Interval time.Duration
+}
+
+// CacheScrubber verifies cached objects against upstream, to catch objects
+// modified there behind the proxy's back: it samples recently cached keys,
+// HEADs them upstream and evicts those whose ETag or size no longer match,
+// or which are gone. Objects whose write-back upload is pending are
+// skipped, and with a MetadataStore upstream is only asked again once the
+// persisted metadata is outside of its window.
+type CacheScrubber struct {
+	config      ScrubberConfig
+	divergences metrics.Counter
+	logger      log.Logger
+	cache       *CachedCloudStorage
+
+	mu   sync.Mutex
+	keys []string
+	next int
+}
+
+// NewCacheScrubber returns a scrubber counting evicted entries in
+// divergences, labelled by "reason": "etag", "size" or "missing". It must
+// be passed to the cache with WithScrubber before running.
+func NewCacheScrubber(config ScrubberConfig, divergences metrics.Counter, logger log.Logger) *CacheScrubber {
+	return &CacheScrubber{
+		config:      config,
+		divergences: divergences,
+		logger:      logger,
+		keys:        make([]string, 0, config.SampleSize),
+	}
+}
+
+// WithScrubber has the cache report the keys it caches to s.
+func WithScrubber(scrubber *CacheScrubber) CacheOption {
+	return func(s *CachedCloudStorage) {
+		s.scrubber = scrubber
+		scrubber.cache = s
+	}
+}
+
+// record adds a cached key to the sample, replacing the oldest one once
+// the sample is full.
+func (s *CacheScrubber) record(cacheKey string) {
+	if s == nil || s.config.SampleSize <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.keys) < s.config.SampleSize {
+		s.keys = append(s.keys, cacheKey)
+		return
+	}
+	s.keys[s.next] = cacheKey
+	s.next = (s.next + 1) % len(s.keys)
+}
+
+// pick returns up to n distinct keys of the sample.
+func (s *CacheScrubber) pick(n int) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	picked := make(map[string]bool, n)
+	for _, i := range rand.Perm(len(s.keys)) {
+		if len(picked) == n {
+			break
+		}
+		picked[s.keys[i]] = true
+	}
+	keys := make([]string, 0, len(picked))
+	for key := range picked {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// verify checks a cached object against upstream, evicting it if it
+// diverged.
+func (s *CacheScrubber) verify(ctx context.Context, cacheKey string) error {
+	c := s.cache
+	entry, found := c.cachedObject(cacheKey)
+	if !found {
+		return nil
+	}
+	c.uploadsMu.Lock()
+	_, pending := c.uploads[cacheKey]
+	c.uploadsMu.Unlock()
+	if pending {
+		return nil
+	}
+
+	bucketName, objectKey, _ := strings.Cut(cacheKey, "/")
+	metadata, err := c.baseStorage.HeadObject(ctx, bucketName, objectKey)
+	reason := ""
+	switch {
+	case err != nil:
+		if !errors.Is(err, repository.ErrNoSuchKey) {
+			return err
+		}
+		reason = "missing"
+	case aws.ToString(metadata.ETag) != entry.info.ETag:
+		reason = "etag"
+	case metadata.ContentLength != entry.info.ContentLength:
+		reason = "size"
+	default:
+		return nil
+	}
+
+	// It may have been rewritten through the proxy in the meantime.
+	if current, found := c.cachedObject(cacheKey); !found || current != entry {
+		return nil
+	}
+	if c.freezes.Frozen(bucketName) {
+		s.logger.Log("msg", "kept diverged cache entry of frozen bucket", "bucket", bucketName, "object", objectKey, "reason", reason)
+		return nil
+	}
+	c.Purge(bucketName, objectKey)
+	s.divergences.With("reason", reason).Add(1)
+	s.logger.Log("msg", "evicted diverged cache entry", "bucket", bucketName, "object", objectKey, "reason", reason)
+	return nil
+}
+
+// Scrub verifies a batch of sampled keys.
+func (s *CacheScrubber) Scrub(ctx context.Context) {
+	for _, key := range s.pick(s.config.Batch) {
+		if err := s.verify(ctx, key); err != nil {
+			s.logger.Log("msg", "cache verification failed", "key", key, "err", err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// Run scrubs every Interval until ctx is done.
+func (s *CacheScrubber) Run(ctx context.Context) {
+	ctx = repository.WithPriority(ctx, repository.PriorityBackground)
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.Scrub(ctx)
+	}
+}
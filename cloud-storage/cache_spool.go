@@ -0,0 +1,204 @@
+package cloud_storage
+
+import (
+	"bytes"
+	"context"
+	md5sum "crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// SpoolConfig makes the cache keep uploads larger than Threshold bytes in
+// temporary files in Dir, the system default if empty, instead of memory
+// until they are written back.
+type SpoolConfig struct {
+	Dir       string
+	Threshold int64
+}
+
+// WithSpool spools large uploads to disk.
+func WithSpool(config SpoolConfig) CacheOption {
+	return func(s *CachedCloudStorage) {
+		s.spoolConfig = config
+	}
+}
+
+// spooledObject is an upload held in a temporary file until it is written
+// back; reads are served from the file meanwhile.
+type spooledObject struct {
+	path      string
+	info      ObjectInfo
+	principal string
+}
+
+// spools reports whether an upload of length bytes, or of unknown length if
+// negative, may have to be spooled.
+func (s *CachedCloudStorage) spools(length int64) bool {
+	return s.spoolConfig.Threshold > 0 && (length < 0 || length > s.spoolConfig.Threshold)
+}
+
+// readOrSpool reads content into memory if it is at most the spool
+// threshold, returning it, or spools it to a temporary file otherwise.
+func (s *CachedCloudStorage) readOrSpool(content io.Reader) ([]byte, *spooledObject, error) {
+	head, err := io.ReadAll(io.LimitReader(content, s.spoolConfig.Threshold+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if int64(len(head)) <= s.spoolConfig.Threshold {
+		return head, nil, nil
+	}
+
+	f, err := os.CreateTemp(s.spoolConfig.Dir, "s3proxy-spool-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	hash := md5sum.New()
+	n, err := copyBuffered(io.MultiWriter(f, hash), io.MultiReader(bytes.NewReader(head), content))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, nil, err
+	}
+	return nil, &spooledObject{
+		path: f.Name(),
+		info: ObjectInfo{
+			ContentLength: n,
+			ContentType:   "application/octet-stream",
+			ETag:          `"` + hex.EncodeToString(hash.Sum(nil)) + `"`,
+			LastModified:  s.clock.Now(),
+		},
+	}, nil
+}
+
+// putSpooled writes a spooled upload back, serving reads from its file until
+// the upload completes. It returns the write ID.
+func (s *CachedCloudStorage) putSpooled(cacheKey, bucketName, objectKey string, object *spooledObject, md5 string, sha256 string, tagging string, headers UploadHeaders) string {
+	if md5 == "" && s.cache.verify {
+		md5 = spooledMD5(object)
+	}
+	return s.writeBackSpooled(cacheKey, "PutObject", bucketName, objectKey, object, func(ctx context.Context, f *os.File) error {
+		return s.baseStorage.PutObject(ctx, bucketName, objectKey, f, object.info.ContentLength, md5, sha256, tagging, headers)
+	})
+}
+
+// writeBackSpooled writes a spooled object back with upload, serving reads
+// from its file until the upload completes. It returns the write ID.
+func (s *CachedCloudStorage) writeBackSpooled(cacheKey, method, bucketName, objectKey string, object *spooledObject, upload func(ctx context.Context, f *os.File) error) string {
+	s.Purge(bucketName, objectKey)
+	s.spooledMu.Lock()
+	s.spooled[cacheKey] = object
+	s.spooledMu.Unlock()
+
+	// The body is on disk, so it doesn't count against the backlog bytes.
+	return s.writeBack(cacheKey, method, bucketName, objectKey, 0, func(ctx context.Context) error {
+		defer s.dropSpooled(cacheKey, object)
+		f, err := os.Open(object.path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return upload(ctx, f)
+	})
+}
+
+// forgetSpooled stops serving reads of cacheKey from its spooled upload,
+// which a newer write supersedes. The file is removed once written back.
+func (s *CachedCloudStorage) forgetSpooled(cacheKey string) {
+	s.spooledMu.Lock()
+	delete(s.spooled, cacheKey)
+	s.spooledMu.Unlock()
+}
+
+// dropSpooled forgets a spooled upload and removes its file. Reads which
+// opened it already can complete.
+func (s *CachedCloudStorage) dropSpooled(cacheKey string, object *spooledObject) {
+	s.spooledMu.Lock()
+	if s.spooled[cacheKey] == object {
+		delete(s.spooled, cacheKey)
+	}
+	s.spooledMu.Unlock()
+	if err := os.Remove(object.path); err != nil {
+		s.logger.Log("msg", "removing spool file failed", "path", object.path, "err", err)
+	}
+}
+
+// spooledUpload returns the spooled upload of cacheKey, if any.
+func (s *CachedCloudStorage) spooledUpload(cacheKey string) (*spooledObject, bool) {
+	s.spooledMu.Lock()
+	defer s.spooledMu.Unlock()
+	object, ok := s.spooled[cacheKey]
+	return object, ok
+}
+
+// headSpooled returns the metadata of a spooled upload.
+func headSpooled(object *spooledObject) *s3.HeadObjectOutput {
+	return &s3.HeadObjectOutput{
+		ContentLength: object.info.ContentLength,
+		ContentType:   aws.String(object.info.ContentType),
+		ETag:          aws.String(object.info.ETag),
+		LastModified:  aws.Time(object.info.LastModified),
+	}
+}
+
+// fileBody is the body of an object, or of a byte range of it, read from a
+// file on disk. Its WriteTo hands the file to the writer, so that the HTTP
+// server sends it with sendfile rather than copying it through userspace
+// buffers. Wrappers of GET bodies implement io.WriterTo to keep this path.
+type fileBody struct {
+	file   *os.File
+	reader io.LimitedReader
+}
+
+// newFileBody returns a body of the length bytes of file from its current
+// offset.
+func newFileBody(file *os.File, length int64) *fileBody {
+	return &fileBody{file: file, reader: io.LimitedReader{R: file, N: length}}
+}
+
+func (b *fileBody) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+// WriteTo writes the body to w, by w.ReadFrom if implemented, which the
+// HTTP server does with sendfile for limited readers of files.
+func (b *fileBody) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, &b.reader)
+}
+
+func (b *fileBody) Close() error {
+	return b.file.Close()
+}
+
+// getSpooled reads a spooled upload, or the contentRange of it.
+func getSpooled(object *spooledObject, contentRange string) (io.ReadCloser, ObjectInfo, error) {
+	f, err := os.Open(object.path)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	info := object.info
+	if contentRange == "" {
+		return newFileBody(f, info.ContentLength), info, nil
+	}
+
+	start, end, ok, err := contentRangeBounds(contentRange, int(info.ContentLength))
+	if err == nil && !ok {
+		return newFileBody(f, info.ContentLength), info, nil
+	}
+	if err == nil {
+		_, err = f.Seek(int64(start), io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, ObjectInfo{}, err
+	}
+	info.ContentRange = fmt.Sprintf("bytes %d-%d/%d", start, end, info.ContentLength)
+	info.ContentLength = int64(end - start + 1)
+	return newFileBody(f, info.ContentLength), info, nil
+}
@@ -0,0 +1,111 @@
+package cloud_storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/rampage644/s3-overlay-proxy/repository"
+)
+
+// staleWarning marks responses served from an expired cached copy because
+// upstream failed, see RFC 7234 section 5.5.
+const staleWarning = `111 s3proxy "Revalidation Failed"`
+
+// StaleConfig configures cache freshness.
+type StaleConfig struct {
+	// MaxAge is how long objects read from upstream are served from the
+	// cache before being read again; 0 keeps them until evicted.
+	MaxAge time.Duration
+
+	// ServeStale serves cached copies, expired ones included, when a GET or
+	// HEAD fails upstream with a server error or a timeout, with a Warning
+	// header.
+	ServeStale bool
+
+	// BucketListTTL is how long the bucket list is kept for ServeStale to
+	// answer ListBuckets with when upstream fails; 0 disables it.
+	BucketListTTL time.Duration
+}
+
+// WithStale sets the freshness of cached objects.
+func WithStale(config StaleConfig) CacheOption {
+	return func(s *CachedCloudStorage) {
+		s.staleConfig = config
+	}
+}
+
+// expired reports whether entry must be read from upstream again. Objects
+// written through the proxy, or of frozen buckets, never expire.
+func (s *CachedCloudStorage) expired(cacheKey string, entry *cacheEntry) bool {
+	if s.freezes.frozenKey(cacheKey) {
+		return false
+	}
+	maxAge := s.Tuning().MaxAge
+	return maxAge > 0 && !entry.fetched.IsZero() && s.clock.Now().Sub(entry.fetched) > maxAge
+}
+
+// staleOnError returns the cached copy of cacheKey to serve instead of
+// failing with the upstream error err, if any, marking the response stale.
+// Copies fetched as another principal aren't, since upstream can't tell
+// whether the principal of ctx may read them.
+func (s *CachedCloudStorage) staleOnError(ctx context.Context, operation, cacheKey string, err error) (*cacheEntry, bool) {
+	if !s.staleConfig.ServeStale || !repository.IsUpstreamFailure(err) {
+		return nil, false
+	}
+	entry, found := s.cachedObject(cacheKey)
+	if !found || entry.principal != cachePrincipal(ctx) {
+		return nil, false
+	}
+	s.requests.With("operation", operation, "result", "stale").Add(1)
+	s.logger.Log("msg", "serving stale cached copy", "method", operation, "key", cacheKey, "err", err)
+	SetResponseHeader(ctx, "Warning", staleWarning)
+	return entry, true
+}
+
+// bucketListKey is the cache key of the bucket list of principal. Bucket
+// lists are cached per principal as tenants may see different buckets.
+func bucketListKey(principal string) string {
+	return "buckets/" + principal
+}
+
+// setBucketList keeps buckets, listed as the principal of ctx, to serve if
+// upstream fails later.
+func (s *CachedCloudStorage) setBucketList(ctx context.Context, buckets []Bucket) {
+	if !s.staleConfig.ServeStale || s.staleConfig.BucketListTTL <= 0 {
+		return
+	}
+	_ = s.cache.SetWithTTL(bucketListKey(cachePrincipal(ctx)), buckets, 1, s.staleConfig.BucketListTTL)
+}
+
+// staleBucketList returns the bucket list last listed as the principal of
+// ctx to serve instead of failing with the upstream error err, if any,
+// marking the response stale.
+func (s *CachedCloudStorage) staleBucketList(ctx context.Context, err error) ([]Bucket, bool) {
+	if !s.staleConfig.ServeStale || !repository.IsUpstreamFailure(err) {
+		return nil, false
+	}
+	value, found := s.cache.Get(bucketListKey(cachePrincipal(ctx)))
+	if !found {
+		return nil, false
+	}
+	buckets, ok := value.([]Bucket)
+	if !ok {
+		return nil, false
+	}
+	s.requests.With("operation", "ListBuckets", "result", "stale").Add(1)
+	s.logger.Log("msg", "serving stale bucket list", "err", err)
+	SetResponseHeader(ctx, "Warning", staleWarning)
+	return buckets, true
+}
+
+// headEntry returns the metadata of a cached object.
+func headEntry(entry *cacheEntry) *s3.HeadObjectOutput {
+	return &s3.HeadObjectOutput{
+		ContentLength: entry.info.ContentLength,
+		ContentType:   aws.String(entry.info.ContentType),
+		ETag:          aws.String(entry.info.ETag),
+		LastModified:  aws.Time(entry.info.LastModified),
+	}
+}
@@ -0,0 +1,98 @@
+package cloud_storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+)
+
+// SyncWriteConfig makes the cache write uploads larger than Threshold bytes
+// straight to upstream, before acknowledging them, as multipart uploads of
+// PartSize parts, instead of holding them until written back. Only one part
+// is held in memory at a time.
+type SyncWriteConfig struct {
+	Threshold int64
+	PartSize  int64
+}
+
+// WithSyncWrites writes large uploads synchronously.
+func WithSyncWrites(config SyncWriteConfig) CacheOption {
+	return func(s *CachedCloudStorage) {
+		if config.PartSize < minPartSize {
+			config.PartSize = minPartSize
+		}
+		s.syncWrites = config
+	}
+}
+
+// syncWrite routes uploads of length bytes, or of unknown length if
+// negative, over the sync write threshold, or all of them with SyncAll, to
+// putSync. It returns the
+// content to write back otherwise, read into memory if its length was
+// unknown, and whether it was written.
+func (s *CachedCloudStorage) syncWrite(ctx context.Context, cacheKey, bucketName, objectKey string, content io.Reader, length int64, tagging string, headers UploadHeaders) (io.Reader, int64, bool, error) {
+	if s.Tuning().SyncAll {
+		return nil, 0, true, s.putSync(ctx, cacheKey, bucketName, objectKey, content, tagging, headers)
+	}
+	threshold := s.syncWrites.Threshold
+	if threshold <= 0 || (length >= 0 && length <= threshold) {
+		return content, length, false, nil
+	}
+	if length < 0 {
+		head, err := io.ReadAll(io.LimitReader(content, threshold+1))
+		if err != nil {
+			return nil, 0, false, err
+		}
+		if int64(len(head)) <= threshold {
+			return bytes.NewReader(head), int64(len(head)), false, nil
+		}
+		content = io.MultiReader(bytes.NewReader(head), content)
+	}
+	return nil, 0, true, s.putSync(ctx, cacheKey, bucketName, objectKey, content, tagging, headers)
+}
+
+// putSync writes content upstream as a multipart upload, after any pending
+// upload of the key, dropping the cached copy. The ETag of the object is a
+// multipart one.
+func (s *CachedCloudStorage) putSync(ctx context.Context, cacheKey, bucketName, objectKey string, content io.Reader, tagging string, headers UploadHeaders) error {
+	if err := s.waitForUpload(ctx, cacheKey); err != nil {
+		return err
+	}
+	s.Purge(bucketName, objectKey)
+	s.forgetSpooled(cacheKey)
+
+	uploadID, err := s.baseStorage.CreateMultipartUpload(ctx, bucketName, objectKey, tagging, headers)
+	if err != nil {
+		return err
+	}
+	abort := func(err error) error {
+		if abortErr := s.baseStorage.AbortMultipartUpload(ctx, bucketName, objectKey, uploadID); abortErr != nil {
+			s.logger.Log("method", "AbortMultipartUpload", "bucket", bucketName, "object", objectKey, "err", abortErr)
+		}
+		return err
+	}
+
+	var parts []CompletedPart
+	part := make([]byte, max(s.syncWrites.PartSize, minPartSize))
+	for partNumber := int32(1); ; partNumber++ {
+		n, err := io.ReadFull(content, part)
+		if n > 0 || partNumber == 1 {
+			etag, uploadErr := s.baseStorage.UploadPart(ctx, bucketName, objectKey, uploadID, partNumber, bytes.NewReader(part[:n]), int64(n), "")
+			if uploadErr != nil {
+				return abort(uploadErr)
+			}
+			parts = append(parts, CompletedPart{PartNumber: partNumber, ETag: etag})
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return abort(err)
+		}
+	}
+	if _, err := s.baseStorage.CompleteMultipartUpload(ctx, bucketName, objectKey, uploadID, parts); err != nil {
+		return abort(err)
+	}
+	return nil
+}
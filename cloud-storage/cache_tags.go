@@ -0,0 +1,107 @@
+package cloud_storage
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/aws/smithy-go"
+)
+
+// maxObjectTags is the number of tags S3 allows per object.
+const maxObjectTags = 10
+
+// ParseTagging decodes an x-amz-tagging header, tags encoded as URL query
+// parameters, e.g. "cache=never&team=data".
+func ParseTagging(tagging string) (map[string]string, error) {
+	tags := map[string]string{}
+	if tagging == "" {
+		return tags, nil
+	}
+	values, err := url.ParseQuery(tagging)
+	if err != nil {
+		return nil, &smithy.GenericAPIError{Code: "InvalidArgument", Message: "The header 'x-amz-tagging' shall be encoded as UTF-8 then URLEncoded URL query parameters without tag name duplicates."}
+	}
+	for key, v := range values {
+		if len(v) > 1 {
+			return nil, &smithy.GenericAPIError{Code: "InvalidTag", Message: "Cannot provide multiple Tags with the same key"}
+		}
+		tags[key] = v[0]
+	}
+	if len(tags) > maxObjectTags {
+		return nil, &smithy.GenericAPIError{Code: "InvalidTag", Message: fmt.Sprintf("Object tags cannot be greater than %d", maxObjectTags)}
+	}
+	return tags, nil
+}
+
+// CacheTagAction is what the cache does with objects matching a tag rule.
+type CacheTagAction string
+
+const (
+	// CacheNever doesn't cache objects: reads go upstream and writes are
+	// written through instead of back.
+	CacheNever CacheTagAction = "never"
+	// CacheAlways caches objects on their first read, regardless of the
+	// hot-key admission threshold.
+	CacheAlways CacheTagAction = "always"
+)
+
+// CacheTagRule applies Action to objects tagged Key=Value, or tagged Key
+// with any value when Value is empty.
+type CacheTagRule struct {
+	Key    string         `json:"key"`
+	Value  string         `json:"value,omitempty"`
+	Action CacheTagAction `json:"action"`
+}
+
+// ValidateCacheTagRules reports the first invalid rule.
+func ValidateCacheTagRules(rules []CacheTagRule) error {
+	for _, rule := range rules {
+		if rule.Key == "" {
+			return fmt.Errorf("tag rule without key")
+		}
+		if rule.Action != CacheNever && rule.Action != CacheAlways {
+			return fmt.Errorf("tag %s: unknown action %q", rule.Key, rule.Action)
+		}
+	}
+	return nil
+}
+
+// CacheTagPolicy holds the cache tag rules, letting object owners control
+// caching by tagging objects.
+type CacheTagPolicy struct {
+	mu    sync.RWMutex
+	rules []CacheTagRule
+}
+
+func NewCacheTagPolicy(rules []CacheTagRule) *CacheTagPolicy {
+	return &CacheTagPolicy{rules: rules}
+}
+
+// SetRules replaces the tag rules.
+func (p *CacheTagPolicy) SetRules(rules []CacheTagRule) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rules = rules
+}
+
+// enabled reports whether there are rules, so that tags are worth looking
+// up.
+func (p *CacheTagPolicy) enabled() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.rules) > 0
+}
+
+// action returns the action of the first rule matching tags, or "" if none
+// does.
+func (p *CacheTagPolicy) action(tags map[string]string) CacheTagAction {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, rule := range p.rules {
+		if value, ok := tags[rule.Key]; ok && (rule.Value == "" || rule.Value == value) {
+			return rule.Action
+		}
+	}
+	return ""
+}
@@ -0,0 +1,30 @@
+package cloud_storage
+
+import "time"
+
+// CacheTuning holds the cache settings which can be changed while serving:
+// the HEAD TTL and MaxAge, as given to WithMetadataCache and WithStale, 0
+// disabling them, and SyncAll, writing every upload straight to upstream
+// as if over the sync write threshold instead of writing it back.
+type CacheTuning struct {
+	HeadTTL time.Duration
+	MaxAge  time.Duration
+	SyncAll bool
+}
+
+// Tuning returns the cache settings in effect.
+func (s *CachedCloudStorage) Tuning() CacheTuning {
+	s.tuningMu.RLock()
+	defer s.tuningMu.RUnlock()
+	return CacheTuning{HeadTTL: s.headTTL, MaxAge: s.staleConfig.MaxAge, SyncAll: s.syncAll}
+}
+
+// SetTuning changes the cache settings. Entries cached already keep their
+// TTLs, but are refetched once older than the new MaxAge.
+func (s *CachedCloudStorage) SetTuning(tuning CacheTuning) {
+	s.tuningMu.Lock()
+	defer s.tuningMu.Unlock()
+	s.headTTL = tuning.HeadTTL
+	s.staleConfig.MaxAge = tuning.MaxAge
+	s.syncAll = tuning.SyncAll
+}
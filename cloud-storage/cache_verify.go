@@ -0,0 +1,60 @@
+package cloud_storage
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"hash/crc32"
+	"strings"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+// castagnoli is the CRC-32C table, which has hardware support.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// WithContentVerification has the cache store a CRC-32C checksum with
+// every cached body and verify it on every hit, so that a body corrupted
+// in the cache is never served: it is evicted and read from upstream
+// again, and counted in corrupted. Spooled uploads are written back with
+// their MD5, so that upstream rejects those corrupted on disk.
+func WithContentVerification(corrupted metrics.Counter) CacheOption {
+	return func(s *CachedCloudStorage) {
+		s.cache.verify = true
+		s.corrupted = corrupted
+	}
+}
+
+// seal records the checksum of the body of e.
+func (e *cacheEntry) seal() {
+	e.sum = crc32.Checksum(e.body, castagnoli)
+	e.sealed = true
+}
+
+// intact reports whether the body of e still has the checksum it was
+// sealed with, if any.
+func (e *cacheEntry) intact() bool {
+	return !e.sealed || crc32.Checksum(e.body, castagnoli) == e.sum
+}
+
+// verified returns entry unless its body is corrupted, evicting it then.
+func (s *CachedCloudStorage) verified(cacheKey string, entry *cacheEntry) (*cacheEntry, bool) {
+	if !s.cache.verify || entry.intact() {
+		return entry, true
+	}
+	s.cache.Del(cacheKey)
+	if s.hotKeys != nil {
+		s.hotKeys.Unpin(cacheKey)
+	}
+	s.corrupted.Add(1)
+	s.logger.Log("msg", "evicted corrupted cache entry", "key", cacheKey, "etag", entry.info.ETag)
+	return nil, false
+}
+
+// spooledMD5 returns the Content-MD5 of a spooled upload, from its ETag.
+func spooledMD5(object *spooledObject) string {
+	sum, err := hex.DecodeString(strings.Trim(object.info.ETag, `"`))
+	if err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(sum)
+}
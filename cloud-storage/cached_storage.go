@@ -0,0 +1,656 @@
+package cloud_storage
+
+import (
+	"bytes"
+	"context"
+	md5sum "crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/dgraph-io/ristretto"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"github.com/rampage644/s3-overlay-proxy/repository"
+	"golang.org/x/time/rate"
+)
+
+type CachedCloudStorage struct {
+	baseStorage CloudStorage
+	logger      log.Logger
+	cache       *objectCache
+	requests    metrics.Counter
+	hotKeys     *HotKeyTracker
+	tagPolicy   *CacheTagPolicy
+	rulePolicy  *CacheRulePolicy
+	peers       *PeerRing
+	scrubber    *CacheScrubber
+	index       *cacheIndex
+	background  *BackgroundPool
+	peerClient  *http.Client
+
+	// ctx is the parent context of background work, such as write-back
+	// uploads and refetches.
+	ctx context.Context
+
+	// pending tracks write-back uploads which haven't completed yet.
+	pending      sync.WaitGroup
+	pendingCount atomic.Int64
+	pendingBytes atomic.Int64
+	// multipartBytes is the size of the parts of multipart uploads held in
+	// memory, which counts against the write-back limits too.
+	multipartBytes atomic.Int64
+
+	writeBackLimits WriteBackLimits
+	staleConfig     StaleConfig
+	syncWrites      SyncWriteConfig
+	headTTL         time.Duration
+	metadataCodec   MetadataCodec
+	clock           Clock
+
+	// tuningMu guards the settings of CacheTuning: headTTL, the MaxAge of
+	// staleConfig and syncAll.
+	tuningMu sync.RWMutex
+	syncAll  bool
+
+	// invalidations are the prefix invalidations applied on lookups, see
+	// invalidatePrefix.
+	invalidationsMu sync.RWMutex
+	invalidations   []prefixInvalidation
+
+	// dedupUploads skips the write-back of uploads the object upstream
+	// already matches, see WithUploadDeduplication.
+	dedupUploads bool
+
+	// corrupted counts the entries evicted by content verification, see
+	// WithContentVerification.
+	corrupted metrics.Counter
+
+	// freezes pins the objects of frozen buckets, see WithFreezes.
+	freezes *BucketFreezes
+
+	// uploads holds, per cache key, a channel closed once the latest
+	// write-back upload of the key completes. Uploads of a key run one after
+	// the other so that upstream ends up with the last write.
+	uploadsMu sync.Mutex
+	uploads   map[string]chan struct{}
+
+	// fetches holds, per cache key, a channel closed once the read of the
+	// whole object from upstream in progress completes, so that concurrent
+	// misses download it once.
+	fetchesMu      sync.Mutex
+	fetches        map[string]chan struct{}
+	refreshLimiter *rate.Limiter
+
+	// receipts holds the receipts of write-back uploads, by write ID.
+	receiptsMu sync.Mutex
+	receipts   map[string]*WriteReceipt
+
+	// multipart holds the multipart uploads in progress, by upload ID, and
+	// uploading their number per cache key, until they are completed and
+	// cached or aborted. They are persisted in multipartDir, if set.
+	multipartMu  sync.Mutex
+	multipart    map[string]*multipartSession
+	uploading    map[string]int
+	multipartDir string
+
+	// spooled holds, per cache key, the upload spooled to disk which is
+	// being written back.
+	spoolConfig SpoolConfig
+	spooledMu   sync.Mutex
+	spooled     map[string]*spooledObject
+}
+
+// cacheEntry is a cached object body along with its response metadata.
+type cacheEntry struct {
+	info ObjectInfo
+	body []byte
+
+	// fetched is when the object was read from upstream, zero if it was
+	// written through the proxy.
+	fetched time.Time
+
+	// principal is who the object was read or written as, see
+	// cachePrincipal.
+	principal string
+
+	// sum is the checksum of body, if sealed, see WithContentVerification.
+	sum    uint32
+	sealed bool
+}
+
+// cached returns when the entry was cached: when it was fetched, or written
+// through the proxy.
+func (e *cacheEntry) cached() time.Time {
+	if e.fetched.IsZero() {
+		return e.info.LastModified
+	}
+	return e.fetched
+}
+
+// CacheOption configures optional behavior of the cached storage.
+type CacheOption func(*CachedCloudStorage)
+
+// WithHotKeyTracker enables adaptive caching: object bodies are only cached
+// once requested often enough, and hot ones are pinned.
+func WithHotKeyTracker(t *HotKeyTracker) CacheOption {
+	return func(s *CachedCloudStorage) {
+		s.hotKeys = t
+	}
+}
+
+// WithContext makes background work, such as write-back uploads, run in
+// ctx, so that it is cancelled once ctx is done.
+func WithContext(ctx context.Context) CacheOption {
+	return func(s *CachedCloudStorage) {
+		s.ctx = ctx
+	}
+}
+
+// WithCacheTagPolicy lets object tags decide whether objects are cached.
+// Tags of objects read from upstream are looked up when the policy has
+// rules, and kept for tagCacheTTL.
+func WithCacheTagPolicy(p *CacheTagPolicy) CacheOption {
+	return func(s *CachedCloudStorage) {
+		s.tagPolicy = p
+	}
+}
+
+// tagCacheTTL is how long the tags of objects are cached. They may be
+// changed upstream without the object changing.
+const tagCacheTTL = time.Minute
+
+// tagAction returns the cache tag policy action for an object with tagCount
+// tags, looking its tags up if needed.
+func (s *CachedCloudStorage) tagAction(ctx context.Context, bucketName, objectKey string, tagCount int32) CacheTagAction {
+	if s.tagPolicy == nil || tagCount == 0 || !s.tagPolicy.enabled() {
+		return ""
+	}
+	tags, err := s.GetObjectTagging(ctx, bucketName, objectKey)
+	if err != nil {
+		s.logger.Log("method", "GetObjectTagging", "bucket", bucketName, "object", objectKey, "err", err)
+		return ""
+	}
+	return s.tagPolicy.action(tags)
+}
+
+// countLookup records a cache lookup for the given operation.
+func (s *CachedCloudStorage) countLookup(operation string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	s.requests.With("operation", operation, "result", result).Add(1)
+}
+
+func (s *CachedCloudStorage) ListBuckets(ctx context.Context) ([]Bucket, error) {
+	buckets, err := s.baseStorage.ListBuckets(ctx)
+	if err != nil {
+		if stale, ok := s.staleBucketList(ctx, err); ok {
+			return stale, nil
+		}
+		return nil, err
+	}
+	s.setBucketList(ctx, buckets)
+	return buckets, nil
+}
+
+func (s *CachedCloudStorage) CreateBucket(ctx context.Context, bucketName string) error {
+	s.cache.Del(bucketListKey(cachePrincipal(ctx)))
+	return s.baseStorage.CreateBucket(ctx, bucketName)
+}
+
+func (s *CachedCloudStorage) DeleteBucket(ctx context.Context, bucketName string) error {
+	s.cache.Del(bucketListKey(cachePrincipal(ctx)))
+	return s.baseStorage.DeleteBucket(ctx, bucketName)
+}
+
+func (s *CachedCloudStorage) ListObjects(ctx context.Context, bucketName string, options ListObjectsOptions) (ListObjectsPage, error) {
+	return s.baseStorage.ListObjects(ctx, bucketName, options)
+}
+
+func (s *CachedCloudStorage) PutObject(ctx context.Context, bucketName, objectKey string, content io.Reader, length int64, md5 string, sha256 string, tagging string, headers UploadHeaders) error {
+	cacheKey := fmt.Sprintf("%s/%s", bucketName, objectKey)
+	if s.rulePolicy != nil && s.rulePolicy.action(bucketName, objectKey, headers.contentType(), length) == CacheNever {
+		return s.writeThrough(ctx, cacheKey, bucketName, objectKey, content, length, md5, sha256, tagging, headers)
+	}
+	if s.tagPolicy != nil {
+		tags, err := ParseTagging(tagging)
+		if err != nil {
+			return err
+		}
+		if s.tagPolicy.action(tags) == CacheNever {
+			err := s.writeThrough(ctx, cacheKey, bucketName, objectKey, content, length, md5, sha256, tagging, headers)
+			if err == nil {
+				s.cache.SetWithTTL("tags/"+cacheKey, tags, 1, tagCacheTTL)
+			}
+			return err
+		}
+		s.cache.SetWithTTL("tags/"+cacheKey, tags, 1, tagCacheTTL)
+	}
+	content, length, written, err := s.syncWrite(ctx, cacheKey, bucketName, objectKey, content, length, tagging, headers)
+	if written || err != nil {
+		return err
+	}
+	size := length
+	if s.spools(length) {
+		size = 0
+	}
+	if s.writeBackSaturated(size) {
+		if s.writeBackLimits.Reject {
+			return errWriteBackSaturated()
+		}
+		return s.writeThrough(ctx, cacheKey, bucketName, objectKey, content, length, md5, sha256, tagging, headers)
+	}
+
+	var value []byte
+	if s.spools(length) {
+		var spooled *spooledObject
+		if value, spooled, err = s.readOrSpool(content); err != nil {
+			return err
+		}
+		if spooled != nil {
+			if s.duplicate(ctx, cacheKey, bucketName, objectKey, spooled.info.ETag, tagging, headers) {
+				os.Remove(spooled.path)
+				return nil
+			}
+			spooled.principal = cachePrincipal(ctx)
+			spooled.info.ContentType = headers.contentType()
+			SetResponseHeader(ctx, WriteIDHeader, s.putSpooled(cacheKey, bucketName, objectKey, spooled, md5, sha256, tagging, headers))
+			return nil
+		}
+	} else if value, err = readAllSized(content, length); err != nil {
+		return err
+	}
+	sum := md5sum.Sum(value)
+	if s.duplicate(ctx, cacheKey, bucketName, objectKey, `"`+hex.EncodeToString(sum[:])+`"`, tagging, headers) {
+		return nil
+	}
+	s.forgetSpooled(cacheKey)
+	reader := io.NopCloser(bytes.NewReader(value))
+
+	entry := &cacheEntry{
+		info: ObjectInfo{
+			ContentLength: int64(len(value)),
+			ContentType:   headers.contentType(),
+			ETag:          `"` + hex.EncodeToString(sum[:]) + `"`,
+			LastModified:  s.clock.Now(),
+		},
+		body:      value,
+		principal: cachePrincipal(ctx),
+	}
+	_ = s.cache.Set(cacheKey, entry, 1)
+	s.cache.Del("head/" + cacheKey)
+	s.scrubber.record(cacheKey)
+	s.index.record(CacheIndexUpdate{Key: cacheKey, ETag: entry.info.ETag, Size: entry.info.ContentLength})
+	// Sets are buffered; make the object readable before acknowledging the
+	// write, since it may not have reached upstream yet.
+	s.cache.Wait()
+	if s.hotKeys != nil {
+		s.hotKeys.Update(cacheKey, entry)
+	}
+
+	writeID := s.writeBack(cacheKey, "PutObject", bucketName, objectKey, int64(len(value)), func(ctx context.Context) error {
+		return s.baseStorage.PutObject(ctx, bucketName, objectKey, reader, length, md5, sha256, tagging, headers)
+	})
+	SetResponseHeader(ctx, WriteIDHeader, writeID)
+	return nil
+}
+
+// writeThrough writes an object straight to upstream, after any pending
+// upload of the key, dropping the cached copy.
+func (s *CachedCloudStorage) writeThrough(ctx context.Context, cacheKey, bucketName, objectKey string, content io.Reader, length int64, md5 string, sha256 string, tagging string, headers UploadHeaders) error {
+	if err := s.waitForUpload(ctx, cacheKey); err != nil {
+		return err
+	}
+	s.Purge(bucketName, objectKey)
+	s.forgetSpooled(cacheKey)
+	return s.baseStorage.PutObject(ctx, bucketName, objectKey, content, length, md5, sha256, tagging, headers)
+}
+
+// writeBack runs upload of size bytes in the background, after the pending
+// write-back uploads of cacheKey, tracking it as pending until it completes.
+// It returns the write ID of its receipt.
+func (s *CachedCloudStorage) writeBack(cacheKey, method, bucketName, objectKey string, size int64, upload func(ctx context.Context) error) string {
+	writeID := s.addReceipt(method, bucketName, objectKey)
+	done := make(chan struct{})
+	s.uploadsMu.Lock()
+	previous := s.uploads[cacheKey]
+	s.uploads[cacheKey] = done
+	s.uploadsMu.Unlock()
+
+	s.pending.Add(1)
+	s.pendingCount.Add(1)
+	s.pendingBytes.Add(size)
+	go func() {
+		defer s.pending.Done()
+		defer s.pendingCount.Add(-1)
+		defer s.pendingBytes.Add(-size)
+		if previous != nil {
+			<-previous
+		}
+		var err error
+		start := time.Now()
+		s.background.Run(func() { err = upload(s.ctx) })
+		s.logger.Log("method", method, "bucket", bucketName, "object", objectKey, "took", time.Since(start), "err", err)
+		s.completeReceipt(writeID, err)
+
+		close(done)
+		s.uploadsMu.Lock()
+		if s.uploads[cacheKey] == done {
+			delete(s.uploads, cacheKey)
+		}
+		s.uploadsMu.Unlock()
+	}()
+	return writeID
+}
+
+// waitForUpload waits for the pending write-back uploads of cacheKey, if any.
+func (s *CachedCloudStorage) waitForUpload(ctx context.Context, cacheKey string) error {
+	s.uploadsMu.Lock()
+	done := s.uploads[cacheKey]
+	s.uploadsMu.Unlock()
+	if done == nil {
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *CachedCloudStorage) HeadObject(ctx context.Context, bucketName, objectKey string) (*s3.HeadObjectOutput, error) {
+	cacheKey := fmt.Sprintf("head/%s/%s", bucketName, objectKey)
+	if metadata, found := s.cachedHead(cacheKey); found {
+		if err := s.authorizeHit(ctx, "HeadObject", bucketName, objectKey, metadata.Principal); err != nil {
+			return nil, err
+		}
+		s.countLookup("HeadObject", true)
+		return metadata.output(), nil
+	}
+	// A cached body has the metadata too, and may not be upstream yet.
+	objectCacheKey := fmt.Sprintf("%s/%s", bucketName, objectKey)
+	if entry, found := s.cachedObject(objectCacheKey); found && !s.expired(objectCacheKey, entry) {
+		if err := s.authorizeHit(ctx, "HeadObject", bucketName, objectKey, entry.principal); err != nil {
+			return nil, err
+		}
+		s.countLookup("HeadObject", true)
+		return headEntry(entry), nil
+	}
+	if spooled, ok := s.spooledUpload(fmt.Sprintf("%s/%s", bucketName, objectKey)); ok {
+		if err := s.authorizeHit(ctx, "HeadObject", bucketName, objectKey, spooled.principal); err != nil {
+			return nil, err
+		}
+		s.countLookup("HeadObject", true)
+		return headSpooled(spooled), nil
+	}
+	s.countLookup("HeadObject", false)
+
+	// The object is about to change, and its previous version could
+	// otherwise be cached after the new one.
+	uploading := s.multipartInProgress(fmt.Sprintf("%s/%s", bucketName, objectKey))
+	headObjectOutput, err := s.baseStorage.HeadObject(ctx, bucketName, objectKey)
+	if err != nil {
+		if entry, ok := s.staleOnError(ctx, "HeadObject", fmt.Sprintf("%s/%s", bucketName, objectKey), err); ok {
+			return headEntry(entry), nil
+		}
+		return nil, err
+	}
+
+	if !uploading {
+		s.setHead(cacheKey, cachePrincipal(ctx), headObjectOutput)
+	}
+
+	return headObjectOutput, nil
+}
+
+// InvalidRangeError is returned for ranges an object of Size bytes doesn't
+// satisfy, answered with 416 and a Content-Range of "bytes */Size".
+type InvalidRangeError struct {
+	Size int64
+}
+
+func (e *InvalidRangeError) Error() string {
+	return fmt.Sprintf("InvalidRange: %s", e.ErrorMessage())
+}
+
+func (e *InvalidRangeError) ErrorCode() string { return "InvalidRange" }
+
+func (e *InvalidRangeError) ErrorMessage() string { return "The requested range is not satisfiable" }
+
+func (e *InvalidRangeError) ErrorFault() smithy.ErrorFault { return smithy.FaultClient }
+
+// Is matches repository.ErrInvalidRange.
+func (e *InvalidRangeError) Is(target error) bool {
+	return errors.Is(repository.ErrInvalidRange, target)
+}
+
+// contentRangeBounds returns the first and last byte of contentRange in an
+// object of size bytes, see repository.RangeBounds: ok is false for ranges
+// ignored, the whole object being served, and unsatisfiable ones fail with
+// InvalidRangeError.
+func contentRangeBounds(contentRange string, size int) (int, int, bool, error) {
+	first, last, ok, err := repository.RangeBounds(contentRange, int64(size))
+	if err != nil {
+		return 0, 0, false, &InvalidRangeError{Size: int64(size)}
+	}
+	return int(first), int(last), ok, nil
+}
+
+// cachedObject looks the object up in the pinned hot keys, then in the
+// cache.
+func (s *CachedCloudStorage) cachedObject(cacheKey string) (*cacheEntry, bool) {
+	entry, found := s.lookupObject(cacheKey)
+	if found && s.invalidated(cacheKey, entry.cached()) {
+		s.cache.Del(cacheKey)
+		if s.hotKeys != nil {
+			s.hotKeys.Unpin(cacheKey)
+		}
+		return nil, false
+	}
+	if found {
+		return s.verified(cacheKey, entry)
+	}
+	return entry, found
+}
+
+func (s *CachedCloudStorage) lookupObject(cacheKey string) (*cacheEntry, bool) {
+	if s.hotKeys != nil {
+		if entry, ok := s.hotKeys.Pinned(cacheKey); ok {
+			return entry, true
+		}
+	}
+	if value, found := s.cache.Get(cacheKey); found {
+		if entry, ok := value.(*cacheEntry); ok {
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+func (s *CachedCloudStorage) GetObject(ctx context.Context, bucketName, objectKey, contentRange string) (io.ReadCloser, ObjectInfo, error) {
+	cacheKey := fmt.Sprintf("%s/%s", bucketName, objectKey)
+
+	var score float64
+	if s.hotKeys != nil {
+		score = s.hotKeys.Touch(cacheKey)
+	}
+
+	if entry, found := s.cachedObject(cacheKey); found && !s.expired(cacheKey, entry) {
+		if err := s.authorizeHit(ctx, "GetObject", bucketName, objectKey, entry.principal); err != nil {
+			return nil, ObjectInfo{}, err
+		}
+		if s.hotKeys != nil && s.hotKeys.IsHot(score) {
+			s.hotKeys.Pin(cacheKey, entry)
+		}
+		s.countLookup("GetObject", true)
+		return s.readEntry(entry, bucketName, objectKey, contentRange)
+	}
+	if spooled, ok := s.spooledUpload(cacheKey); ok {
+		if err := s.authorizeHit(ctx, "GetObject", bucketName, objectKey, spooled.principal); err != nil {
+			return nil, ObjectInfo{}, err
+		}
+		// The file is gone if the upload completed in the meantime.
+		if body, info, err := getSpooled(spooled, contentRange); !errors.Is(err, os.ErrNotExist) {
+			s.countLookup("GetObject", true)
+			return body, info, err
+		}
+	}
+	s.countLookup("GetObject", false)
+
+	if body, info, ok, err := s.getFromPeer(ctx, cacheKey, bucketName, objectKey, contentRange); ok {
+		return body, info, err
+	}
+
+	if contentRange == "" {
+		entry, found, err := s.awaitFetch(ctx, cacheKey)
+		if err != nil {
+			return nil, ObjectInfo{}, err
+		}
+		if found {
+			if err := s.authorizeHit(ctx, "GetObject", bucketName, objectKey, entry.principal); err != nil {
+				return nil, ObjectInfo{}, err
+			}
+			return s.readEntry(entry, bucketName, objectKey, "")
+		}
+		if done, leader := s.joinFetch(cacheKey); leader {
+			defer s.endFetch(cacheKey, done)
+		}
+	}
+
+	object, info, err := s.baseStorage.GetObject(ctx, bucketName, objectKey, contentRange)
+	if err != nil {
+		if entry, ok := s.staleOnError(ctx, "GetObject", cacheKey, err); ok {
+			return s.readEntry(entry, bucketName, objectKey, contentRange)
+		}
+		return nil, ObjectInfo{}, err
+	}
+	defer object.Close()
+
+	action := s.cacheAction(ctx, bucketName, objectKey, info)
+
+	// Avoid caching imcomplete objects
+	if contentRange != "" && action != CacheNever {
+		// Instead, schedule getting full one
+		s.refresh(bucketName, objectKey, cacheKey)
+
+		body, err := readPooled(object)
+		return body, info, err
+	}
+	if action == CacheNever {
+		body, err := readPooled(object)
+		return body, info, err
+	}
+
+	value, err := io.ReadAll(object)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	entry := &cacheEntry{info: info, body: value, fetched: s.clock.Now(), principal: cachePrincipal(ctx)}
+	if s.cache.verify {
+		// Sealed even if only pinned.
+		entry.seal()
+	}
+	if s.hotKeys == nil || s.hotKeys.ShouldAdmit(score) || action == CacheAlways {
+		_ = s.cache.Set(cacheKey, entry, 1)
+		s.scrubber.record(cacheKey)
+		s.index.record(CacheIndexUpdate{Key: cacheKey, ETag: info.ETag, Size: info.ContentLength})
+	}
+	if s.hotKeys != nil && s.hotKeys.IsHot(score) {
+		s.hotKeys.Pin(cacheKey, entry)
+	}
+
+	return io.NopCloser(bytes.NewReader(value)), info, nil
+}
+
+// readEntry reads a cached object, or the contentRange of it.
+func (s *CachedCloudStorage) readEntry(entry *cacheEntry, bucketName, objectKey, contentRange string) (io.ReadCloser, ObjectInfo, error) {
+	ret, info := entry.body, entry.info
+	// Handle Range Request explicitly here as base S3 handles this automatically
+	if contentRange != "" {
+		start, end, ok, err := contentRangeBounds(contentRange, len(ret))
+		if err != nil {
+			return nil, ObjectInfo{}, err
+		}
+		if !ok {
+			return io.NopCloser(bytes.NewReader(ret)), info, nil
+		}
+		s.logger.Log("method", "GetObject", "bucket", bucketName, "object", objectKey, "objectSize", len(ret), "contentRange", contentRange, "start", start, "end", end, "err", err)
+		info.ContentRange = fmt.Sprintf("bytes %d-%d/%d", start, end, len(ret))
+		ret = ret[start : end+1]
+		info.ContentLength = int64(len(ret))
+	}
+	return io.NopCloser(bytes.NewReader(ret)), info, nil
+}
+
+func (s *CachedCloudStorage) DeleteObject(ctx context.Context, bucketName, objectKey string) error {
+	// Otherwise a pending upload could recreate the object afterwards.
+	if err := s.waitForUpload(ctx, fmt.Sprintf("%s/%s", bucketName, objectKey)); err != nil {
+		return err
+	}
+	err := s.baseStorage.DeleteObject(ctx, bucketName, objectKey)
+	if err == nil {
+		s.Purge(bucketName, objectKey)
+	}
+	return err
+}
+
+// GetObjectTagging returns the object's tags, from the cache if they are
+// known.
+func (s *CachedCloudStorage) GetObjectTagging(ctx context.Context, bucketName, objectKey string) (map[string]string, error) {
+	cacheKey := fmt.Sprintf("tags/%s/%s", bucketName, objectKey)
+	if value, found := s.cache.Get(cacheKey); found {
+		if tags, ok := value.(map[string]string); ok {
+			return tags, nil
+		}
+	}
+	// The object may not be upstream yet.
+	if err := s.waitForUpload(ctx, fmt.Sprintf("%s/%s", bucketName, objectKey)); err != nil {
+		return nil, err
+	}
+	tags, err := s.baseStorage.GetObjectTagging(ctx, bucketName, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	s.cache.SetWithTTL(cacheKey, tags, 1, tagCacheTTL)
+	return tags, nil
+}
+
+// NewCachedCloudStorage wraps baseStorage with an in-memory cache. Cache
+// lookups are counted in requests, labelled by "operation" and "result"
+// (hit, miss, stale when an expired copy is served because upstream
+// failed, or denied when upstream doesn't let a principal read a copy
+// cached by another).
+func NewCachedCloudStorage(baseStorage CloudStorage, logger log.Logger, cache *ristretto.Cache, requests metrics.Counter, options ...CacheOption) *CachedCloudStorage {
+	s := &CachedCloudStorage{
+		baseStorage:   baseStorage,
+		logger:        logger,
+		ctx:           context.Background(),
+		cache:         &objectCache{Cache: cache},
+		requests:      requests,
+		uploads:       make(map[string]chan struct{}),
+		receipts:      make(map[string]*WriteReceipt),
+		fetches:       make(map[string]chan struct{}),
+		multipart:     make(map[string]*multipartSession),
+		uploading:     make(map[string]int),
+		metadataCodec: JSONMetadataCodec{},
+		clock:         SystemClock,
+		spooled:       make(map[string]*spooledObject),
+	}
+	for _, option := range options {
+		option(s)
+	}
+	// Background work waits for the upstream budget behind client requests.
+	s.ctx = repository.WithPriority(s.ctx, repository.PriorityBackground)
+	return s
+}
@@ -36,6 +36,9 @@ var errMalformedEncoding = errors.New("malformed chunked encoding")
 // chunk is considered too big if its bigger than > 16MiB.
 var errChunkTooBig = errors.New("chunk too big: choose chunk size <= 16MiB")
 
+// reader is used after its buffers have been returned to the pools.
+var errReaderClosed = errors.New("read from closed chunked reader")
+
 // newSignV4ChunkedReader returns a new s3ChunkedReader that translates the data read from r
 // out of HTTP "chunked" format before returning it.
 // The s3ChunkedReader returns io.EOF when the final 0-length chunk is read.
@@ -56,13 +59,13 @@ func newSignV4ChunkedReader(req *http.Request, trailer bool) (io.ReadCloser, err
 	}
 	return &s3ChunkedReader{
 		trailers: req.Trailer,
-		reader:   bufio.NewReader(req.Body),
+		reader:   getBufioReader(req.Body),
 		// cred:              cred,
 		// seedSignature:     seedSignature,
 		// seedDate:          seedDate,
 		// region:            region,
 		chunkSHA256Writer: sha256.New(),
-		buffer:            make([]byte, 64*1024),
+		buffer:            getChunkBuffer(),
 		debug:             false,
 	}, nil
 }
@@ -84,7 +87,16 @@ type s3ChunkedReader struct {
 	debug             bool // Print details on failure. Add your own if more are needed.
 }
 
+// Close returns the reader's buffers to their pools; the reader must not be
+// used afterwards.
 func (cr *s3ChunkedReader) Close() (err error) {
+	if cr.buffer == nil {
+		return nil
+	}
+	putChunkBuffer(cr.buffer)
+	putBufioReader(cr.reader)
+	cr.buffer, cr.reader = nil, nil
+	cr.err = errReaderClosed
 	return nil
 }
 
@@ -0,0 +1,88 @@
+package cloud_storage
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type contextKey int
+
+const (
+	clientIdentityContextKey contextKey = iota
+	requestInfoContextKey
+	responseHeaderContextKey
+	requestSignatureContextKey
+	xmlModeContextKey
+	asOfContextKey
+	verifiedAccessKeyContextKey
+)
+
+// ClientIdentity identifies the caller of a request. AccessKey is extracted
+// from the request signature (not verified) and is empty for anonymous
+// requests; SourceIP is the remote address of the connection.
+type ClientIdentity struct {
+	AccessKey string
+	SourceIP  string
+}
+
+// Key returns the value used to partition per-client state such as rate
+// limits: the access key when the request is signed, the source IP otherwise.
+func (c ClientIdentity) Key() string {
+	if c.AccessKey != "" {
+		return "key:" + c.AccessKey
+	}
+	return "ip:" + c.SourceIP
+}
+
+// ClientFromContext returns the ClientIdentity stored by populateClientIdentity.
+func ClientFromContext(ctx context.Context) ClientIdentity {
+	client, _ := ctx.Value(clientIdentityContextKey).(ClientIdentity)
+	return client
+}
+
+// populateClientIdentity is a ServerBefore function which stores the caller's
+// identity in the context for the endpoint middlewares.
+func populateClientIdentity(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, clientIdentityContextKey, ClientIdentity{
+		AccessKey: accessKeyFromRequest(r),
+		SourceIP:  sourceIP(r),
+	})
+}
+
+// accessKeyFromRequest extracts the access key id from either the
+// Authorization header (SigV4 and SigV2) or presigned URL query parameters.
+func accessKeyFromRequest(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	switch {
+	case strings.HasPrefix(auth, "AWS4-HMAC-SHA256 "):
+		// AWS4-HMAC-SHA256 Credential=AKID/20230101/us-east-1/s3/aws4_request, SignedHeaders=..., Signature=...
+		for _, part := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ",") {
+			part = strings.TrimSpace(part)
+			if credential, ok := strings.CutPrefix(part, "Credential="); ok {
+				accessKey, _, _ := strings.Cut(credential, "/")
+				return accessKey
+			}
+		}
+	case strings.HasPrefix(auth, "AWS "):
+		// AWS AKID:signature
+		accessKey, _, _ := strings.Cut(strings.TrimPrefix(auth, "AWS "), ":")
+		return accessKey
+	}
+
+	query := r.URL.Query()
+	if credential := query.Get("X-Amz-Credential"); credential != "" {
+		accessKey, _, _ := strings.Cut(credential, "/")
+		return accessKey
+	}
+	return query.Get("AWSAccessKeyId")
+}
+
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,26 @@
+package cloud_storage
+
+import "time"
+
+// Clock tells the time. The cache reads it, rather than time.Now, for the
+// ages of cached copies, the expiry of multipart uploads and write receipts,
+// and the Last-Modified of objects written through it, so that tests can
+// control them. The TTLs of cache entries are kept by ristretto with the
+// system clock.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// SystemClock is the Clock of the system, used unless WithClock is given.
+var SystemClock Clock = systemClock{}
+
+// WithClock has the cache read the time from clock.
+func WithClock(clock Clock) CacheOption {
+	return func(s *CachedCloudStorage) {
+		s.clock = clock
+	}
+}
@@ -0,0 +1,115 @@
+package cloud_storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/rampage644/s3-overlay-proxy/repository"
+)
+
+// fakeClock is a Clock which only moves forward when advanced.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// newTestCache returns a cache in front of a memory backend of bucket
+// "bucket", and the uncached storage of the backend.
+func newTestCache(t *testing.T, options ...CacheOption) (*CachedCloudStorage, CloudStorage) {
+	t.Helper()
+	cache, err := ristretto.NewCache(&ristretto.Config{NumCounters: 1e4, MaxCost: 1 << 20, BufferItems: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := NewCloudStorage(repository.NewMemoryStorage("bucket"), log.NewNopLogger())
+	return NewCachedCloudStorage(upstream, log.NewNopLogger(), cache, discard.NewCounter(), options...), upstream
+}
+
+func readObject(t *testing.T, s CloudStorage, key string) string {
+	t.Helper()
+	body, _, err := s.GetObject(context.Background(), "bucket", key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestClockMaxAge(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s, upstream := newTestCache(t, WithClock(clock), WithStale(StaleConfig{MaxAge: time.Minute}))
+
+	write := func(body string) {
+		t.Helper()
+		if err := upstream.PutObject(ctx, "bucket", "key", strings.NewReader(body), int64(len(body)), "", "", "", UploadHeaders{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("v1")
+	if got := readObject(t, s, "key"); got != "v1" {
+		t.Fatalf("got %q, want v1", got)
+	}
+
+	write("v2")
+	clock.Advance(30 * time.Second)
+	if got := readObject(t, s, "key"); got != "v1" {
+		t.Errorf("got %q before max age, want the cached v1", got)
+	}
+	clock.Advance(time.Minute)
+	if got := readObject(t, s, "key"); got != "v2" {
+		t.Errorf("got %q after max age, want v2", got)
+	}
+}
+
+func TestClockMultipartUploadTTL(t *testing.T) {
+	ctx := context.Background()
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s, _ := newTestCache(t, WithClock(clock))
+
+	expiring, err := s.CreateMultipartUpload(ctx, "bucket", "expiring", "", UploadHeaders{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(multipartUploadTTL - time.Hour)
+	live, err := s.CreateMultipartUpload(ctx, "bucket", "live", "", UploadHeaders{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Expired uploads are dropped when the next one starts.
+	clock.Advance(2 * time.Hour)
+	if _, err := s.CreateMultipartUpload(ctx, "bucket", "other", "", UploadHeaders{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UploadPart(ctx, "bucket", "expiring", expiring, 1, strings.NewReader("part"), 4, ""); !errors.Is(err, repository.ErrNoSuchUpload) {
+		t.Errorf("uploading a part of an expired upload: got %v, want NoSuchUpload", err)
+	}
+	if _, err := s.UploadPart(ctx, "bucket", "live", live, 1, strings.NewReader("part"), 4, ""); err != nil {
+		t.Errorf("uploading a part of a live upload: %v", err)
+	}
+}
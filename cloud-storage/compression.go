@@ -0,0 +1,160 @@
+package cloud_storage
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"mime"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content encodings the proxy can produce, in order of preference.
+var supportedEncodings = []string{"zstd", "gzip"}
+
+// CompressionPolicy decides which GET responses get compressed on the fly.
+type CompressionPolicy struct {
+	mu sync.RWMutex
+
+	// buckets lists the buckets compression is enabled for; "*" enables it
+	// for every bucket.
+	buckets []string
+}
+
+func NewCompressionPolicy(buckets []string) *CompressionPolicy {
+	return &CompressionPolicy{buckets: buckets}
+}
+
+// SetBuckets replaces the buckets compression is enabled for.
+func (p *CompressionPolicy) SetBuckets(buckets []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.buckets = buckets
+}
+
+func (p *CompressionPolicy) enabled(bucket string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, b := range p.buckets {
+		if b == "*" || b == bucket {
+			return true
+		}
+	}
+	return false
+}
+
+// isCompressibleContentType reports whether content of the given type is
+// worth compressing, i.e. is textual and not already compressed.
+func isCompressibleContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/x-ndjson", "application/xml",
+		"application/javascript", "application/x-javascript", "application/ecmascript",
+		"application/yaml", "application/x-yaml", "application/toml",
+		"application/csv", "application/x-sh", "application/wasm",
+		"image/svg+xml", "image/bmp", "application/x-tar":
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// negotiateEncoding picks the preferred supported encoding the client
+// accepts, or "" if there is none.
+func negotiateEncoding(acceptEncoding string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, _ = strconv.ParseFloat(v, 64)
+		}
+		accepted[strings.ToLower(strings.TrimSpace(coding))] = q > 0
+	}
+	for _, encoding := range supportedEncodings {
+		if accepted[encoding] {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// compressingReader compresses body on the fly, streaming through a pipe.
+func compressingReader(body io.ReadCloser, encoding string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer body.Close()
+
+		var (
+			w   io.WriteCloser
+			err error
+		)
+		switch encoding {
+		case "zstd":
+			w, err = zstd.NewWriter(pw)
+		default:
+			w = gzip.NewWriter(pw)
+		}
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		if _, err = copyBuffered(w, body); err != nil {
+			w.Close()
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(w.Close())
+	}()
+	return pr
+}
+
+// CompressionMiddleware returns an endpoint middleware which compresses GET
+// responses when the client accepts a supported encoding, the bucket has
+// compression enabled and the object's content type is compressible. Range
+// requests, and objects stored with a Content-Encoding already, are passed
+// through untouched. Compressed responses get a weak ETag, as their bytes
+// differ from the object's.
+func CompressionMiddleware(policy *CompressionPolicy) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			response, err := next(ctx, request)
+
+			req, ok := request.(GetObjectRequest)
+			if !ok || req.Range != "" || !policy.enabled(req.Bucket) {
+				return response, err
+			}
+			resp, ok := response.(GetObjectResponse)
+			if !ok || resp.Info.ContentEncoding != "" {
+				return response, err
+			}
+
+			contentType := resp.Info.ContentType
+			if contentType == "" {
+				contentType = mime.TypeByExtension(path.Ext(req.Key))
+			}
+			encoding := negotiateEncoding(req.AcceptEncoding)
+			if encoding == "" || !isCompressibleContentType(contentType) {
+				return response, err
+			}
+
+			resp.Body = compressingReader(resp.Body, encoding)
+			resp.ContentEncoding = encoding
+			if resp.Info.ETag != "" && !strings.HasPrefix(resp.Info.ETag, "W/") {
+				resp.Info.ETag = "W/" + resp.Info.ETag
+			}
+			return resp, err
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package cloud_storage
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// ConcurrencyLimiter is a semaphore bounding the number of operations in
+// flight. Callers over the limit wait up to queueTimeout for a free slot.
+type ConcurrencyLimiter struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+}
+
+// NewConcurrencyLimiter returns a limiter allowing up to n concurrent
+// operations, queueing excess ones for at most queueTimeout.
+func NewConcurrencyLimiter(n int, queueTimeout time.Duration) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		slots:        make(chan struct{}, n),
+		queueTimeout: queueTimeout,
+	}
+}
+
+// Acquire takes a slot, returning false if none became available in time.
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Release frees a slot taken by Acquire.
+func (l *ConcurrencyLimiter) Release() {
+	<-l.slots
+}
+
+// releasingReadCloser releases a slot once the response body is closed, as
+// GetObject bodies are streamed after the endpoint has returned.
+type releasingReadCloser struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+// WriteTo keeps the zero-copy path of file bodies, see fileBody.
+func (r *releasingReadCloser) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, r.ReadCloser)
+}
+
+func (r *releasingReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
+
+// ConcurrencyMiddleware returns an endpoint middleware bounding concurrent
+// object reads (GET, HEAD) and writes (PUT, DELETE, multipart parts and
+// completions) separately. Requests which can't get a slot in time are
+// rejected with SlowDown. Either limiter may be nil.
+func ConcurrencyMiddleware(reads, writes *ConcurrencyLimiter) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			var limiter *ConcurrencyLimiter
+			switch request.(type) {
+			case GetObjectRequest, HeadObjectRequest:
+				limiter = reads
+			case PutObjectRequest, DeleteObjectRequest, UploadPartRequest, CompleteMultipartUploadRequest:
+				limiter = writes
+			}
+			if limiter == nil {
+				return next(ctx, request)
+			}
+
+			if !limiter.Acquire(ctx) {
+				return APIErrorResponse{
+					Code:    "SlowDown",
+					Message: "Please reduce your request rate.",
+				}, nil
+			}
+
+			response, err := next(ctx, request)
+			if resp, ok := response.(GetObjectResponse); ok {
+				resp.Body = &releasingReadCloser{ReadCloser: resp.Body, release: limiter.Release}
+				return resp, err
+			}
+			limiter.Release()
+			return response, err
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package cloud_storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/go-kit/kit/endpoint"
+)
+
+// CopyObjectRequest copies the object Key of Bucket to DestinationKey of
+// DestinationBucket. The metadata and tags of the source are kept unless
+// their directives are "REPLACE", in which case Headers and Tagging are
+// stored instead.
+type CopyObjectRequest struct {
+	Bucket            string
+	Key               string
+	DestinationBucket string
+	DestinationKey    string
+
+	MetadataDirective string
+	TaggingDirective  string
+	Headers           UploadHeaders
+	Tagging           string
+}
+
+type CopyObjectResponse struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CopyObjectResult" json:"-"`
+
+	ETag         string
+	LastModified string // time string of format "2006-01-02T15:04:05.000Z"
+}
+
+// copyPreconditions are the headers of conditional copies, which aren't
+// supported.
+var copyPreconditions = []string{
+	"x-amz-copy-source-if-match",
+	"x-amz-copy-source-if-none-match",
+	"x-amz-copy-source-if-modified-since",
+	"x-amz-copy-source-if-unmodified-since",
+	"x-amz-copy-source-range",
+}
+
+func decodeCopyObjectRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	bucket, key, err := objectPath(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range copyPreconditions {
+		if r.Header.Get(header) != "" {
+			return nil, &smithy.GenericAPIError{Code: "NotImplemented", Message: "The " + header + " header is not implemented."}
+		}
+	}
+	sourceBucket, sourceKey, err := parseCopySource(r.Header.Get("x-amz-copy-source"))
+	if err != nil {
+		return nil, err
+	}
+	req := CopyObjectRequest{
+		Bucket:            sourceBucket,
+		Key:               sourceKey,
+		DestinationBucket: bucket,
+		DestinationKey:    key,
+		MetadataDirective: r.Header.Get("x-amz-metadata-directive"),
+		TaggingDirective:  r.Header.Get("x-amz-tagging-directive"),
+	}
+	for _, directive := range []*string{&req.MetadataDirective, &req.TaggingDirective} {
+		switch *directive {
+		case "":
+			*directive = "COPY"
+		case "COPY", "REPLACE":
+		default:
+			return nil, &smithy.GenericAPIError{Code: "InvalidArgument", Message: "Unknown directive " + *directive}
+		}
+	}
+	if req.MetadataDirective == "REPLACE" {
+		req.Headers = decodeUploadHeaders(r)
+	}
+	if req.TaggingDirective == "REPLACE" {
+		req.Tagging = r.Header.Get("x-amz-tagging")
+		if _, err := ParseTagging(req.Tagging); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// parseCopySource returns the bucket and key of source, "bucket/key" or
+// "/bucket/key", URL-encoded, optionally followed by "?versionId=...".
+func parseCopySource(source string) (bucket, key string, err error) {
+	source, query, _ := strings.Cut(source, "?")
+	if query != "" {
+		return "", "", &smithy.GenericAPIError{Code: "NotImplemented", Message: "Copying object versions is not implemented."}
+	}
+	source, err = url.PathUnescape(strings.TrimPrefix(source, "/"))
+	bucket, key, ok := strings.Cut(source, "/")
+	if err != nil || !ok || bucket == "" || key == "" {
+		return "", "", &smithy.GenericAPIError{Code: "InvalidArgument", Message: "Copy Source must mention the source bucket and key: sourcebucket/sourcekey"}
+	}
+	return bucket, key, nil
+}
+
+// makeCopyObjectEndpoint copies objects through the proxy rather than
+// asking upstream to: the source is read with get, from the cache if held
+// there, and written with put, so that copies work across backends and
+// buckets mapped to different upstreams. The endpoints passed are those of
+// the HTTP handler, so that the middlewares authorize and rewrite both the
+// read and the write as for any other GET and PUT.
+func makeCopyObjectEndpoint(head, get, put endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CopyObjectRequest)
+		if req.Bucket == req.DestinationBucket && req.Key == req.DestinationKey && req.MetadataDirective == "COPY" {
+			return APIErrorResponse{
+				Code:    "InvalidRequest",
+				Message: "This copy request is illegal because it is trying to copy an object to itself without changing the object's metadata, storage class, website redirect location or encryption attributes.",
+			}, nil
+		}
+
+		headers := req.Headers
+		if req.MetadataDirective == "COPY" {
+			response, err := head(ctx, HeadObjectRequest{Bucket: req.Bucket, Key: req.Key})
+			if err != nil {
+				return nil, err
+			}
+			metadata, ok := response.(HeadObjectResponse)
+			if !ok {
+				return response, nil
+			}
+			headers = sourceHeaders(metadata)
+		}
+
+		response, err := get(ctx, GetObjectRequest{Bucket: req.Bucket, Key: req.Key})
+		if err != nil {
+			return nil, err
+		}
+		source, ok := response.(GetObjectResponse)
+		if !ok {
+			return response, nil
+		}
+		if req.TaggingDirective == "COPY" && source.Info.TagCount > 0 {
+			source.Body.Close()
+			return APIErrorResponse{
+				Code:    "NotImplemented",
+				Message: "Copying the tags of objects is not implemented; use the REPLACE tagging directive.",
+			}, nil
+		}
+
+		hash := md5.New()
+		response, err = put(ctx, PutObjectRequest{
+			BucketName:    req.DestinationBucket,
+			ObjectKey:     req.DestinationKey,
+			ObjectBody:    hashingReadCloser{source.Body, hash},
+			ContentLength: source.Info.ContentLength,
+			Tagging:       req.Tagging,
+			Headers:       headers,
+		})
+		if _, ok := response.(PutObjectResponse); err != nil || !ok {
+			return response, err
+		}
+		return CopyObjectResponse{
+			ETag:         `"` + hex.EncodeToString(hash.Sum(nil)) + `"`,
+			LastModified: time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+		}, nil
+	}
+}
+
+// sourceHeaders returns the upload headers storing the Content-Type and
+// user metadata of a HEAD response.
+func sourceHeaders(response HeadObjectResponse) UploadHeaders {
+	headers := UploadHeaders{ContentType: response.Metadata["Content-Type"]}
+	for name, value := range response.Metadata {
+		if key, ok := strings.CutPrefix(strings.ToLower(name), "x-amz-meta-"); ok {
+			if headers.Metadata == nil {
+				headers.Metadata = map[string]string{}
+			}
+			headers.Metadata[key] = value
+		}
+	}
+	return headers
+}
+
+// hashingReadCloser hashes what is read from its ReadCloser.
+type hashingReadCloser struct {
+	io.ReadCloser
+	hash hash.Hash
+}
+
+func (r hashingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	return n, err
+}
@@ -0,0 +1,149 @@
+package cloud_storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+)
+
+// DryRunHeader is set on the responses of writes acknowledged without being
+// sent upstream.
+const DryRunHeader = "x-proxy-dry-run"
+
+// dryRunUploadPrefix starts the IDs of multipart uploads started in dry-run
+// mode, so that their parts and completion are acknowledged as well.
+const dryRunUploadPrefix = "dryrun-"
+
+// DryRun makes uploads and deletes in Buckets, or in every bucket if All,
+// validated, logged and acknowledged without being sent upstream, so that
+// pipelines can be rehearsed against production buckets. With Cache, the
+// bodies of uploads are cached so that they can be read back until
+// evicted; deletes evict cached copies but objects upstream stay readable.
+type DryRun struct {
+	All     bool     `json:"all,omitempty"`
+	Buckets []string `json:"buckets,omitempty"`
+	Cache   bool     `json:"cache,omitempty"`
+}
+
+// DryRunPolicy holds the dry-run configuration.
+type DryRunPolicy struct {
+	mu     sync.RWMutex
+	config DryRun
+}
+
+func NewDryRunPolicy(config DryRun) *DryRunPolicy {
+	return &DryRunPolicy{config: config}
+}
+
+// SetConfig replaces the dry-run configuration.
+func (p *DryRunPolicy) SetConfig(config DryRun) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.config = config
+}
+
+// dryRun reports whether writes to bucket are dry runs, and whether their
+// bodies are cached.
+func (p *DryRunPolicy) dryRun(bucket string) (dryRun, cache bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.config.All || slices.Contains(p.config.Buckets, bucket), p.config.Cache
+}
+
+// DryRunMiddleware returns an endpoint middleware acknowledging the uploads
+// and deletes policy makes dry runs without calling next. Upload bodies are
+// read in full, so that their length and digests are verified, and cached
+// in cache, if not nil and the policy says so, as by CachedCloudStorage
+// without partitions. Multipart uploads started in dry-run mode stay so
+// whatever the policy becomes.
+func DryRunMiddleware(policy *DryRunPolicy, cache *ristretto.Cache, logger log.Logger) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			bucket, key, operation, ok := requestOperation(request)
+			if !ok {
+				return next(ctx, request)
+			}
+			dryRun, cached := policy.dryRun(bucket)
+			switch req := request.(type) {
+			case UploadPartRequest:
+				dryRun = strings.HasPrefix(req.UploadID, dryRunUploadPrefix)
+			case CompleteMultipartUploadRequest:
+				dryRun = strings.HasPrefix(req.UploadID, dryRunUploadPrefix)
+			case AbortMultipartUploadRequest:
+				dryRun = strings.HasPrefix(req.UploadID, dryRunUploadPrefix)
+			case GetObjectRequest, HeadObjectRequest, ListObjectsRequest:
+				dryRun = false
+			}
+			if !dryRun {
+				return next(ctx, request)
+			}
+			logger.Log("msg", "dry run", "requestId", requestInfoFromContext(ctx).ID, "method", operation, "bucket", bucket, "object", key)
+			SetResponseHeader(ctx, DryRunHeader, "true")
+
+			switch req := request.(type) {
+			case PutObjectRequest:
+				defer req.ObjectBody.Close()
+				body, err := readAllSized(req.ObjectBody, req.ContentLength)
+				if err != nil {
+					return apiErrorResponse(err), nil
+				}
+				if cache != nil && cached {
+					sum := md5.Sum(body)
+					cacheKey := fmt.Sprintf("%s/%s", bucket, key)
+					cache.Del("head/" + cacheKey)
+					_ = cache.Set(cacheKey, &cacheEntry{
+						info: ObjectInfo{
+							ContentLength: int64(len(body)),
+							ContentType:   req.Headers.contentType(),
+							ETag:          `"` + hex.EncodeToString(sum[:]) + `"`,
+							LastModified:  time.Now(),
+						},
+						body:      body,
+						principal: cachePrincipal(ctx),
+					}, 1)
+					cache.Wait()
+				}
+				return PutObjectResponse{}, nil
+			case DeleteObjectRequest:
+				if cache != nil {
+					cacheKey := fmt.Sprintf("%s/%s", bucket, key)
+					cache.Del(cacheKey)
+					cache.Del("head/" + cacheKey)
+				}
+				return DeleteObjectResponse{}, nil
+			case CreateMultipartUploadRequest:
+				return CreateMultipartUploadResponse{Bucket: bucket, Key: key, UploadId: dryRunUploadPrefix + randomHex(16)}, nil
+			case UploadPartRequest:
+				defer req.Body.Close()
+				hash := md5.New()
+				if _, err := io.Copy(hash, req.Body); err != nil {
+					return apiErrorResponse(err), nil
+				}
+				return UploadPartResponse{ETag: `"` + hex.EncodeToString(hash.Sum(nil)) + `"`}, nil
+			case CompleteMultipartUploadRequest:
+				sums := make([][]byte, 0, len(req.Parts))
+				for _, part := range req.Parts {
+					sum, err := hex.DecodeString(trimETag(part.ETag))
+					if err != nil {
+						return APIErrorResponse{Code: "InvalidPart", Message: "One or more of the specified parts could not be found. The part may not have been uploaded, or the specified entity tag may not match the part's entity tag."}, nil
+					}
+					sums = append(sums, sum)
+				}
+				return CompleteMultipartUploadResponse{Location: "/" + bucket + "/" + key, Bucket: bucket, Key: key, ETag: MultipartETag(sums)}, nil
+			case AbortMultipartUploadRequest:
+				return AbortMultipartUploadResponse{}, nil
+			}
+			return next(ctx, request)
+		}
+	}
+}
@@ -0,0 +1,406 @@
+package cloud_storage
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/go-kit/kit/endpoint"
+)
+
+// GetObject request
+type GetObjectRequest struct {
+	Bucket         string
+	Key            string
+	Range          string
+	AcceptEncoding string
+
+	// Transform lists the transformations requested by the client, see
+	// TransformMiddleware.
+	Transform string
+
+	// IfNoneMatch is the If-None-Match header, see PublicCacheMiddleware.
+	IfNoneMatch string
+}
+
+// GetObject response
+type GetObjectResponse struct {
+	Body io.ReadCloser
+	Info ObjectInfo
+
+	// ContentEncoding is set when Body has been compressed by the proxy.
+	ContentEncoding string
+}
+
+type PutObjectRequest struct {
+	BucketName     string
+	ObjectKey      string
+	ObjectBody     io.ReadCloser
+	ContentLength  int64
+	ContentMD5     string
+	ChecksumSHA256 string
+
+	// Tagging is the x-amz-tagging header, tags encoded as URL query
+	// parameters.
+	Tagging string
+
+	Headers UploadHeaders
+}
+
+type PutObjectResponse struct {
+}
+type HeadObjectRequest struct {
+	Bucket      string
+	Key         string
+	IfNoneMatch string
+}
+
+type HeadObjectResponse struct {
+	Metadata map[string]string `json:"metadata"`
+}
+
+// ListObjects request
+type ListObjectsRequest struct {
+	Bucket            string
+	Prefix            string
+	Delimiter         string
+	EncodingType      string
+	StartAfter        string
+	ContinuationToken string
+	// MaxKeys is -1 unless the client asked for a page size.
+	MaxKeys    int
+	FetchOwner bool
+}
+
+type ListBucketsRequest struct {
+	Prefix            string
+	MaxBuckets        int
+	ContinuationToken string
+}
+type ListBucketsResponse struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult" json:"-"`
+
+	// Container for one or more buckets.
+	Buckets struct {
+		Buckets []Bucket `xml:"Bucket"`
+	} // Buckets are nested
+
+	// ContinuationToken is set when more buckets are left to list.
+	ContinuationToken string `xml:"ContinuationToken,omitempty"`
+	Prefix            string `xml:"Prefix,omitempty"`
+
+	// Error to indicate business logic error
+	Err string `json:"err,omitempty"`
+}
+type ListObjectsResponse struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult" json:"-"`
+
+	Name       string
+	Prefix     string
+	StartAfter string `xml:"StartAfter,omitempty"`
+
+	ContinuationToken     string `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string `xml:"NextContinuationToken,omitempty"`
+
+	KeyCount  int
+	MaxKeys   int
+	Delimiter string `xml:"Delimiter,omitempty"`
+
+	IsTruncated bool
+
+	Contents       []Object
+	CommonPrefixes []CommonPrefix
+
+	// Encoding type used to encode object keys in the response.
+	EncodingType string `xml:"EncodingType,omitempty"`
+}
+
+// encodeListingKey encodes a key the way S3 does for listings requested with
+// encoding-type=url: form-encoded, except for slashes.
+func encodeListingKey(key string) string {
+	return strings.ReplaceAll(url.QueryEscape(key), "%2F", "/")
+}
+
+// encodeListing encodes the keys and prefixes of a listing response for
+// encoding-type=url, which clients use to get keys that aren't valid XML.
+func encodeListing(req *ListObjectsRequest, page *ListObjectsPage) {
+	req.Prefix = encodeListingKey(req.Prefix)
+	req.Delimiter = encodeListingKey(req.Delimiter)
+	req.StartAfter = encodeListingKey(req.StartAfter)
+	for i := range page.Objects {
+		page.Objects[i].Key = encodeListingKey(page.Objects[i].Key)
+	}
+	for i := range page.CommonPrefixes {
+		page.CommonPrefixes[i].Prefix = encodeListingKey(page.CommonPrefixes[i].Prefix)
+	}
+}
+
+// defaultMaxKeys is the page size of listings when the client doesn't ask for
+// one, as in S3.
+const defaultMaxKeys = 1000
+
+type DeleteObjectRequest struct {
+	BucketName string
+	ObjectKey  string
+}
+
+type DeleteObjectResponse struct {
+}
+
+type APIErrorResponse struct {
+	XMLName    xml.Name `xml:"Error" json:"-"`
+	Code       string
+	Message    string
+	Key        string `xml:"Key,omitempty" json:"Key,omitempty"`
+	BucketName string `xml:"BucketName,omitempty" json:"BucketName,omitempty"`
+	Resource   string
+	Region     string `xml:"Region,omitempty" json:"Region,omitempty"`
+
+	// StorageClass and AccessTier are set on InvalidObjectState errors for
+	// archived objects.
+	StorageClass string `xml:"StorageClass,omitempty" json:"StorageClass,omitempty"`
+	AccessTier   string `xml:"AccessTier,omitempty" json:"AccessTier,omitempty"`
+
+	// RequestTime, ServerTime, MaxAllowedSkewMilliseconds and Expires are
+	// set on errors about the time requests were signed.
+	RequestTime                string `xml:"RequestTime,omitempty" json:"RequestTime,omitempty"`
+	ServerTime                 string `xml:"ServerTime,omitempty" json:"ServerTime,omitempty"`
+	MaxAllowedSkewMilliseconds int64  `xml:"MaxAllowedSkewMilliseconds,omitempty" json:"MaxAllowedSkewMilliseconds,omitempty"`
+	Expires                    string `xml:"Expires,omitempty" json:"Expires,omitempty"`
+
+	RequestID string `xml:"RequestId" json:"RequestId"`
+	HostID    string `xml:"HostId" json:"HostId"`
+}
+
+type Bucket struct {
+	Name         string
+	CreationDate string // time string of format "2006-01-02T15:04:05.000Z"
+}
+
+type Object struct {
+	Key          string
+	LastModified string // time string of format "2006-01-02T15:04:05.000Z"
+	ETag         string
+	Size         int64
+	Owner        *Owner `xml:"Owner,omitempty" json:"Owner,omitempty"`
+	StorageClass string `xml:"StorageClass,omitempty" json:"StorageClass,omitempty"`
+}
+
+type Owner struct {
+	ID          string
+	DisplayName string `xml:"DisplayName,omitempty" json:"DisplayName,omitempty"`
+}
+type CommonPrefix struct {
+	Prefix string
+}
+
+func MakeHeadObjectEndpoint(svc CloudStorage) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(HeadObjectRequest)
+		metadata, err := svc.HeadObject(ctx, req.Bucket, req.Key)
+		if err != nil {
+			code, message := "InternalError", err.Error()
+			var ae smithy.APIError
+			if errors.As(err, &ae) {
+				code, message = ae.ErrorCode(), ae.ErrorMessage()
+			}
+
+			return APIErrorResponse{
+				Code:    code,
+				Message: message,
+			}, nil
+		}
+		return HeadObjectResponse{headObjectHeaders(metadata)}, nil
+	}
+}
+
+// headObjectHeaders returns the response headers of a HEAD request.
+func headObjectHeaders(metadata *s3.HeadObjectOutput) map[string]string {
+	headers := map[string]string{
+		"Accept-Ranges":  "bytes",
+		"Content-Length": strconv.FormatInt(metadata.ContentLength, 10),
+	}
+	if metadata.ContentType != nil {
+		headers["Content-Type"] = *metadata.ContentType
+	}
+	if metadata.ETag != nil {
+		headers["ETag"] = *metadata.ETag
+	}
+	if metadata.LastModified != nil {
+		headers["Last-Modified"] = metadata.LastModified.UTC().Format(http.TimeFormat)
+	}
+	if metadata.StorageClass != "" {
+		headers["x-amz-storage-class"] = string(metadata.StorageClass)
+	}
+	if metadata.ArchiveStatus != "" {
+		headers["x-amz-archive-status"] = string(metadata.ArchiveStatus)
+	}
+	if metadata.Restore != nil {
+		headers["x-amz-restore"] = *metadata.Restore
+	}
+	for key, value := range metadata.Metadata {
+		headers["x-amz-meta-"+key] = value
+	}
+	return headers
+}
+
+// GetObject endpoint
+func MakeGetObjectEndpoint(svc CloudStorage) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetObjectRequest)
+		body, info, err := svc.GetObject(ctx, req.Bucket, req.Key, req.Range)
+		if err != nil {
+			var archived *types.InvalidObjectState
+			if errors.As(err, &archived) {
+				return APIErrorResponse{
+					Code:         "InvalidObjectState",
+					Message:      "The operation is not valid for the object's storage class",
+					StorageClass: string(archived.StorageClass),
+					AccessTier:   string(archived.AccessTier),
+				}, nil
+			}
+			var invalidRange *InvalidRangeError
+			if errors.As(err, &invalidRange) {
+				SetResponseHeader(ctx, "Content-Range", fmt.Sprintf("bytes */%d", invalidRange.Size))
+			}
+			code, message := "InternalError", err.Error()
+			var ae smithy.APIError
+			if errors.As(err, &ae) {
+				code, message = ae.ErrorCode(), ae.ErrorMessage()
+			}
+			return APIErrorResponse{
+				Code:    code,
+				Message: message,
+			}, nil
+		}
+		return GetObjectResponse{Body: body, Info: info}, nil
+	}
+}
+
+// ListObjects endpoint
+func MakeListObjectsEndpoint(svc CloudStorage) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(ListObjectsRequest)
+		page, err := svc.ListObjects(ctx, req.Bucket, ListObjectsOptions{
+			Prefix:            req.Prefix,
+			Delimiter:         req.Delimiter,
+			StartAfter:        req.StartAfter,
+			ContinuationToken: req.ContinuationToken,
+			MaxKeys:           req.MaxKeys,
+			FetchOwner:        req.FetchOwner,
+		})
+		if err != nil {
+			code, message := "InternalError", err.Error()
+			var ae smithy.APIError
+			if errors.As(err, &ae) {
+				code, message = ae.ErrorCode(), ae.ErrorMessage()
+			}
+			return APIErrorResponse{
+				Code:    code,
+				Message: message,
+			}, nil
+		}
+
+		if req.EncodingType == "url" {
+			encodeListing(&req, &page)
+		}
+
+		maxKeys := req.MaxKeys
+		if maxKeys < 0 {
+			maxKeys = defaultMaxKeys
+		}
+		response := ListObjectsResponse{
+			Name:                  req.Bucket,
+			Prefix:                req.Prefix,
+			StartAfter:            req.StartAfter,
+			EncodingType:          req.EncodingType,
+			ContinuationToken:     req.ContinuationToken,
+			NextContinuationToken: page.NextContinuationToken,
+			KeyCount:              len(page.Objects) + len(page.CommonPrefixes),
+			MaxKeys:               maxKeys,
+			Delimiter:             req.Delimiter,
+			IsTruncated:           page.IsTruncated,
+			Contents:              page.Objects,
+			CommonPrefixes:        page.CommonPrefixes,
+		}
+
+		return response, nil
+	}
+}
+
+func MakeListBucketsEndpoint(svc CloudStorage) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		objects, err := svc.ListBuckets(ctx)
+		if err != nil {
+			code, message := "InternalError", err.Error()
+			var ae smithy.APIError
+			if errors.As(err, &ae) {
+				code, message = ae.ErrorCode(), ae.ErrorMessage()
+			}
+			return APIErrorResponse{
+				Code:    code,
+				Message: message,
+			}, nil
+		}
+
+		buckets := make([]Bucket, len(objects))
+		for i, obj := range objects {
+			buckets[i] = Bucket{
+				Name:         obj.Name,
+				CreationDate: obj.CreationDate,
+			}
+		}
+
+		response := ListBucketsResponse{}
+		response.Buckets.Buckets = buckets
+		return response, nil
+	}
+}
+
+func MakePutObjectEndpoint(svc CloudStorage) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(PutObjectRequest)
+		err := svc.PutObject(ctx, req.BucketName, req.ObjectKey, req.ObjectBody, req.ContentLength, req.ContentMD5, req.ChecksumSHA256, req.Tagging, req.Headers)
+		defer req.ObjectBody.Close()
+		if err != nil {
+			code, message := "InternalError", err.Error()
+			var ae smithy.APIError
+			if errors.As(err, &ae) {
+				code, message = ae.ErrorCode(), ae.ErrorMessage()
+			}
+			return APIErrorResponse{
+				Code:    code,
+				Message: message,
+			}, nil
+		}
+		return PutObjectResponse{}, nil
+	}
+}
+
+func MakeDeleteObjectEndpoint(svc CloudStorage) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(DeleteObjectRequest)
+		err := svc.DeleteObject(ctx, req.BucketName, req.ObjectKey)
+		if err != nil {
+			code, message := "InternalError", err.Error()
+			var ae smithy.APIError
+			if errors.As(err, &ae) {
+				code, message = ae.ErrorCode(), ae.ErrorMessage()
+			}
+			return APIErrorResponse{
+				Code:    code,
+				Message: message,
+			}, nil
+		}
+		return DeleteObjectResponse{}, nil
+	}
+}
@@ -0,0 +1,107 @@
+package cloud_storage
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/rampage644/s3-overlay-proxy/repository"
+)
+
+func TestEncodeListingKey(t *testing.T) {
+	for _, tt := range keyTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := encodeListingKey(tt.key); got != tt.listing {
+				t.Errorf("encodeListingKey(%q) = %q, want %q", tt.key, got, tt.listing)
+			}
+			if decoded, err := url.QueryUnescape(tt.listing); err != nil || decoded != tt.key {
+				t.Errorf("%q decodes to %q, %v, want %q", tt.listing, decoded, err, tt.key)
+			}
+		})
+	}
+}
+
+func TestListingEncodingType(t *testing.T) {
+	p, err := NewProxy(ProxyOptions{Backend: repository.NewMemoryStorage("bucket")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{}
+	for _, tt := range keyTests {
+		put := httptest.NewRecorder()
+		p.ServeHTTP(put, httptest.NewRequest("PUT", tt.path, strings.NewReader("body")))
+		if put.Code != http.StatusOK {
+			t.Fatalf("PUT %s: got status %d: %s", tt.path, put.Code, put.Body)
+		}
+		want[tt.listing] = true
+	}
+
+	var listing struct {
+		EncodingType string
+		Contents     []struct{ Key string }
+	}
+	list := httptest.NewRecorder()
+	p.ServeHTTP(list, httptest.NewRequest("GET", "/bucket?list-type=2&encoding-type=url", nil))
+	if err := xml.Unmarshal(list.Body.Bytes(), &listing); err != nil {
+		t.Fatal(err)
+	}
+	if listing.EncodingType != "url" {
+		t.Errorf("got EncodingType %q, want url", listing.EncodingType)
+	}
+	got := map[string]bool{}
+	for _, object := range listing.Contents {
+		got[object.Key] = true
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got keys %v, want %v", got, want)
+	}
+	for key := range want {
+		if !got[key] {
+			t.Errorf("missing key %q in %v", key, got)
+		}
+	}
+}
+
+func TestListingMaxKeys(t *testing.T) {
+	p, err := NewProxy(ProxyOptions{Backend: repository.NewMemoryStorage("bucket")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		put := httptest.NewRecorder()
+		p.ServeHTTP(put, httptest.NewRequest("PUT", "/bucket/"+key, strings.NewReader("body")))
+		if put.Code != http.StatusOK {
+			t.Fatalf("PUT %s: got status %d: %s", key, put.Code, put.Body)
+		}
+	}
+
+	tests := []struct {
+		query    string
+		maxKeys  int
+		keys     int
+		truncate bool
+	}{
+		{"", 1000, 3, false},
+		{"&max-keys=0", 0, 0, false},
+		{"&max-keys=2", 2, 2, true},
+	}
+	for _, tt := range tests {
+		var listing struct {
+			KeyCount    int
+			MaxKeys     int
+			IsTruncated bool
+			Contents    []struct{ Key string }
+		}
+		list := httptest.NewRecorder()
+		p.ServeHTTP(list, httptest.NewRequest("GET", "/bucket?list-type=2"+tt.query, nil))
+		if err := xml.Unmarshal(list.Body.Bytes(), &listing); err != nil {
+			t.Fatal(err)
+		}
+		if listing.MaxKeys != tt.maxKeys || listing.KeyCount != tt.keys || len(listing.Contents) != tt.keys || listing.IsTruncated != tt.truncate {
+			t.Errorf("list-type=2%s: got %+v, want MaxKeys %d, %d keys, IsTruncated %v", tt.query, listing, tt.maxKeys, tt.keys, tt.truncate)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package cloud_storage
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+)
+
+// expressSessionDuration is how long the sessions handed to clients last,
+// as on S3 Express One Zone.
+const expressSessionDuration = 5 * time.Minute
+
+// CreateSessionRequest is the CreateSession call SDKs make before accessing
+// an S3 Express One Zone directory bucket.
+type CreateSessionRequest struct {
+	Bucket    string
+	AccessKey string
+}
+
+type CreateSessionResponse struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CreateSessionResult" json:"-"`
+
+	Credentials SessionCredentials
+}
+
+type SessionCredentials struct {
+	SessionToken    string
+	SecretAccessKey string
+	AccessKeyId     string
+	Expiration      time.Time
+}
+
+func (r CreateSessionRequest) KeyVals() []interface{} {
+	return []interface{}{
+		"bucket", r.Bucket,
+	}
+}
+
+// MakeCreateSessionEndpoint returns an endpoint handing out sessions, so
+// that clients of directory buckets can go through the proxy. The proxy
+// doesn't check request signatures, so the session credentials only need to
+// be well-formed; the session keeps the client's access key ID, so that
+// requests made with it are attributed to the client as before. Upstream
+// sessions are created separately, see repository.ExpressSigner.
+func MakeCreateSessionEndpoint() endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CreateSessionRequest)
+		accessKey := req.AccessKey
+		if accessKey == "" {
+			accessKey = "ASIA" + randomHex(8)
+		}
+		return CreateSessionResponse{Credentials: SessionCredentials{
+			SessionToken:    randomHex(32),
+			SecretAccessKey: randomHex(20),
+			AccessKeyId:     accessKey,
+			Expiration:      time.Now().Add(expressSessionDuration).UTC(),
+		}}, nil
+	}
+}
+
+func decodeCreateSessionRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return CreateSessionRequest{
+		Bucket:    mux.Vars(r)["bucket"],
+		AccessKey: accessKeyFromRequest(r),
+	}, nil
+}
+
+// handleCreateSession mounts CreateSession, GET /bucket?session. Requests
+// made with the session carry its token in the x-amz-s3session-token header,
+// which is ignored like other credentials.
+func handleCreateSession(r *mux.Router, middleware func(method string) endpoint.Middleware, options []httptransport.ServerOption) {
+	r.Methods("GET").Path("/{bucket:[^/]+}{slash:/?}").MatcherFunc(hasQuery("session")).Handler(httptransport.NewServer(
+		middleware("CreateSession")(MakeCreateSessionEndpoint()),
+		decodeCreateSessionRequest,
+		encodeResponse,
+		options...,
+	))
+}
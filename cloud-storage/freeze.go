@@ -0,0 +1,323 @@
+package cloud_storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+// BucketFreeze records why, when and by whom a bucket was frozen.
+type BucketFreeze struct {
+	Reason string    `json:"reason"`
+	By     string    `json:"by,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// FreezeRequest is the body of the freeze and unfreeze admin endpoints.
+type FreezeRequest struct {
+	Reason string `json:"reason"`
+}
+
+// BucketFreezes holds the frozen buckets, legal-hold style: writes to them
+// through the proxy are rejected and their cached objects kept, during an
+// incident investigation for instance. Buckets are only frozen and unfrozen
+// through the admin API, see AdminRoutes, by the holders of admin tokens,
+// and every change is audit logged. With a path, freezes are persisted
+// there and survive restarts.
+type BucketFreezes struct {
+	path   string
+	tokens *AdminTokens
+	logger log.Logger
+
+	mu        sync.RWMutex
+	buckets   map[string]BucketFreeze
+	listeners []func(bucket string, frozen bool)
+}
+
+// onChange has fn called whenever bucket is frozen or unfrozen.
+func (f *BucketFreezes) onChange(fn func(bucket string, frozen bool)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.listeners = append(f.listeners, fn)
+}
+
+// NewBucketFreezes returns the freezes persisted at path, none if it
+// doesn't exist yet, changed by the holders of tokens. An empty path keeps
+// them in memory.
+func NewBucketFreezes(path string, tokens *AdminTokens, logger log.Logger) (*BucketFreezes, error) {
+	f := &BucketFreezes{path: path, tokens: tokens, logger: logger, buckets: map[string]BucketFreeze{}}
+	if path == "" {
+		return f, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &f.buckets); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Frozen reports whether bucket is frozen.
+func (f *BucketFreezes) Frozen(bucket string) bool {
+	if f == nil {
+		return false
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	_, frozen := f.buckets[bucket]
+	return frozen
+}
+
+// frozenKey reports whether the bucket of a cache key, "bucket/key", is
+// frozen.
+func (f *BucketFreezes) frozenKey(cacheKey string) bool {
+	bucket, _, _ := strings.Cut(cacheKey, "/")
+	return f.Frozen(bucket)
+}
+
+// Freezes returns the frozen buckets.
+func (f *BucketFreezes) Freezes() map[string]BucketFreeze {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	freezes := make(map[string]BucketFreeze, len(f.buckets))
+	for bucket, freeze := range f.buckets {
+		freezes[bucket] = freeze
+	}
+	return freezes
+}
+
+// set freezes bucket, or unfreezes it if freeze is nil, persisting the
+// change and telling the listeners. It reports whether anything changed.
+func (f *BucketFreezes) set(bucket string, freeze *BucketFreeze) (bool, error) {
+	changed, err := f.update(bucket, freeze)
+	if !changed {
+		return false, err
+	}
+	f.mu.RLock()
+	listeners := f.listeners
+	f.mu.RUnlock()
+	for _, fn := range listeners {
+		fn(bucket, freeze != nil)
+	}
+	return true, nil
+}
+
+func (f *BucketFreezes) update(bucket string, freeze *BucketFreeze) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, frozen := f.buckets[bucket]
+	if frozen == (freeze != nil) {
+		return false, nil
+	}
+	buckets := make(map[string]BucketFreeze, len(f.buckets)+1)
+	for b, fr := range f.buckets {
+		buckets[b] = fr
+	}
+	if freeze != nil {
+		buckets[bucket] = *freeze
+	} else {
+		delete(buckets, bucket)
+	}
+	if err := f.persist(buckets); err != nil {
+		return false, err
+	}
+	f.buckets = buckets
+	return true, nil
+}
+
+// persist writes buckets to the path, if any, replacing the file at once.
+func (f *BucketFreezes) persist(buckets map[string]BucketFreeze) error {
+	if f.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(buckets)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), ".freezes-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// FreezeMiddleware returns an endpoint middleware rejecting the uploads and
+// deletes of frozen buckets with AccessDenied, logging every attempt.
+// Aborting multipart uploads is allowed, as it doesn't change objects.
+func FreezeMiddleware(freezes *BucketFreezes) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			bucket, key, operation, ok := requestOperation(request)
+			if !ok || !freezes.Frozen(bucket) {
+				return next(ctx, request)
+			}
+			switch operation {
+			case "PutObject", "DeleteObject", "CreateMultipartUpload", "UploadPart", "CompleteMultipartUpload":
+				freezes.logger.Log("msg", "write to frozen bucket rejected", "audit", true, "operation", operation, "bucket", bucket, "object", key, "client", ClientFromContext(ctx).Key())
+				return APIErrorResponse{Code: "AccessDenied", Message: "The bucket is frozen, writes are rejected until it is unfrozen", BucketName: bucket, Key: key}, nil
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// AdminRoutes mounts the endpoints listing, freezing and unfreezing
+// buckets; freezing and unfreezing require an admin token, whose holder
+// is recorded:
+//
+//	GET  /freezes
+//	POST /buckets/{bucket}/freeze    {"reason": "incident 42"}
+//	POST /buckets/{bucket}/unfreeze  {"reason": "investigation closed"}
+func (f *BucketFreezes) AdminRoutes(r *mux.Router) {
+	r.Methods("GET").Path("/freezes").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(f.Freezes())
+	})
+
+	change := func(freeze bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			by, ok := f.tokens.authenticate(w, r)
+			if !ok {
+				f.logger.Log("msg", "unauthenticated freeze change rejected", "audit", true, "bucket", mux.Vars(r)["bucket"], "remote", r.RemoteAddr)
+				return
+			}
+			bucket := mux.Vars(r)["bucket"]
+			var req FreezeRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if req.Reason == "" {
+				http.Error(w, "reason is required", http.StatusBadRequest)
+				return
+			}
+			var state *BucketFreeze
+			msg := "bucket unfrozen"
+			if freeze {
+				state = &BucketFreeze{Reason: req.Reason, By: by, Since: time.Now().UTC()}
+				msg = "bucket frozen"
+			}
+			changed, err := f.set(bucket, state)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if changed {
+				f.logger.Log("msg", msg, "audit", true, "bucket", bucket, "reason", req.Reason, "by", by, "remote", r.RemoteAddr)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(f.Freezes())
+		}
+	}
+	r.Methods("POST").Path("/buckets/{bucket}/freeze").HandlerFunc(change(true))
+	r.Methods("POST").Path("/buckets/{bucket}/unfreeze").HandlerFunc(change(false))
+}
+
+// WithFreezes has the cache keep the objects of frozen buckets: they are
+// pinned, out of reach of evictions when the cache is full, they don't
+// expire, and purges and invalidations skip them. Objects cached when a
+// bucket is frozen are pinned then if the cache has an index, see
+// WithCacheIndex, otherwise once read; pins are released into the cache
+// when the bucket is unfrozen.
+func WithFreezes(freezes *BucketFreezes) CacheOption {
+	return func(s *CachedCloudStorage) {
+		s.freezes = freezes
+		s.cache.freezes = freezes
+		s.cache.pins = map[string]*cacheEntry{}
+		freezes.onChange(s.freezeChanged)
+	}
+}
+
+// freezeChanged pins the cached objects of bucket when it is frozen, and
+// releases them when it is unfrozen.
+func (s *CachedCloudStorage) freezeChanged(bucket string, frozen bool) {
+	if !frozen {
+		s.cache.unpinBucket(bucket)
+		return
+	}
+	if s.index == nil {
+		return
+	}
+	for _, key := range s.index.keys() {
+		if strings.HasPrefix(key, bucket+"/") {
+			// Get pins what it finds.
+			s.cache.Get(key)
+		}
+	}
+}
+
+// pinned returns the pinned body of key, if any.
+func (c *objectCache) pinned(key string) (*cacheEntry, bool) {
+	if c.freezes == nil {
+		return nil, false
+	}
+	c.pinsMu.RLock()
+	defer c.pinsMu.RUnlock()
+	entry, ok := c.pins[key]
+	return entry, ok
+}
+
+// pin pins value if it is the body of an object of a frozen bucket.
+func (c *objectCache) pin(key string, value interface{}) {
+	entry, ok := value.(*cacheEntry)
+	if !ok || !c.freezes.frozenKey(key) {
+		return
+	}
+	c.pinsMu.Lock()
+	defer c.pinsMu.Unlock()
+	c.pins[key] = entry
+}
+
+// unpin drops the pinned body of key, if any.
+func (c *objectCache) unpin(key string) {
+	if c.freezes == nil {
+		return
+	}
+	c.pinsMu.Lock()
+	defer c.pinsMu.Unlock()
+	delete(c.pins, key)
+}
+
+// unpinBucket releases the pinned bodies of bucket into the cache, which
+// may evict them again.
+func (c *objectCache) unpinBucket(bucket string) {
+	c.pinsMu.Lock()
+	released := map[string]*cacheEntry{}
+	for key, entry := range c.pins {
+		if strings.HasPrefix(key, bucket+"/") {
+			released[key] = entry
+			delete(c.pins, key)
+		}
+	}
+	c.pinsMu.Unlock()
+	for key, entry := range released {
+		if partition := c.partition(key); partition != nil {
+			partition.Set(key, entry, partitionCost(entry))
+		} else {
+			c.Cache.Set(key, entry, 1)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package cloud_storage
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// Hook lets deployers customise request handling without forking the proxy,
+// e.g. to rewrite keys, add response headers, veto requests or record
+// custom metrics.
+//
+// The On* methods run before a request is served and may modify it.
+// Multipart upload requests go through OnPut, with a PutObjectRequest
+// carrying only their bucket and key. A
+// non-nil error vetoes the request: a smithy.APIError, such as
+// repository.ErrAccessDenied, is returned to the client
+// as is, any other error as an InternalError.
+//
+// OnResponse runs once the request has been served, with the request as
+// passed to the service and its response, which is an APIErrorResponse if
+// the request failed. It returns the response to send, allowing hooks to
+// undo their rewrites, e.g. in listings.
+//
+// Embed NopHook to implement only some of the methods.
+type Hook interface {
+	OnGet(ctx context.Context, req *GetObjectRequest) error
+	OnHead(ctx context.Context, req *HeadObjectRequest) error
+	OnPut(ctx context.Context, req *PutObjectRequest) error
+	OnDelete(ctx context.Context, req *DeleteObjectRequest) error
+	OnList(ctx context.Context, req *ListObjectsRequest) error
+	OnListBuckets(ctx context.Context, req *ListBucketsRequest) error
+	OnResponse(ctx context.Context, request, response interface{}) interface{}
+}
+
+// NopHook implements Hook, leaving requests and responses unchanged.
+type NopHook struct{}
+
+func (NopHook) OnGet(context.Context, *GetObjectRequest) error                    { return nil }
+func (NopHook) OnHead(context.Context, *HeadObjectRequest) error                  { return nil }
+func (NopHook) OnPut(context.Context, *PutObjectRequest) error                    { return nil }
+func (NopHook) OnDelete(context.Context, *DeleteObjectRequest) error              { return nil }
+func (NopHook) OnList(context.Context, *ListObjectsRequest) error                 { return nil }
+func (NopHook) OnListBuckets(context.Context, *ListBucketsRequest) error          { return nil }
+func (NopHook) OnResponse(_ context.Context, _, response interface{}) interface{} { return response }
+
+// HookMiddleware returns an endpoint middleware running hooks, in order,
+// around every request. Responses are passed through the hooks in reverse
+// order.
+func HookMiddleware(hooks ...Hook) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			for _, hook := range hooks {
+				var err error
+				switch req := request.(type) {
+				case GetObjectRequest:
+					err = hook.OnGet(ctx, &req)
+					request = req
+				case HeadObjectRequest:
+					err = hook.OnHead(ctx, &req)
+					request = req
+				case PutObjectRequest:
+					err = hook.OnPut(ctx, &req)
+					request = req
+				case DeleteObjectRequest:
+					err = hook.OnDelete(ctx, &req)
+					request = req
+				case CreateMultipartUploadRequest:
+					err = onMultipart(ctx, hook, &req.Bucket, &req.Key)
+					request = req
+				case UploadPartRequest:
+					err = onMultipart(ctx, hook, &req.Bucket, &req.Key)
+					request = req
+				case CompleteMultipartUploadRequest:
+					err = onMultipart(ctx, hook, &req.Bucket, &req.Key)
+					request = req
+				case AbortMultipartUploadRequest:
+					err = onMultipart(ctx, hook, &req.Bucket, &req.Key)
+					request = req
+				case ListObjectsRequest:
+					err = hook.OnList(ctx, &req)
+					request = req
+				case ListBucketsRequest:
+					err = hook.OnListBuckets(ctx, &req)
+					request = req
+				}
+				if err != nil {
+					return apiErrorResponse(err), nil
+				}
+			}
+
+			response, err := next(ctx, request)
+			if err != nil {
+				return response, err
+			}
+			for i := len(hooks) - 1; i >= 0; i-- {
+				response = hooks[i].OnResponse(ctx, request, response)
+			}
+			return response, nil
+		}
+	}
+}
+
+// onMultipart runs OnPut for a multipart upload request, which writes the
+// object as a PutObject does, so that hooks see and may rewrite its bucket
+// and key.
+func onMultipart(ctx context.Context, hook Hook, bucket, key *string) error {
+	req := PutObjectRequest{BucketName: *bucket, ObjectKey: *key}
+	err := hook.OnPut(ctx, &req)
+	*bucket, *key = req.BucketName, req.ObjectKey
+	return err
+}
+
+// SetResponseHeader sets a header on the HTTP response of the request
+// being served by ctx. It is meant for hooks and does nothing outside of a
+// request.
+func SetResponseHeader(ctx context.Context, key, value string) {
+	if header, ok := ctx.Value(responseHeaderContextKey).(http.Header); ok {
+		header.Set(key, value)
+	}
+}
+
+// withResponseHeader makes SetResponseHeader available to the endpoints.
+func withResponseHeader(ctx context.Context, _ *http.Request) context.Context {
+	return context.WithValue(ctx, responseHeaderContextKey, http.Header{})
+}
+
+// writeResponseHeader copies the headers set with SetResponseHeader to w.
+func writeResponseHeader(ctx context.Context, w http.ResponseWriter) context.Context {
+	if header, ok := ctx.Value(responseHeaderContextKey).(http.Header); ok {
+		for key, values := range header {
+			w.Header()[key] = values
+		}
+	}
+	return ctx
+}
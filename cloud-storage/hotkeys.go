@@ -0,0 +1,235 @@
+package cloud_storage
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// HotKeyConfig configures hot-key detection and adaptive caching.
+type HotKeyConfig struct {
+	// HalfLife is the time it takes for a key's request score to halve.
+	HalfLife time.Duration
+
+	// HotThreshold is the score above which a key is hot and gets pinned.
+	HotThreshold float64
+
+	// AdmitThreshold is the number of recent requests for a key before its
+	// body gets cached; 2 means objects read only once are never cached.
+	AdmitThreshold float64
+
+	// MaxTrackedKeys bounds the memory used for tracking.
+	MaxTrackedKeys int
+
+	// PinnedBytes is the memory budget for pinned hot objects.
+	PinnedBytes int64
+}
+
+type keyScore struct {
+	score    float64
+	lastSeen time.Time
+}
+
+// HotKey is a tracked key and its current request score.
+type HotKey struct {
+	Key    string  `json:"key"`
+	Score  float64 `json:"score"`
+	Pinned bool    `json:"pinned"`
+}
+
+// HotKeyTracker keeps an exponentially decaying request score per key, and
+// pins the bodies of hot keys outside of the regular cache so that a scan
+// can't evict them.
+type HotKeyTracker struct {
+	config HotKeyConfig
+
+	mu          sync.Mutex
+	keys        map[string]*keyScore
+	pinned      map[string]*cacheEntry
+	pinnedBytes int64
+}
+
+func NewHotKeyTracker(config HotKeyConfig) *HotKeyTracker {
+	return &HotKeyTracker{
+		config: config,
+		keys:   make(map[string]*keyScore),
+		pinned: make(map[string]*cacheEntry),
+	}
+}
+
+// SetPolicy changes the thresholds and the pinned memory budget. Pinned
+// keys over the new budget are released as other keys get pinned.
+func (t *HotKeyTracker) SetPolicy(hotThreshold, admitThreshold float64, pinnedBytes int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.config.HotThreshold = hotThreshold
+	t.config.AdmitThreshold = admitThreshold
+	t.config.PinnedBytes = pinnedBytes
+}
+
+// decayed returns the score of k as of now.
+func (t *HotKeyTracker) decayed(k *keyScore, now time.Time) float64 {
+	elapsed := now.Sub(k.lastSeen)
+	return k.score * math.Exp2(-float64(elapsed)/float64(t.config.HalfLife))
+}
+
+// Touch records a request for key and returns its updated score.
+func (t *HotKeyTracker) Touch(key string) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	k, ok := t.keys[key]
+	if !ok {
+		if len(t.keys) >= t.config.MaxTrackedKeys {
+			t.evictCold(now)
+		}
+		k = &keyScore{}
+		t.keys[key] = k
+	}
+	k.score = t.decayed(k, now) + 1
+	k.lastSeen = now
+	return k.score
+}
+
+// evictCold forgets keys whose score has decayed below a single request,
+// and arbitrary ones if that's not enough to get below the limit.
+func (t *HotKeyTracker) evictCold(now time.Time) {
+	for key, k := range t.keys {
+		if _, pinned := t.pinned[key]; !pinned && t.decayed(k, now) < 1 {
+			delete(t.keys, key)
+		}
+	}
+	for key := range t.keys {
+		if len(t.keys) < t.config.MaxTrackedKeys*9/10 {
+			break
+		}
+		if _, pinned := t.pinned[key]; !pinned {
+			delete(t.keys, key)
+		}
+	}
+}
+
+// ShouldAdmit reports whether a key with the given score is requested often
+// enough for its body to be cached.
+func (t *HotKeyTracker) ShouldAdmit(score float64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return score >= t.config.AdmitThreshold
+}
+
+// IsHot reports whether a key with the given score should be pinned.
+func (t *HotKeyTracker) IsHot(score float64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.isHot(score)
+}
+
+func (t *HotKeyTracker) isHot(score float64) bool {
+	return score >= t.config.HotThreshold
+}
+
+// Pinned returns the pinned entry of key, if any.
+func (t *HotKeyTracker) Pinned(key string) (*cacheEntry, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	value, ok := t.pinned[key]
+	return value, ok
+}
+
+// Pin keeps value for key until the key cools down. Keys which are no
+// longer hot are unpinned to make room; if there's still not enough budget
+// the value isn't pinned.
+func (t *HotKeyTracker) Pin(key string, value *cacheEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.unpin(key)
+	size := int64(len(value.body))
+	if t.pinnedBytes+size > t.config.PinnedBytes {
+		now := time.Now()
+		for pinnedKey := range t.pinned {
+			if k, ok := t.keys[pinnedKey]; !ok || !t.isHot(t.decayed(k, now)) {
+				t.unpin(pinnedKey)
+			}
+		}
+	}
+	if t.pinnedBytes+size > t.config.PinnedBytes {
+		return
+	}
+	t.pinned[key] = value
+	t.pinnedBytes += size
+}
+
+// Update replaces the pinned entry of key if it is pinned.
+func (t *HotKeyTracker) Update(key string, value *cacheEntry) {
+	t.mu.Lock()
+	_, ok := t.pinned[key]
+	t.mu.Unlock()
+	if ok {
+		t.Pin(key, value)
+	}
+}
+
+// Unpin drops the pinned body of key, if any.
+func (t *HotKeyTracker) Unpin(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.unpin(key)
+}
+
+// UnpinAll drops every pinned body.
+func (t *HotKeyTracker) UnpinAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pinned = make(map[string]*cacheEntry)
+	t.pinnedBytes = 0
+}
+
+func (t *HotKeyTracker) unpin(key string) {
+	if value, ok := t.pinned[key]; ok {
+		t.pinnedBytes -= int64(len(value.body))
+		delete(t.pinned, key)
+	}
+}
+
+// HotKeys returns up to limit keys with the highest scores, hottest first.
+func (t *HotKeyTracker) HotKeys(limit int) []HotKey {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	keys := make([]HotKey, 0, len(t.keys))
+	for key, k := range t.keys {
+		_, pinned := t.pinned[key]
+		keys = append(keys, HotKey{Key: key, Score: t.decayed(k, now), Pinned: pinned})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Score > keys[j].Score })
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys
+}
+
+// AdminRoutes mounts GET /hotkeys[?limit=N] listing the hottest keys.
+func (t *HotKeyTracker) AdminRoutes(r *mux.Router) {
+	r.Methods("GET").Path("/hotkeys").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := 100
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t.HotKeys(limit))
+	})
+}
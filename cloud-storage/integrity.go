@@ -0,0 +1,122 @@
+package cloud_storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/aws/smithy-go"
+)
+
+// checksumAlgorithms maps the x-amz-checksum-* suffixes to their hash.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"crc32":  func() hash.Hash { return crc32.NewIEEE() },
+	"crc32c": func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// expectedDigest is a digest an upload must match, either known upfront
+// from a header or read from the trailers once the body has been read.
+type expectedDigest struct {
+	header string
+	value  []byte
+	hash   hash.Hash
+
+	// trailer holds the value once read, if it's sent as a trailer.
+	trailer http.Header
+}
+
+// verifyingReader checks an uploaded body against its announced length and
+// digests once fully read. A mismatch fails the final read, so the upload
+// is neither acknowledged nor forwarded as complete.
+type verifyingReader struct {
+	io.ReadCloser
+	length  int64
+	n       int64
+	digests []*expectedDigest
+}
+
+// newVerifyingReader wraps body with the verification of length (-1 if
+// unknown), Content-MD5 and the x-amz-checksum-* headers or trailers of r.
+func newVerifyingReader(r *http.Request, body io.ReadCloser, length int64) (io.ReadCloser, error) {
+	var digests []*expectedDigest
+	if v := r.Header.Get("Content-MD5"); v != "" {
+		value, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(value) != md5.Size {
+			return nil, &smithy.GenericAPIError{Code: "InvalidDigest", Message: "The Content-MD5 you specified was invalid."}
+		}
+		digests = append(digests, &expectedDigest{header: "Content-MD5", value: value, hash: md5.New()})
+	}
+	for algorithm, newHash := range checksumAlgorithms {
+		header := "x-amz-checksum-" + algorithm
+		digest := &expectedDigest{header: header, hash: newHash()}
+		if _, ok := r.Trailer[http.CanonicalHeaderKey(header)]; ok {
+			digest.trailer = r.Trailer
+		} else if v := r.Header.Get(header); v != "" {
+			value, err := base64.StdEncoding.DecodeString(v)
+			if err != nil || len(value) != digest.hash.Size() {
+				return nil, &smithy.GenericAPIError{Code: "InvalidRequest", Message: fmt.Sprintf("Value for %s header is invalid.", header)}
+			}
+			digest.value = value
+		} else {
+			continue
+		}
+		digests = append(digests, digest)
+	}
+
+	if len(digests) == 0 && length < 0 {
+		return body, nil
+	}
+	return &verifyingReader{ReadCloser: body, length: length, digests: digests}, nil
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	v.n += int64(n)
+	for _, d := range v.digests {
+		d.hash.Write(p[:n])
+	}
+	// net/http ends bodies shorter than their Content-Length with
+	// io.ErrUnexpectedEOF, which verify reports as IncompleteBody.
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		if verr := v.verify(); verr != nil {
+			return n, verr
+		}
+	}
+	return n, err
+}
+
+// errIncompleteBody is the error of bodies of n bytes instead of the length
+// their Content-Length announced.
+func errIncompleteBody(n, length int64) error {
+	return &smithy.GenericAPIError{Code: "IncompleteBody", Message: fmt.Sprintf("You did not provide the number of bytes specified by the Content-Length HTTP header: got %d of %d bytes.", n, length)}
+}
+
+func (v *verifyingReader) verify() error {
+	if v.length >= 0 && v.n != v.length {
+		return errIncompleteBody(v.n, v.length)
+	}
+	for _, d := range v.digests {
+		want := d.value
+		if d.trailer != nil {
+			var err error
+			want, err = base64.StdEncoding.DecodeString(strings.TrimSpace(d.trailer.Get(d.header)))
+			if err != nil {
+				return &smithy.GenericAPIError{Code: "InvalidRequest", Message: fmt.Sprintf("Value for %s trailing header is invalid.", d.header)}
+			}
+		}
+		if !bytes.Equal(d.hash.Sum(nil), want) {
+			return &smithy.GenericAPIError{Code: "BadDigest", Message: fmt.Sprintf("The %s you specified did not match the calculated checksum.", d.header)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+package cloud_storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+// inventoryRowsPerFile bounds the number of objects per inventory data file.
+const inventoryRowsPerFile = 1000000
+
+// inventoryFileSchema lists the CSV columns, as in the manifest.
+const inventoryFileSchema = "Bucket, Key, Size, LastModifiedDate, ETag"
+
+// InventoryConfig describes an inventory of Bucket, optionally limited to
+// the keys starting with Prefix, written to the Destination bucket under
+// DestinationPrefix.
+type InventoryConfig struct {
+	ID                string `json:"id"`
+	Bucket            string `json:"bucket"`
+	Prefix            string `json:"prefix,omitempty"`
+	Destination       string `json:"destination"`
+	DestinationPrefix string `json:"destinationPrefix,omitempty"`
+}
+
+// InventoryFile is a data file of an inventory, as listed in its manifest.
+type InventoryFile struct {
+	Key         string `json:"key"`
+	Size        int64  `json:"size"`
+	MD5Checksum string `json:"MD5checksum"`
+}
+
+// InventoryManifest is the manifest.json of an inventory, in the format of
+// S3 Inventory, so that existing consumers can read it.
+type InventoryManifest struct {
+	SourceBucket      string          `json:"sourceBucket"`
+	DestinationBucket string          `json:"destinationBucket"`
+	Version           string          `json:"version"`
+	CreationTimestamp string          `json:"creationTimestamp"`
+	FileFormat        string          `json:"fileFormat"`
+	FileSchema        string          `json:"fileSchema"`
+	Files             []InventoryFile `json:"files"`
+}
+
+// InventoryResult reports a completed inventory.
+type InventoryResult struct {
+	ManifestKey string `json:"manifestKey"`
+	Objects     int64  `json:"objects"`
+	Files       int    `json:"files"`
+}
+
+// InventoryExporter writes S3 Inventory style listings of buckets: gzipped
+// CSV data files plus a manifest.json and manifest.checksum, laid out as
+//
+//	{destinationPrefix}/{bucket}/{id}/data/{random}.csv.gz
+//	{destinationPrefix}/{bucket}/{id}/{YYYY-MM-DDTHH-MMZ}/manifest.json
+//
+// Objects are listed upstream, then overlaid with the write-back uploads
+// still pending in the cache, so that the inventory matches what clients of
+// the proxy see.
+type InventoryExporter struct {
+	storage CloudStorage
+	cache   *CachedCloudStorage
+	logger  log.Logger
+
+	// running holds the IDs of running inventories; an inventory isn't
+	// started again while it runs.
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+// NewInventoryExporter returns an exporter reading from and writing to
+// storage. cache may be nil.
+func NewInventoryExporter(storage CloudStorage, cache *CachedCloudStorage, logger log.Logger) *InventoryExporter {
+	return &InventoryExporter{storage: storage, cache: cache, logger: logger, running: map[string]bool{}}
+}
+
+// inventoryWriter accumulates the rows of a data file.
+type inventoryWriter struct {
+	buf  bytes.Buffer
+	gz   *gzip.Writer
+	csv  *csv.Writer
+	rows int
+}
+
+func newInventoryWriter() *inventoryWriter {
+	w := &inventoryWriter{}
+	w.gz = gzip.NewWriter(&w.buf)
+	w.csv = csv.NewWriter(w.gz)
+	return w
+}
+
+// Export writes an inventory of config.Bucket.
+func (e *InventoryExporter) Export(ctx context.Context, config InventoryConfig) (InventoryResult, error) {
+	if config.Bucket == "" || config.Destination == "" {
+		return InventoryResult{}, errors.New("bucket and destination are required")
+	}
+	if config.ID == "" {
+		config.ID = "proxy"
+	}
+	e.mu.Lock()
+	runKey := config.Bucket + "/" + config.ID
+	if e.running[runKey] {
+		e.mu.Unlock()
+		return InventoryResult{}, fmt.Errorf("inventory %s of %s is already running", config.ID, config.Bucket)
+	}
+	e.running[runKey] = true
+	e.mu.Unlock()
+	defer func() {
+		e.mu.Lock()
+		delete(e.running, runKey)
+		e.mu.Unlock()
+	}()
+
+	start := time.Now().UTC()
+	base := strings.TrimSuffix(config.DestinationPrefix, "/")
+	if base != "" {
+		base += "/"
+	}
+	base += config.Bucket + "/" + config.ID + "/"
+
+	overlay, err := e.pendingObjects(ctx, config.Bucket, config.Prefix)
+	if err != nil {
+		return InventoryResult{}, err
+	}
+
+	manifest := InventoryManifest{
+		SourceBucket:      config.Bucket,
+		DestinationBucket: "arn:aws:s3:::" + config.Destination,
+		Version:           "2016-11-30",
+		CreationTimestamp: strconv.FormatInt(start.UnixMilli(), 10),
+		FileFormat:        "CSV",
+		FileSchema:        inventoryFileSchema,
+	}
+	var result InventoryResult
+
+	w := newInventoryWriter()
+	flush := func() error {
+		if w.rows == 0 {
+			return nil
+		}
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			return err
+		}
+		if err := w.gz.Close(); err != nil {
+			return err
+		}
+		key := base + "data/" + randomHex(16) + ".csv.gz"
+		data := w.buf.Bytes()
+		if err := e.put(ctx, config.Destination, key, data); err != nil {
+			return err
+		}
+		sum := md5.Sum(data)
+		manifest.Files = append(manifest.Files, InventoryFile{Key: key, Size: int64(len(data)), MD5Checksum: hex.EncodeToString(sum[:])})
+		w = newInventoryWriter()
+		return nil
+	}
+	write := func(object Object) error {
+		// S3 Inventory URL-encodes keys in CSV files.
+		if err := w.csv.Write([]string{
+			config.Bucket,
+			url.QueryEscape(object.Key),
+			strconv.FormatInt(object.Size, 10),
+			object.LastModified,
+			strings.Trim(object.ETag, `"`),
+		}); err != nil {
+			return err
+		}
+		result.Objects++
+		if w.rows++; w.rows >= inventoryRowsPerFile {
+			return flush()
+		}
+		return nil
+	}
+
+	options := ListObjectsOptions{Prefix: config.Prefix, MaxKeys: defaultMaxKeys}
+	for {
+		page, err := e.storage.ListObjects(ctx, config.Bucket, options)
+		if err != nil {
+			return result, fmt.Errorf("listing %s: %w", config.Bucket, err)
+		}
+		for _, object := range page.Objects {
+			if pending, ok := overlay[object.Key]; ok {
+				object = pending
+				delete(overlay, object.Key)
+			}
+			if err := write(object); err != nil {
+				return result, err
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		options.ContinuationToken = page.NextContinuationToken
+	}
+	// Uploads of new objects which haven't reached upstream yet.
+	for _, object := range overlay {
+		if err := write(object); err != nil {
+			return result, err
+		}
+	}
+	if err := flush(); err != nil {
+		return result, err
+	}
+	result.Files = len(manifest.Files)
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return result, err
+	}
+	dir := base + start.Format("2006-01-02T15-04Z") + "/"
+	if err := e.put(ctx, config.Destination, dir+"manifest.json", data); err != nil {
+		return result, err
+	}
+	sum := md5.Sum(data)
+	if err := e.put(ctx, config.Destination, dir+"manifest.checksum", []byte(hex.EncodeToString(sum[:]))); err != nil {
+		return result, err
+	}
+	result.ManifestKey = dir + "manifest.json"
+	e.logger.Log("msg", "inventory written", "bucket", config.Bucket, "id", config.ID, "manifest", result.ManifestKey, "objects", result.Objects, "took", time.Since(start))
+	return result, nil
+}
+
+func (e *InventoryExporter) put(ctx context.Context, bucket, key string, data []byte) error {
+	if err := e.storage.PutObject(ctx, bucket, key, bytes.NewReader(data), int64(len(data)), "", "", "", UploadHeaders{}); err != nil {
+		return fmt.Errorf("writing %s/%s: %w", bucket, key, err)
+	}
+	return nil
+}
+
+// pendingObjects returns the objects of bucket under prefix whose
+// write-back upload is pending, as served by the cache.
+func (e *InventoryExporter) pendingObjects(ctx context.Context, bucket, prefix string) (map[string]Object, error) {
+	objects := map[string]Object{}
+	if e.cache == nil {
+		return objects, nil
+	}
+	for _, cacheKey := range e.cache.PendingUploads() {
+		key, ok := strings.CutPrefix(cacheKey, bucket+"/")
+		if !ok || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		metadata, err := e.cache.HeadObject(ctx, bucket, key)
+		if err != nil {
+			// Deleted, or uploaded and evicted in the meantime; either way
+			// the listing is right.
+			continue
+		}
+		objects[key] = Object{
+			Key:          key,
+			Size:         metadata.ContentLength,
+			ETag:         aws.ToString(metadata.ETag),
+			LastModified: aws.ToTime(metadata.LastModified).UTC().Format("2006-01-02T15:04:05.000Z"),
+		}
+	}
+	return objects, nil
+}
+
+// Schedule exports the inventories of configs every interval until ctx is
+// done.
+func (e *InventoryExporter) Schedule(ctx context.Context, interval time.Duration, configs []InventoryConfig) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, config := range configs {
+			if _, err := e.Export(ctx, config); err != nil {
+				e.logger.Log("msg", "inventory failed", "bucket", config.Bucket, "id", config.ID, "err", err)
+			}
+		}
+	}
+}
+
+// AdminRoutes mounts the inventory endpoint, which runs an inventory and
+// returns an InventoryResult:
+//
+//	POST /inventory  {"bucket": "b", "destination": "d", "destinationPrefix": "inventories"}
+func (e *InventoryExporter) AdminRoutes(r *mux.Router) {
+	r.Methods("POST").Path("/inventory").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var config InventoryConfig
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if config.Bucket == "" || config.Destination == "" {
+			http.Error(w, "bucket and destination are required", http.StatusBadRequest)
+			return
+		}
+		result, err := e.Export(r.Context(), config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
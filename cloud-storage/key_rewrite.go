@@ -0,0 +1,163 @@
+package cloud_storage
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+)
+
+// KeyRewriteRule rewrites the keys of objects in Bucket, or in every bucket
+// if empty, matching the regular expression Pattern into Replace, in which
+// $1 or ${name} stand for the submatches as in regexp.Expand. For example,
+// Pattern "^legacy/(.*)" with Replace "$1" strips a legacy prefix, and
+// Pattern `^logs/(\d{4})-(\d{2})-(\d{2})/` with Replace
+// "logs/year=$1/month=$2/day=$3/" partitions logs by date.
+type KeyRewriteRule struct {
+	Bucket  string `json:"bucket,omitempty"`
+	Pattern string `json:"pattern"`
+	Replace string `json:"replace"`
+}
+
+// keyRewrite is a KeyRewriteRule with its pattern compiled.
+type keyRewrite struct {
+	bucket  string
+	pattern *regexp.Regexp
+	replace string
+}
+
+func compileKeyRewrites(rules []KeyRewriteRule) ([]keyRewrite, error) {
+	rewrites := make([]keyRewrite, len(rules))
+	for i, rule := range rules {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("pattern %q: %w", rule.Pattern, err)
+		}
+		rewrites[i] = keyRewrite{bucket: rule.Bucket, pattern: pattern, replace: rule.Replace}
+	}
+	return rewrites, nil
+}
+
+// ValidateKeyRewriteRules reports the first rule with an invalid pattern.
+func ValidateKeyRewriteRules(rules []KeyRewriteRule) error {
+	_, err := compileKeyRewrites(rules)
+	return err
+}
+
+// KeyRewriter holds the key rewrite rules.
+type KeyRewriter struct {
+	mu       sync.RWMutex
+	rewrites []keyRewrite
+}
+
+// NewKeyRewriter returns a rewriter applying rules, which must be valid.
+func NewKeyRewriter(rules []KeyRewriteRule) *KeyRewriter {
+	r := &KeyRewriter{}
+	r.SetRules(rules)
+	return r
+}
+
+// SetRules replaces the rules, which must be valid.
+func (r *KeyRewriter) SetRules(rules []KeyRewriteRule) {
+	rewrites, _ := compileKeyRewrites(rules)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rewrites = rewrites
+}
+
+// Rewrite returns the key key of bucket is rewritten to by the first
+// matching rule, or key if none matches.
+func (r *KeyRewriter) Rewrite(bucket, key string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, rewrite := range r.rewrites {
+		if rewrite.bucket != "" && rewrite.bucket != bucket {
+			continue
+		}
+		if rewrite.pattern.MatchString(key) {
+			return rewrite.pattern.ReplaceAllString(key, rewrite.replace)
+		}
+	}
+	return key
+}
+
+// KeyRewriteMiddleware returns an endpoint middleware rewriting the keys of
+// object requests with rewriter, before they reach the cache and upstream.
+// Rewrites are logged with the original key. Multipart upload responses
+// hold the original key; listings aren't rewritten.
+func KeyRewriteMiddleware(rewriter *KeyRewriter, logger log.Logger) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			rewrite := func(bucket string, key *string) (string, bool) {
+				original := *key
+				*key = rewriter.Rewrite(bucket, original)
+				if *key == original {
+					return original, true
+				}
+				logger.Log("msg", "key rewritten", "requestId", requestInfoFromContext(ctx).ID, "bucket", bucket, "object", original, "rewritten", *key)
+				return original, *key != ""
+			}
+			invalid := APIErrorResponse{Code: "InvalidArgument", Message: "The object key is rewritten to an empty key"}
+
+			switch req := request.(type) {
+			case GetObjectRequest:
+				if _, ok := rewrite(req.Bucket, &req.Key); !ok {
+					return invalid, nil
+				}
+				request = req
+			case HeadObjectRequest:
+				if _, ok := rewrite(req.Bucket, &req.Key); !ok {
+					return invalid, nil
+				}
+				request = req
+			case PutObjectRequest:
+				if _, ok := rewrite(req.BucketName, &req.ObjectKey); !ok {
+					return invalid, nil
+				}
+				request = req
+			case DeleteObjectRequest:
+				if _, ok := rewrite(req.BucketName, &req.ObjectKey); !ok {
+					return invalid, nil
+				}
+				request = req
+			case CreateMultipartUploadRequest:
+				key, ok := rewrite(req.Bucket, &req.Key)
+				if !ok {
+					return invalid, nil
+				}
+				response, err := next(ctx, req)
+				if resp, ok := response.(CreateMultipartUploadResponse); ok {
+					resp.Key = key
+					response = resp
+				}
+				return response, err
+			case UploadPartRequest:
+				if _, ok := rewrite(req.Bucket, &req.Key); !ok {
+					return invalid, nil
+				}
+				request = req
+			case CompleteMultipartUploadRequest:
+				key, ok := rewrite(req.Bucket, &req.Key)
+				if !ok {
+					return invalid, nil
+				}
+				response, err := next(ctx, req)
+				if resp, ok := response.(CompleteMultipartUploadResponse); ok {
+					resp.Key = key
+					resp.Location = "/" + resp.Bucket + "/" + key
+					response = resp
+				}
+				return response, err
+			case AbortMultipartUploadRequest:
+				if _, ok := rewrite(req.Bucket, &req.Key); !ok {
+					return invalid, nil
+				}
+				request = req
+			}
+			return next(ctx, request)
+		}
+	}
+}
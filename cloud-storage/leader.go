@@ -0,0 +1,259 @@
+package cloud_storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+
+	"github.com/rampage644/s3-overlay-proxy/repository"
+)
+
+// LeaderElectionConfig configures a LeaderElector. The lease is the object
+// Key in Bucket of the upstream, which all replicas must be able to read
+// and write.
+type LeaderElectionConfig struct {
+	Bucket string
+	Key    string
+
+	// Identity names this replica in the lease, e.g. its hostname.
+	Identity string
+
+	// LeaseDuration is how long a lease is valid without being renewed;
+	// it is renewed every RetryPeriod, which should be a fraction of it.
+	LeaseDuration time.Duration
+	RetryPeriod   time.Duration
+}
+
+// leaderLease is the content of the lease object.
+type leaderLease struct {
+	Holder    string    `json:"holder"`
+	RenewTime time.Time `json:"renewTime"`
+	Duration  string    `json:"leaseDuration"`
+}
+
+// expired reports whether the lease has run out at now.
+func (l leaderLease) expired(now time.Time) bool {
+	d, err := time.ParseDuration(l.Duration)
+	return err != nil || l.Holder == "" || now.After(l.RenewTime.Add(d))
+}
+
+// LeaderElector elects one replica of a multi-replica deployment to run the
+// background workers which must not run concurrently, such as scheduled
+// inventories. Workers added with AddWorker run while this replica holds the
+// lease and are cancelled when it loses it.
+//
+// S3 has no compare-and-swap, so a replica taking over a free or expired
+// lease writes it and reads it back after a RetryPeriod, leading only if its
+// write survived. Two replicas can both believe they lead for at most a
+// RetryPeriod when their writes race on a slow store, which the workers must
+// tolerate.
+type LeaderElector struct {
+	config  LeaderElectionConfig
+	storage repository.ObjectStorage
+	logger  log.Logger
+
+	mu      sync.Mutex
+	workers []func(ctx context.Context)
+	leading bool
+	holder  string
+	cancel  context.CancelFunc
+
+	// renewed is when the lease was last written by this replica; it is
+	// only accessed by Run.
+	renewed time.Time
+}
+
+// NewLeaderElector returns an elector keeping its lease in storage, which
+// should be the upstream itself rather than the cache.
+func NewLeaderElector(config LeaderElectionConfig, storage repository.ObjectStorage, logger log.Logger) *LeaderElector {
+	return &LeaderElector{config: config, storage: storage, logger: logger}
+}
+
+// AddWorker registers work to run while this replica leads. It is called
+// with a context that is done once leadership is lost, and called again
+// when it is regained. Workers must be added before Run.
+func (e *LeaderElector) AddWorker(work func(ctx context.Context)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.workers = append(e.workers, work)
+}
+
+// IsLeader reports whether this replica currently leads.
+func (e *LeaderElector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leading
+}
+
+// read returns the current lease, or a zero lease if there is none.
+func (e *LeaderElector) read(ctx context.Context) (leaderLease, error) {
+	out, err := e.storage.GetObject(ctx, &repository.GetObjectInput{
+		Bucket: aws.String(e.config.Bucket),
+		Key:    aws.String(e.config.Key),
+	})
+	if err != nil {
+		if errors.Is(err, repository.ErrNoSuchKey) {
+			return leaderLease{}, nil
+		}
+		return leaderLease{}, err
+	}
+	defer out.Body.Close()
+
+	var lease leaderLease
+	if err := json.NewDecoder(io.LimitReader(out.Body, 64*1024)).Decode(&lease); err != nil {
+		// A corrupt lease is as good as none.
+		return leaderLease{}, nil
+	}
+	return lease, nil
+}
+
+// write stores a lease held by holder, renewed now.
+func (e *LeaderElector) write(ctx context.Context, holder string, now time.Time) error {
+	data, err := json.Marshal(leaderLease{Holder: holder, RenewTime: now.UTC(), Duration: e.config.LeaseDuration.String()})
+	if err != nil {
+		return err
+	}
+	_, err = e.storage.PutObject(ctx, &repository.PutObjectInput{
+		Bucket:        aws.String(e.config.Bucket),
+		Key:           aws.String(e.config.Key),
+		Body:          bytes.NewReader(data),
+		ContentLength: int64(len(data)),
+		ContentType:   aws.String("application/json"),
+	})
+	return err
+}
+
+// try runs one election round, returning whether this replica leads.
+func (e *LeaderElector) try(ctx context.Context) (bool, error) {
+	lease, err := e.read(ctx)
+	if err != nil {
+		return false, err
+	}
+	e.mu.Lock()
+	e.holder = lease.Holder
+	leading := e.leading
+	e.mu.Unlock()
+
+	now := time.Now()
+	switch {
+	case lease.Holder == e.config.Identity && leading:
+		if err := e.write(ctx, e.config.Identity, now); err != nil {
+			return false, err
+		}
+		e.renewed = now
+		return true, nil
+	case lease.Holder != e.config.Identity && !lease.expired(now):
+		return false, nil
+	}
+
+	// The lease is free, expired or left over from an earlier run of this
+	// replica: claim it, then check the claim held against other replicas
+	// doing the same.
+	if err := e.write(ctx, e.config.Identity, now); err != nil {
+		return false, err
+	}
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-time.After(e.config.RetryPeriod):
+	}
+	lease, err = e.read(ctx)
+	if err != nil {
+		return false, err
+	}
+	e.mu.Lock()
+	e.holder = lease.Holder
+	e.mu.Unlock()
+	if lease.Holder != e.config.Identity {
+		return false, nil
+	}
+	e.renewed = now
+	return true, nil
+}
+
+// setLeading starts or cancels the workers when leadership changes.
+func (e *LeaderElector) setLeading(ctx context.Context, leading bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if leading == e.leading {
+		return
+	}
+	e.leading = leading
+	if !leading {
+		e.cancel()
+		e.cancel = nil
+		e.logger.Log("msg", "lost leadership", "identity", e.config.Identity)
+		return
+	}
+	e.logger.Log("msg", "became leader", "identity", e.config.Identity)
+	var workCtx context.Context
+	workCtx, e.cancel = context.WithCancel(ctx)
+	for _, work := range e.workers {
+		go work(workCtx)
+	}
+}
+
+// Run takes part in the election every RetryPeriod until ctx is done, then
+// releases the lease if it holds it.
+func (e *LeaderElector) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.config.RetryPeriod)
+	defer ticker.Stop()
+	for {
+		leading, err := e.try(ctx)
+		if err != nil && ctx.Err() == nil {
+			e.logger.Log("msg", "leader election failed", "err", err)
+			// Keep leading through transient failures, as long as the
+			// lease written last is still valid for others.
+			leading = e.IsLeader() && time.Since(e.renewed) < e.config.LeaseDuration-e.config.RetryPeriod
+		}
+		e.setLeading(ctx, leading)
+
+		select {
+		case <-ctx.Done():
+			e.release()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// release stops the workers and clears the lease if this replica leads, so
+// that another one takes over right away rather than once it expires.
+func (e *LeaderElector) release() {
+	if !e.IsLeader() {
+		return
+	}
+	e.setLeading(context.Background(), false)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := e.write(ctx, "", time.Time{}); err != nil {
+		e.logger.Log("msg", "releasing lease failed", "err", err)
+	}
+}
+
+// LeaderStatus reports the state of the election.
+type LeaderStatus struct {
+	Identity string `json:"identity"`
+	Leader   bool   `json:"leader"`
+	Holder   string `json:"holder"`
+}
+
+// AdminRoutes mounts GET /leader returning a LeaderStatus.
+func (e *LeaderElector) AdminRoutes(r *mux.Router) {
+	r.Methods("GET").Path("/leader").HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		e.mu.Lock()
+		status := LeaderStatus{Identity: e.config.Identity, Leader: e.leading, Holder: e.holder}
+		e.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+}
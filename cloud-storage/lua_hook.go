@@ -0,0 +1,234 @@
+package cloud_storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rampage644/s3-overlay-proxy/repository"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// luaRemovedGlobals are base library functions scripts can't use, as they
+// reach outside of the sandbox.
+var luaRemovedGlobals = []string{"collectgarbage", "dofile", "load", "loadfile", "loadstring", "module", "print", "require"}
+
+// LuaHook is a Hook running a Lua script, letting operators rewrite and
+// filter requests without rebuilding the proxy. The script may define any
+// of on_get, on_head, on_put, on_delete, on_list and on_list_buckets. Each
+// is called with a table of the request fields, which it may modify:
+//
+//	function on_get(req)
+//	  if req.client.access_key == "" then
+//	    return false, "anonymous access denied"
+//	  end
+//	  req.key = "tenant-a/" .. req.key
+//	  set_header("X-Tenant", "a")
+//	end
+//
+// The fields are bucket and key for object requests, plus range for gets,
+// and bucket, prefix, delimiter and start_after for listings. Every table
+// also holds method and client.access_key/client.source_ip, which are read
+// only, the access key being empty unless the signature of the request was
+// verified, see SignatureMiddleware. Returning false denies the request with AccessDenied and the
+// optional message; a script error fails it with InternalError.
+//
+// Scripts run in a sandbox with only the base, string, table and math
+// libraries, without string.rep, and no file or module loading. Each call
+// is aborted after the configured timeout, after luaMaxInstructions
+// instructions, or once the strings and tables it made take more than the
+// configured memory, see luaBudget, and the Lua stack is capped at a number
+// of slots. Globals, and the fields of the tables among them such as the
+// libraries, are reset after every call, so that calls don't see what
+// others left there; locals of the script's top level are not.
+type LuaHook struct {
+	NopHook
+
+	proto       *lua.FunctionProto
+	timeout     time.Duration
+	maxRegistry int
+	maxMemory   int64
+	states      sync.Pool
+}
+
+// luaState is a pooled Lua state, with its globals once the script ran.
+type luaState struct {
+	*lua.LState
+	globals luaGlobals
+}
+
+// NewLuaHook loads the script at path. Calls time out after timeout, the
+// Lua stack of each is capped at maxRegistry slots, and the memory it
+// allocates at about maxMemory bytes.
+func NewLuaHook(path string, timeout time.Duration, maxRegistry int, maxMemory int64) (*LuaHook, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := parse.Parse(strings.NewReader(string(source)), path)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, path)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &LuaHook{proto: proto, timeout: timeout, maxRegistry: maxRegistry, maxMemory: maxMemory}
+	// Run the script once up front, so that errors in its top level are
+	// reported at startup rather than on the first request.
+	L, err := h.newState()
+	if err != nil {
+		return nil, err
+	}
+	h.states.Put(L)
+	return h, nil
+}
+
+func (h *LuaHook) newState() (*luaState, error) {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:    true,
+		RegistrySize:    1024,
+		RegistryMaxSize: h.maxRegistry,
+		CallStackSize:   128,
+	})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range luaRemovedGlobals {
+		L.SetGlobal(name, lua.LNil)
+	}
+	limitLibraries(L)
+	L.SetGlobal("set_header", L.NewFunction(func(L *lua.LState) int {
+		SetResponseHeader(L.Context(), L.CheckString(1), L.CheckString(2))
+		return 0
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	L.SetContext(newLuaBudget(ctx, L, h.maxMemory))
+	L.Push(L.NewFunctionFromProto(h.proto))
+	err := L.PCall(0, lua.MultRet, nil)
+	L.RemoveContext()
+	if err != nil {
+		L.Close()
+		return nil, err
+	}
+	L.SetTop(0)
+	return &luaState{LState: L, globals: snapshotGlobals(L)}, nil
+}
+
+// luaField binds a request field to a script table field.
+type luaField struct {
+	name  string
+	value *string
+}
+
+// call runs the script function fn, if defined, with a table of fields,
+// copying the fields back once it returns.
+func (h *LuaHook) call(ctx context.Context, fn, method string, fields ...luaField) error {
+	L, _ := h.states.Get().(*luaState)
+	if L == nil {
+		var err error
+		if L, err = h.newState(); err != nil {
+			return err
+		}
+	}
+
+	f, ok := L.GetGlobal(fn).(*lua.LFunction)
+	if !ok {
+		h.states.Put(L)
+		return nil
+	}
+
+	req := L.NewTable()
+	for _, field := range fields {
+		req.RawSetString(field.name, lua.LString(*field.value))
+	}
+	client := ClientFromContext(ctx)
+	clientTable := L.NewTable()
+	accessKey, _ := verifiedAccessKey(ctx)
+	clientTable.RawSetString("access_key", lua.LString(accessKey))
+	clientTable.RawSetString("source_ip", lua.LString(client.SourceIP))
+	req.RawSetString("client", clientTable)
+	req.RawSetString("method", lua.LString(method))
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	L.SetContext(newLuaBudget(ctx, L.LState, h.maxMemory))
+	L.Push(f)
+	L.Push(req)
+	err := L.PCall(1, 2, nil)
+	L.RemoveContext()
+	if err != nil {
+		// The state may have been left half way through the script.
+		L.Close()
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			return fmt.Errorf("%s: %s", fn, apiErr.Object)
+		}
+		return fmt.Errorf("%s: %w", fn, err)
+	}
+
+	allowed, message := L.Get(-2), L.Get(-1)
+	L.SetTop(0)
+	L.globals.restore()
+	h.states.Put(L)
+
+	if allowed == lua.LFalse {
+		msg := "Access Denied"
+		if s, ok := message.(lua.LString); ok {
+			msg = string(s)
+		}
+		return repository.ErrAccessDenied.WithMessage(msg)
+	}
+	for _, field := range fields {
+		if s, ok := req.RawGetString(field.name).(lua.LString); ok {
+			*field.value = string(s)
+		}
+	}
+	return nil
+}
+
+func (h *LuaHook) OnGet(ctx context.Context, req *GetObjectRequest) error {
+	return h.call(ctx, "on_get", "GetObject",
+		luaField{"bucket", &req.Bucket}, luaField{"key", &req.Key}, luaField{"range", &req.Range})
+}
+
+func (h *LuaHook) OnHead(ctx context.Context, req *HeadObjectRequest) error {
+	return h.call(ctx, "on_head", "HeadObject",
+		luaField{"bucket", &req.Bucket}, luaField{"key", &req.Key})
+}
+
+func (h *LuaHook) OnPut(ctx context.Context, req *PutObjectRequest) error {
+	return h.call(ctx, "on_put", "PutObject",
+		luaField{"bucket", &req.BucketName}, luaField{"key", &req.ObjectKey})
+}
+
+func (h *LuaHook) OnDelete(ctx context.Context, req *DeleteObjectRequest) error {
+	return h.call(ctx, "on_delete", "DeleteObject",
+		luaField{"bucket", &req.BucketName}, luaField{"key", &req.ObjectKey})
+}
+
+func (h *LuaHook) OnList(ctx context.Context, req *ListObjectsRequest) error {
+	return h.call(ctx, "on_list", "ListObjects",
+		luaField{"bucket", &req.Bucket}, luaField{"prefix", &req.Prefix},
+		luaField{"delimiter", &req.Delimiter}, luaField{"start_after", &req.StartAfter})
+}
+
+func (h *LuaHook) OnListBuckets(ctx context.Context, _ *ListBucketsRequest) error {
+	return h.call(ctx, "on_list_buckets", "ListBuckets")
+}
@@ -0,0 +1,338 @@
+package cloud_storage
+
+import (
+	"context"
+	"errors"
+	"unsafe"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/pm"
+)
+
+const (
+	// luaMaxInstructions is the number of instructions a Lua hook call may
+	// run, which also bounds the table fields and short strings it makes.
+	luaMaxInstructions = 1 << 18
+	// luaTrackedString is the length from which strings are counted
+	// against the memory of a call, shorter ones being bounded by
+	// luaMaxInstructions.
+	luaTrackedString = 64
+	// luaTableSize and luaFieldSize are the memory counted for a table and
+	// for each of its array fields.
+	luaTableSize = 64
+	luaFieldSize = 16
+	// luaMaxGsubWork is the number of bytes string.gsub may copy, as it
+	// copies its whole result for every match.
+	luaMaxGsubWork = 1 << 26
+)
+
+var (
+	errLuaInstructions = errors.New("instruction limit exceeded")
+	errLuaMemory       = errors.New("memory limit exceeded")
+)
+
+// closedDone is the Done channel of a call over its budget.
+var closedDone = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// luaBudget is the context Lua hook calls run with. The VM checks Done
+// before every instruction, when luaBudget counts the instruction, and the
+// strings and tables in the registers of the running function it hasn't
+// seen yet as allocated. Every value a script makes goes through a
+// register, so this approximates what the call allocates; once it is over
+// maxMemory, or over luaMaxInstructions, Done is closed and the VM aborts
+// the call with Err.
+type luaBudget struct {
+	context.Context
+	L         *lua.LState
+	maxMemory int64
+
+	instructions int
+	memory       int64
+	strings      map[*byte]struct{}
+	tables       map[*lua.LTable]int
+	err          error
+}
+
+func newLuaBudget(ctx context.Context, L *lua.LState, maxMemory int64) *luaBudget {
+	return &luaBudget{
+		Context:   ctx,
+		L:         L,
+		maxMemory: maxMemory,
+		strings:   map[*byte]struct{}{},
+		tables:    map[*lua.LTable]int{},
+	}
+}
+
+func (b *luaBudget) Done() <-chan struct{} {
+	if b.err == nil {
+		b.check()
+	}
+	if b.err != nil {
+		return closedDone
+	}
+	return b.Context.Done()
+}
+
+func (b *luaBudget) Err() error {
+	if b.err != nil {
+		return b.err
+	}
+	return b.Context.Err()
+}
+
+// check counts an instruction and the values in the registers.
+func (b *luaBudget) check() {
+	b.instructions++
+	if b.instructions > luaMaxInstructions {
+		b.err = errLuaInstructions
+		return
+	}
+	for i, top := 1, b.L.GetTop(); i <= top; i++ {
+		switch v := b.L.Get(i).(type) {
+		case lua.LString:
+			if len(v) < luaTrackedString {
+				continue
+			}
+			data := unsafe.StringData(string(v))
+			if _, seen := b.strings[data]; !seen {
+				b.strings[data] = struct{}{}
+				b.memory += int64(len(v))
+			}
+		case *lua.LTable:
+			fields, seen := b.tables[v]
+			if !seen {
+				b.memory += luaTableSize
+			}
+			if n := v.Len(); !seen || n > fields {
+				b.memory += int64(max(n-fields, 0)) * luaFieldSize
+				b.tables[v] = n
+			}
+		}
+	}
+	if b.memory > b.maxMemory {
+		b.err = errLuaMemory
+	}
+}
+
+// reserve fails the call of L unless n more bytes fit in its budget, before
+// a library function allocates them.
+func reserve(L *lua.LState, n int64) {
+	if b, ok := L.Context().(*luaBudget); ok && b.memory+n > b.maxMemory {
+		L.RaiseError(errLuaMemory.Error())
+	}
+}
+
+// limitLibraries removes string.rep, and wraps the library functions which
+// could otherwise allocate far more than their arguments in one go.
+func limitLibraries(L *lua.LState) {
+	str := L.GetGlobal(lua.StringLibName).(*lua.LTable)
+	str.RawSetString("rep", lua.LNil)
+	for name, limit := range map[string]func(*lua.LState, *lua.LFunction) int{
+		"format": luaFormat,
+		"gsub":   luaGsub,
+	} {
+		str.RawSetString(name, luaWrap(L, str.RawGetString(name).(*lua.LFunction), limit))
+	}
+	table := L.GetGlobal(lua.TabLibName).(*lua.LTable)
+	table.RawSetString("concat", luaWrap(L, table.RawGetString("concat").(*lua.LFunction), luaConcat))
+}
+
+// luaWrap returns a function calling limit with the original function fn.
+func luaWrap(L *lua.LState, fn *lua.LFunction, limit func(*lua.LState, *lua.LFunction) int) *lua.LFunction {
+	return L.NewFunction(func(L *lua.LState) int {
+		return limit(L, fn)
+	})
+}
+
+// callWith calls fn with args, returning its nret results.
+func callWith(L *lua.LState, fn *lua.LFunction, nret int, args ...lua.LValue) int {
+	L.Push(fn)
+	for _, arg := range args {
+		L.Push(arg)
+	}
+	L.Call(len(args), nret)
+	return nret
+}
+
+// luaFormat is string.format with the widths and precisions Lua allows,
+// at most two digits, without the argument indexes and * widths of Go's
+// fmt, so that the length of the result is bounded by the arguments.
+func luaFormat(L *lua.LState, format *lua.LFunction) int {
+	spec := L.CheckString(1)
+	size, arg := int64(len(spec)), 2
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			continue
+		}
+		i++
+		for i < len(spec) && (spec[i] == '-' || spec[i] == '+' || spec[i] == ' ' || spec[i] == '#' || spec[i] == '0') {
+			i++
+		}
+		for _, part := range []string{"width", "precision"} {
+			if part == "precision" {
+				if i >= len(spec) || spec[i] != '.' {
+					break
+				}
+				i++
+			}
+			digits := 0
+			for i < len(spec) && spec[i] >= '0' && spec[i] <= '9' {
+				i, digits = i+1, digits+1
+			}
+			if digits > 2 {
+				L.RaiseError("invalid format (%s too long)", part)
+			}
+		}
+		if i >= len(spec) || spec[i] == '*' || spec[i] == '[' {
+			L.RaiseError("invalid format %q", spec)
+		}
+		if spec[i] == '%' {
+			continue
+		}
+		// Quoting may escape every byte as \xNN.
+		size += 128
+		if s, ok := L.Get(arg).(lua.LString); ok {
+			size += 4*int64(len(s)) + 2
+		} else {
+			size += 384
+		}
+		arg++
+	}
+	reserve(L, size)
+	args := make([]lua.LValue, L.GetTop())
+	for i := range args {
+		args[i] = L.Get(i + 1)
+	}
+	return callWith(L, format, 1, args...)
+}
+
+// luaGsub is string.gsub bounding its result, which it reserves upfront
+// for string replacements and as it goes otherwise, and the bytes it
+// copies.
+func luaGsub(L *lua.LState, gsub *lua.LFunction) int {
+	str := L.CheckString(1)
+	pattern := L.CheckString(2)
+	L.CheckTypes(3, lua.LTString, lua.LTTable, lua.LTFunction)
+	repl := L.Get(3)
+	limit := L.OptInt(4, -1)
+	matches, err := pm.Find(pattern, []byte(str), 0, limit)
+	if err != nil || len(matches) == 0 {
+		// Errors are raised by gsub.
+		return callWith(L, gsub, 2, L.Get(1), L.Get(2), repl, lua.LNumber(limit))
+	}
+	n := int64(len(matches))
+	bound := func(size int64) {
+		if n*size > luaMaxGsubWork {
+			L.RaiseError("string.gsub: too many replacements")
+		}
+		reserve(L, size)
+	}
+
+	switch r := repl.(type) {
+	case lua.LString:
+		// Matches don't overlap, so every capture reference expands to at
+		// most the string in total, plus the positions of position
+		// captures.
+		refs := int64(0)
+		for i := 0; i+1 < len(r); i++ {
+			if r[i] == '%' {
+				if r[i+1] >= '0' && r[i+1] <= '9' {
+					refs++
+				}
+				i++
+			}
+		}
+		bound(int64(len(str)) + n*int64(len(r)) + refs*(int64(len(str))+20*n))
+	case *lua.LTable, *lua.LFunction:
+		size := int64(len(str))
+		repl = L.NewFunction(func(L *lua.LState) int {
+			var value lua.LValue
+			if t, ok := r.(*lua.LTable); ok {
+				value = L.GetTable(t, L.Get(1))
+			} else {
+				args := make([]lua.LValue, L.GetTop())
+				for i := range args {
+					args[i] = L.Get(i + 1)
+				}
+				callWith(L, r.(*lua.LFunction), 1, args...)
+				value = L.Get(-1)
+			}
+			if value != lua.LFalse && value != lua.LNil {
+				size += int64(len(lua.LVAsString(value)))
+				bound(size)
+			}
+			L.Push(value)
+			return 1
+		})
+	}
+	return callWith(L, gsub, 2, L.Get(1), L.Get(2), repl, lua.LNumber(limit))
+}
+
+// luaConcat is table.concat reserving the length of its result first.
+func luaConcat(L *lua.LState, concat *lua.LFunction) int {
+	table := L.CheckTable(1)
+	sep := L.OptString(2, "")
+	first, last := max(L.OptInt(3, 1), 1), min(L.OptInt(4, table.Len()), table.Len())
+	size := int64(0)
+	for i := first; i <= last; i++ {
+		size += int64(len(lua.LVAsString(table.RawGetInt(i))) + len(sep))
+	}
+	reserve(L, size)
+	args := make([]lua.LValue, L.GetTop())
+	for i := range args {
+		args[i] = L.Get(i + 1)
+	}
+	return callWith(L, concat, 1, args...)
+}
+
+// luaGlobals is a snapshot of the globals of a state, and of the fields
+// and metatables of the tables among them, such as the libraries.
+type luaGlobals map[*lua.LTable]luaTable
+
+type luaTable struct {
+	fields    map[lua.LValue]lua.LValue
+	metatable lua.LValue
+}
+
+// snapshotGlobals returns the snapshot of the globals of L.
+func snapshotGlobals(L *lua.LState) luaGlobals {
+	globals := luaGlobals{}
+	record := func(t *lua.LTable) {
+		if _, ok := globals[t]; ok {
+			return
+		}
+		fields := map[lua.LValue]lua.LValue{}
+		t.ForEach(func(k, v lua.LValue) { fields[k] = v })
+		globals[t] = luaTable{fields: fields, metatable: t.Metatable}
+	}
+	record(L.G.Global)
+	for _, v := range globals[L.G.Global].fields {
+		if t, ok := v.(*lua.LTable); ok {
+			record(t)
+		}
+	}
+	return globals
+}
+
+// restore undoes the changes made to the globals since the snapshot.
+func (g luaGlobals) restore() {
+	for t, snapshot := range g {
+		var added []lua.LValue
+		t.ForEach(func(k, _ lua.LValue) {
+			if _, ok := snapshot.fields[k]; !ok {
+				added = append(added, k)
+			}
+		})
+		for _, k := range added {
+			t.RawSet(k, lua.LNil)
+		}
+		for k, v := range snapshot.fields {
+			t.RawSet(k, v)
+		}
+		t.Metatable = snapshot.metatable
+	}
+}
@@ -0,0 +1,129 @@
+package cloud_storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/aws/smithy-go"
+	bolt "go.etcd.io/bbolt"
+)
+
+// localTokenPrefix starts the continuation tokens of listings computed from
+// the metadata store, telling them apart from upstream ones.
+const localTokenPrefix = "local:"
+
+// SetOfflineListings makes listings which fail upstream with a server error
+// or a timeout be computed from the recorded metadata, so that browsing
+// keeps working while upstream is down. Such listings only hold the objects
+// the proxy has seen, recently or not.
+func (m *MetadataStore) SetOfflineListings(enabled bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.offlineListings = enabled
+}
+
+func (m *MetadataStore) listsOffline() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.offlineListings
+}
+
+// list computes a page of the listing of bucket from the records, grouping
+// keys into common prefixes by the delimiter as S3 does.
+func (m *MetadataStore) list(bucket string, options ListObjectsOptions) (ListObjectsPage, error) {
+	after := options.StartAfter
+	if options.ContinuationToken != "" {
+		encoded, ok := strings.CutPrefix(options.ContinuationToken, localTokenPrefix)
+		token, err := base64.RawURLEncoding.DecodeString(encoded)
+		if !ok || err != nil {
+			return ListObjectsPage{}, &smithy.GenericAPIError{Code: "InvalidArgument", Message: "The continuation token provided is incorrect"}
+		}
+		if string(token) > after {
+			after = string(token)
+		}
+	}
+	maxKeys := options.MaxKeys
+	if maxKeys < 0 {
+		maxKeys = defaultMaxKeys
+	}
+
+	page := ListObjectsPage{Objects: []Object{}, CommonPrefixes: []CommonPrefix{}}
+	if maxKeys == 0 {
+		return page, nil
+	}
+	err := m.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		start := options.Prefix
+		if after > start {
+			start = after
+		}
+		last := ""
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(start)); k != nil && bytes.HasPrefix(k, []byte(options.Prefix)); {
+			key := string(k)
+			entry, isPrefix := key, false
+			if options.Delimiter != "" {
+				if i := strings.Index(key[len(options.Prefix):], options.Delimiter); i >= 0 {
+					entry, isPrefix = key[:len(options.Prefix)+i+len(options.Delimiter)], true
+				}
+			}
+
+			var record metadataRecord
+			live := false
+			if entry > after {
+				if isPrefix {
+					live = hasLiveRecords(b, entry)
+				} else {
+					live = json.Unmarshal(v, &record) == nil && !record.Deleted
+				}
+			}
+			if live {
+				if len(page.Objects)+len(page.CommonPrefixes) == maxKeys {
+					page.IsTruncated = true
+					page.NextContinuationToken = localTokenPrefix + base64.RawURLEncoding.EncodeToString([]byte(last))
+					return nil
+				}
+				if isPrefix {
+					page.CommonPrefixes = append(page.CommonPrefixes, CommonPrefix{Prefix: entry})
+				} else {
+					page.Objects = append(page.Objects, Object{
+						Key:          key,
+						LastModified: record.LastModified.Format(time.RFC3339),
+						ETag:         record.ETag,
+						Size:         record.Size,
+					})
+				}
+				last = entry
+			}
+
+			if isPrefix {
+				// No UTF-8 key has a 0xff byte, so this skips the other
+				// keys of the common prefix.
+				k, v = c.Seek([]byte(entry + "\xff"))
+			} else {
+				k, v = c.Next()
+			}
+		}
+		return nil
+	})
+	return page, err
+}
+
+// hasLiveRecords reports whether b has records of objects under prefix which
+// weren't deleted.
+func hasLiveRecords(b *bolt.Bucket, prefix string) bool {
+	c := b.Cursor()
+	for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+		var record metadataRecord
+		if json.Unmarshal(v, &record) == nil && !record.Deleted {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,299 @@
+package cloud_storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/go-kit/kit/log"
+	"github.com/rampage644/s3-overlay-proxy/repository"
+	bolt "go.etcd.io/bbolt"
+)
+
+// metadataRecord is the stored metadata of an object. Deleted records that
+// the object is known not to exist.
+type metadataRecord struct {
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"lastModified"`
+	ContentType  string    `json:"contentType,omitempty"`
+	Deleted      bool      `json:"deleted,omitempty"`
+
+	// Seen is when the record was learned.
+	Seen time.Time `json:"seen"`
+}
+
+// MetadataStore persists object metadata in a bbolt database, so that HEAD
+// requests can be answered without asking upstream, across restarts too.
+// Records are trusted for a consistency window, configurable per bucket:
+// changes made upstream by other clients become visible once it expires.
+type MetadataStore struct {
+	db *bolt.DB
+
+	mu              sync.RWMutex
+	defaultWindow   time.Duration
+	windows         map[string]time.Duration
+	offlineListings bool
+}
+
+// OpenMetadataStore opens, or creates, the database at path. Records are
+// trusted for defaultWindow, unless windows sets another duration for their
+// bucket; a window of 0 disables the store for a bucket.
+func OpenMetadataStore(path string, defaultWindow time.Duration, windows map[string]time.Duration) (*MetadataStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening metadata store %s: %w", path, err)
+	}
+	return &MetadataStore{db: db, defaultWindow: defaultWindow, windows: windows}, nil
+}
+
+// Close closes the database.
+func (m *MetadataStore) Close() error {
+	return m.db.Close()
+}
+
+// SetWindows replaces the consistency windows.
+func (m *MetadataStore) SetWindows(defaultWindow time.Duration, windows map[string]time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.defaultWindow, m.windows = defaultWindow, windows
+}
+
+func (m *MetadataStore) window(bucket string) time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if window, ok := m.windows[bucket]; ok {
+		return window
+	}
+	return m.defaultWindow
+}
+
+// get returns the record of bucket/key if it is within the consistency
+// window. Expired records are removed.
+func (m *MetadataStore) get(bucket, key string) (metadataRecord, bool) {
+	window := m.window(bucket)
+	if window <= 0 {
+		return metadataRecord{}, false
+	}
+	var record metadataRecord
+	found := false
+	_ = m.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		if data := b.Get([]byte(key)); data != nil {
+			found = json.Unmarshal(data, &record) == nil
+		}
+		return nil
+	})
+	if found && time.Since(record.Seen) > window {
+		_ = m.delete(bucket, key)
+		return metadataRecord{}, false
+	}
+	return record, found
+}
+
+// put stores records of keys in bucket.
+func (m *MetadataStore) put(bucket string, records map[string]metadataRecord) error {
+	if len(records) == 0 || m.window(bucket) <= 0 {
+		return nil
+	}
+	return m.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		for key, record := range records {
+			data, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(key), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (m *MetadataStore) delete(bucket, key string) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(bucket)); b != nil {
+			return b.Delete([]byte(key))
+		}
+		return nil
+	})
+}
+
+// metadataStorage is a CloudStorage answering HEAD requests from a
+// MetadataStore, recording the metadata returned by every other operation.
+type metadataStorage struct {
+	baseStorage CloudStorage
+	store       *MetadataStore
+	logger      log.Logger
+}
+
+// NewMetadataStorage returns baseStorage with HEAD requests answered from
+// store when possible.
+func NewMetadataStorage(baseStorage CloudStorage, store *MetadataStore, logger log.Logger) CloudStorage {
+	return &metadataStorage{baseStorage: baseStorage, store: store, logger: logger}
+}
+
+func (s *metadataStorage) record(bucketName string, records map[string]metadataRecord) {
+	if err := s.store.put(bucketName, records); err != nil {
+		s.logger.Log("msg", "recording metadata failed", "bucket", bucketName, "err", err)
+	}
+}
+
+func (s *metadataStorage) forget(bucketName, objectKey string) {
+	if err := s.store.delete(bucketName, objectKey); err != nil {
+		s.logger.Log("msg", "removing metadata failed", "bucket", bucketName, "object", objectKey, "err", err)
+	}
+}
+
+func (s *metadataStorage) ListBuckets(ctx context.Context) ([]Bucket, error) {
+	return s.baseStorage.ListBuckets(ctx)
+}
+
+func (s *metadataStorage) CreateBucket(ctx context.Context, bucketName string) error {
+	return s.baseStorage.CreateBucket(ctx, bucketName)
+}
+
+func (s *metadataStorage) DeleteBucket(ctx context.Context, bucketName string) error {
+	return s.baseStorage.DeleteBucket(ctx, bucketName)
+}
+
+// ListObjects records the listed objects. Listings have no content type, so
+// HEAD responses for objects only seen listed have none either. With
+// offline listings, listings failing upstream are computed from the store.
+func (s *metadataStorage) ListObjects(ctx context.Context, bucketName string, options ListObjectsOptions) (ListObjectsPage, error) {
+	page, err := s.baseStorage.ListObjects(ctx, bucketName, options)
+	if err != nil {
+		if !s.store.listsOffline() || !repository.IsUpstreamFailure(err) {
+			return page, err
+		}
+		offline, listErr := s.store.list(bucketName, options)
+		if listErr != nil {
+			s.logger.Log("msg", "listing offline failed", "bucket", bucketName, "err", listErr)
+			return page, err
+		}
+		s.logger.Log("msg", "listing offline", "bucket", bucketName, "prefix", options.Prefix, "err", err)
+		SetResponseHeader(ctx, "Warning", staleWarning)
+		return offline, nil
+	}
+	now := time.Now()
+	records := make(map[string]metadataRecord, len(page.Objects))
+	for _, object := range page.Objects {
+		lastModified, _ := time.Parse(time.RFC3339, object.LastModified)
+		records[object.Key] = metadataRecord{
+			Size:         object.Size,
+			ETag:         object.ETag,
+			LastModified: lastModified,
+			Seen:         now,
+		}
+	}
+	s.record(bucketName, records)
+	return page, nil
+}
+
+// PutObject forgets the object's metadata, as the new ETag isn't known.
+func (s *metadataStorage) PutObject(ctx context.Context, bucketName, objectKey string, content io.Reader, length int64, md5 string, sha256 string, tagging string, headers UploadHeaders) error {
+	err := s.baseStorage.PutObject(ctx, bucketName, objectKey, content, length, md5, sha256, tagging, headers)
+	s.forget(bucketName, objectKey)
+	return err
+}
+
+// HeadObject answers from the recorded metadata, except requests made as an
+// assumed role, which upstream must authorize.
+func (s *metadataStorage) HeadObject(ctx context.Context, bucketName, objectKey string) (*s3.HeadObjectOutput, error) {
+	if _, assumed := repository.AssumedRoleFromContext(ctx); assumed {
+		return s.baseStorage.HeadObject(ctx, bucketName, objectKey)
+	}
+	if record, ok := s.store.get(bucketName, objectKey); ok {
+		if record.Deleted {
+			return nil, repository.ErrNoSuchKey
+		}
+		output := &s3.HeadObjectOutput{
+			ContentLength: record.Size,
+			ETag:          aws.String(record.ETag),
+			LastModified:  aws.Time(record.LastModified),
+		}
+		if record.ContentType != "" {
+			output.ContentType = aws.String(record.ContentType)
+		}
+		return output, nil
+	}
+
+	output, err := s.baseStorage.HeadObject(ctx, bucketName, objectKey)
+	if err != nil {
+		var ae smithy.APIError
+		if errors.As(err, &ae) && (ae.ErrorCode() == "NotFound" || ae.ErrorCode() == "NoSuchKey") {
+			s.record(bucketName, map[string]metadataRecord{objectKey: {Deleted: true, Seen: time.Now()}})
+		}
+		return nil, err
+	}
+	s.record(bucketName, map[string]metadataRecord{objectKey: {
+		Size:         output.ContentLength,
+		ETag:         aws.ToString(output.ETag),
+		LastModified: aws.ToTime(output.LastModified),
+		ContentType:  aws.ToString(output.ContentType),
+		Seen:         time.Now(),
+	}})
+	return output, nil
+}
+
+// GetObject records the metadata of whole object bodies; ranges don't carry
+// the object size in ContentLength.
+func (s *metadataStorage) GetObject(ctx context.Context, bucketName, objectKey, contentRange string) (io.ReadCloser, ObjectInfo, error) {
+	body, info, err := s.baseStorage.GetObject(ctx, bucketName, objectKey, contentRange)
+	if err == nil && info.ContentRange == "" {
+		s.record(bucketName, map[string]metadataRecord{objectKey: {
+			Size:         info.ContentLength,
+			ETag:         info.ETag,
+			LastModified: info.LastModified,
+			ContentType:  info.ContentType,
+			Seen:         time.Now(),
+		}})
+	}
+	return body, info, err
+}
+
+func (s *metadataStorage) DeleteObject(ctx context.Context, bucketName, objectKey string) error {
+	if err := s.baseStorage.DeleteObject(ctx, bucketName, objectKey); err != nil {
+		s.forget(bucketName, objectKey)
+		return err
+	}
+	s.record(bucketName, map[string]metadataRecord{objectKey: {Deleted: true, Seen: time.Now()}})
+	return nil
+}
+
+func (s *metadataStorage) GetObjectTagging(ctx context.Context, bucketName, objectKey string) (map[string]string, error) {
+	return s.baseStorage.GetObjectTagging(ctx, bucketName, objectKey)
+}
+
+func (s *metadataStorage) CreateMultipartUpload(ctx context.Context, bucketName, objectKey, tagging string, headers UploadHeaders) (string, error) {
+	return s.baseStorage.CreateMultipartUpload(ctx, bucketName, objectKey, tagging, headers)
+}
+
+func (s *metadataStorage) UploadPart(ctx context.Context, bucketName, objectKey, uploadID string, partNumber int32, content io.Reader, length int64, md5 string) (string, error) {
+	return s.baseStorage.UploadPart(ctx, bucketName, objectKey, uploadID, partNumber, content, length, md5)
+}
+
+// CompleteMultipartUpload forgets the object's metadata, like PutObject.
+func (s *metadataStorage) CompleteMultipartUpload(ctx context.Context, bucketName, objectKey, uploadID string, parts []CompletedPart) (string, error) {
+	etag, err := s.baseStorage.CompleteMultipartUpload(ctx, bucketName, objectKey, uploadID, parts)
+	s.forget(bucketName, objectKey)
+	return etag, err
+}
+
+func (s *metadataStorage) AbortMultipartUpload(ctx context.Context, bucketName, objectKey, uploadID string) error {
+	return s.baseStorage.AbortMultipartUpload(ctx, bucketName, objectKey, uploadID)
+}
@@ -35,6 +35,25 @@ func (r PutObjectRequest) KeyVals() []interface{} {
 	}
 }
 
+func (r UploadPartRequest) KeyVals() []interface{} {
+	return []interface{}{
+		"bucket", r.Bucket,
+		"object", r.Key,
+		"uploadId", r.UploadID,
+		"partNumber", r.PartNumber,
+		"contentLength", r.ContentLength,
+	}
+}
+
+func (r CompleteMultipartUploadRequest) KeyVals() []interface{} {
+	return []interface{}{
+		"bucket", r.Bucket,
+		"object", r.Key,
+		"uploadId", r.UploadID,
+		"parts", len(r.Parts),
+	}
+}
+
 func (r APIErrorResponse) KeyVals() []interface{} {
 	return []interface{}{
 		"code", r.Code,
@@ -50,6 +69,7 @@ func LoggingMiddleware(logger log.Logger) endpoint.Middleware {
 
 			defer func(begin time.Time) {
 				keyvals := []interface{}{
+					"requestId", requestInfoFromContext(ctx).ID,
 					"took", time.Since(begin),
 					"err", err,
 				}
@@ -0,0 +1,216 @@
+package cloud_storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/go-kit/kit/log"
+	"github.com/rampage644/s3-overlay-proxy/repository"
+)
+
+// MigrateConfig describes a copy of the objects of Bucket, optionally
+// limited to the keys starting with Prefix, to DestinationBucket, Bucket if
+// empty, of another backend.
+type MigrateConfig struct {
+	Bucket            string
+	DestinationBucket string
+	Prefix            string
+
+	// Concurrency bounds the number of objects copied at a time.
+	Concurrency int
+
+	// Checkpoint is the file recording the progress of the copy, if not
+	// empty. A copy started again with the same file resumes after the last
+	// listing page fully copied.
+	Checkpoint string
+}
+
+// MigrateResult reports a copy.
+type MigrateResult struct {
+	// Copied objects, of Bytes in total, and Skipped ones, which the
+	// destination holds already with the same size and ETag.
+	Copied  int64 `json:"copied"`
+	Skipped int64 `json:"skipped"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// migrateCheckpoint is the content of a checkpoint file.
+type migrateCheckpoint struct {
+	Bucket     string        `json:"bucket"`
+	Prefix     string        `json:"prefix,omitempty"`
+	StartAfter string        `json:"startAfter"`
+	Result     MigrateResult `json:"result"`
+}
+
+// Migrate copies the objects of config.Bucket from source to destination.
+// Every copy is verified: the MD5 of the bytes read must match the source
+// ETag, unless it is the ETag of a multipart upload, and the destination
+// must then report the same size and, for single part ETags, the same MD5.
+// Content types and user metadata are copied; tags aren't. Objects the
+// proxy encrypted are copied as they are, and fail to copy to another
+// bucket, as their encryption binds them to their bucket and key.
+func Migrate(ctx context.Context, source, destination CloudStorage, config MigrateConfig, logger log.Logger) (MigrateResult, error) {
+	if config.Bucket == "" {
+		return MigrateResult{}, errors.New("bucket is required")
+	}
+	if config.DestinationBucket == "" {
+		config.DestinationBucket = config.Bucket
+	}
+	if config.Concurrency <= 0 {
+		config.Concurrency = 1
+	}
+
+	checkpoint := migrateCheckpoint{Bucket: config.Bucket, Prefix: config.Prefix}
+	if config.Checkpoint != "" {
+		data, err := os.ReadFile(config.Checkpoint)
+		switch {
+		case err == nil:
+			var saved migrateCheckpoint
+			if err := json.Unmarshal(data, &saved); err != nil {
+				return MigrateResult{}, fmt.Errorf("checkpoint %s: %w", config.Checkpoint, err)
+			}
+			if saved.Bucket != config.Bucket || saved.Prefix != config.Prefix {
+				return MigrateResult{}, fmt.Errorf("checkpoint %s is of a copy of %s/%s", config.Checkpoint, saved.Bucket, saved.Prefix)
+			}
+			checkpoint = saved
+			logger.Log("msg", "resuming copy", "bucket", config.Bucket, "after", checkpoint.StartAfter)
+		case !errors.Is(err, os.ErrNotExist):
+			return MigrateResult{}, err
+		}
+	}
+
+	var copied, skipped, bytes atomic.Int64
+	copied.Store(checkpoint.Result.Copied)
+	skipped.Store(checkpoint.Result.Skipped)
+	bytes.Store(checkpoint.Result.Bytes)
+	result := func() MigrateResult {
+		return MigrateResult{Copied: copied.Load(), Skipped: skipped.Load(), Bytes: bytes.Load()}
+	}
+
+	start := time.Now()
+	options := ListObjectsOptions{Prefix: config.Prefix, StartAfter: checkpoint.StartAfter, MaxKeys: defaultMaxKeys}
+	for {
+		page, err := source.ListObjects(ctx, config.Bucket, options)
+		if err != nil {
+			return result(), fmt.Errorf("listing %s: %w", config.Bucket, err)
+		}
+
+		var (
+			wg       sync.WaitGroup
+			mu       sync.Mutex
+			firstErr error
+		)
+		slots := make(chan struct{}, config.Concurrency)
+		for _, object := range page.Objects {
+			slots <- struct{}{}
+			wg.Add(1)
+			go func(object Object) {
+				defer func() {
+					<-slots
+					wg.Done()
+				}()
+				n, err := migrateObject(ctx, source, destination, config, object)
+				switch {
+				case err != nil:
+					logger.Log("msg", "copy failed", "bucket", config.Bucket, "object", object.Key, "err", err)
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = fmt.Errorf("copying %s: %w", object.Key, err)
+					}
+					mu.Unlock()
+				case n < 0:
+					skipped.Add(1)
+				default:
+					copied.Add(1)
+					bytes.Add(n)
+				}
+			}(object)
+		}
+		wg.Wait()
+		if firstErr != nil {
+			return result(), firstErr
+		}
+
+		if len(page.Objects) > 0 {
+			checkpoint.StartAfter = page.Objects[len(page.Objects)-1].Key
+			checkpoint.Result = result()
+			if err := saveCheckpoint(config.Checkpoint, checkpoint); err != nil {
+				return result(), err
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		options.ContinuationToken = page.NextContinuationToken
+	}
+	logger.Log("msg", "copy done", "bucket", config.Bucket, "destination", config.DestinationBucket, "copied", copied.Load(), "skipped", skipped.Load(), "bytes", bytes.Load(), "took", time.Since(start))
+	return result(), nil
+}
+
+// migrateObject copies object, returning the bytes copied, or -1 if the
+// destination holds it already.
+func migrateObject(ctx context.Context, source, destination CloudStorage, config MigrateConfig, object Object) (int64, error) {
+	// Compared to the HEAD of the source rather than to its listing, which
+	// reports the sizes and ETags of encrypted bodies.
+	head, err := source.HeadObject(ctx, config.Bucket, object.Key)
+	if err != nil {
+		return 0, err
+	}
+	if config.DestinationBucket != config.Bucket && repository.IsEncrypted(head.Metadata) {
+		return 0, fmt.Errorf("encrypted for bucket %s, it can't be decrypted in %s", config.Bucket, config.DestinationBucket)
+	}
+	if existing, err := destination.HeadObject(ctx, config.DestinationBucket, object.Key); err == nil &&
+		existing.ContentLength == head.ContentLength && aws.ToString(existing.ETag) == aws.ToString(head.ETag) {
+		return -1, nil
+	}
+	body, info, err := source.GetObject(ctx, config.Bucket, object.Key, "")
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	hash := md5.New()
+	headers := UploadHeaders{ContentType: info.ContentType, Metadata: head.Metadata}
+	if err := destination.PutObject(ctx, config.DestinationBucket, object.Key, io.TeeReader(body, hash), info.ContentLength, "", "", "", headers); err != nil {
+		return 0, err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if etag := trimETag(info.ETag); !strings.Contains(etag, "-") && etag != sum {
+		return 0, fmt.Errorf("read MD5 %s, expected the source ETag %s", sum, etag)
+	}
+	copied, err := destination.HeadObject(ctx, config.DestinationBucket, object.Key)
+	if err != nil {
+		return 0, err
+	}
+	if copied.ContentLength != info.ContentLength {
+		return 0, fmt.Errorf("copied %d bytes, the source has %d", copied.ContentLength, info.ContentLength)
+	}
+	if etag := trimETag(aws.ToString(copied.ETag)); !strings.Contains(etag, "-") && etag != sum {
+		return 0, fmt.Errorf("copied MD5 %s, expected %s", etag, sum)
+	}
+	return info.ContentLength, nil
+}
+
+// saveCheckpoint writes checkpoint to path, if not empty.
+func saveCheckpoint(path string, checkpoint migrateCheckpoint) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Dir(path), filepath.Base(path), data)
+}
@@ -0,0 +1,278 @@
+package cloud_storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/smithy-go"
+	"github.com/go-kit/kit/endpoint"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+)
+
+// maxPartNumber is the highest part number S3 accepts.
+const maxPartNumber = 10000
+
+// minPartSize is the minimum size of every part but the last of a multipart
+// upload.
+const minPartSize = 5 << 20
+
+type CreateMultipartUploadRequest struct {
+	Bucket  string
+	Key     string
+	Tagging string
+	Headers UploadHeaders
+}
+
+type CreateMultipartUploadResponse struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult" json:"-"`
+
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+type UploadPartRequest struct {
+	Bucket        string
+	Key           string
+	UploadID      string
+	PartNumber    int32
+	Body          io.ReadCloser
+	ContentLength int64
+	ContentMD5    string
+}
+
+type UploadPartResponse struct {
+	ETag string `xml:"-"`
+}
+
+func (r UploadPartResponse) Headers() http.Header {
+	return http.Header{"ETag": {r.ETag}}
+}
+
+// CompletedPart identifies an uploaded part in CompleteMultipartUpload.
+type CompletedPart struct {
+	PartNumber int32
+	ETag       string
+}
+
+type CompleteMultipartUploadRequest struct {
+	Bucket   string
+	Key      string
+	UploadID string
+	Parts    []CompletedPart
+}
+
+type CompleteMultipartUploadResponse struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult" json:"-"`
+
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+type AbortMultipartUploadRequest struct {
+	Bucket   string
+	Key      string
+	UploadID string
+}
+
+type AbortMultipartUploadResponse struct{}
+
+// MultipartETag computes the ETag S3 gives objects assembled from parts:
+// the MD5 of the concatenated binary MD5s of the parts, followed by the
+// number of parts, e.g. "9b2cf535f27731c974343645a3985328-2".
+func MultipartETag(partMD5s [][]byte) string {
+	h := md5.New()
+	for _, sum := range partMD5s {
+		h.Write(sum)
+	}
+	return fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(h.Sum(nil)), len(partMD5s))
+}
+
+// apiErrorResponse converts a service error to an S3 error response.
+func apiErrorResponse(err error) APIErrorResponse {
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		return APIErrorResponse{Code: ae.ErrorCode(), Message: ae.ErrorMessage()}
+	}
+	return APIErrorResponse{Code: "InternalError", Message: err.Error()}
+}
+
+func MakeCreateMultipartUploadEndpoint(svc CloudStorage) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CreateMultipartUploadRequest)
+		uploadID, err := svc.CreateMultipartUpload(ctx, req.Bucket, req.Key, req.Tagging, req.Headers)
+		if err != nil {
+			return apiErrorResponse(err), nil
+		}
+		return CreateMultipartUploadResponse{Bucket: req.Bucket, Key: req.Key, UploadId: uploadID}, nil
+	}
+}
+
+func MakeUploadPartEndpoint(svc CloudStorage) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(UploadPartRequest)
+		defer req.Body.Close()
+		etag, err := svc.UploadPart(ctx, req.Bucket, req.Key, req.UploadID, req.PartNumber, req.Body, req.ContentLength, req.ContentMD5)
+		if err != nil {
+			return apiErrorResponse(err), nil
+		}
+		return UploadPartResponse{ETag: etag}, nil
+	}
+}
+
+func MakeCompleteMultipartUploadEndpoint(svc CloudStorage) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CompleteMultipartUploadRequest)
+		etag, err := svc.CompleteMultipartUpload(ctx, req.Bucket, req.Key, req.UploadID, req.Parts)
+		if err != nil {
+			return apiErrorResponse(err), nil
+		}
+		return CompleteMultipartUploadResponse{
+			Location: "/" + req.Bucket + "/" + req.Key,
+			Bucket:   req.Bucket,
+			Key:      req.Key,
+			ETag:     etag,
+		}, nil
+	}
+}
+
+func MakeAbortMultipartUploadEndpoint(svc CloudStorage) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(AbortMultipartUploadRequest)
+		if err := svc.AbortMultipartUpload(ctx, req.Bucket, req.Key, req.UploadID); err != nil {
+			return apiErrorResponse(err), nil
+		}
+		return AbortMultipartUploadResponse{}, nil
+	}
+}
+
+func decodeCreateMultipartUploadRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	bucket, key, err := objectPath(r)
+	if err != nil {
+		return nil, err
+	}
+	tagging := r.Header.Get("x-amz-tagging")
+	if _, err := ParseTagging(tagging); err != nil {
+		return nil, err
+	}
+	return CreateMultipartUploadRequest{Bucket: bucket, Key: key, Tagging: tagging, Headers: decodeUploadHeaders(r)}, nil
+}
+
+func decodeUploadPartRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	bucket, key, err := objectPath(r)
+	if err != nil {
+		return nil, err
+	}
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > maxPartNumber {
+		return nil, &smithy.GenericAPIError{Code: "InvalidArgument", Message: fmt.Sprintf("Part number must be an integer between 1 and %d, inclusive", maxPartNumber)}
+	}
+	body, contentLength, err := decodeObjectBody(r)
+	if err != nil {
+		return nil, err
+	}
+	return UploadPartRequest{
+		Bucket:        bucket,
+		Key:           key,
+		UploadID:      r.URL.Query().Get("uploadId"),
+		PartNumber:    int32(partNumber),
+		Body:          body,
+		ContentLength: contentLength,
+		ContentMD5:    r.Header.Get("Content-MD5"),
+	}, nil
+}
+
+func decodeCompleteMultipartUploadRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	bucket, key, err := objectPath(r)
+	if err != nil {
+		return nil, err
+	}
+	var body struct {
+		Parts []CompletedPart `xml:"Part"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&body); err != nil || len(body.Parts) == 0 {
+		return nil, &smithy.GenericAPIError{Code: "MalformedXML", Message: "The XML you provided was not well-formed or did not validate against our published schema."}
+	}
+	return CompleteMultipartUploadRequest{
+		Bucket:   bucket,
+		Key:      key,
+		UploadID: r.URL.Query().Get("uploadId"),
+		Parts:    body.Parts,
+	}, nil
+}
+
+func decodeAbortMultipartUploadRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	bucket, key, err := objectPath(r)
+	if err != nil {
+		return nil, err
+	}
+	return AbortMultipartUploadRequest{Bucket: bucket, Key: key, UploadID: r.URL.Query().Get("uploadId")}, nil
+}
+
+func encodeAbortMultipartUploadResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if _, ok := response.(AbortMultipartUploadResponse); !ok {
+		return encodeResponse(ctx, w, response)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// hasQuery matches requests with all of the given query parameters, with
+// any value.
+func hasQuery(names ...string) mux.MatcherFunc {
+	return func(r *http.Request, _ *mux.RouteMatch) bool {
+		query := r.URL.Query()
+		for _, name := range names {
+			if !query.Has(name) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// handleMultipart mounts the multipart upload operations. Listing uploads
+// and parts isn't supported. It must be called before handleUnsupported,
+// which rejects the uploads and uploadId sub-resources.
+func handleMultipart(r *mux.Router, svc CloudStorage, middleware func(method string) endpoint.Middleware, options []httptransport.ServerOption) {
+	r.Methods("POST").Path("/{bucket}/{object:.+}").MatcherFunc(hasQuery("uploads")).Handler(httptransport.NewServer(
+		middleware("CreateMultipartUpload")(MakeCreateMultipartUploadEndpoint(svc)),
+		decodeCreateMultipartUploadRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("PUT").Path("/{bucket}/{object:.+}").MatcherFunc(hasQuery("uploadId", "partNumber")).Handler(httptransport.NewServer(
+		middleware("UploadPart")(MakeUploadPartEndpoint(svc)),
+		decodeUploadPartRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/{bucket}/{object:.+}").MatcherFunc(hasQuery("uploadId")).Handler(httptransport.NewServer(
+		middleware("CompleteMultipartUpload")(MakeCompleteMultipartUploadEndpoint(svc)),
+		decodeCompleteMultipartUploadRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("DELETE").Path("/{bucket}/{object:.+}").MatcherFunc(hasQuery("uploadId")).Handler(httptransport.NewServer(
+		middleware("AbortMultipartUpload")(MakeAbortMultipartUploadEndpoint(svc)),
+		decodeAbortMultipartUploadRequest,
+		encodeAbortMultipartUploadResponse,
+		options...,
+	))
+}
+
+// trimETag strips the quotes around an ETag.
+func trimETag(etag string) string {
+	return strings.Trim(etag, `"`)
+}
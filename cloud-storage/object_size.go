@@ -0,0 +1,58 @@
+package cloud_storage
+
+import (
+	"context"
+	"io"
+
+	"github.com/aws/smithy-go"
+	"github.com/go-kit/kit/endpoint"
+)
+
+const entityTooLargeMessage = "Your proposed upload exceeds the maximum allowed object size."
+
+func errEntityTooLarge() error {
+	return &smithy.GenericAPIError{Code: "EntityTooLarge", Message: entityTooLargeMessage}
+}
+
+// sizeLimitedReader fails reads once more than limit bytes were read.
+type sizeLimitedReader struct {
+	io.ReadCloser
+	limit int64
+}
+
+func (r *sizeLimitedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.limit -= int64(n)
+	if r.limit < 0 {
+		return n, errEntityTooLarge()
+	}
+	return n, err
+}
+
+// ObjectSizeMiddleware returns an endpoint middleware rejecting object and
+// part uploads larger than maxBytes with EntityTooLarge. Uploads announcing
+// their size are rejected before being read, others once they exceed it.
+func ObjectSizeMiddleware(maxBytes int64) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			tooLarge := APIErrorResponse{Code: "EntityTooLarge", Message: entityTooLargeMessage}
+			switch req := request.(type) {
+			case PutObjectRequest:
+				if req.ContentLength > maxBytes {
+					req.ObjectBody.Close()
+					return tooLarge, nil
+				}
+				req.ObjectBody = &sizeLimitedReader{ReadCloser: req.ObjectBody, limit: maxBytes}
+				request = req
+			case UploadPartRequest:
+				if req.ContentLength > maxBytes {
+					req.Body.Close()
+					return tooLarge, nil
+				}
+				req.Body = &sizeLimitedReader{ReadCloser: req.Body, limit: maxBytes}
+				request = req
+			}
+			return next(ctx, request)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package cloud_storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// peerRingReplicas is the number of points each peer has on the ring, which
+// spreads keys evenly and moves few of them when peers come and go.
+const peerRingReplicas = 128
+
+// PeerRing assigns cache keys to the replicas of a multi-replica deployment
+// with consistent hashing, so that each object is cached by one replica,
+// its owner, which the others fetch it from. Peers are identified by the
+// host:port address of their admin listener.
+type PeerRing struct {
+	self string
+
+	mu     sync.RWMutex
+	peers  []string
+	hashes []uint64
+	owners map[uint64]string
+}
+
+// NewPeerRing returns an empty ring for the replica reachable at self.
+func NewPeerRing(self string) *PeerRing {
+	return &PeerRing{self: self}
+}
+
+// peerHash hashes ring points and keys. Peer addresses differ in few bytes,
+// which FNV and the like don't spread well.
+func peerHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// SetPeers replaces the peers, which should include self. The ring is
+// rebuilt aside and swapped in, so lookups are never blocked for long, and
+// fetches from a peer which is no longer listed run to completion.
+func (r *PeerRing) SetPeers(peers []string) {
+	peers = append([]string(nil), peers...)
+	sort.Strings(peers)
+	hashes := make([]uint64, 0, len(peers)*peerRingReplicas)
+	owners := make(map[uint64]string, len(peers)*peerRingReplicas)
+	for _, peer := range peers {
+		for i := 0; i < peerRingReplicas; i++ {
+			hash := peerHash(strconv.Itoa(i) + peer)
+			hashes = append(hashes, hash)
+			owners[hash] = peer
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.peers, r.hashes, r.owners = peers, hashes, owners
+}
+
+// Peers returns the current peers.
+func (r *PeerRing) Peers() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]string(nil), r.peers...)
+}
+
+// Owner returns the address of the peer owning key, or "" if this replica
+// owns it or there are no peers.
+func (r *PeerRing) Owner(key string) string {
+	if owner := r.KeyOwner(key); owner != r.self {
+		return owner
+	}
+	return ""
+}
+
+// KeyOwner returns the address of the peer owning key, self included, or ""
+// if there are no peers.
+func (r *PeerRing) KeyOwner(key string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	hash := peerHash(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= hash })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+// PeerDiscoveryConfig configures how peers are found: either a static list
+// of addresses, or a DNS name resolving to the addresses of all replicas,
+// such as a headless Kubernetes service, combined with Port.
+type PeerDiscoveryConfig struct {
+	Static   []string
+	DNSName  string
+	Port     string
+	Interval time.Duration
+}
+
+// PeerDiscovery keeps a PeerRing up to date.
+type PeerDiscovery struct {
+	config   PeerDiscoveryConfig
+	ring     *PeerRing
+	logger   log.Logger
+	resolver *net.Resolver
+}
+
+func NewPeerDiscovery(config PeerDiscoveryConfig, ring *PeerRing, logger log.Logger) *PeerDiscovery {
+	return &PeerDiscovery{config: config, ring: ring, logger: logger, resolver: net.DefaultResolver}
+}
+
+// resolve returns the current peer addresses.
+func (d *PeerDiscovery) resolve(ctx context.Context) ([]string, error) {
+	if d.config.DNSName == "" {
+		return append([]string(nil), d.config.Static...), nil
+	}
+	hosts, err := d.resolver.LookupHost(ctx, d.config.DNSName)
+	if err != nil {
+		return nil, err
+	}
+	peers := make([]string, len(hosts))
+	for i, host := range hosts {
+		peers[i] = net.JoinHostPort(host, d.config.Port)
+	}
+	return peers, nil
+}
+
+// Refresh resolves the peers and updates the ring if they changed. When
+// resolution fails the ring is kept as is.
+func (d *PeerDiscovery) Refresh(ctx context.Context) error {
+	peers, err := d.resolve(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Strings(peers)
+	if strings.Join(peers, ",") != strings.Join(d.ring.Peers(), ",") {
+		d.ring.SetPeers(peers)
+		d.logger.Log("msg", "peers changed", "peers", strings.Join(peers, ","))
+	}
+	return nil
+}
+
+// Run refreshes the peers every Interval until ctx is done.
+func (d *PeerDiscovery) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.config.Interval)
+	defer ticker.Stop()
+	for {
+		if err := d.Refresh(ctx); err != nil {
+			d.logger.Log("msg", "peer discovery failed", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package cloud_storage
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+// unsignedPayload is the payload hash of presigned URLs.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// PresignConfig configures the presigned URLs handed out by Presigner.
+type PresignConfig struct {
+	// URL is the base URL clients reach the S3 API of the proxy at.
+	URL string
+
+	// Credentials sign the URLs, for Region. They are the proxy's own,
+	// so that callers need no AWS credentials.
+	Credentials aws.Credentials
+	Region      string
+
+	// Expires is the validity of URLs requested without one, and
+	// MaxExpires the longest validity which may be requested.
+	Expires    time.Duration
+	MaxExpires time.Duration
+
+	// Token authenticates the callers, who pass it as a bearer token.
+	Token string
+}
+
+// PresignRequest is the body of POST /presign. Expires is a duration, e.g.
+// "15m", the configured default if empty.
+type PresignRequest struct {
+	Bucket  string `json:"bucket"`
+	Key     string `json:"key"`
+	Expires string `json:"expires,omitempty"`
+}
+
+// PresignResponse is the response of POST /presign.
+type PresignResponse struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// Presigner generates presigned download URLs of objects, against the
+// proxy, for internal services to hand out temporary links without
+// holding AWS credentials. The proxy verifies them with SignatureMiddleware,
+// given the credentials in SignatureConfig.Keys, and so enforces their
+// expiry.
+type Presigner struct {
+	config PresignConfig
+	signer *v4.Signer
+	logger log.Logger
+}
+
+func NewPresigner(config PresignConfig, logger log.Logger) *Presigner {
+	return &Presigner{
+		config: config,
+		signer: v4.NewSigner(func(o *v4.SignerOptions) {
+			o.DisableURIPathEscaping = true
+		}),
+		logger: logger,
+	}
+}
+
+// Presign returns a URL downloading the object key of bucket until
+// expires from now.
+func (p *Presigner) Presign(r *http.Request, bucket, key string, expires time.Duration) (PresignResponse, error) {
+	u, err := url.Parse(p.config.URL)
+	if err != nil {
+		return PresignResponse{}, err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + bucket + "/" + key
+	u.RawQuery = url.Values{"X-Amz-Expires": {strconv.FormatInt(int64(expires/time.Second), 10)}}.Encode()
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return PresignResponse{}, err
+	}
+	now := time.Now().UTC()
+	signed, _, err := p.signer.PresignHTTP(r.Context(), p.config.Credentials, req, unsignedPayload, "s3", p.config.Region, now)
+	if err != nil {
+		return PresignResponse{}, err
+	}
+	return PresignResponse{URL: signed, Expires: now.Add(expires)}, nil
+}
+
+// authorized reports whether r carries the bearer token.
+func (p *Presigner) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && p.config.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(p.config.Token)) == 1
+}
+
+// AdminRoutes mounts the endpoint generating presigned URLs, which requires
+// the bearer token of the configuration:
+//
+//	POST /presign {"bucket": "b", "key": "k", "expires": "15m"}
+func (p *Presigner) AdminRoutes(r *mux.Router) {
+	r.Methods("POST").Path("/presign").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !p.authorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req PresignRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Bucket == "" || req.Key == "" {
+			http.Error(w, "bucket and key are required", http.StatusBadRequest)
+			return
+		}
+		expires := p.config.Expires
+		if req.Expires != "" {
+			var err error
+			if expires, err = time.ParseDuration(req.Expires); err != nil || expires < time.Second {
+				http.Error(w, "invalid expires", http.StatusBadRequest)
+				return
+			}
+		}
+		if p.config.MaxExpires > 0 && expires > p.config.MaxExpires {
+			http.Error(w, "expires must be at most "+p.config.MaxExpires.String(), http.StatusBadRequest)
+			return
+		}
+		resp, err := p.Presign(r, req.Bucket, req.Key, expires)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		p.logger.Log("msg", "presigned", "bucket", req.Bucket, "key", req.Key, "expires", resp.Expires, "source", r.RemoteAddr)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+}
@@ -0,0 +1,102 @@
+package cloud_storage
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/rampage644/s3-overlay-proxy/repository"
+)
+
+// PriorityHeader sets the class of a request, see PriorityClass.
+const PriorityHeader = "x-proxy-priority"
+
+// PriorityClass is the class a request is scheduled in: batch requests
+// wait for the upstream request budget behind interactive ones, and their
+// bodies are throttled by the batch bandwidth caps, so that bulk syncs
+// don't degrade interactive reads.
+type PriorityClass string
+
+const (
+	PriorityInteractive PriorityClass = "interactive"
+	PriorityBatch       PriorityClass = "batch"
+)
+
+// priority returns the upstream priority of c.
+func (c PriorityClass) priority() (repository.Priority, bool) {
+	switch c {
+	case PriorityInteractive:
+		return repository.PriorityInteractive, true
+	case PriorityBatch:
+		return repository.PriorityBatch, true
+	}
+	return 0, false
+}
+
+// ValidateTenantPriorities reports the first unknown class.
+func ValidateTenantPriorities(classes map[string]PriorityClass) error {
+	for accessKey, class := range classes {
+		if _, ok := class.priority(); accessKey == "" || !ok {
+			return fmt.Errorf("invalid class %q for %q", class, accessKey)
+		}
+	}
+	return nil
+}
+
+// populatePriority is a ServerBefore function which schedules requests in
+// the class of PriorityHeader. Unknown classes are ignored.
+func populatePriority(ctx context.Context, r *http.Request) context.Context {
+	if priority, ok := PriorityClass(r.Header.Get(PriorityHeader)).priority(); ok {
+		return repository.WithPriority(ctx, priority)
+	}
+	return ctx
+}
+
+// TenantPriorities maps the access keys of tenants to the class their
+// requests are scheduled in.
+type TenantPriorities struct {
+	mu      sync.RWMutex
+	classes map[string]PriorityClass
+}
+
+func NewTenantPriorities(classes map[string]PriorityClass) *TenantPriorities {
+	return &TenantPriorities{classes: classes}
+}
+
+// Set replaces all mappings.
+func (t *TenantPriorities) Set(classes map[string]PriorityClass) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.classes = classes
+}
+
+// Class returns the class of the tenant with accessKey.
+func (t *TenantPriorities) Class(accessKey string) (PriorityClass, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	class, ok := t.classes[accessKey]
+	return class, ok
+}
+
+// TenantPriorityMiddleware returns an endpoint middleware scheduling the
+// requests of tenants with a class in it. A request takes the lowest of
+// the priorities of its tenant and of PriorityHeader, so that batch tenants
+// can't pass as interactive. Tenants are identified by the access key whose
+// signature SignatureMiddleware verified; other requests keep their
+// priority.
+func TenantPriorityMiddleware(tenants *TenantPriorities) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if accessKey, ok := verifiedAccessKey(ctx); ok {
+				if class, ok := tenants.Class(accessKey); ok {
+					if priority, ok := class.priority(); ok && priority > repository.PriorityFromContext(ctx) {
+						ctx = repository.WithPriority(ctx, priority)
+					}
+				}
+			}
+			return next(ctx, request)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package cloud_storage
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+const s3XMLNamespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// probeStubs are canned answers to the bucket configuration calls high-level
+// clients make before the actual operation, keyed by sub-resource. Each is
+// either a successful "not configured" response or the error clients expect
+// when the configuration doesn't exist.
+var probeStubs = map[string]interface{}{
+	"accelerate": struct {
+		XMLName xml.Name `xml:"AccelerateConfiguration"`
+		Xmlns   string   `xml:"xmlns,attr"`
+	}{Xmlns: s3XMLNamespace},
+	"location": struct {
+		XMLName xml.Name `xml:"LocationConstraint"`
+		Xmlns   string   `xml:"xmlns,attr"`
+	}{Xmlns: s3XMLNamespace},
+	"policyStatus": struct {
+		XMLName  xml.Name `xml:"PolicyStatus"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		IsPublic bool
+	}{Xmlns: s3XMLNamespace},
+	"publicAccessBlock": APIErrorResponse{
+		Code:    "NoSuchPublicAccessBlockConfiguration",
+		Message: "The public access block configuration was not found",
+	},
+	"requestPayment": struct {
+		XMLName xml.Name `xml:"RequestPaymentConfiguration"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Payer   string
+	}{Xmlns: s3XMLNamespace, Payer: "BucketOwner"},
+}
+
+// ProbeStubNames returns the sub-resources which have a stub response.
+func ProbeStubNames() []string {
+	names := make([]string, 0, len(probeStubs))
+	for name := range probeStubs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// handleProbeStubs answers GET bucket requests for the given sub-resources
+// with their stub response. Like handleUnsupported, it must be called before
+// the routes the probes would otherwise match.
+func handleProbeStubs(r *mux.Router, names []string) error {
+	for _, name := range names {
+		response, ok := probeStubs[name]
+		if !ok {
+			return fmt.Errorf("no stub response for %q", name)
+		}
+
+		name := name
+		r.Methods("GET").Path("/{bucket:[^/]+}{slash:/?}").MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+			return r.URL.Query().Has(name)
+		}).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encodeResponse(r.Context(), w, response)
+		})
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+// Package cloud_storage implements the S3 overlay proxy: an S3 API server in
+// front of an upstream object store, with an in-memory write-back cache and
+// optional traffic shaping middlewares.
+//
+// NewProxy wires the pieces together; the individual components remain
+// usable on their own for custom setups.
+package cloud_storage
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/dgraph-io/ristretto"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/gorilla/mux"
+
+	"github.com/rampage644/s3-overlay-proxy/repository"
+)
+
+// ProxyOptions configures NewProxy.
+type ProxyOptions struct {
+	// Backend is the upstream object storage. Required.
+	Backend repository.ObjectStorage
+
+	// Logger defaults to discarding logs.
+	Logger log.Logger
+
+	// Cache enables the write-back cache when set.
+	Cache *ristretto.Cache
+
+	// CacheRequests counts cache lookups, labelled by "operation" and
+	// "result"; it defaults to discarding them.
+	CacheRequests metrics.Counter
+
+	// CacheOptions configure the cache, e.g. WithHotKeyTracker.
+	CacheOptions []CacheOption
+
+	// Metadata, when set, answers HEAD requests from persisted metadata,
+	// see MetadataStore. The caller closes it.
+	Metadata *MetadataStore
+
+	// Middlewares wrap every S3 endpoint, see MakeHTTPHandler.
+	Middlewares []endpoint.Middleware
+
+	// Authentication wraps the hooks and the middlewares, so that they see
+	// the requests it verified, see SignatureMiddleware.
+	Authentication endpoint.Middleware
+
+	// Hooks customise request handling, see Hook. They run before the
+	// middlewares, once requests are authenticated, seeing them as sent by
+	// clients.
+	Hooks []Hook
+
+	// ProbeStubs lists the bucket probes answered with a stub response, see
+	// ProbeStubNames.
+	ProbeStubs []string
+
+	// XMLMode selects how XML responses are rendered, XMLModeDefault if
+	// empty.
+	XMLMode XMLMode
+}
+
+// Proxy is an S3 API http.Handler backed by the configured storage.
+type Proxy struct {
+	http.Handler
+
+	// Storage is the service behind the handler, including the cache.
+	Storage CloudStorage
+
+	// Cache is nil unless caching is enabled.
+	Cache *CachedCloudStorage
+
+	metadata *MetadataStore
+}
+
+// NewProxy builds a proxy from options.
+func NewProxy(options ProxyOptions) (*Proxy, error) {
+	if options.Backend == nil {
+		return nil, errors.New("no backend configured")
+	}
+	logger := options.Logger
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	p := &Proxy{metadata: options.Metadata}
+	p.Storage = NewCloudStorage(options.Backend, log.With(logger, "component", "service"))
+	if options.Metadata != nil {
+		p.Storage = NewMetadataStorage(p.Storage, options.Metadata, log.With(logger, "component", "metadata"))
+	}
+	if options.Cache != nil {
+		requests := options.CacheRequests
+		if requests == nil {
+			requests = discard.NewCounter()
+		}
+		p.Cache = NewCachedCloudStorage(p.Storage, log.With(logger, "component", "cache"), options.Cache, requests, options.CacheOptions...)
+		p.Storage = p.Cache
+	}
+
+	middlewares := options.Middlewares
+	if len(options.Hooks) > 0 {
+		middlewares = append([]endpoint.Middleware{HookMiddleware(options.Hooks...)}, middlewares...)
+	}
+	if options.Authentication != nil {
+		middlewares = append([]endpoint.Middleware{options.Authentication}, middlewares...)
+	}
+
+	var err error
+	p.Handler, err = MakeHTTPHandler(p.Storage, log.With(logger, "component", "HTTP"), options.ProbeStubs, options.XMLMode, middlewares...)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// AdminRoutes mounts the admin endpoints of the proxy's components.
+func (p *Proxy) AdminRoutes(r *mux.Router) {
+	if p.Cache != nil {
+		p.Cache.AdminRoutes(r)
+	}
+	if p.Cache != nil || p.metadata != nil {
+		p.InvalidationRoutes(r)
+	}
+}
@@ -0,0 +1,131 @@
+package cloud_storage
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// PublicBucket marks a bucket as serving public assets, so that an ordinary
+// CDN or browser cache can sit in front of the proxy: its GET and HEAD
+// responses carry Cache-Control "public, max-age=MaxAge", MaxAge being in
+// seconds, and requests revalidating an ETag with If-None-Match are
+// answered with 304 Not Modified.
+type PublicBucket struct {
+	MaxAge int64 `json:"maxAge"`
+}
+
+// ValidatePublicBuckets reports the first invalid bucket.
+func ValidatePublicBuckets(buckets map[string]PublicBucket) error {
+	for bucket, public := range buckets {
+		if public.MaxAge < 0 {
+			return fmt.Errorf("bucket %q: maxAge must not be negative", bucket)
+		}
+	}
+	return nil
+}
+
+// PublicCachePolicy holds the public buckets, by the names clients use.
+type PublicCachePolicy struct {
+	mu      sync.RWMutex
+	buckets map[string]PublicBucket
+}
+
+func NewPublicCachePolicy(buckets map[string]PublicBucket) *PublicCachePolicy {
+	return &PublicCachePolicy{buckets: buckets}
+}
+
+// SetBuckets replaces all public buckets.
+func (p *PublicCachePolicy) SetBuckets(buckets map[string]PublicBucket) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.buckets = buckets
+}
+
+func (p *PublicCachePolicy) bucket(name string) (PublicBucket, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	public, ok := p.buckets[name]
+	return public, ok
+}
+
+// NotModifiedResponse answers a conditional GET or HEAD whose ETag matches,
+// without a body.
+type NotModifiedResponse struct {
+	ETag         string
+	CacheControl string
+}
+
+func (r NotModifiedResponse) StatusCode() int { return http.StatusNotModified }
+
+func (r NotModifiedResponse) Headers() http.Header {
+	return http.Header{"ETag": {r.ETag}, "Cache-Control": {r.CacheControl}}
+}
+
+// PublicCacheMiddleware returns an endpoint middleware adding the caching
+// headers of the public buckets of policy to their GET and HEAD responses.
+func PublicCacheMiddleware(policy *PublicCachePolicy) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			var bucket, ifNoneMatch string
+			switch req := request.(type) {
+			case GetObjectRequest:
+				bucket, ifNoneMatch = req.Bucket, req.IfNoneMatch
+			case HeadObjectRequest:
+				bucket, ifNoneMatch = req.Bucket, req.IfNoneMatch
+			default:
+				return next(ctx, request)
+			}
+			public, ok := policy.bucket(bucket)
+			if !ok {
+				return next(ctx, request)
+			}
+
+			response, err := next(ctx, request)
+			if err != nil {
+				return response, err
+			}
+			var etag string
+			switch resp := response.(type) {
+			case GetObjectResponse:
+				if resp.Info.ContentRange != "" {
+					// Ranges are cached by their own rules.
+					return response, nil
+				}
+				etag = resp.Info.ETag
+			case HeadObjectResponse:
+				etag = resp.Metadata["ETag"]
+			default:
+				return response, nil
+			}
+			cacheControl := "public, max-age=" + strconv.FormatInt(public.MaxAge, 10)
+			if etag != "" && etagMatches(ifNoneMatch, etag) {
+				if resp, ok := response.(GetObjectResponse); ok {
+					resp.Body.Close()
+				}
+				return NotModifiedResponse{ETag: etag, CacheControl: cacheControl}, nil
+			}
+			SetResponseHeader(ctx, "Cache-Control", cacheControl)
+			return response, nil
+		}
+	}
+}
+
+// etagMatches reports whether the If-None-Match header condition, a list of
+// ETags or "*", matches etag, comparing them weakly as HTTP does.
+func etagMatches(condition, etag string) bool {
+	if strings.TrimSpace(condition) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(condition, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
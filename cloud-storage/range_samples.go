@@ -0,0 +1,230 @@
+package cloud_storage
+
+import (
+	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+)
+
+// RangeSampleConfig configures RangeSampler.
+type RangeSampleConfig struct {
+	// Rate is the fraction of GET requests sampled, 0 disables sampling.
+	Rate float64
+	// Path is the file samples are appended to as JSON lines, empty to
+	// only record them in the histograms.
+	Path string
+	// MaxSize is the size in bytes beyond which the file is rotated, keeping
+	// MaxFiles previous ones as Path.1, Path.2 and so on.
+	MaxSize  int64
+	MaxFiles int
+	// Salt keys the hashes keys are anonymized with, so that samples of the
+	// same object can be told apart without revealing its name. A random
+	// one is used if empty, so hashes then only match within a process.
+	Salt string
+}
+
+// RangeSample is a sampled GET request. The key is anonymized, its
+// extension kept so that the samples of a format, e.g. Parquet, can be
+// told apart.
+type RangeSample struct {
+	Time      time.Time `json:"ts"`
+	Key       string    `json:"key"`
+	Extension string    `json:"ext,omitempty"`
+	Offset    int64     `json:"offset"`
+	Length    int64     `json:"length"`
+	Size      int64     `json:"size"`
+	// Suffix is set for suffix ranges, e.g. "bytes=-8", which columnar
+	// readers use to read footers.
+	Suffix bool `json:"suffix,omitempty"`
+}
+
+// RangeSampler samples the byte ranges GET requests read, to tune block
+// sizes and prefetching on real access patterns: lengths, and offsets
+// relative to object sizes, are observed in histograms, and samples written
+// to a rotating file if configured.
+type RangeSampler struct {
+	config  RangeSampleConfig
+	lengths metrics.Histogram
+	offsets metrics.Histogram
+	logger  log.Logger
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewRangeSampler returns a sampler observing lengths, in bytes, and
+// offsets, as fractions of object sizes.
+func NewRangeSampler(config RangeSampleConfig, lengths, offsets metrics.Histogram, logger log.Logger) (*RangeSampler, error) {
+	if config.Salt == "" {
+		salt := make([]byte, 32)
+		if _, err := crand.Read(salt); err != nil {
+			return nil, err
+		}
+		config.Salt = string(salt)
+	}
+	s := &RangeSampler{config: config, lengths: lengths, offsets: offsets, logger: logger}
+	if config.Path == "" {
+		return s, nil
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// open opens the file for appending.
+func (s *RangeSampler) open() error {
+	f, err := os.OpenFile(s.config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file, s.size = f, info.Size()
+	return nil
+}
+
+// rotate moves the file to Path.1, and the previous ones one up, dropping
+// the oldest, and opens a new one.
+func (s *RangeSampler) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	for i := s.config.MaxFiles - 1; i >= 1; i-- {
+		_ = os.Rename(s.config.Path+"."+strconv.Itoa(i), s.config.Path+"."+strconv.Itoa(i+1))
+	}
+	if s.config.MaxFiles > 0 {
+		if err := os.Rename(s.config.Path, s.config.Path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(s.config.Path); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+// Close closes the file, if any.
+func (s *RangeSampler) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// anonymize returns the hash of the key of bucket.
+func (s *RangeSampler) anonymize(bucket, key string) string {
+	mac := hmac.New(sha256.New, []byte(s.config.Salt))
+	mac.Write([]byte(bucket + "/" + key))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// record observes sample and writes it to the file.
+func (s *RangeSampler) record(sample RangeSample) {
+	s.lengths.Observe(float64(sample.Length))
+	if sample.Size > 0 {
+		s.offsets.Observe(float64(sample.Offset) / float64(sample.Size))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return
+	}
+	line, err := json.Marshal(sample)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	if s.config.MaxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.config.MaxSize {
+		if err := s.rotate(); err != nil {
+			s.logger.Log("msg", "rotating range samples failed", "path", s.config.Path, "err", err)
+			if s.file == nil {
+				return
+			}
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		s.logger.Log("msg", "writing range sample failed", "path", s.config.Path, "err", err)
+	}
+}
+
+// parseContentRange returns the first byte and the object size of a
+// Content-Range header, e.g. "bytes 0-99/1000".
+func parseContentRange(contentRange string) (int64, int64, error) {
+	spec, ok := strings.CutPrefix(contentRange, "bytes ")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", contentRange)
+	}
+	bounds, size, _ := strings.Cut(spec, "/")
+	first, _, _ := strings.Cut(bounds, "-")
+	offset, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", contentRange)
+	}
+	total, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		// The size may be unknown, "*".
+		total = 0
+	}
+	return offset, total, nil
+}
+
+// RangeSamplingMiddleware returns an endpoint middleware recording a sample
+// of the successful GET requests in sampler, at its rate.
+func RangeSamplingMiddleware(sampler *RangeSampler) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			response, err := next(ctx, request)
+			req, ok := request.(GetObjectRequest)
+			if !ok || err != nil || rand.Float64() >= sampler.config.Rate {
+				return response, err
+			}
+			resp, ok := response.(GetObjectResponse)
+			if !ok {
+				return response, err
+			}
+			sample := RangeSample{
+				Time:      time.Now().UTC(),
+				Key:       sampler.anonymize(req.Bucket, req.Key),
+				Extension: path.Ext(req.Key),
+				Length:    resp.Info.ContentLength,
+				Size:      resp.Info.ContentLength,
+				Suffix:    strings.HasPrefix(req.Range, "bytes=-"),
+			}
+			if resp.Info.ContentRange != "" {
+				offset, size, err := parseContentRange(resp.Info.ContentRange)
+				if err != nil {
+					return response, nil
+				}
+				sample.Offset, sample.Size = offset, size
+			}
+			sampler.record(sample)
+			return response, nil
+		}
+	}
+}
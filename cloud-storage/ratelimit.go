@@ -0,0 +1,131 @@
+package cloud_storage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"golang.org/x/time/rate"
+)
+
+// limiterIdleTimeout is how long a key's bucket is kept after its last use;
+// an idle bucket has refilled completely long before that.
+const limiterIdleTimeout = 10 * time.Minute
+
+type keyedLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// keyedLimiters lazily creates one token bucket per key and forgets the ones
+// which have been idle for a while.
+type keyedLimiters struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	limiters  map[string]*keyedLimiter
+	lastSweep time.Time
+}
+
+func newKeyedLimiters(limit rate.Limit, burst int) *keyedLimiters {
+	return &keyedLimiters{
+		limit:     limit,
+		burst:     burst,
+		limiters:  make(map[string]*keyedLimiter),
+		lastSweep: time.Now(),
+	}
+}
+
+// setLimit changes the limit and burst of existing and future buckets.
+func (l *keyedLimiters) setLimit(limit rate.Limit, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limit, l.burst = limit, burst
+	now := time.Now()
+	for _, c := range l.limiters {
+		c.limiter.SetLimitAt(now, limit)
+		c.limiter.SetBurstAt(now, burst)
+	}
+}
+
+// unlimited reports whether the buckets let everything through.
+func (l *keyedLimiters) unlimited() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit == rate.Inf
+}
+
+func (l *keyedLimiters) get(key string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > limiterIdleTimeout {
+		for k, c := range l.limiters {
+			if now.Sub(c.lastSeen) > limiterIdleTimeout {
+				delete(l.limiters, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	c, ok := l.limiters[key]
+	if !ok {
+		c = &keyedLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[key] = c
+	}
+	c.lastSeen = now
+	return c.limiter
+}
+
+// ClientRateLimiter keeps one token bucket per client (see ClientIdentity.Key).
+type ClientRateLimiter struct {
+	limiters *keyedLimiters
+}
+
+// NewClientRateLimiter returns a limiter allowing each client rps requests
+// per second on average, with bursts of up to burst requests. A zero rps
+// disables the limit.
+func NewClientRateLimiter(rps float64, burst int) *ClientRateLimiter {
+	return &ClientRateLimiter{
+		limiters: newKeyedLimiters(requestRate(rps), burst),
+	}
+}
+
+func requestRate(rps float64) rate.Limit {
+	if rps <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(rps)
+}
+
+// SetLimit changes the rate limit of every client.
+func (l *ClientRateLimiter) SetLimit(rps float64, burst int) {
+	l.limiters.setLimit(requestRate(rps), burst)
+}
+
+// Allow reports whether the client identified by key may proceed now.
+func (l *ClientRateLimiter) Allow(key string) bool {
+	if l.limiters.unlimited() {
+		return true
+	}
+	return l.limiters.get(key).Allow()
+}
+
+// RateLimitingMiddleware returns an endpoint middleware that rejects requests
+// with SlowDown once the calling client exceeds its request rate.
+func RateLimitingMiddleware(limiter *ClientRateLimiter) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if !limiter.Allow(ClientFromContext(ctx).Key()) {
+				return APIErrorResponse{
+					Code:    "SlowDown",
+					Message: "Please reduce your request rate.",
+				}, nil
+			}
+			return next(ctx, request)
+		}
+	}
+}
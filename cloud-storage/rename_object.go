@@ -0,0 +1,82 @@
+package cloud_storage
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// RenameSourceHeader names the object a rename moves, as "bucket/key" or
+// "/bucket/key", URL-encoded as x-amz-copy-source.
+const RenameSourceHeader = "x-amz-rename-source"
+
+// RenameObjectRequest moves the object Key of Bucket to DestinationKey of
+// DestinationBucket. It is a proxy extension, requested with
+// PUT /bucket/key?rename.
+type RenameObjectRequest struct {
+	Bucket            string
+	Key               string
+	DestinationBucket string
+	DestinationKey    string
+}
+
+type RenameObjectResponse struct {
+}
+
+func decodeRenameObjectRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	bucket, key, err := objectPath(r)
+	if err != nil {
+		return nil, err
+	}
+	sourceBucket, sourceKey, err := parseCopySource(r.Header.Get(RenameSourceHeader))
+	if err != nil {
+		return nil, err
+	}
+	return RenameObjectRequest{
+		Bucket:            sourceBucket,
+		Key:               sourceKey,
+		DestinationBucket: bucket,
+		DestinationKey:    key,
+	}, nil
+}
+
+// makeRenameObjectEndpoint renames objects within the proxy, so that
+// clients don't download and upload them again: the object is copied with
+// copyObject, which reads it from the cache if held there and caches the
+// destination, then deleted with deleteObject, which evicts it. The delete
+// waits for a written back destination to reach upstream with waitForWrite,
+// so that the object isn't lost if the upload fails. Renames aren't atomic:
+// readers may see both objects until the delete, and if it fails both are
+// left and its error is returned.
+func makeRenameObjectEndpoint(copyObject, deleteObject endpoint.Endpoint, waitForWrite func(ctx context.Context, bucketName, objectKey, writeID string) error) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(RenameObjectRequest)
+		if req.Bucket == req.DestinationBucket && req.Key == req.DestinationKey {
+			return APIErrorResponse{Code: "InvalidRequest", Message: "The source and destination of a rename must differ."}, nil
+		}
+		response, err := copyObject(ctx, CopyObjectRequest{
+			Bucket:            req.Bucket,
+			Key:               req.Key,
+			DestinationBucket: req.DestinationBucket,
+			DestinationKey:    req.DestinationKey,
+			MetadataDirective: "COPY",
+			TaggingDirective:  "COPY",
+		})
+		if _, ok := response.(CopyObjectResponse); err != nil || !ok {
+			return response, err
+		}
+		var writeID string
+		if header, ok := ctx.Value(responseHeaderContextKey).(http.Header); ok {
+			writeID = header.Get(WriteIDHeader)
+		}
+		if err := waitForWrite(ctx, req.DestinationBucket, req.DestinationKey, writeID); err != nil {
+			return nil, err
+		}
+		response, err = deleteObject(ctx, DeleteObjectRequest{BucketName: req.Bucket, ObjectKey: req.Key})
+		if _, ok := response.(DeleteObjectResponse); err != nil || !ok {
+			return response, err
+		}
+		return RenameObjectResponse{}, nil
+	}
+}
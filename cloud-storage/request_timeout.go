@@ -0,0 +1,27 @@
+package cloud_storage
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rampage644/s3-overlay-proxy/repository"
+)
+
+// RequestTimeoutHeader sets the timeout of the upstream calls of a request
+// in milliseconds, so that latency-sensitive clients can fail fast instead
+// of waiting for the server timeouts. It only shortens them, and is bounded
+// by the maximum of repository.TimeoutConfig.
+const RequestTimeoutHeader = "x-proxy-timeout-ms"
+
+// populateRequestTimeout is a ServerBefore function which passes the timeout
+// requested with RequestTimeoutHeader to the upstream calls. Values which
+// aren't positive integers are ignored.
+func populateRequestTimeout(ctx context.Context, r *http.Request) context.Context {
+	ms, err := strconv.ParseInt(r.Header.Get(RequestTimeoutHeader), 10, 64)
+	if err != nil || ms <= 0 {
+		return ctx
+	}
+	return repository.WithRequestTimeout(ctx, time.Duration(ms)*time.Millisecond)
+}
@@ -0,0 +1,61 @@
+package cloud_storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// requestInfo identifies a request in responses, the way S3 does with its
+// x-amz-request-id and x-amz-id-2 headers.
+type requestInfo struct {
+	ID       string
+	HostID   string
+	Resource string
+}
+
+func newRequestInfo(r *http.Request) requestInfo {
+	var b [40]byte
+	rand.Read(b[:])
+	return requestInfo{
+		ID:       strings.ToUpper(hex.EncodeToString(b[:8])),
+		HostID:   base64.StdEncoding.EncodeToString(b[8:]),
+		Resource: r.URL.EscapedPath(),
+	}
+}
+
+// requestInfoFromContext returns the requestInfo stored by withRequestID.
+func requestInfoFromContext(ctx context.Context) requestInfo {
+	info, _ := ctx.Value(requestInfoContextKey).(requestInfo)
+	return info
+}
+
+// withRequestID assigns every request an ID, returned in the response
+// headers and available to the encoders through the context.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := newRequestInfo(r)
+		w.Header().Set("x-amz-request-id", info.ID)
+		w.Header().Set("x-amz-id-2", info.HostID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestInfoContextKey, info)))
+	})
+}
+
+// withRequestInfo fills the request-identifying fields of an error left
+// empty by the endpoint.
+func (r APIErrorResponse) withRequestInfo(ctx context.Context) APIErrorResponse {
+	info := requestInfoFromContext(ctx)
+	if r.Resource == "" {
+		r.Resource = info.Resource
+	}
+	if r.RequestID == "" {
+		r.RequestID = info.ID
+	}
+	if r.HostID == "" {
+		r.HostID = info.HostID
+	}
+	return r
+}
@@ -0,0 +1,40 @@
+package cloud_storage
+
+import (
+	"context"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// KeyOwnerHeader is the routing hint of object responses: the address of
+// the replica owning the object on the PeerRing. Load balancers or clients
+// routing requests for a key to its owner get the hits of a single cache,
+// without the replicas fetching objects from each other.
+const KeyOwnerHeader = "x-proxy-key-owner"
+
+// RoutingHintMiddleware returns an endpoint middleware setting
+// KeyOwnerHeader on the responses of object requests. Owners are looked up
+// by bucket and key as requested, so that every replica hints alike.
+func RoutingHintMiddleware(ring *PeerRing) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			var bucket, key string
+			switch req := request.(type) {
+			case GetObjectRequest:
+				bucket, key = req.Bucket, req.Key
+			case HeadObjectRequest:
+				bucket, key = req.Bucket, req.Key
+			case PutObjectRequest:
+				bucket, key = req.BucketName, req.ObjectKey
+			case DeleteObjectRequest:
+				bucket, key = req.BucketName, req.ObjectKey
+			}
+			if key != "" {
+				if owner := ring.KeyOwner(bucket + "/" + key); owner != "" {
+					SetResponseHeader(ctx, KeyOwnerHeader, owner)
+				}
+			}
+			return next(ctx, request)
+		}
+	}
+}
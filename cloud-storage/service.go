@@ -0,0 +1,381 @@
+package cloud_storage
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/go-kit/kit/log"
+
+	"github.com/rampage644/s3-overlay-proxy/repository"
+)
+
+// CloudStorage represents an interface for interacting with a cloud-based storage service.
+// Implementations of this interface can provide functionality to manage buckets and objects
+// within the cloud storage system.
+type CloudStorage interface {
+	// ListBuckets lists all buckets associated with the account.
+	// It takes a context.Context as an argument for cancellation and timeout purposes.
+	// It returns a slice of Bucket objects and an error if the operation fails.
+	ListBuckets(ctx context.Context) ([]Bucket, error)
+
+	// CreateBucket creates a new bucket with the specified name.
+	// It takes a context.Context for cancellation and timeout, and the desired bucket name.
+	// It returns an error if the bucket creation fails.
+	CreateBucket(ctx context.Context, bucketName string) error
+
+	// DeleteBucket deletes the bucket with the provided name.
+	// It requires a context.Context for timeout and cancellation.
+	// It returns an error if the bucket deletion operation fails.
+	DeleteBucket(ctx context.Context, bucketName string) error
+
+	// ListObjects lists a page of the objects within the specified bucket.
+	// It takes a context.Context for cancellation and timeout, the target bucket name and the
+	// listing options. It returns the page and an error if the listing operation fails.
+	ListObjects(ctx context.Context, bucketName string, options ListObjectsOptions) (ListObjectsPage, error)
+
+	// PutObject uploads an object to the specified bucket and object key.
+	// It requires a context.Context, the bucket name, and a reader for the object's content.
+	// tagging holds the object's tags as URL query parameters, as in the
+	// x-amz-tagging header, or is empty. headers are stored with the object.
+	// It returns an error if the object upload operation fails.
+	PutObject(ctx context.Context, bucketName, objectKey string, content io.Reader, length int64, md5 string, sha256 string, tagging string, headers UploadHeaders) error
+
+	HeadObject(ctx context.Context, bucketName, objectKey string) (*s3.HeadObjectOutput, error)
+	// GetObject downloads the object with the given bucket and object key.
+	// It takes a context.Context, the bucket name, and object key.
+	// It returns an io.ReadCloser for reading the object content, the metadata of the returned
+	// content and an error if the operation fails.
+	GetObject(ctx context.Context, bucketName, objectKey, contentRange string) (io.ReadCloser, ObjectInfo, error)
+
+	// DeleteObject deletes the object with the specified bucket and object key.
+	// It requires a context.Context, the bucket name, and the object key.
+	// It returns an error if the object deletion operation fails.
+	DeleteObject(ctx context.Context, bucketName, objectKey string) error
+
+	// GetObjectTagging returns the tags of the object with the given bucket and object key.
+	GetObjectTagging(ctx context.Context, bucketName, objectKey string) (map[string]string, error)
+
+	// CreateMultipartUpload starts a multipart upload of the given object, returning its upload ID.
+	// tagging and headers are as for PutObject.
+	CreateMultipartUpload(ctx context.Context, bucketName, objectKey, tagging string, headers UploadHeaders) (string, error)
+
+	// UploadPart uploads a part of a multipart upload, returning the part's ETag.
+	UploadPart(ctx context.Context, bucketName, objectKey, uploadID string, partNumber int32, content io.Reader, length int64, md5 string) (string, error)
+
+	// CompleteMultipartUpload assembles the given parts into the object, returning its ETag.
+	CompleteMultipartUpload(ctx context.Context, bucketName, objectKey, uploadID string, parts []CompletedPart) (string, error)
+
+	// AbortMultipartUpload discards a multipart upload and its parts.
+	AbortMultipartUpload(ctx context.Context, bucketName, objectKey, uploadID string) error
+}
+
+type cloudStorageService struct {
+	os     repository.ObjectStorage
+	logger log.Logger
+}
+
+// ListObjectsOptions selects a page of a bucket listing.
+type ListObjectsOptions struct {
+	Prefix            string
+	Delimiter         string
+	StartAfter        string
+	ContinuationToken string
+
+	// MaxKeys bounds the number of keys in the page, empty if 0; negative
+	// uses the upstream default of 1000.
+	MaxKeys int
+
+	// FetchOwner includes the owner of every object.
+	FetchOwner bool
+}
+
+// ListObjectsPage is a page of a bucket listing. When IsTruncated is set, the
+// next page is listed with NextContinuationToken.
+type ListObjectsPage struct {
+	Objects               []Object
+	CommonPrefixes        []CommonPrefix
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// UploadHeaders are the headers of an upload stored with the object.
+type UploadHeaders struct {
+	ContentType string
+	// Metadata is the user metadata, from the x-amz-meta-* headers, by
+	// lowercase name without the prefix.
+	Metadata map[string]string
+}
+
+// contentType returns the Content-Type of the uploaded object, which S3
+// defaults to binary data.
+func (h UploadHeaders) contentType() string {
+	if h.ContentType == "" {
+		return "application/octet-stream"
+	}
+	return h.ContentType
+}
+
+// ObjectInfo is the metadata of an object body returned by GetObject.
+type ObjectInfo struct {
+	ContentLength int64
+	ContentType   string
+	ETag          string
+	LastModified  time.Time
+
+	// ContentRange is set when the body is a byte range of the object, e.g.
+	// "bytes 0-99/1234".
+	ContentRange string
+
+	// TagCount is the number of tags of the object, when known.
+	TagCount int32
+
+	// ContentEncoding is the Content-Encoding the object was stored with,
+	// e.g. gzip, if any.
+	ContentEncoding string
+}
+
+func (s *cloudStorageService) ListBuckets(ctx context.Context) ([]Bucket, error) {
+	bckts, err := s.os.ListBuckets(ctx, &repository.ListBucketsInput{})
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := make([]Bucket, len(bckts.Buckets))
+	for i, b := range bckts.Buckets {
+		buckets[i] = Bucket{
+			Name:         *b.Name,
+			CreationDate: b.CreationDate.Format(time.RFC3339),
+		}
+	}
+	return buckets, nil
+}
+
+func (s *cloudStorageService) CreateBucket(ctx context.Context, bucketName string) error {
+	_, err := s.os.CreateBucket(ctx, &repository.CreateBucketInput{Bucket: &bucketName})
+	return err
+}
+
+func (s *cloudStorageService) DeleteBucket(ctx context.Context, bucketName string) error {
+	_, err := s.os.DeleteBucket(ctx, &repository.DeleteBucketInput{Bucket: &bucketName})
+	return err
+}
+
+func (s *cloudStorageService) ListObjects(ctx context.Context, bucketName string, options ListObjectsOptions) (ListObjectsPage, error) {
+	input := &repository.ListObjectsInput{
+		Bucket:     &bucketName,
+		Prefix:     &options.Prefix,
+		FetchOwner: options.FetchOwner,
+	}
+	if options.MaxKeys == 0 {
+		// The SDK doesn't send max-keys=0: a page of one key is listed,
+		// for the errors of the bucket, and dropped.
+		input.MaxKeys = 1
+		if _, err := s.os.ListObjects(ctx, input); err != nil {
+			return ListObjectsPage{}, err
+		}
+		return ListObjectsPage{Objects: []Object{}, CommonPrefixes: []CommonPrefix{}}, nil
+	}
+	if options.MaxKeys > 0 {
+		input.MaxKeys = int32(options.MaxKeys)
+	}
+	if options.Delimiter != "" {
+		input.Delimiter = &options.Delimiter
+	}
+	if options.StartAfter != "" {
+		input.StartAfter = &options.StartAfter
+	}
+	if options.ContinuationToken != "" {
+		input.ContinuationToken = &options.ContinuationToken
+	}
+
+	objs, err := s.os.ListObjects(ctx, input)
+	if err != nil {
+		return ListObjectsPage{}, err
+	}
+
+	page := ListObjectsPage{
+		Objects:               make([]Object, len(objs.Contents)),
+		CommonPrefixes:        make([]CommonPrefix, len(objs.CommonPrefixes)),
+		IsTruncated:           objs.IsTruncated,
+		NextContinuationToken: aws.ToString(objs.NextContinuationToken),
+	}
+	for i, obj := range objs.Contents {
+		page.Objects[i] = Object{
+			Key:          *obj.Key,
+			LastModified: obj.LastModified.Format(time.RFC3339),
+			ETag:         aws.ToString(obj.ETag),
+			Size:         obj.Size,
+			StorageClass: string(obj.StorageClass),
+		}
+		if obj.Owner != nil {
+			page.Objects[i].Owner = &Owner{
+				ID:          aws.ToString(obj.Owner.ID),
+				DisplayName: aws.ToString(obj.Owner.DisplayName),
+			}
+		}
+	}
+	for i, p := range objs.CommonPrefixes {
+		page.CommonPrefixes[i] = CommonPrefix{Prefix: aws.ToString(p.Prefix)}
+	}
+	return page, nil
+}
+
+func (s *cloudStorageService) PutObject(ctx context.Context, bucketName, objectKey string, content io.Reader, length int64, md5 string, sha256 string, tagging string, headers UploadHeaders) error {
+	req := &repository.PutObjectInput{
+		Bucket:        &bucketName,
+		Key:           &objectKey,
+		Body:          content,
+		ContentLength: length,
+		ContentMD5:    &md5,
+	}
+	if tagging != "" {
+		req.Tagging = &tagging
+	}
+	if headers.ContentType != "" {
+		req.ContentType = &headers.ContentType
+	}
+	req.Metadata = headers.Metadata
+
+	_, err := s.os.PutObject(ctx, req)
+	s.logger.Log("method", "PutObject", "err", err)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *cloudStorageService) HeadObject(ctx context.Context, bucketName, objectKey string) (*s3.HeadObjectOutput, error) {
+	metadata, err := s.os.HeadObject(ctx, &repository.HeadObjectInput{
+		Bucket: &bucketName,
+		Key:    &objectKey,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
+func (s *cloudStorageService) GetObject(ctx context.Context, bucketName, objectKey, contentRange string) (io.ReadCloser, ObjectInfo, error) {
+	output, err := s.os.GetObject(ctx, &repository.GetObjectInput{
+		Bucket: &bucketName,
+		Key:    &objectKey,
+		Range:  &contentRange,
+	})
+
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	return output.Body, ObjectInfo{
+		ContentLength:   output.ContentLength,
+		ContentType:     aws.ToString(output.ContentType),
+		ETag:            aws.ToString(output.ETag),
+		LastModified:    aws.ToTime(output.LastModified),
+		ContentRange:    aws.ToString(output.ContentRange),
+		TagCount:        output.TagCount,
+		ContentEncoding: aws.ToString(output.ContentEncoding),
+	}, nil
+}
+
+func (s *cloudStorageService) CreateMultipartUpload(ctx context.Context, bucketName, objectKey, tagging string, headers UploadHeaders) (string, error) {
+	req := &repository.CreateMultipartUploadInput{
+		Bucket:   &bucketName,
+		Key:      &objectKey,
+		Metadata: headers.Metadata,
+	}
+	if tagging != "" {
+		req.Tagging = &tagging
+	}
+	if headers.ContentType != "" {
+		req.ContentType = &headers.ContentType
+	}
+	output, err := s.os.CreateMultipartUpload(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(output.UploadId), nil
+}
+
+func (s *cloudStorageService) UploadPart(ctx context.Context, bucketName, objectKey, uploadID string, partNumber int32, content io.Reader, length int64, md5 string) (string, error) {
+	req := &repository.UploadPartInput{
+		Bucket:        &bucketName,
+		Key:           &objectKey,
+		UploadId:      &uploadID,
+		PartNumber:    partNumber,
+		Body:          content,
+		ContentLength: length,
+	}
+	if md5 != "" {
+		req.ContentMD5 = &md5
+	}
+	output, err := s.os.UploadPart(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(output.ETag), nil
+}
+
+func (s *cloudStorageService) CompleteMultipartUpload(ctx context.Context, bucketName, objectKey, uploadID string, parts []CompletedPart) (string, error) {
+	completed := make([]types.CompletedPart, len(parts))
+	for i, part := range parts {
+		completed[i] = types.CompletedPart{PartNumber: part.PartNumber, ETag: aws.String(part.ETag)}
+	}
+	output, err := s.os.CompleteMultipartUpload(ctx, &repository.CompleteMultipartUploadInput{
+		Bucket:          &bucketName,
+		Key:             &objectKey,
+		UploadId:        &uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(output.ETag), nil
+}
+
+func (s *cloudStorageService) AbortMultipartUpload(ctx context.Context, bucketName, objectKey, uploadID string) error {
+	_, err := s.os.AbortMultipartUpload(ctx, &repository.AbortMultipartUploadInput{
+		Bucket:   &bucketName,
+		Key:      &objectKey,
+		UploadId: &uploadID,
+	})
+	return err
+}
+
+func (s *cloudStorageService) GetObjectTagging(ctx context.Context, bucketName, objectKey string) (map[string]string, error) {
+	output, err := s.os.GetObjectTagging(ctx, &repository.GetObjectTaggingInput{
+		Bucket: &bucketName,
+		Key:    &objectKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string, len(output.TagSet))
+	for _, tag := range output.TagSet {
+		tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return tags, nil
+}
+
+func (s *cloudStorageService) DeleteObject(ctx context.Context, bucketName, objectKey string) error {
+	_, err := s.os.DeleteObject(ctx, &repository.DeleteObjectInput{
+		Bucket: &bucketName,
+		Key:    &objectKey,
+	})
+	return err
+}
+
+func NewCloudStorage(os repository.ObjectStorage, logger log.Logger) *cloudStorageService {
+	return &cloudStorageService{
+		os:     os,
+		logger: logger,
+	}
+}
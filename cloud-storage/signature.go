@@ -0,0 +1,329 @@
+package cloud_storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// sigV4Algorithm is the signing algorithm of SigV4 Authorization headers and
+// presigned URLs.
+const sigV4Algorithm = "AWS4-HMAC-SHA256"
+
+// sigV4TimeFormat is the format of X-Amz-Date.
+const sigV4TimeFormat = "20060102T150405Z"
+
+// requestSignature is what a SigV4 signed request claims about when and for
+// whom it was signed. The signature itself is only verified for the access
+// keys of SigningKeys, see SignatureMiddleware.
+type requestSignature struct {
+	Presigned bool
+	// Date is zero if X-Amz-Date, or the Date header, is missing or
+	// invalid.
+	Date time.Time
+	// Expires is X-Amz-Expires of presigned URLs, -1 if invalid.
+	Expires time.Duration
+	Region  string
+	Service string
+
+	// AccessKey and Scope, e.g. 20230101/us-east-1/s3/aws4_request, make
+	// up the credential. Signature is the one the request carries, of
+	// stringToSign.
+	AccessKey    string
+	Scope        string
+	Signature    string
+	stringToSign string
+}
+
+// verify reports whether the request was signed with secretKey.
+func (s requestSignature) verify(secretKey string) bool {
+	if s.stringToSign == "" || s.Signature == "" {
+		return false
+	}
+	key := []byte("AWS4" + secretKey)
+	for _, part := range strings.Split(s.Scope, "/") {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s.stringToSign))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(s.Signature)) == 1
+}
+
+// sigV4Escape URI-encodes s as SigV4 canonical query strings do, every
+// byte but the unreserved characters as %XY.
+func sigV4Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// sigV4StringToSign returns the string a SigV4 signature of r, of the
+// headers signedHeaders and a payload with hash payloadHash, signs. The
+// signature of presigned URLs is left out of the query.
+func sigV4StringToSign(r *http.Request, presigned bool, date, scope, signedHeaders, payloadHash string) string {
+	query, _ := url.ParseQuery(r.URL.RawQuery)
+	var params [][2]string
+	for key, values := range query {
+		if presigned && key == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			params = append(params, [2]string{sigV4Escape(key), sigV4Escape(value)})
+		}
+	}
+	// By name, then by value.
+	slices.SortFunc(params, func(a, b [2]string) int {
+		if c := strings.Compare(a[0], b[0]); c != 0 {
+			return c
+		}
+		return strings.Compare(a[1], b[1])
+	})
+	encoded := make([]string, len(params))
+	for i, param := range params {
+		encoded[i] = param[0] + "=" + param[1]
+	}
+
+	var headers strings.Builder
+	for _, name := range strings.Split(signedHeaders, ";") {
+		values := slices.Clone(r.Header.Values(name))
+		for i, v := range values {
+			values[i] = strings.Join(strings.Fields(v), " ")
+		}
+		value := strings.Join(values, ",")
+		switch {
+		case name == "host":
+			value = r.Host
+		case name == "content-length" && value == "":
+			value = strconv.FormatInt(r.ContentLength, 10)
+		}
+		headers.WriteString(name + ":" + value + "\n")
+	}
+
+	canonical := strings.Join([]string{r.Method, r.URL.EscapedPath(), strings.Join(encoded, "&"), headers.String(), signedHeaders, payloadHash}, "\n")
+	hash := sha256.Sum256([]byte(canonical))
+	return strings.Join([]string{sigV4Algorithm, date, scope, hex.EncodeToString(hash[:])}, "\n")
+}
+
+// signatureFromContext returns the signature stored by
+// populateRequestSignature, if the request is signed with SigV4.
+func signatureFromContext(ctx context.Context) (requestSignature, bool) {
+	signature, ok := ctx.Value(requestSignatureContextKey).(requestSignature)
+	return signature, ok
+}
+
+// populateRequestSignature is a ServerBefore function which stores the SigV4
+// signature of the request, if any, in the context for
+// SignatureMiddleware.
+func populateRequestSignature(ctx context.Context, r *http.Request) context.Context {
+	var signature requestSignature
+	var credential, date, signedHeaders, payloadHash string
+	query := r.URL.Query()
+	if auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), sigV4Algorithm+" "); ok {
+		for _, part := range strings.Split(auth, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			switch key {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signedHeaders = value
+			case "Signature":
+				signature.Signature = value
+			}
+		}
+		payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		date = r.Header.Get("X-Amz-Date")
+		if date == "" {
+			if t, err := http.ParseTime(r.Header.Get("Date")); err == nil {
+				signature.Date = t
+			}
+		}
+	} else if query.Get("X-Amz-Algorithm") == sigV4Algorithm {
+		signature.Presigned = true
+		credential, date = query.Get("X-Amz-Credential"), query.Get("X-Amz-Date")
+		signedHeaders, signature.Signature = query.Get("X-Amz-SignedHeaders"), query.Get("X-Amz-Signature")
+		payloadHash = unsignedPayload
+		signature.Expires = -1
+		if seconds, err := strconv.Atoi(query.Get("X-Amz-Expires")); err == nil && seconds >= 0 {
+			signature.Expires = time.Duration(seconds) * time.Second
+		}
+	} else {
+		return ctx
+	}
+	if t, err := time.Parse(sigV4TimeFormat, date); err == nil {
+		signature.Date = t
+	}
+	// AKID/20230101/us-east-1/s3/aws4_request
+	if scope := strings.Split(credential, "/"); len(scope) == 5 {
+		signature.Region, signature.Service = scope[2], scope[3]
+		signature.AccessKey, signature.Scope, _ = strings.Cut(credential, "/")
+		if !signature.Date.IsZero() && signedHeaders != "" && payloadHash != "" {
+			signature.stringToSign = sigV4StringToSign(r, signature.Presigned, signature.Date.UTC().Format(sigV4TimeFormat), signature.Scope, signedHeaders, payloadHash)
+		}
+	}
+	return context.WithValue(ctx, requestSignatureContextKey, signature)
+}
+
+// SignatureConfig configures the validation of the time and credential scope
+// of SigV4 signed requests.
+type SignatureConfig struct {
+	// MaxSkew is how far the time of signing may be from the proxy's clock,
+	// 0 disabling the check. S3 allows 15 minutes.
+	MaxSkew time.Duration
+
+	// MaxExpires is the longest X-Amz-Expires of presigned URLs, 0
+	// disabling the check. S3 allows a week.
+	MaxExpires time.Duration
+
+	// Regions and Services are the credential scopes requests may be
+	// signed for; any if empty.
+	Regions  []string
+	Services []string
+
+	// Keys holds the secret keys of the credentials whose signatures are
+	// verified, if any.
+	Keys *SigningKeys
+}
+
+// SigningKeys holds secret keys by access key.
+type SigningKeys struct {
+	mu   sync.RWMutex
+	keys map[string]string
+}
+
+func NewSigningKeys(keys map[string]string) *SigningKeys {
+	return &SigningKeys{keys: keys}
+}
+
+// Set replaces all keys.
+func (k *SigningKeys) Set(keys map[string]string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keys
+}
+
+// SecretKey returns the secret key of accessKey.
+func (k *SigningKeys) SecretKey(accessKey string) (string, bool) {
+	if k == nil {
+		return "", false
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	secretKey, ok := k.keys[accessKey]
+	return secretKey, ok
+}
+
+// verifiedAccessKey returns the access key whose signature of the request
+// SignatureMiddleware verified, if any.
+func verifiedAccessKey(ctx context.Context) (string, bool) {
+	accessKey, ok := ctx.Value(verifiedAccessKeyContextKey).(string)
+	return accessKey, ok
+}
+
+// SignatureMiddleware returns an endpoint middleware validating the time and
+// credential scope of SigV4 signed requests as S3 does: requests signed
+// further than MaxSkew from the proxy's clock fail with
+// RequestTimeTooSkewed, presigned URLs once expired with AccessDenied, and
+// requests signed for another region or service with
+// AuthorizationHeaderMalformed, or AuthorizationQueryParametersError for
+// presigned URLs. Requests signed with an access key of Keys fail with
+// SignatureDoesNotMatch unless signed with its secret key; as the proxy
+// streams bodies, their payload hash and the signatures of streamed chunks
+// aren't checked. Other SigV4 requests, and unsigned and SigV2 ones, are let
+// through unverified.
+func SignatureMiddleware(config SignatureConfig) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if signature, ok := signatureFromContext(ctx); ok {
+				if response, failed := config.validate(signature, time.Now()); failed {
+					return response, nil
+				}
+				if secretKey, ok := config.Keys.SecretKey(signature.AccessKey); ok {
+					if !signature.verify(secretKey) {
+						return APIErrorResponse{Code: "SignatureDoesNotMatch", Message: "The request signature we calculated does not match the signature you provided. Check your key and signing method."}, nil
+					}
+					ctx = context.WithValue(ctx, verifiedAccessKeyContextKey, signature.AccessKey)
+				}
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// validate returns the error response for signature at now, if it is
+// invalid.
+func (c SignatureConfig) validate(signature requestSignature, now time.Time) (APIErrorResponse, bool) {
+	malformed := func(message string) (APIErrorResponse, bool) {
+		if signature.Presigned {
+			return APIErrorResponse{Code: "AuthorizationQueryParametersError", Message: message}, true
+		}
+		return APIErrorResponse{Code: "AuthorizationHeaderMalformed", Message: "The authorization header is malformed; " + message}, true
+	}
+	if len(c.Regions) > 0 && !slices.Contains(c.Regions, signature.Region) {
+		response, _ := malformed(fmt.Sprintf("the region '%s' is wrong; expecting '%s'", signature.Region, c.Regions[0]))
+		response.Region = c.Regions[0]
+		return response, true
+	}
+	if len(c.Services) > 0 && !slices.Contains(c.Services, signature.Service) {
+		return malformed(fmt.Sprintf("incorrect service '%s'. This endpoint belongs to '%s'.", signature.Service, c.Services[0]))
+	}
+	if signature.Date.IsZero() {
+		if signature.Presigned {
+			return malformed("X-Amz-Date must be in the ISO8601 Long Format \"yyyyMMdd'T'HHmmss'Z'\"")
+		}
+		return APIErrorResponse{Code: "AccessDenied", Message: "AWS authentication requires a valid Date or x-amz-date header"}, true
+	}
+
+	serverTime := now.UTC().Format(time.RFC3339)
+	if signature.Presigned {
+		if signature.Expires < 0 {
+			return malformed("X-Amz-Expires should be a number")
+		}
+		if c.MaxExpires > 0 && signature.Expires > c.MaxExpires {
+			return malformed(fmt.Sprintf("X-Amz-Expires must be less than %d seconds", int64(c.MaxExpires/time.Second)))
+		}
+		if expires := signature.Date.Add(signature.Expires); now.After(expires.Add(c.MaxSkew)) {
+			return APIErrorResponse{
+				Code:       "AccessDenied",
+				Message:    "Request has expired",
+				Expires:    expires.UTC().Format(time.RFC3339),
+				ServerTime: serverTime,
+			}, true
+		}
+		if c.MaxSkew > 0 && signature.Date.Sub(now) > c.MaxSkew {
+			return APIErrorResponse{Code: "AccessDenied", Message: "Request is not valid yet", ServerTime: serverTime}, true
+		}
+		return APIErrorResponse{}, false
+	}
+	if skew := now.Sub(signature.Date); c.MaxSkew > 0 && (skew > c.MaxSkew || skew < -c.MaxSkew) {
+		return APIErrorResponse{
+			Code:                       "RequestTimeTooSkewed",
+			Message:                    "The difference between the request time and the current time is too large.",
+			RequestTime:                signature.Date.UTC().Format(sigV4TimeFormat),
+			ServerTime:                 serverTime,
+			MaxAllowedSkewMilliseconds: c.MaxSkew.Milliseconds(),
+		}, true
+	}
+	return APIErrorResponse{}, false
+}
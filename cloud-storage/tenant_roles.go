@@ -0,0 +1,98 @@
+package cloud_storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/rampage644/s3-overlay-proxy/repository"
+)
+
+// maxRoleSessionName is the longest role session name STS accepts.
+const maxRoleSessionName = 64
+
+// TenantRoles maps the access keys of tenants to the upstream IAM roles
+// their requests are made as.
+type TenantRoles struct {
+	mu    sync.RWMutex
+	roles map[string]string
+}
+
+func NewTenantRoles(roles map[string]string) *TenantRoles {
+	return &TenantRoles{roles: roles}
+}
+
+// Set replaces all mappings.
+func (t *TenantRoles) Set(roles map[string]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.roles = roles
+}
+
+// Role returns the role of the tenant with accessKey.
+func (t *TenantRoles) Role(accessKey string) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	role, ok := t.roles[accessKey]
+	return role, ok
+}
+
+// ValidateTenantRoles reports the first invalid tenant role, including
+// those of tenants without a secret key in secrets: their signatures
+// couldn't be verified, so that anyone could claim their role.
+func ValidateTenantRoles(roles, secrets map[string]string) error {
+	for accessKey, role := range roles {
+		if accessKey == "" || !strings.HasPrefix(role, "arn:") {
+			return fmt.Errorf("invalid role %q for %q", role, accessKey)
+		}
+		if secrets[accessKey] == "" {
+			return fmt.Errorf("no secret key for %q to verify its signatures with", accessKey)
+		}
+	}
+	return nil
+}
+
+// roleSessionName returns the session name identifying the tenant with
+// accessKey, restricted to the characters STS allows.
+func roleSessionName(accessKey string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune("_+=,.@-", r):
+			return r
+		}
+		return '-'
+	}, "s3proxy-"+accessKey)
+	if len(name) > maxRoleSessionName {
+		name = name[:maxRoleSessionName]
+	}
+	return name
+}
+
+// TenantRoleMiddleware returns an endpoint middleware making the upstream
+// requests of tenants with a role as that role, through a
+// repository.AssumedRoleStorage. The access key is taken from the request
+// signature, which must have been verified by SignatureMiddleware, with the
+// tenant's secret key in SignatureConfig.Keys; other requests claiming it,
+// such as SigV2 ones, are denied with AccessDenied. Write-back uploads
+// happen after the request and use the proxy's own credentials.
+func TenantRoleMiddleware(roles *TenantRoles) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			client := ClientFromContext(ctx)
+			if client.AccessKey != "" {
+				if role, ok := roles.Role(client.AccessKey); ok {
+					if verified, _ := verifiedAccessKey(ctx); verified != client.AccessKey {
+						return APIErrorResponse{Code: "AccessDenied", Message: "Requests of tenants must be signed with AWS Signature Version 4"}, nil
+					}
+					ctx = repository.WithAssumedRole(ctx, repository.AssumedRole{
+						RoleARN:     role,
+						SessionName: roleSessionName(client.AccessKey),
+					})
+				}
+			}
+			return next(ctx, request)
+		}
+	}
+}
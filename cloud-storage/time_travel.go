@@ -0,0 +1,150 @@
+package cloud_storage
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/smithy-go"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/rampage644/s3-overlay-proxy/repository"
+)
+
+// AsOfQuery and AsOfHeader request the version of an object which was
+// current at a point in time, as RFC 3339 or Unix seconds, so that reads of
+// changing datasets are reproducible. See TimeTravelMiddleware.
+const (
+	AsOfQuery  = "proxy-as-of"
+	AsOfHeader = "x-proxy-as-of"
+)
+
+// maxVersionPages bounds the listings of the versions of a key.
+const maxVersionPages = 100
+
+// populateAsOf is a ServerBefore function which passes the point in time
+// requested with AsOfQuery or AsOfHeader on to TimeTravelMiddleware.
+func populateAsOf(ctx context.Context, r *http.Request) context.Context {
+	asOf := r.URL.Query().Get(AsOfQuery)
+	if asOf == "" {
+		asOf = r.Header.Get(AsOfHeader)
+	}
+	if asOf == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, asOfContextKey, asOf)
+}
+
+// parseAsOf parses a point in time, as RFC 3339 or Unix seconds.
+func parseAsOf(asOf string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(asOf, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, asOf)
+	if err != nil {
+		return time.Time{}, &smithy.GenericAPIError{Code: "InvalidArgument", Message: "Invalid " + AsOfQuery + ", expected RFC 3339 or Unix seconds: " + asOf}
+	}
+	return t, nil
+}
+
+// versionAsOf returns the ID of the version of key which was current at
+// asOf, the latest one created until then, failing with NoSuchKey if there
+// was none or it was a delete marker.
+func versionAsOf(ctx context.Context, storage repository.ObjectStorage, bucket, key string, asOf time.Time) (string, error) {
+	var versionID string
+	var current time.Time
+	var deleted bool
+	consider := func(k, id *string, modified *time.Time, marker bool) {
+		t := aws.ToTime(modified)
+		if aws.ToString(k) != key || t.After(asOf) || (versionID != "" && !t.After(current)) {
+			return
+		}
+		versionID, current, deleted = aws.ToString(id), t, marker
+	}
+
+	input := &repository.ListObjectVersionsInput{Bucket: &bucket, Prefix: &key}
+	for page := 0; page < maxVersionPages; page++ {
+		output, err := storage.ListObjectVersions(ctx, input)
+		if err != nil {
+			return "", err
+		}
+		past := false
+		for _, version := range output.Versions {
+			consider(version.Key, version.VersionId, version.LastModified, false)
+			past = past || aws.ToString(version.Key) > key
+		}
+		for _, marker := range output.DeleteMarkers {
+			consider(marker.Key, marker.VersionId, marker.LastModified, true)
+			past = past || aws.ToString(marker.Key) > key
+		}
+		// Keys are listed in order, the ones the key prefixes last.
+		if past || !output.IsTruncated {
+			break
+		}
+		input.KeyMarker, input.VersionIdMarker = output.NextKeyMarker, output.NextVersionIdMarker
+	}
+	if versionID == "" || deleted {
+		return "", repository.ErrNoSuchKey.WithMessage("The specified key did not exist at " + asOf.UTC().Format(time.RFC3339) + ".")
+	}
+	return versionID, nil
+}
+
+// TimeTravelMiddleware returns an endpoint middleware serving GET and HEAD
+// requests with AsOfQuery or AsOfHeader from the version of the object
+// current at that time, as resolved with ListObjectVersions on versioned
+// upstream buckets. Versions are read from storage, bypassing the cache,
+// and their ID is sent in x-amz-version-id. Other requests ignore them.
+func TimeTravelMiddleware(storage repository.ObjectStorage) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			raw, ok := ctx.Value(asOfContextKey).(string)
+			if !ok {
+				return next(ctx, request)
+			}
+			var bucket, key string
+			switch req := request.(type) {
+			case GetObjectRequest:
+				bucket, key = req.Bucket, req.Key
+			case HeadObjectRequest:
+				bucket, key = req.Bucket, req.Key
+			default:
+				return next(ctx, request)
+			}
+			asOf, err := parseAsOf(raw)
+			if err != nil {
+				return apiErrorResponse(err), nil
+			}
+			versionID, err := versionAsOf(ctx, storage, bucket, key, asOf)
+			if err != nil {
+				return apiErrorResponse(err), nil
+			}
+			SetResponseHeader(ctx, "x-amz-version-id", versionID)
+
+			if _, ok := request.(HeadObjectRequest); ok {
+				output, err := storage.HeadObject(ctx, &repository.HeadObjectInput{Bucket: &bucket, Key: &key, VersionId: &versionID})
+				if err != nil {
+					return apiErrorResponse(err), nil
+				}
+				return HeadObjectResponse{headObjectHeaders(output)}, nil
+			}
+			input := &repository.GetObjectInput{Bucket: &bucket, Key: &key, VersionId: &versionID}
+			if r := request.(GetObjectRequest).Range; r != "" {
+				input.Range = &r
+			}
+			output, err := storage.GetObject(ctx, input)
+			if err != nil {
+				return apiErrorResponse(err), nil
+			}
+			return GetObjectResponse{Body: output.Body, Info: ObjectInfo{
+				ContentLength:   output.ContentLength,
+				ContentType:     aws.ToString(output.ContentType),
+				ETag:            aws.ToString(output.ETag),
+				LastModified:    aws.ToTime(output.LastModified),
+				ContentRange:    aws.ToString(output.ContentRange),
+				TagCount:        output.TagCount,
+				ContentEncoding: aws.ToString(output.ContentEncoding),
+			}}, nil
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package cloud_storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // decoder for thumbnails
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dgraph-io/ristretto"
+	"github.com/go-kit/kit/endpoint"
+)
+
+// TransformQueryParameter is the GET query parameter clients use to request
+// transformations, e.g. ?x-proxy-transform=thumbnail:128.
+const TransformQueryParameter = "x-proxy-transform"
+
+// Transformer rewrites the body of an object served by GET. It returns the
+// new body and updates info to describe it; ContentLength and ETag are
+// computed by the caller.
+type Transformer interface {
+	Transform(body io.Reader, info *ObjectInfo) (io.Reader, error)
+}
+
+// TransformerFunc adapts a function to the Transformer interface.
+type TransformerFunc func(body io.Reader, info *ObjectInfo) (io.Reader, error)
+
+func (f TransformerFunc) Transform(body io.Reader, info *ObjectInfo) (io.Reader, error) {
+	return f(body, info)
+}
+
+// TransformerFactory makes a transformer from its argument, the part of its
+// spec after the colon, e.g. "128" in "thumbnail:128".
+type TransformerFactory func(arg string) (Transformer, error)
+
+var (
+	transformersMu sync.RWMutex
+	transformers   = map[string]TransformerFactory{
+		"gunzip":    newGunzipTransformer,
+		"csv2json":  newCSVToJSONTransformer,
+		"thumbnail": newThumbnailTransformer,
+	}
+)
+
+// RegisterTransformer makes a transformer available to transform rules
+// under name.
+func RegisterTransformer(name string, factory TransformerFactory) {
+	transformersMu.Lock()
+	defer transformersMu.Unlock()
+	transformers[name] = factory
+}
+
+// TransformerNames returns the names of the available transformers.
+func TransformerNames() []string {
+	transformersMu.RLock()
+	defer transformersMu.RUnlock()
+	names := make([]string, 0, len(transformers))
+	for name := range transformers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseTransformChain makes the transformers of a chain of "name[:arg]"
+// specs.
+func parseTransformChain(specs []string) ([]Transformer, error) {
+	transformersMu.RLock()
+	defer transformersMu.RUnlock()
+	chain := make([]Transformer, len(specs))
+	for i, spec := range specs {
+		name, arg, _ := strings.Cut(spec, ":")
+		factory, ok := transformers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown transformer %q", name)
+		}
+		var err error
+		if chain[i], err = factory(arg); err != nil {
+			return nil, fmt.Errorf("transformer %q: %w", spec, err)
+		}
+	}
+	return chain, nil
+}
+
+// TransformRule configures the transformations of objects in Bucket whose
+// keys start with Prefix. Chain is applied to every GET, e.g.
+// ["gunzip", "csv2json"]; Query lists the transformers clients may append
+// with TransformQueryParameter, e.g. ["thumbnail"].
+type TransformRule struct {
+	Bucket string   `json:"bucket"`
+	Prefix string   `json:"prefix,omitempty"`
+	Chain  []string `json:"chain,omitempty"`
+	Query  []string `json:"query,omitempty"`
+}
+
+// ValidateTransformRules reports the first rule with an invalid chain.
+func ValidateTransformRules(rules []TransformRule) error {
+	for _, rule := range rules {
+		if rule.Bucket == "" {
+			return fmt.Errorf("transform rule without bucket")
+		}
+		if _, err := parseTransformChain(rule.Chain); err != nil {
+			return fmt.Errorf("bucket %s prefix %q: %w", rule.Bucket, rule.Prefix, err)
+		}
+		for _, name := range rule.Query {
+			transformersMu.RLock()
+			_, ok := transformers[name]
+			transformersMu.RUnlock()
+			if !ok {
+				return fmt.Errorf("bucket %s prefix %q: unknown transformer %q", rule.Bucket, rule.Prefix, name)
+			}
+		}
+	}
+	return nil
+}
+
+// TransformPolicy holds the transform rules.
+type TransformPolicy struct {
+	mu    sync.RWMutex
+	rules []TransformRule
+}
+
+func NewTransformPolicy(rules []TransformRule) *TransformPolicy {
+	return &TransformPolicy{rules: rules}
+}
+
+// SetRules replaces the transform rules.
+func (p *TransformPolicy) SetRules(rules []TransformRule) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rules = rules
+}
+
+// chain returns the transformer specs to apply to a GET of bucket/key
+// given the client's query, using the rule with the longest matching
+// prefix.
+func (p *TransformPolicy) chain(bucket, key, query string) ([]string, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var rule *TransformRule
+	for i, r := range p.rules {
+		if r.Bucket == bucket && strings.HasPrefix(key, r.Prefix) && (rule == nil || len(r.Prefix) > len(rule.Prefix)) {
+			rule = &p.rules[i]
+		}
+	}
+
+	var chain []string
+	if rule != nil {
+		chain = append(chain, rule.Chain...)
+	}
+	if query == "" {
+		return chain, nil
+	}
+	for _, spec := range strings.Split(query, ",") {
+		name, _, _ := strings.Cut(spec, ":")
+		allowed := false
+		if rule != nil {
+			for _, q := range rule.Query {
+				allowed = allowed || q == name
+			}
+		}
+		if !allowed {
+			return nil, fmt.Errorf("transformer %q is not enabled for this object", name)
+		}
+		chain = append(chain, spec)
+	}
+	return chain, nil
+}
+
+// TransformMiddleware returns an endpoint middleware applying the
+// transformations configured in policy to GET responses. Transformed
+// variants are kept in cache, if not nil, under keys derived from the
+// object's ETag, so that they're never served for a newer version. Range
+// requests for transformed objects are rejected, and so are transformations
+// whose output, or that of any step in their chain, exceeds maxSize bytes
+// (0 disables the limit).
+func TransformMiddleware(policy *TransformPolicy, cache *ristretto.Cache, maxSize int64) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			req, ok := request.(GetObjectRequest)
+			if !ok {
+				return next(ctx, request)
+			}
+			specs, err := policy.chain(req.Bucket, req.Key, req.Transform)
+			if err != nil {
+				return APIErrorResponse{Code: "InvalidArgument", Message: err.Error()}, nil
+			}
+			if len(specs) == 0 {
+				return next(ctx, request)
+			}
+			if req.Range != "" {
+				return APIErrorResponse{Code: "InvalidRequest", Message: "Range requests are not supported for transformed objects."}, nil
+			}
+			chain, err := parseTransformChain(specs)
+			if err != nil {
+				return APIErrorResponse{Code: "InvalidArgument", Message: err.Error()}, nil
+			}
+
+			response, err := next(ctx, request)
+			resp, ok := response.(GetObjectResponse)
+			if err != nil || !ok {
+				return response, err
+			}
+			defer resp.Body.Close()
+
+			var cacheKey string
+			if cache != nil && resp.Info.ETag != "" {
+				cacheKey = fmt.Sprintf("variant/%s/%s/%s?%s", resp.Info.ETag, req.Bucket, req.Key, strings.Join(specs, ","))
+				if value, ok := cache.Get(cacheKey); ok {
+					entry := value.(*cacheEntry)
+					resp.Body, resp.Info = io.NopCloser(bytes.NewReader(entry.body)), entry.info
+					return resp, nil
+				}
+			}
+
+			info := resp.Info
+			var body io.Reader = resp.Body
+			for _, t := range chain {
+				if body, err = t.Transform(body, &info); err != nil {
+					return APIErrorResponse{Code: "InvalidObjectState", Message: "Transforming object: " + err.Error()}, nil
+				}
+				if maxSize > 0 {
+					body = &transformLimitReader{r: body, n: maxSize}
+				}
+			}
+			data, err := io.ReadAll(body)
+			if errors.Is(err, errTransformTooLarge) {
+				return APIErrorResponse{Code: "EntityTooLarge", Message: fmt.Sprintf("Transformed object exceeds the maximum of %d bytes.", maxSize)}, nil
+			}
+			if err != nil {
+				return APIErrorResponse{Code: "InvalidObjectState", Message: "Transforming object: " + err.Error()}, nil
+			}
+			sum := md5.Sum(data)
+			info.ETag = `"` + hex.EncodeToString(sum[:]) + `"`
+			info.ContentLength = int64(len(data))
+
+			if cacheKey != "" {
+				_ = cache.Set(cacheKey, &cacheEntry{info: info, body: data}, 1)
+			}
+			resp.Body, resp.Info = io.NopCloser(bytes.NewReader(data)), info
+			return resp, nil
+		}
+	}
+}
+
+// errTransformTooLarge is returned by reads past the size limit of
+// transformed objects.
+var errTransformTooLarge = errors.New("transformed object too large")
+
+// transformLimitReader fails reads of r once more than n bytes were read, so
+// that transformations like gunzip can't expand objects without bound.
+type transformLimitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *transformLimitReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	if l.n -= int64(n); l.n < 0 {
+		return n, errTransformTooLarge
+	}
+	return n, err
+}
+
+// newGunzipTransformer decompresses gzipped objects. The output is streamed,
+// so that TransformMiddleware bounds it.
+func newGunzipTransformer(string) (Transformer, error) {
+	return TransformerFunc(func(body io.Reader, info *ObjectInfo) (io.Reader, error) {
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		br := bufio.NewReader(zr)
+		head, err := br.Peek(512)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		info.ContentType = http.DetectContentType(head)
+		return br, nil
+	}), nil
+}
+
+// newCSVToJSONTransformer converts CSV with a header row into a JSON array
+// of objects keyed by the header fields.
+func newCSVToJSONTransformer(string) (Transformer, error) {
+	return TransformerFunc(func(body io.Reader, info *ObjectInfo) (io.Reader, error) {
+		records, err := csv.NewReader(body).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		rows := make([]map[string]string, 0, len(records))
+		if len(records) > 0 {
+			header := records[0]
+			for _, record := range records[1:] {
+				row := make(map[string]string, len(header))
+				for i, field := range record {
+					if i < len(header) {
+						row[header[i]] = field
+					}
+				}
+				rows = append(rows, row)
+			}
+		}
+		data, err := json.Marshal(rows)
+		if err != nil {
+			return nil, err
+		}
+		info.ContentType = "application/json"
+		return bytes.NewReader(data), nil
+	}), nil
+}
+
+// maxThumbnailSize bounds the size clients may ask thumbnails of.
+const maxThumbnailSize = 2048
+
+// maxThumbnailSourcePixels bounds the dimensions of the images thumbnails
+// are made of, as decoding allocates whatever the image header declares.
+const maxThumbnailSourcePixels = 32 << 20
+
+// newThumbnailTransformer scales PNG, JPEG and GIF images down to fit in a
+// square of arg pixels, 128 if unset. GIFs are converted to PNG.
+func newThumbnailTransformer(arg string) (Transformer, error) {
+	size := 128
+	if arg != "" {
+		var err error
+		if size, err = strconv.Atoi(arg); err != nil || size <= 0 || size > maxThumbnailSize {
+			return nil, fmt.Errorf("size must be between 1 and %d", maxThumbnailSize)
+		}
+	}
+	return TransformerFunc(func(body io.Reader, info *ObjectInfo) (io.Reader, error) {
+		var header bytes.Buffer
+		config, _, err := image.DecodeConfig(io.TeeReader(body, &header))
+		if err != nil {
+			return nil, err
+		}
+		if int64(config.Width)*int64(config.Height) > maxThumbnailSourcePixels {
+			return nil, fmt.Errorf("image of %dx%d pixels exceeds the maximum of %d pixels", config.Width, config.Height, maxThumbnailSourcePixels)
+		}
+		img, format, err := image.Decode(io.MultiReader(&header, body))
+		if err != nil {
+			return nil, err
+		}
+		thumbnail := scaleDown(img, size)
+
+		var buf bytes.Buffer
+		switch format {
+		case "jpeg":
+			err = jpeg.Encode(&buf, thumbnail, nil)
+			info.ContentType = "image/jpeg"
+		default:
+			err = png.Encode(&buf, thumbnail)
+			info.ContentType = "image/png"
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &buf, nil
+	}), nil
+}
+
+// scaleDown resizes img to fit in a size x size square by averaging the
+// source pixels covered by each destination pixel. Smaller images are
+// returned as is.
+func scaleDown(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	dw, dh := size, h*size/w
+	if h > w {
+		dw, dh = w*size/h, size
+	}
+	dw, dh = max(dw, 1), max(dh, 1)
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := b.Min.Y+y*h/dh, b.Min.Y+max((y+1)*h/dh, y*h/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := b.Min.X+x*w/dw, b.Min.X+max((x+1)*w/dw, x*w/dw+1)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(bl / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,518 @@
+package cloud_storage
+
+// The profilesvc is just over HTTP, so we just have a single transport.go.
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/smithy-go"
+	"github.com/gorilla/mux"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/transport"
+	httptransport "github.com/go-kit/kit/transport/http"
+)
+
+var (
+	// ErrBadRouting is returned when an expected path variable is missing.
+	// It always indicates programmer error.
+	ErrBadRouting = errors.New("inconsistent mapping between route and handler (programmer error)")
+)
+
+// MakeHTTPHandler mounts all of the service endpoints into an http.Handler.
+// Useful in a profilesvc server. Bucket probes for the sub-resources in
+// probeStubs get a canned response (see ProbeStubNames). The given
+// middlewares wrap every endpoint, inside of the logging middleware. XML
+// responses are rendered in xmlMode.
+func MakeHTTPHandler(s CloudStorage, logger log.Logger, probeStubs []string, xmlMode XMLMode, middlewares ...endpoint.Middleware) (http.Handler, error) {
+	// Match on the escaped path without cleaning it, so that keys with
+	// encoded or repeated slashes and dot segments reach the decoders intact.
+	r := mux.NewRouter().SkipClean(true).UseEncodedPath()
+	options := []httptransport.ServerOption{
+		httptransport.ServerErrorHandler(transport.NewLogErrorHandler(logger)),
+		httptransport.ServerErrorEncoder(encodeError),
+		httptransport.ServerBefore(populateClientIdentity, populateRequestSignature, populateRequestTimeout, populatePriority, populateAsOf, withResponseHeader),
+		httptransport.ServerAfter(writeResponseHeader),
+	}
+
+	middleware := func(method string) endpoint.Middleware {
+		return endpoint.Chain(LoggingMiddleware(log.With(logger, "method", method)), middlewares...)
+	}
+
+	var (
+		getObjectEndpoint    endpoint.Endpoint
+		headObjectEndpoint   endpoint.Endpoint
+		putObjectEndpoint    endpoint.Endpoint
+		listObjectsEndpoint  endpoint.Endpoint
+		listBucketsEndpoint  endpoint.Endpoint
+		deleteObjectEndpoint endpoint.Endpoint
+	)
+	{
+		getObjectEndpoint = MakeGetObjectEndpoint(s)
+		getObjectEndpoint = middleware("GetObject")(getObjectEndpoint)
+
+		headObjectEndpoint = MakeHeadObjectEndpoint(s)
+		headObjectEndpoint = middleware("HeadObject")(headObjectEndpoint)
+
+		putObjectEndpoint = MakePutObjectEndpoint(s)
+		putObjectEndpoint = middleware("PutObject")(putObjectEndpoint)
+
+		listObjectsEndpoint = MakeListObjectsEndpoint(s)
+		listObjectsEndpoint = middleware("ListObjects")(listObjectsEndpoint)
+
+		listBucketsEndpoint = MakeListBucketsEndpoint(s)
+		listBucketsEndpoint = middleware("ListBuckets")(listBucketsEndpoint)
+		listBucketsEndpoint = paginateBuckets(listBucketsEndpoint)
+
+		deleteObjectEndpoint = MakeDeleteObjectEndpoint(s)
+		deleteObjectEndpoint = middleware("DeleteObject")(deleteObjectEndpoint)
+	}
+
+	if err := handleProbeStubs(r, probeStubs); err != nil {
+		return nil, err
+	}
+	handleMultipart(r, s, middleware, options)
+	handleCreateSession(r, middleware, options)
+	handleUnsupported(r)
+	r.Methods("GET").Path("/{bucket}/{object:.+}").Handler(httptransport.NewServer(
+		getObjectEndpoint,
+		decodeGetObjectRequest,
+		encodeGetObjectResponse,
+		options...,
+	))
+	r.Methods("DELETE").Path("/{bucket}/{object:.+}").Handler(httptransport.NewServer(
+		deleteObjectEndpoint,
+		decodeDeleteObjectRequest,
+		encodeDeleteObjectResponse,
+		options...,
+	))
+	r.Methods("HEAD").Path("/{bucket}/{object:.+}").Handler(httptransport.NewServer(
+		headObjectEndpoint,
+		decodeHeadObjectRequest,
+		encodeHeadResponse,
+		options...,
+	))
+	// Copies and renames are made of the endpoints above, so that the
+	// middlewares apply to every read and write they make.
+	waitForWrite := func(context.Context, string, string, string) error { return nil }
+	if cache, ok := s.(*CachedCloudStorage); ok {
+		waitForWrite = cache.waitForWrite
+	}
+	copyObjectEndpoint := LoggingMiddleware(log.With(logger, "method", "CopyObject"))(makeCopyObjectEndpoint(headObjectEndpoint, getObjectEndpoint, putObjectEndpoint))
+	r.Methods("PUT").Path("/{bucket}/{object:.+}").MatcherFunc(hasQuery("rename")).Handler(httptransport.NewServer(
+		LoggingMiddleware(log.With(logger, "method", "RenameObject"))(makeRenameObjectEndpoint(copyObjectEndpoint, deleteObjectEndpoint, waitForWrite)),
+		decodeRenameObjectRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("PUT").Path("/{bucket}/{object:.+}").Headers("x-amz-copy-source", "").Handler(httptransport.NewServer(
+		copyObjectEndpoint,
+		decodeCopyObjectRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("PUT").Path("/{bucket}/{object:.+}").Handler(httptransport.NewServer(
+		putObjectEndpoint,
+		decodePutObjectRequest,
+		encodeResponse,
+		options...,
+	))
+	listObjects := httptransport.NewServer(
+		listObjectsEndpoint,
+		decodeListObjectsRequest,
+		encodeResponse,
+		options...,
+	)
+	r.Methods("GET").Path("/{bucket}/").Queries("list-type", "2").Handler(listObjects)
+	// Path-style SDK clients leave out the trailing slash.
+	r.Methods("GET").Path("/{bucket}").Queries("list-type", "2").Handler(listObjects)
+	r.Methods("GET").Path("/").Handler(httptransport.NewServer(
+		listBucketsEndpoint,
+		decodeListBucketRequest,
+		encodeResponse,
+		options...,
+	))
+
+	return withRequestID(withXMLMode(xmlMode, r)), nil
+}
+
+func isRequestSignStreamingV4(r *http.Request) bool {
+	return r.Header.Get("x-amz-content-sha256") == streamingContentSHA256 &&
+		r.Method == http.MethodPut
+}
+
+func isRequestSignStreamingV4Trailer(r *http.Request) bool {
+	return r.Header.Get("x-amz-content-sha256") == streamingContentSHA256Trailer &&
+		r.Method == http.MethodPut
+}
+
+// objectPath returns the decoded bucket and object key of a request.
+func objectPath(r *http.Request) (bucket, key string, err error) {
+	vars := mux.Vars(r)
+	if bucket, err = url.PathUnescape(vars["bucket"]); err == nil {
+		key, err = url.PathUnescape(vars["object"])
+	}
+	if err != nil {
+		return "", "", &smithy.GenericAPIError{Code: "InvalidURI", Message: "Couldn't parse the specified URI."}
+	}
+	return bucket, key, nil
+}
+
+func decodePutObjectRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	bucket, key, err := objectPath(r)
+	if err != nil {
+		return nil, err
+	}
+
+	body, contentLength, err := decodeObjectBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	tagging := r.Header.Get("x-amz-tagging")
+	if _, err := ParseTagging(tagging); err != nil {
+		return nil, err
+	}
+
+	return PutObjectRequest{
+		ObjectKey:     key,
+		BucketName:    bucket,
+		ObjectBody:    body,
+		ContentLength: contentLength,
+		ContentMD5:    r.Header.Get("Content-MD5"),
+		Tagging:       tagging,
+		Headers:       decodeUploadHeaders(r),
+	}, nil
+}
+
+// decodeUploadHeaders returns the headers of an upload stored with the
+// object.
+func decodeUploadHeaders(r *http.Request) UploadHeaders {
+	headers := UploadHeaders{ContentType: r.Header.Get("Content-Type")}
+	for name, values := range r.Header {
+		if key, ok := strings.CutPrefix(strings.ToLower(name), "x-amz-meta-"); ok && len(values) > 0 {
+			if headers.Metadata == nil {
+				headers.Metadata = map[string]string{}
+			}
+			headers.Metadata[key] = values[0]
+		}
+	}
+	return headers
+}
+
+// decodeObjectBody returns the body of an upload and its length, decoding
+// streaming signature chunks and verifying the payload checksums.
+func decodeObjectBody(r *http.Request) (io.ReadCloser, int64, error) {
+	var body io.ReadCloser = r.Body
+	var contentLength int64 = r.ContentLength
+	if trailer := isRequestSignStreamingV4Trailer(r); trailer || isRequestSignStreamingV4(r) {
+		reader, err := newSignV4ChunkedReader(r, trailer)
+		if err != nil {
+			return nil, 0, err
+		}
+		body = reader
+
+		contentLengthStr := r.Header.Get("x-amz-decoded-content-length")
+		if contentLength, err = strconv.ParseInt(contentLengthStr, 10, 64); err != nil {
+			return nil, 0, &smithy.GenericAPIError{Code: "MissingContentLength", Message: "You must provide the x-amz-decoded-content-length HTTP header."}
+		}
+	}
+	body, err := newVerifyingReader(r, body, contentLength)
+	if err != nil {
+		return nil, 0, err
+	}
+	return body, contentLength, nil
+}
+
+func decodeDeleteObjectRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	bucket, key, err := objectPath(r)
+	if err != nil {
+		return nil, err
+	}
+	return DeleteObjectRequest{
+		ObjectKey:  key,
+		BucketName: bucket,
+	}, nil
+}
+
+func decodeHeadObjectRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	bucket, key, err := objectPath(r)
+	if err != nil {
+		return nil, err
+	}
+	return HeadObjectRequest{
+		Key:         key,
+		Bucket:      bucket,
+		IfNoneMatch: r.Header.Get("If-None-Match"),
+	}, nil
+}
+
+func decodeGetObjectRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	bucket, key, err := objectPath(r)
+	if err != nil {
+		return nil, err
+	}
+	return GetObjectRequest{
+		Key:    key,
+		Bucket: bucket,
+		Range:  r.Header.Get("Range"),
+
+		AcceptEncoding: r.Header.Get("Accept-Encoding"),
+		Transform:      r.URL.Query().Get(TransformQueryParameter),
+		IfNoneMatch:    r.Header.Get("If-None-Match"),
+	}, nil
+}
+
+type StatusCoder interface {
+	StatusCode() int
+}
+
+func (r HeadObjectResponse) Headers() http.Header {
+	ret := http.Header{}
+	for k, v := range r.Metadata {
+		ret.Add(k, v)
+	}
+	return ret
+}
+
+// errorStatusCodes maps S3 error codes to their HTTP status, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/ErrorResponses.html.
+var errorStatusCodes = map[string]int{
+	"AccessDenied":                         http.StatusForbidden,
+	"AccountProblem":                       http.StatusForbidden,
+	"AllAccessDisabled":                    http.StatusForbidden,
+	"AuthorizationHeaderMalformed":         http.StatusBadRequest,
+	"BadDigest":                            http.StatusBadRequest,
+	"BadRequest":                           http.StatusBadRequest,
+	"BucketAlreadyExists":                  http.StatusConflict,
+	"BucketAlreadyOwnedByYou":              http.StatusConflict,
+	"BucketNotEmpty":                       http.StatusConflict,
+	"Conflict":                             http.StatusConflict,
+	"EntityTooLarge":                       http.StatusBadRequest,
+	"EntityTooSmall":                       http.StatusBadRequest,
+	"ExpiredToken":                         http.StatusBadRequest,
+	"Forbidden":                            http.StatusForbidden,
+	"IncompleteBody":                       http.StatusBadRequest,
+	"InternalError":                        http.StatusInternalServerError,
+	"InvalidAccessKeyId":                   http.StatusForbidden,
+	"InvalidArgument":                      http.StatusBadRequest,
+	"InvalidBucketName":                    http.StatusBadRequest,
+	"InvalidBucketState":                   http.StatusConflict,
+	"InvalidDigest":                        http.StatusBadRequest,
+	"InvalidObjectState":                   http.StatusForbidden,
+	"InvalidPart":                          http.StatusBadRequest,
+	"InvalidPartOrder":                     http.StatusBadRequest,
+	"InvalidRange":                         http.StatusRequestedRangeNotSatisfiable,
+	"InvalidRequest":                       http.StatusBadRequest,
+	"InvalidTag":                           http.StatusBadRequest,
+	"InvalidToken":                         http.StatusBadRequest,
+	"InvalidURI":                           http.StatusBadRequest,
+	"KeyTooLongError":                      http.StatusBadRequest,
+	"MalformedXML":                         http.StatusBadRequest,
+	"MethodNotAllowed":                     http.StatusMethodNotAllowed,
+	"MissingContentLength":                 http.StatusLengthRequired,
+	"NoSuchBucket":                         http.StatusNotFound,
+	"NoSuchKey":                            http.StatusNotFound,
+	"NoSuchPublicAccessBlockConfiguration": http.StatusNotFound,
+	"NoSuchUpload":                         http.StatusNotFound,
+	"NoSuchVersion":                        http.StatusNotFound,
+	"NotFound":                             http.StatusNotFound,
+	"NotImplemented":                       http.StatusNotImplemented,
+	"NotModified":                          http.StatusNotModified,
+	"OperationAborted":                     http.StatusConflict,
+	"PreconditionFailed":                   http.StatusPreconditionFailed,
+	"RequestLimitExceeded":                 http.StatusServiceUnavailable,
+	"RequestTimeout":                       http.StatusBadRequest,
+	"RequestTimeTooSkewed":                 http.StatusForbidden,
+	"ServiceUnavailable":                   http.StatusServiceUnavailable,
+	"SignatureDoesNotMatch":                http.StatusForbidden,
+	"SlowDown":                             http.StatusServiceUnavailable,
+	"Throttling":                           http.StatusServiceUnavailable,
+	"ThrottlingException":                  http.StatusServiceUnavailable,
+	"TokenRefreshRequired":                 http.StatusBadRequest,
+	"TooManyBuckets":                       http.StatusBadRequest,
+	"UnexpectedContent":                    http.StatusBadRequest,
+	"XAmzContentSHA256Mismatch":            http.StatusBadRequest,
+}
+
+// errorStatusCode returns the HTTP status of an S3 error code, defaulting
+// to 500 for unknown codes.
+func errorStatusCode(code string) int {
+	if status, ok := errorStatusCodes[code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+func (r APIErrorResponse) StatusCode() int {
+	return errorStatusCode(r.Code)
+}
+
+func encodeGetObjectResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if notModified, ok := response.(NotModifiedResponse); ok {
+		return encodeHeadResponse(ctx, w, notModified)
+	}
+	if _, ok := response.(GetObjectResponse); !ok {
+		return encodeResponse(ctx, w, response)
+	}
+
+	resp := response.(GetObjectResponse)
+	defer resp.Body.Close()
+
+	h := w.Header()
+	h.Set("Accept-Ranges", "bytes")
+	if resp.Info.ContentType != "" {
+		h.Set("Content-Type", resp.Info.ContentType)
+	}
+	if resp.Info.ETag != "" {
+		h.Set("ETag", resp.Info.ETag)
+	}
+	if !resp.Info.LastModified.IsZero() {
+		h.Set("Last-Modified", resp.Info.LastModified.UTC().Format(http.TimeFormat))
+	}
+	if resp.ContentEncoding != "" {
+		// The compressed length isn't known upfront.
+		h.Set("Content-Encoding", resp.ContentEncoding)
+		h.Add("Vary", "Accept-Encoding")
+	} else {
+		if resp.Info.ContentEncoding != "" {
+			h.Set("Content-Encoding", resp.Info.ContentEncoding)
+		}
+		h.Set("Content-Length", strconv.FormatInt(resp.Info.ContentLength, 10))
+	}
+
+	status := http.StatusOK
+	if resp.Info.ContentRange != "" {
+		h.Set("Content-Range", resp.Info.ContentRange)
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+
+	// Bodies read from disk, see fileBody, are sent by their WriteTo.
+	_, err := copyBuffered(w, resp.Body)
+	return err
+}
+
+// encodeDeleteObjectResponse answers a successful delete with an empty 204,
+// as S3 does.
+func encodeDeleteObjectResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if _, ok := response.(DeleteObjectResponse); !ok {
+		return encodeResponse(ctx, w, response)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func decodeListBucketRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	query := r.URL.Query()
+	req := ListBucketsRequest{
+		Prefix:            query.Get("prefix"),
+		ContinuationToken: query.Get("continuation-token"),
+	}
+	if v := query.Get("max-buckets"); v != "" {
+		if req.MaxBuckets, err = strconv.Atoi(v); err != nil || req.MaxBuckets < 1 || req.MaxBuckets > maxBuckets {
+			return nil, &smithy.GenericAPIError{Code: "InvalidArgument", Message: "max-buckets must be an integer between 1 and " + strconv.Itoa(maxBuckets)}
+		}
+	}
+	return req, nil
+}
+
+func decodeListObjectsRequest(_ context.Context, r *http.Request) (request interface{}, err error) {
+	bucket, _, err := objectPath(r)
+	if err != nil {
+		return nil, err
+	}
+	query := r.URL.Query()
+	req := ListObjectsRequest{
+		Bucket:            bucket,
+		Prefix:            query.Get("prefix"),
+		Delimiter:         query.Get("delimiter"),
+		EncodingType:      query.Get("encoding-type"),
+		StartAfter:        query.Get("start-after"),
+		ContinuationToken: query.Get("continuation-token"),
+		MaxKeys:           -1,
+		FetchOwner:        query.Get("fetch-owner") == "true",
+	}
+	if v := query.Get("max-keys"); v != "" {
+		if req.MaxKeys, err = strconv.Atoi(v); err != nil || req.MaxKeys < 0 {
+			return nil, &smithy.GenericAPIError{Code: "InvalidArgument", Message: "max-keys must be a non-negative integer"}
+		}
+	}
+	return req, nil
+}
+
+// encodeResponse is the common method to encode all response types to the
+// client. I chose to do it this way because, since we're using JSON, there's no
+// reason to provide anything more specific. It's certainly possible to
+// specialize on a per-response (per-method) basis.
+func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if e, ok := response.(APIErrorResponse); ok {
+		response = e.withRequestInfo(ctx)
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	if sc, ok := response.(StatusCoder); ok {
+		w.WriteHeader(sc.StatusCode())
+	}
+	if headerer, ok := response.(httptransport.Headerer); ok {
+		for k, values := range headerer.Headers() {
+			for _, v := range values {
+				w.Header().Add(k, v)
+			}
+		}
+	}
+
+	if xmlModeFromContext(ctx) == XMLModeAWS {
+		return encodeAWSXML(w, response)
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(response)
+}
+
+func encodeHeadResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	// Headers must be set before the status is written to be sent at all.
+	if headerer, ok := response.(httptransport.Headerer); ok {
+		for k, values := range headerer.Headers() {
+			for _, v := range values {
+				w.Header().Add(k, v)
+			}
+		}
+	}
+	if sc, ok := response.(StatusCoder); ok {
+		w.WriteHeader(sc.StatusCode())
+	}
+	return nil
+}
+
+func encodeError(ctx context.Context, err error, w http.ResponseWriter) {
+	if err == nil {
+		panic("encodeError with nil error")
+	}
+
+	response := APIErrorResponse{
+		Code:    "InternalError",
+		Message: err.Error(),
+	}
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		response = APIErrorResponse{
+			Code:    ae.ErrorCode(),
+			Message: ae.ErrorMessage(),
+		}
+	}
+	response = response.withRequestInfo(ctx)
+	writeResponseHeader(ctx, w)
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(response.StatusCode())
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	enc.Encode(response)
+}
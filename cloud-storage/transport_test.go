@@ -0,0 +1,76 @@
+package cloud_storage
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/smithy-go"
+	"github.com/gorilla/mux"
+	"github.com/rampage644/s3-overlay-proxy/repository"
+)
+
+// keyTests are object keys which need escaping, with their escaped request
+// paths and their encodings in encoding-type=url listings.
+var keyTests = []struct {
+	name    string
+	key     string
+	path    string
+	listing string
+}{
+	{"percent", "100%", "/bucket/100%25", "100%25"},
+	{"plus", "a+b", "/bucket/a+b", "a%2Bb"},
+	{"space", "a b", "/bucket/a%20b", "a+b"},
+	{"non-ASCII", "café/ß", "/bucket/caf%C3%A9/%C3%9F", "caf%C3%A9/%C3%9F"},
+	{"escaped slash", "a%2Fb", "/bucket/a%252Fb", "a%252Fb"},
+	{"double slash", "a//b", "/bucket/a//b", "a//b"},
+	{"dot dot", "a/../b", "/bucket/a/../b", "a/../b"},
+	{"trailing dot dot", "a/..", "/bucket/a/..", "a/.."},
+}
+
+func TestObjectPath(t *testing.T) {
+	for _, tt := range keyTests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewProxy(ProxyOptions{Backend: repository.NewMemoryStorage("bucket")})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			put := httptest.NewRecorder()
+			p.ServeHTTP(put, httptest.NewRequest("PUT", tt.path, strings.NewReader("body")))
+			if put.Code != http.StatusOK {
+				t.Fatalf("PUT %s: got status %d: %s", tt.path, put.Code, put.Body)
+			}
+
+			var listing struct {
+				Contents []struct{ Key string }
+			}
+			list := httptest.NewRecorder()
+			p.ServeHTTP(list, httptest.NewRequest("GET", "/bucket?list-type=2", nil))
+			if err := xml.Unmarshal(list.Body.Bytes(), &listing); err != nil {
+				t.Fatal(err)
+			}
+			if len(listing.Contents) != 1 || listing.Contents[0].Key != tt.key {
+				t.Fatalf("PUT %s: got keys %+v, want %q", tt.path, listing.Contents, tt.key)
+			}
+
+			get := httptest.NewRecorder()
+			p.ServeHTTP(get, httptest.NewRequest("GET", tt.path, nil))
+			if get.Code != http.StatusOK || get.Body.String() != "body" {
+				t.Fatalf("GET %s: got status %d: %s", tt.path, get.Code, get.Body)
+			}
+		})
+	}
+}
+
+func TestObjectPathInvalidEscape(t *testing.T) {
+	r := mux.SetURLVars(httptest.NewRequest("GET", "/", nil), map[string]string{"bucket": "bucket", "object": "a%zz"})
+	_, _, err := objectPath(r)
+	var ae smithy.APIError
+	if !errors.As(err, &ae) || ae.ErrorCode() != "InvalidURI" {
+		t.Fatalf("got %v, want InvalidURI", err)
+	}
+}
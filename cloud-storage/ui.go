@@ -0,0 +1,322 @@
+package cloud_storage
+
+import (
+	"crypto/subtle"
+	"encoding/xml"
+	"errors"
+	"html/template"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/gorilla/mux"
+)
+
+// uiMaxUploadMemory is how much of an upload form is buffered in memory;
+// the rest is spooled to temporary files.
+const uiMaxUploadMemory = 32 << 20
+
+// uiCSRFCookie holds the token the UI forms must post back, so that other
+// sites can't have browsers post them.
+const uiCSRFCookie = "s3proxy_csrf"
+
+// uiCSRFToken returns the token of the session of r, starting one if it
+// has none.
+func uiCSRFToken(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(uiCSRFCookie); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	token := randomHex(16)
+	http.SetCookie(w, &http.Cookie{Name: uiCSRFCookie, Value: token, Path: "/ui", HttpOnly: true, SameSite: http.SameSiteStrictMode})
+	return token
+}
+
+// uiSameOrigin reports whether r comes from a page of the UI's own origin,
+// going by its Origin header, or Referer if it has none. Requests with
+// neither are left to the token check.
+func uiSameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Header.Get("Referer")
+	}
+	if source == "" {
+		return true
+	}
+	u, err := url.Parse(source)
+	return err == nil && u.Host == r.Host
+}
+
+// uiCheckCSRF reports whether the form posted with r carries the token of
+// its session.
+func uiCheckCSRF(r *http.Request) bool {
+	cookie, err := r.Cookie(uiCSRFCookie)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(r.FormValue("csrf"))) == 1
+}
+
+var uiTemplates = template.Must(template.New("").Funcs(template.FuncMap{
+	"query": func(kv ...string) template.URL {
+		v := url.Values{}
+		for i := 0; i+1 < len(kv); i += 2 {
+			if kv[i+1] != "" {
+				v.Set(kv[i], kv[i+1])
+			}
+		}
+		return template.URL(v.Encode())
+	},
+	"base": func(key string) string {
+		return path.Base(key)
+	},
+}).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>S3 overlay proxy</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: .2em 1em; text-align: left; border-bottom: 1px solid #ddd; }
+.error { color: #b00; }
+</style></head><body>
+<p><a href="/ui">Buckets</a>{{if .Bucket}} / <a href="/ui/list?{{query "bucket" .Bucket}}">{{.Bucket}}</a>{{end}}</p>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{end}}
+
+{{define "footer"}}</body></html>{{end}}
+
+{{define "buckets"}}{{template "header" .}}
+<h1>Buckets</h1>
+<table><tr><th>Name</th><th>Created</th></tr>
+{{range .Buckets}}<tr><td><a href="/ui/list?{{query "bucket" .Name}}">{{.Name}}</a></td><td>{{.CreationDate}}</td></tr>
+{{end}}</table>
+{{template "footer" .}}{{end}}
+
+{{define "list"}}{{template "header" .}}
+<h1>{{.Bucket}}/{{.Prefix}}</h1>
+<table><tr><th>Key</th><th>Size</th><th>Last modified</th><th>ETag</th><th>Cache</th></tr>
+{{range .Page.CommonPrefixes}}<tr><td><a href="/ui/list?{{query "bucket" $.Bucket "prefix" .Prefix}}">{{.Prefix}}</a></td><td></td><td></td><td></td><td></td></tr>
+{{end}}{{range .Objects}}<tr><td><a href="/ui/object?{{query "bucket" $.Bucket "key" .Key}}">{{base .Key}}</a></td><td>{{.Size}}</td><td>{{.LastModified}}</td><td>{{.ETag}}</td><td>{{.Status}}</td></tr>
+{{end}}</table>
+{{if .Page.IsTruncated}}<p><a href="/ui/list?{{query "bucket" .Bucket "prefix" .Prefix "token" .Page.NextContinuationToken}}">Next page</a></p>{{end}}
+<h2>Upload</h2>
+<form method="post" action="/ui/upload" enctype="multipart/form-data">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<input type="hidden" name="bucket" value="{{.Bucket}}">
+<input type="hidden" name="prefix" value="{{.Prefix}}">
+<input type="file" name="file" required> <input type="submit" value="Upload to {{.Bucket}}/{{.Prefix}}">
+</form>
+{{template "footer" .}}{{end}}
+
+{{define "object"}}{{template "header" .}}
+<h1>{{.Bucket}}/{{.Key}}</h1>
+{{with .Info}}<table>
+<tr><th>Size</th><td>{{.ContentLength}}</td></tr>
+<tr><th>Content type</th><td>{{.ContentType}}</td></tr>
+<tr><th>ETag</th><td>{{.ETag}}</td></tr>
+<tr><th>Last modified</th><td>{{.LastModified.UTC.Format "2006-01-02T15:04:05Z"}}</td></tr>
+<tr><th>Cache</th><td>{{$.Status}}</td></tr>
+</table>
+<p><a href="/ui/download?{{query "bucket" $.Bucket "key" $.Key}}">Download</a></p>
+<form method="post" action="/ui/delete">
+<input type="hidden" name="csrf" value="{{$.CSRF}}">
+<input type="hidden" name="bucket" value="{{$.Bucket}}">
+<input type="hidden" name="key" value="{{$.Key}}">
+<input type="submit" value="Delete" onclick="return confirm('Delete {{$.Key}}?')">
+</form>{{end}}
+{{template "footer" .}}{{end}}
+`))
+
+// uiObject is an object row of the listing page.
+type uiObject struct {
+	Object
+	Status string
+}
+
+// s3Request has the S3 API of the proxy serve a request of the UI, so that
+// it goes through the middlewares and hooks as the requests of S3 clients
+// do, returning the status and the error it answered with, if any.
+func (p *Proxy) s3Request(r *http.Request, method, bucket, key string, body io.Reader, size int64) (int, error) {
+	target := (&url.URL{Path: "/" + bucket + "/" + key}).EscapedPath()
+	req, err := http.NewRequestWithContext(r.Context(), method, target, body)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	req.RemoteAddr = r.RemoteAddr
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	recorder := httptest.NewRecorder()
+	p.Handler.ServeHTTP(recorder, req)
+	if recorder.Code < 300 {
+		return recorder.Code, nil
+	}
+	var response APIErrorResponse
+	if err := xml.Unmarshal(recorder.Body.Bytes(), &response); err == nil && response.Code != "" {
+		return recorder.Code, errors.New(response.Code + ": " + response.Message)
+	}
+	return recorder.Code, errors.New(http.StatusText(recorder.Code))
+}
+
+// UIRoutes mounts a browser UI for inspecting what the proxy sees: bucket
+// listings, object metadata and cache status, and downloading, uploading
+// and deleting objects. Every page requires one of tokens, as a bearer
+// token or as the password of basic authentication. Reads go through the
+// proxy's storage, including the cache, but uploads and deletes are served
+// by the S3 API of the proxy, as anonymous requests, so that its
+// middlewares and hooks apply to them. They are also rejected with 403
+// Forbidden unless they come from the UI's own origin and carry the token
+// of the session, set in a cookie by the pages.
+//
+//	GET  /ui
+//	GET  /ui/list?bucket=b[&prefix=p&token=t]
+//	GET  /ui/object?bucket=b&key=k
+//	GET  /ui/download?bucket=b&key=k
+//	POST /ui/upload  (multipart form: bucket, prefix, file)
+//	POST /ui/delete  (form: bucket, key)
+func (p *Proxy) UIRoutes(tokens *AdminTokens) AdminRoutes {
+	return func(r *mux.Router) {
+		p.uiRoutes(r, tokens)
+	}
+}
+
+func (p *Proxy) uiRoutes(r *mux.Router, tokens *AdminTokens) {
+	authenticated := func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := tokens.authenticate(w, r); ok {
+				h(w, r)
+			}
+		}
+	}
+	render := func(w http.ResponseWriter, r *http.Request, name string, data map[string]interface{}) {
+		data["CSRF"] = uiCSRFToken(w, r)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err, ok := data["Error"]; ok && err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		uiTemplates.ExecuteTemplate(w, name, data)
+	}
+	status := func(bucket, key string) string {
+		if p.Cache == nil {
+			return "disabled"
+		}
+		s := p.Cache.Status(bucket, key)
+		var parts []string
+		if s.Cached {
+			parts = append(parts, "cached")
+		}
+		if s.Pinned {
+			parts = append(parts, "pinned")
+		}
+		if s.UploadPending {
+			parts = append(parts, "upload pending")
+		}
+		if len(parts) == 0 {
+			return "-"
+		}
+		return strings.Join(parts, ", ")
+	}
+
+	r.Methods("GET").Path("/ui").HandlerFunc(authenticated(func(w http.ResponseWriter, r *http.Request) {
+		buckets, err := p.Storage.ListBuckets(r.Context())
+		render(w, r, "buckets", map[string]interface{}{"Buckets": buckets, "Error": err})
+	}))
+
+	r.Methods("GET").Path("/ui/list").HandlerFunc(authenticated(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		bucket, prefix := q.Get("bucket"), q.Get("prefix")
+		page, err := p.Storage.ListObjects(r.Context(), bucket, ListObjectsOptions{
+			Prefix:            prefix,
+			Delimiter:         "/",
+			ContinuationToken: q.Get("token"),
+			MaxKeys:           defaultMaxKeys,
+		})
+		objects := make([]uiObject, len(page.Objects))
+		for i, object := range page.Objects {
+			objects[i] = uiObject{Object: object, Status: status(bucket, object.Key)}
+		}
+		render(w, r, "list", map[string]interface{}{
+			"Bucket": bucket, "Prefix": prefix, "Page": page, "Objects": objects, "Error": err,
+		})
+	}))
+
+	r.Methods("GET").Path("/ui/object").HandlerFunc(authenticated(func(w http.ResponseWriter, r *http.Request) {
+		bucket, key := r.URL.Query().Get("bucket"), r.URL.Query().Get("key")
+		data := map[string]interface{}{"Bucket": bucket, "Key": key, "Status": status(bucket, key)}
+		metadata, err := p.Storage.HeadObject(r.Context(), bucket, key)
+		if err != nil {
+			data["Error"] = err
+		} else {
+			data["Info"] = ObjectInfo{
+				ContentLength: metadata.ContentLength,
+				ContentType:   aws.ToString(metadata.ContentType),
+				ETag:          aws.ToString(metadata.ETag),
+				LastModified:  aws.ToTime(metadata.LastModified),
+			}
+		}
+		render(w, r, "object", data)
+	}))
+
+	r.Methods("GET").Path("/ui/download").HandlerFunc(authenticated(func(w http.ResponseWriter, r *http.Request) {
+		bucket, key := r.URL.Query().Get("bucket"), r.URL.Query().Get("key")
+		body, info, err := p.Storage.GetObject(r.Context(), bucket, key, "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer body.Close()
+		if info.ContentType != "" {
+			w.Header().Set("Content-Type", info.ContentType)
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="`+strings.ReplaceAll(path.Base(key), `"`, "")+`"`)
+		io.Copy(w, body)
+	}))
+
+	r.Methods("POST").Path("/ui/upload").HandlerFunc(authenticated(func(w http.ResponseWriter, r *http.Request) {
+		if !uiSameOrigin(r) {
+			http.Error(w, "cross-origin request", http.StatusForbidden)
+			return
+		}
+		if err := r.ParseMultipartForm(uiMaxUploadMemory); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+		if !uiCheckCSRF(r) {
+			http.Error(w, "invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		bucket, key := r.FormValue("bucket"), r.FormValue("prefix")+header.Filename
+		if status, err := p.s3Request(r, http.MethodPut, bucket, key, file, header.Size); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		http.Redirect(w, r, "/ui/object?"+url.Values{"bucket": {bucket}, "key": {key}}.Encode(), http.StatusSeeOther)
+	}))
+
+	r.Methods("POST").Path("/ui/delete").HandlerFunc(authenticated(func(w http.ResponseWriter, r *http.Request) {
+		if !uiSameOrigin(r) || !uiCheckCSRF(r) {
+			http.Error(w, "cross-origin request or invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		bucket, key := r.FormValue("bucket"), r.FormValue("key")
+		if status, err := p.s3Request(r, http.MethodDelete, bucket, key, nil, 0); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		prefix := key[:strings.LastIndex(key, "/")+1]
+		http.Redirect(w, r, "/ui/list?"+url.Values{"bucket": {bucket}, "prefix": {prefix}}.Encode(), http.StatusSeeOther)
+	}))
+}
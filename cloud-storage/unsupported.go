@@ -0,0 +1,49 @@
+package cloud_storage
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// s3SubResources are the query parameters selecting an S3 operation other
+// than the plain object and bucket ones, e.g. GET /bucket/key?acl.
+var s3SubResources = []string{
+	"accelerate", "acl", "analytics", "attributes", "cors", "delete",
+	"encryption", "intelligent-tiering", "inventory", "legal-hold",
+	"lifecycle", "location", "logging", "metrics", "notification",
+	"object-lock", "ownershipControls", "policy", "policyStatus",
+	"publicAccessBlock", "replication", "requestPayment", "restore",
+	"retention", "select", "tagging", "torrent", "uploadId", "uploads",
+	"versioning", "versions", "website",
+}
+
+// hasSubResource matches requests for an S3 sub-resource operation.
+func hasSubResource(r *http.Request, _ *mux.RouteMatch) bool {
+	query := r.URL.Query()
+	for _, name := range s3SubResources {
+		if query.Has(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// errorHandler answers every request with the given S3 error.
+func errorHandler(code, message string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodeResponse(r.Context(), w, APIErrorResponse{Code: code, Message: message})
+	})
+}
+
+// handleUnsupported makes requests for operations the proxy doesn't
+// implement fail with S3 errors SDKs understand: NotImplemented for
+// sub-resources and unknown operations, MethodNotAllowed for unsupported
+// methods on a known resource. It must be called before any other route is
+// added, so that sub-resource requests don't reach the object handlers.
+func handleUnsupported(r *mux.Router) {
+	notImplemented := errorHandler("NotImplemented", "A header or query you provided implies functionality that is not implemented.")
+	r.MatcherFunc(hasSubResource).Handler(notImplemented)
+	r.NotFoundHandler = notImplemented
+	r.MethodNotAllowedHandler = errorHandler("MethodNotAllowed", "The specified method is not allowed against this resource.")
+}
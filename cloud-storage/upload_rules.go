@@ -0,0 +1,193 @@
+package cloud_storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// UploadRule sets the headers of uploads to Bucket whose keys start with
+// Prefix, correcting clients which don't. ContentTypes maps key suffixes,
+// e.g. ".json", to the Content-Type of uploads sent without a specific one;
+// Metadata is added to the user metadata of every upload, replacing the
+// client's values.
+//
+// Uploads whose type isn't set that way either get the type of the key's
+// extension, if ContentTypeByExtension, or the type detected from the
+// first bytes of PUT bodies, if SniffContentType, so that browsers render
+// downloads. Either applies if set in any matching rule.
+type UploadRule struct {
+	Bucket                 string            `json:"bucket"`
+	Prefix                 string            `json:"prefix,omitempty"`
+	ContentTypes           map[string]string `json:"contentTypes,omitempty"`
+	Metadata               map[string]string `json:"metadata,omitempty"`
+	ContentTypeByExtension bool              `json:"contentTypeByExtension,omitempty"`
+	SniffContentType       bool              `json:"sniffContentType,omitempty"`
+}
+
+// sniffLength is how much of a body http.DetectContentType considers.
+const sniffLength = 512
+
+// genericContentTypes are sent by clients which don't know the type of what
+// they upload, and are replaced by the type of the key's suffix.
+var genericContentTypes = map[string]bool{
+	"":                         true,
+	"application/octet-stream": true,
+	"binary/octet-stream":      true,
+}
+
+// ValidateUploadRules reports the first invalid upload rule.
+func ValidateUploadRules(rules []UploadRule) error {
+	for _, rule := range rules {
+		if rule.Bucket == "" {
+			return fmt.Errorf("upload rule without bucket")
+		}
+		for suffix, contentType := range rule.ContentTypes {
+			if suffix == "" {
+				return fmt.Errorf("bucket %s prefix %q: empty suffix", rule.Bucket, rule.Prefix)
+			}
+			if _, _, err := mime.ParseMediaType(contentType); err != nil {
+				return fmt.Errorf("bucket %s prefix %q: content type of %q: %w", rule.Bucket, rule.Prefix, suffix, err)
+			}
+		}
+		for name := range rule.Metadata {
+			if name == "" || name != strings.ToLower(name) || strings.ContainsAny(name, " :\r\n") {
+				return fmt.Errorf("bucket %s prefix %q: invalid metadata name %q", rule.Bucket, rule.Prefix, name)
+			}
+		}
+	}
+	return nil
+}
+
+// UploadPolicy holds the upload rules.
+type UploadPolicy struct {
+	mu    sync.RWMutex
+	rules []UploadRule
+}
+
+func NewUploadPolicy(rules []UploadRule) *UploadPolicy {
+	return &UploadPolicy{rules: rules}
+}
+
+// SetRules replaces the upload rules.
+func (p *UploadPolicy) SetRules(rules []UploadRule) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rules = rules
+}
+
+// apply returns the headers of an upload to bucket/key once the matching
+// rules are applied, those with longer prefixes last so that they win. Of
+// the content types, the one of the longest matching suffix is used, else
+// the one of the extension. It also reports whether the type is still
+// generic and should be sniffed from the body.
+func (p *UploadPolicy) apply(bucket, key string, headers UploadHeaders) (UploadHeaders, bool) {
+	p.mu.RLock()
+	var rules []UploadRule
+	for _, rule := range p.rules {
+		if rule.Bucket == bucket && strings.HasPrefix(key, rule.Prefix) {
+			rules = append(rules, rule)
+		}
+	}
+	p.mu.RUnlock()
+	if len(rules) == 0 {
+		return headers, false
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return len(rules[i].Prefix) < len(rules[j].Prefix)
+	})
+
+	generic := genericContentTypes[headers.ContentType]
+	suffixLength := 0
+	byExtension, sniff := false, false
+	metadata := make(map[string]string, len(headers.Metadata))
+	for name, value := range headers.Metadata {
+		metadata[name] = value
+	}
+	for _, rule := range rules {
+		for suffix, contentType := range rule.ContentTypes {
+			if generic && strings.HasSuffix(key, suffix) && len(suffix) >= suffixLength {
+				headers.ContentType, suffixLength = contentType, len(suffix)
+			}
+		}
+		for name, value := range rule.Metadata {
+			metadata[name] = value
+		}
+		byExtension = byExtension || rule.ContentTypeByExtension
+		sniff = sniff || rule.SniffContentType
+	}
+	if len(metadata) > 0 {
+		headers.Metadata = metadata
+	}
+	if generic && suffixLength == 0 && byExtension {
+		if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+			headers.ContentType = contentType
+			return headers, false
+		}
+	}
+	return headers, generic && suffixLength == 0 && sniff
+}
+
+// sniffContentType returns the type http.DetectContentType detects from the
+// first bytes of body, empty if it can't tell, along with a reader of the
+// whole body.
+func sniffContentType(body io.ReadCloser) (io.ReadCloser, string, error) {
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(body, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return body, "", err
+	}
+	head = head[:n]
+	body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), body), body}
+	if n == 0 {
+		return body, "", nil
+	}
+	contentType := http.DetectContentType(head)
+	if genericContentTypes[contentType] {
+		return body, "", nil
+	}
+	return body, contentType, nil
+}
+
+// UploadRulesMiddleware returns an endpoint middleware applying the upload
+// rules of policy to PUT and multipart uploads. Multipart uploads aren't
+// sniffed, as their type is set before any part is sent.
+func UploadRulesMiddleware(policy *UploadPolicy) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			switch req := request.(type) {
+			case PutObjectRequest:
+				var sniff bool
+				req.Headers, sniff = policy.apply(req.BucketName, req.ObjectKey, req.Headers)
+				if sniff {
+					body, contentType, err := sniffContentType(req.ObjectBody)
+					if err != nil {
+						req.ObjectBody.Close()
+						return apiErrorResponse(err), nil
+					}
+					req.ObjectBody = body
+					if contentType != "" {
+						req.Headers.ContentType = contentType
+					}
+				}
+				request = req
+			case CreateMultipartUploadRequest:
+				req.Headers, _ = policy.apply(req.Bucket, req.Key, req.Headers)
+				request = req
+			}
+			return next(ctx, request)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package cloud_storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// VirtualBucket is a bucket which only exists in the proxy, backed by the
+// keys under Prefix in the upstream Bucket. It is listed by ListBuckets
+// with CreationDate, or the time the proxy started if unset.
+type VirtualBucket struct {
+	Bucket       string    `json:"bucket"`
+	Prefix       string    `json:"prefix,omitempty"`
+	CreationDate time.Time `json:"creationDate,omitempty"`
+}
+
+// ValidateVirtualBuckets reports the first invalid virtual bucket.
+func ValidateVirtualBuckets(buckets map[string]VirtualBucket) error {
+	for name, bucket := range buckets {
+		if name == "" || bucket.Bucket == "" {
+			return fmt.Errorf("virtual bucket %q: name and bucket are required", name)
+		}
+		if name == bucket.Bucket && bucket.Prefix == "" {
+			return fmt.Errorf("virtual bucket %q: backed by itself", name)
+		}
+	}
+	return nil
+}
+
+// proxyStart is the creation date of virtual buckets without one.
+var proxyStart = time.Now()
+
+// VirtualBuckets holds the virtual buckets, by name.
+type VirtualBuckets struct {
+	mu      sync.RWMutex
+	buckets map[string]VirtualBucket
+}
+
+func NewVirtualBuckets(buckets map[string]VirtualBucket) *VirtualBuckets {
+	return &VirtualBuckets{buckets: buckets}
+}
+
+// Set replaces all virtual buckets.
+func (v *VirtualBuckets) Set(buckets map[string]VirtualBucket) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.buckets = buckets
+}
+
+// Get returns the virtual bucket named name.
+func (v *VirtualBuckets) Get(name string) (VirtualBucket, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	bucket, ok := v.buckets[name]
+	return bucket, ok
+}
+
+// withVirtual adds the virtual buckets to buckets, replacing upstream ones
+// of the same name.
+func (v *VirtualBuckets) withVirtual(buckets []Bucket) []Bucket {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if len(v.buckets) == 0 {
+		return buckets
+	}
+	listed := make([]Bucket, 0, len(buckets)+len(v.buckets))
+	for _, bucket := range buckets {
+		if _, ok := v.buckets[bucket.Name]; !ok {
+			listed = append(listed, bucket)
+		}
+	}
+	for name, bucket := range v.buckets {
+		created := bucket.CreationDate
+		if created.IsZero() {
+			created = proxyStart
+		}
+		listed = append(listed, Bucket{Name: name, CreationDate: created.UTC().Format("2006-01-02T15:04:05.000Z")})
+	}
+	sort.Slice(listed, func(i, j int) bool { return listed[i].Name < listed[j].Name })
+	return listed
+}
+
+// VirtualBucketMiddleware returns an endpoint middleware serving the
+// virtual buckets: requests for them are rewritten to their upstream bucket
+// and prefix, and responses back to the names clients asked for.
+func VirtualBucketMiddleware(virtual *VirtualBuckets) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			switch req := request.(type) {
+			case GetObjectRequest:
+				if vb, ok := virtual.Get(req.Bucket); ok {
+					req.Bucket, req.Key = vb.Bucket, vb.Prefix+req.Key
+					request = req
+				}
+			case HeadObjectRequest:
+				if vb, ok := virtual.Get(req.Bucket); ok {
+					req.Bucket, req.Key = vb.Bucket, vb.Prefix+req.Key
+					request = req
+				}
+			case PutObjectRequest:
+				if vb, ok := virtual.Get(req.BucketName); ok {
+					req.BucketName, req.ObjectKey = vb.Bucket, vb.Prefix+req.ObjectKey
+					request = req
+				}
+			case DeleteObjectRequest:
+				if vb, ok := virtual.Get(req.BucketName); ok {
+					req.BucketName, req.ObjectKey = vb.Bucket, vb.Prefix+req.ObjectKey
+					request = req
+				}
+			case CreateMultipartUploadRequest:
+				vb, ok := virtual.Get(req.Bucket)
+				if !ok {
+					break
+				}
+				bucket, key := req.Bucket, req.Key
+				req.Bucket, req.Key = vb.Bucket, vb.Prefix+req.Key
+				response, err := next(ctx, req)
+				if resp, ok := response.(CreateMultipartUploadResponse); ok {
+					resp.Bucket, resp.Key = bucket, key
+					response = resp
+				}
+				return response, err
+			case UploadPartRequest:
+				if vb, ok := virtual.Get(req.Bucket); ok {
+					req.Bucket, req.Key = vb.Bucket, vb.Prefix+req.Key
+					request = req
+				}
+			case CompleteMultipartUploadRequest:
+				vb, ok := virtual.Get(req.Bucket)
+				if !ok {
+					break
+				}
+				bucket, key := req.Bucket, req.Key
+				req.Bucket, req.Key = vb.Bucket, vb.Prefix+req.Key
+				response, err := next(ctx, req)
+				if resp, ok := response.(CompleteMultipartUploadResponse); ok {
+					resp.Bucket, resp.Key = bucket, key
+					resp.Location = "/" + bucket + "/" + key
+					response = resp
+				}
+				return response, err
+			case AbortMultipartUploadRequest:
+				if vb, ok := virtual.Get(req.Bucket); ok {
+					req.Bucket, req.Key = vb.Bucket, vb.Prefix+req.Key
+					request = req
+				}
+			case ListObjectsRequest:
+				vb, ok := virtual.Get(req.Bucket)
+				if !ok {
+					break
+				}
+				original := req
+				req.Bucket, req.Prefix = vb.Bucket, vb.Prefix+req.Prefix
+				if req.StartAfter != "" {
+					req.StartAfter = vb.Prefix + req.StartAfter
+				}
+				response, err := next(ctx, req)
+				if resp, ok := response.(ListObjectsResponse); ok {
+					response = unprefixListing(resp, original, vb.Prefix)
+				}
+				return response, err
+			case ListBucketsRequest:
+				response, err := next(ctx, req)
+				if resp, ok := response.(ListBucketsResponse); ok {
+					resp.Buckets.Buckets = virtual.withVirtual(resp.Buckets.Buckets)
+					response = resp
+				}
+				return response, err
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// unprefixListing rewrites a listing of the prefix of a virtual bucket into
+// the listing of the virtual bucket req asked for.
+func unprefixListing(resp ListObjectsResponse, req ListObjectsRequest, prefix string) ListObjectsResponse {
+	if req.EncodingType == "url" {
+		// The listing is encoded already.
+		prefix = encodeListingKey(prefix)
+		req.Prefix = encodeListingKey(req.Prefix)
+		req.StartAfter = encodeListingKey(req.StartAfter)
+	}
+	resp.Name = req.Bucket
+	resp.Prefix = req.Prefix
+	resp.StartAfter = req.StartAfter
+	contents := make([]Object, len(resp.Contents))
+	for i, object := range resp.Contents {
+		object.Key = strings.TrimPrefix(object.Key, prefix)
+		contents[i] = object
+	}
+	resp.Contents = contents
+	prefixes := make([]CommonPrefix, len(resp.CommonPrefixes))
+	for i, p := range resp.CommonPrefixes {
+		prefixes[i] = CommonPrefix{Prefix: strings.TrimPrefix(p.Prefix, prefix)}
+	}
+	resp.CommonPrefixes = prefixes
+	return resp
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rampage644/s3-overlay-proxy/internal/harness"
+)
+
+// conformanceClient issues raw S3 requests against the proxy, so that the
+// checks see exactly what goes over the wire.
+type conformanceClient struct {
+	url    string
+	bucket string
+	prefix string
+	http   *http.Client
+}
+
+// objectPath returns the escaped path of key in the test bucket.
+func (c *conformanceClient) objectPath(key string) string {
+	return "/" + url.PathEscape(c.bucket) + "/" + strings.ReplaceAll(url.PathEscape(c.prefix+key), "%2F", "/")
+}
+
+func (c *conformanceClient) do(method, path string, header http.Header, body []byte) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(method, c.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return resp, data, err
+}
+
+func (c *conformanceClient) put(key string, body []byte) error {
+	resp, _, err := c.do("PUT", c.objectPath(key), nil, body)
+	if err != nil {
+		return err
+	}
+	return expectStatus(resp, http.StatusOK)
+}
+
+func expectStatus(resp *http.Response, status int) error {
+	if resp.StatusCode != status {
+		return fmt.Errorf("got status %d, want %d", resp.StatusCode, status)
+	}
+	return nil
+}
+
+func expectHeader(resp *http.Response, name, want string) error {
+	if got := resp.Header.Get(name); got != want {
+		return fmt.Errorf("got %s %q, want %q", name, got, want)
+	}
+	return nil
+}
+
+// expectError checks an S3 XML error response.
+func expectError(resp *http.Response, body []byte, status int, code string) error {
+	if err := expectStatus(resp, status); err != nil {
+		return err
+	}
+	if resp.Header.Get("x-amz-request-id") == "" {
+		return fmt.Errorf("missing x-amz-request-id header")
+	}
+	var e struct {
+		Code      string
+		RequestId string
+	}
+	if err := xml.Unmarshal(body, &e); err != nil {
+		return fmt.Errorf("invalid error body: %w", err)
+	}
+	if e.Code != code {
+		return fmt.Errorf("got error code %q, want %q", e.Code, code)
+	}
+	if e.RequestId != resp.Header.Get("x-amz-request-id") {
+		return fmt.Errorf("error RequestId %q doesn't match x-amz-request-id %q", e.RequestId, resp.Header.Get("x-amz-request-id"))
+	}
+	return nil
+}
+
+type listBucketResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	KeyCount              int
+	Contents              []struct {
+		Key  string
+		ETag string
+		Size int64
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+}
+
+func (c *conformanceClient) list(query url.Values) (*listBucketResult, error) {
+	query.Set("list-type", "2")
+	resp, body, err := c.do("GET", "/"+url.PathEscape(c.bucket)+"/?"+query.Encode(), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := expectStatus(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+	var result listBucketResult
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("invalid listing: %w", err)
+	}
+	return &result, nil
+}
+
+// conformanceCheck is a single protocol check, modelled on the ceph/s3-tests
+// cases of the same name.
+type conformanceCheck struct {
+	name string
+	run  func(c *conformanceClient) error
+}
+
+var conformanceChecks = []conformanceCheck{
+	{"object_write_read_update_read_delete", func(c *conformanceClient) error {
+		for _, body := range []string{"foo", "bar"} {
+			if err := c.put("rw", []byte(body)); err != nil {
+				return err
+			}
+			resp, got, err := c.do("GET", c.objectPath("rw"), nil, nil)
+			if err != nil {
+				return err
+			}
+			if err := expectStatus(resp, http.StatusOK); err != nil {
+				return err
+			}
+			if string(got) != body {
+				return fmt.Errorf("got body %q, want %q", got, body)
+			}
+		}
+		resp, body, err := c.do("DELETE", c.objectPath("rw"), nil, nil)
+		if err != nil {
+			return err
+		}
+		if err := expectStatus(resp, http.StatusNoContent); err != nil {
+			return err
+		}
+		if len(body) != 0 {
+			return fmt.Errorf("DELETE returned a body")
+		}
+		resp, body, err = c.do("GET", c.objectPath("rw"), nil, nil)
+		if err != nil {
+			return err
+		}
+		return expectError(resp, body, http.StatusNotFound, "NoSuchKey")
+	}},
+	{"object_read_headers", func(c *conformanceClient) error {
+		body := []byte("header check")
+		if err := c.put("headers", body); err != nil {
+			return err
+		}
+		sum := md5.Sum(body)
+		etag := fmt.Sprintf(`"%x"`, sum)
+		for _, method := range []string{"GET", "HEAD"} {
+			resp, _, err := c.do(method, c.objectPath("headers"), nil, nil)
+			if err != nil {
+				return err
+			}
+			if err := expectStatus(resp, http.StatusOK); err != nil {
+				return fmt.Errorf("%s: %w", method, err)
+			}
+			for name, want := range map[string]string{
+				"Content-Length": fmt.Sprint(len(body)),
+				"ETag":           etag,
+				"Accept-Ranges":  "bytes",
+			} {
+				if err := expectHeader(resp, name, want); err != nil {
+					return fmt.Errorf("%s: %w", method, err)
+				}
+			}
+			for _, name := range []string{"Content-Type", "Last-Modified", "x-amz-request-id", "x-amz-id-2"} {
+				if resp.Header.Get(name) == "" {
+					return fmt.Errorf("%s: missing %s header", method, name)
+				}
+			}
+			if _, err := http.ParseTime(resp.Header.Get("Last-Modified")); err != nil {
+				return fmt.Errorf("%s: invalid Last-Modified: %w", method, err)
+			}
+		}
+		return nil
+	}},
+	{"ranged_request_response_code", func(c *conformanceClient) error {
+		if err := c.put("range", []byte("testcontent")); err != nil {
+			return err
+		}
+		for _, tc := range []struct{ rng, body, contentRange string }{
+			{"bytes=4-7", "cont", "bytes 4-7/11"},
+			{"bytes=4-", "content", "bytes 4-10/11"},
+			{"bytes=0-0", "t", "bytes 0-0/11"},
+		} {
+			resp, got, err := c.do("GET", c.objectPath("range"), http.Header{"Range": {tc.rng}}, nil)
+			if err != nil {
+				return err
+			}
+			if err := expectStatus(resp, http.StatusPartialContent); err != nil {
+				return fmt.Errorf("%s: %w", tc.rng, err)
+			}
+			if err := expectHeader(resp, "Content-Range", tc.contentRange); err != nil {
+				return fmt.Errorf("%s: %w", tc.rng, err)
+			}
+			if string(got) != tc.body {
+				return fmt.Errorf("%s: got body %q, want %q", tc.rng, got, tc.body)
+			}
+		}
+		return nil
+	}},
+	{"object_head_zero_bytes_nonexistent", func(c *conformanceClient) error {
+		resp, body, err := c.do("HEAD", c.objectPath("does-not-exist"), nil, nil)
+		if err != nil {
+			return err
+		}
+		if err := expectStatus(resp, http.StatusNotFound); err != nil {
+			return err
+		}
+		if len(body) != 0 {
+			return fmt.Errorf("HEAD returned a body")
+		}
+		return nil
+	}},
+	{"object_read_not_exist", func(c *conformanceClient) error {
+		resp, body, err := c.do("GET", c.objectPath("does-not-exist"), nil, nil)
+		if err != nil {
+			return err
+		}
+		return expectError(resp, body, http.StatusNotFound, "NoSuchKey")
+	}},
+	{"object_create_bad_md5_invalid", func(c *conformanceClient) error {
+		sum := md5.Sum([]byte("something else"))
+		header := http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum[:])}}
+		resp, body, err := c.do("PUT", c.objectPath("bad-md5"), header, []byte("bar"))
+		if err != nil {
+			return err
+		}
+		if err := expectError(resp, body, http.StatusBadRequest, "BadDigest"); err != nil {
+			return err
+		}
+		resp, _, err = c.do("HEAD", c.objectPath("bad-md5"), nil, nil)
+		if err != nil {
+			return err
+		}
+		return expectStatus(resp, http.StatusNotFound)
+	}},
+	{"object_write_read_awkward_keys", func(c *conformanceClient) error {
+		for _, key := range []string{"with space", "with+plus", "100%", "ünïcödé", "a//double", "dot/./segment"} {
+			if err := c.put(key, []byte(key)); err != nil {
+				return fmt.Errorf("%q: %w", key, err)
+			}
+			resp, got, err := c.do("GET", c.objectPath(key), nil, nil)
+			if err != nil {
+				return err
+			}
+			if err := expectStatus(resp, http.StatusOK); err != nil {
+				return fmt.Errorf("%q: %w", key, err)
+			}
+			if string(got) != key {
+				return fmt.Errorf("%q: got body %q", key, got)
+			}
+		}
+		return nil
+	}},
+	{"bucket_listv2_maxkeys_pagination", func(c *conformanceClient) error {
+		for _, key := range []string{"a", "b", "c"} {
+			if err := c.put("page/"+key, []byte(key)); err != nil {
+				return err
+			}
+		}
+		var keys []string
+		query := url.Values{"prefix": {c.prefix + "page/"}, "max-keys": {"2"}}
+		for page := 0; ; page++ {
+			result, err := c.list(query)
+			if err != nil {
+				return err
+			}
+			if result.KeyCount != len(result.Contents) {
+				return fmt.Errorf("KeyCount %d doesn't match %d keys", result.KeyCount, len(result.Contents))
+			}
+			for _, obj := range result.Contents {
+				if obj.ETag == "" {
+					return fmt.Errorf("%s: missing ETag in listing", obj.Key)
+				}
+				keys = append(keys, strings.TrimPrefix(obj.Key, c.prefix+"page/"))
+			}
+			if !result.IsTruncated {
+				break
+			}
+			if result.NextContinuationToken == "" || page > 3 {
+				return fmt.Errorf("truncated listing without usable NextContinuationToken")
+			}
+			query.Set("continuation-token", result.NextContinuationToken)
+		}
+		if strings.Join(keys, ",") != "a,b,c" {
+			return fmt.Errorf("listed %v, want [a b c]", keys)
+		}
+		return nil
+	}},
+	{"bucket_listv2_delimiter_basic", func(c *conformanceClient) error {
+		for _, key := range []string{"delim/foo/bar", "delim/foo/baz", "delim/quux"} {
+			if err := c.put(key, []byte(key)); err != nil {
+				return err
+			}
+		}
+		result, err := c.list(url.Values{"prefix": {c.prefix + "delim/"}, "delimiter": {"/"}})
+		if err != nil {
+			return err
+		}
+		if len(result.Contents) != 1 || result.Contents[0].Key != c.prefix+"delim/quux" {
+			return fmt.Errorf("got contents %v, want [%squux]", result.Contents, c.prefix+"delim/")
+		}
+		if len(result.CommonPrefixes) != 1 || result.CommonPrefixes[0].Prefix != c.prefix+"delim/foo/" {
+			return fmt.Errorf("got common prefixes %v, want [%sfoo/]", result.CommonPrefixes, c.prefix+"delim/")
+		}
+		return nil
+	}},
+	{"bucket_listv2_encoding_basic", func(c *conformanceClient) error {
+		if err := c.put("enc/a b+c", []byte("x")); err != nil {
+			return err
+		}
+		result, err := c.list(url.Values{"prefix": {c.prefix + "enc/"}, "encoding-type": {"url"}})
+		if err != nil {
+			return err
+		}
+		if len(result.Contents) != 1 {
+			return fmt.Errorf("got %d keys, want 1", len(result.Contents))
+		}
+		key, err := url.QueryUnescape(result.Contents[0].Key)
+		if err != nil || key != c.prefix+"enc/a b+c" {
+			return fmt.Errorf("got encoded key %q", result.Contents[0].Key)
+		}
+		return nil
+	}},
+	{"unsupported_operations", func(c *conformanceClient) error {
+		resp, body, err := c.do("GET", c.objectPath("headers")+"?acl", nil, nil)
+		if err != nil {
+			return err
+		}
+		if err := expectError(resp, body, http.StatusNotImplemented, "NotImplemented"); err != nil {
+			return fmt.Errorf("GET ?acl: %w", err)
+		}
+		resp, body, err = c.do("POST", c.objectPath("headers"), nil, nil)
+		if err != nil {
+			return err
+		}
+		if err := expectError(resp, body, http.StatusMethodNotAllowed, "MethodNotAllowed"); err != nil {
+			return fmt.Errorf("POST: %w", err)
+		}
+		return nil
+	}},
+}
+
+// runConformance implements the conformance subcommand: it runs S3 protocol
+// checks against a running proxy, or one started in-process with -harness,
+// and reports which pass.
+func runConformance(args []string) int {
+	fs := flag.NewFlagSet("conformance", flag.ExitOnError)
+	var (
+		proxyURL     = fs.String("url", "http://localhost:8080", "proxy URL")
+		bucket       = fs.String("bucket", "conformance", "bucket to run against; objects under the prefix are overwritten")
+		prefix       = fs.String("prefix", fmt.Sprintf("conformance-%d/", time.Now().Unix()), "key prefix of the test objects")
+		run          = fs.String("run", "", "only run checks whose name contains this string")
+		harnessOf    = fs.String("harness", "", "start a proxy in-process in front of this backend, memory or minio (a docker container), instead of using -url, and also run SDK client checks")
+		harnessCache = fs.Bool("harness.cache", false, "enable the write-back cache of the -harness proxy")
+		minIOImage   = fs.String("harness.minio-image", "minio/minio", "image of the minio -harness backend")
+	)
+	if err := parseFlags(fs, args); err != nil {
+		fmt.Fprintln(os.Stderr, "conformance:", err)
+		return 2
+	}
+
+	var h *harness.Harness
+	if *harnessOf != "" {
+		var err error
+		h, err = harness.Start(context.Background(), harness.Options{
+			Backend:    harness.Backend(*harnessOf),
+			Bucket:     *bucket,
+			Cache:      *harnessCache,
+			MinIOImage: *minIOImage,
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "conformance:", err)
+			return 1
+		}
+		defer h.Close()
+		*proxyURL = h.URL
+	}
+
+	c := &conformanceClient{
+		url:    strings.TrimSuffix(*proxyURL, "/"),
+		bucket: *bucket,
+		prefix: *prefix,
+		http:   &http.Client{Timeout: 30 * time.Second},
+	}
+
+	passed, failed := 0, 0
+	for _, check := range conformanceChecks {
+		if !strings.Contains(check.name, *run) {
+			continue
+		}
+		if err := check.run(c); err != nil {
+			fmt.Printf("FAIL  %s: %v\n", check.name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("PASS  %s\n", check.name)
+		passed++
+	}
+	if h != nil {
+		sdkPassed, sdkFailed := harness.Run(context.Background(), h, *prefix, *run, func(name string, err error) {
+			if err != nil {
+				fmt.Printf("FAIL  %s: %v\n", name, err)
+				return
+			}
+			fmt.Printf("PASS  %s\n", name)
+		})
+		passed, failed = passed+sdkPassed, failed+sdkFailed
+	}
+
+	fmt.Printf("\n%d passed, %d failed\n", passed, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
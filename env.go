@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envPrefix prefixes the environment variables read by setFlagsFromEnv.
+const envPrefix = "S3PROXY_"
+
+// flagEnvName maps a flag name to its environment variable, e.g.
+// "http.addr" to "S3PROXY_HTTP_ADDR".
+func flagEnvName(prefix, name string) string {
+	return prefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+}
+
+// setFlagsFromEnv sets every flag of fs which has a corresponding
+// environment variable. It must be called before fs.Parse, so that the
+// precedence is: command line, then environment, then flag defaults.
+func setFlagsFromEnv(fs *flag.FlagSet, prefix string) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := flagEnvName(prefix, f.Name)
+		if value, ok := os.LookupEnv(name); ok && err == nil {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %w", value, name, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// usageWithEnv returns a usage function that also documents the environment
+// variable of each flag.
+func usageWithEnv(fs *flag.FlagSet, prefix string) func() {
+	return func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage of %s:\n", fs.Name())
+		fs.PrintDefaults()
+
+		var example string
+		fs.VisitAll(func(f *flag.Flag) {
+			if example == "" {
+				example = f.Name
+			}
+		})
+		fmt.Fprintf(out, "\nEvery flag can also be set with an environment variable named after it, e.g. -%s as %s.\n", example, flagEnvName(prefix, example))
+		fmt.Fprintln(out, "Flags given on the command line take precedence over the environment.")
+	}
+}
@@ -0,0 +1,306 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: admin.proto
+
+package adminpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Admin_WarmCache_FullMethodName          = "/s3proxy.admin.v1.Admin/WarmCache"
+	Admin_PurgeCache_FullMethodName         = "/s3proxy.admin.v1.Admin/PurgeCache"
+	Admin_ReloadConfig_FullMethodName       = "/s3proxy.admin.v1.Admin/ReloadConfig"
+	Admin_BackendHealth_FullMethodName      = "/s3proxy.admin.v1.Admin/BackendHealth"
+	Admin_ListPendingUploads_FullMethodName = "/s3proxy.admin.v1.Admin/ListPendingUploads"
+	Admin_FlushUploads_FullMethodName       = "/s3proxy.admin.v1.Admin/FlushUploads"
+)
+
+// AdminClient is the client API for Admin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AdminClient interface {
+	// WarmCache loads objects into the cache, regardless of admission policy.
+	WarmCache(ctx context.Context, in *CacheKeysRequest, opts ...grpc.CallOption) (*CacheKeysResponse, error)
+	// PurgeCache evicts objects, or everything, from the cache.
+	PurgeCache(ctx context.Context, in *CacheKeysRequest, opts ...grpc.CallOption) (*CacheKeysResponse, error)
+	// ReloadConfig re-reads the config file and applies it.
+	ReloadConfig(ctx context.Context, in *ReloadConfigRequest, opts ...grpc.CallOption) (*ReloadConfigResponse, error)
+	// BackendHealth reports whether the upstream can serve traffic.
+	BackendHealth(ctx context.Context, in *BackendHealthRequest, opts ...grpc.CallOption) (*BackendHealthResponse, error)
+	// ListPendingUploads lists write-back uploads which haven't completed yet.
+	ListPendingUploads(ctx context.Context, in *ListPendingUploadsRequest, opts ...grpc.CallOption) (*ListPendingUploadsResponse, error)
+	// FlushUploads waits for pending write-back uploads to complete.
+	FlushUploads(ctx context.Context, in *FlushUploadsRequest, opts ...grpc.CallOption) (*FlushUploadsResponse, error)
+}
+
+type adminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAdminClient(cc grpc.ClientConnInterface) AdminClient {
+	return &adminClient{cc}
+}
+
+func (c *adminClient) WarmCache(ctx context.Context, in *CacheKeysRequest, opts ...grpc.CallOption) (*CacheKeysResponse, error) {
+	out := new(CacheKeysResponse)
+	err := c.cc.Invoke(ctx, Admin_WarmCache_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) PurgeCache(ctx context.Context, in *CacheKeysRequest, opts ...grpc.CallOption) (*CacheKeysResponse, error) {
+	out := new(CacheKeysResponse)
+	err := c.cc.Invoke(ctx, Admin_PurgeCache_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) ReloadConfig(ctx context.Context, in *ReloadConfigRequest, opts ...grpc.CallOption) (*ReloadConfigResponse, error) {
+	out := new(ReloadConfigResponse)
+	err := c.cc.Invoke(ctx, Admin_ReloadConfig_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) BackendHealth(ctx context.Context, in *BackendHealthRequest, opts ...grpc.CallOption) (*BackendHealthResponse, error) {
+	out := new(BackendHealthResponse)
+	err := c.cc.Invoke(ctx, Admin_BackendHealth_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) ListPendingUploads(ctx context.Context, in *ListPendingUploadsRequest, opts ...grpc.CallOption) (*ListPendingUploadsResponse, error) {
+	out := new(ListPendingUploadsResponse)
+	err := c.cc.Invoke(ctx, Admin_ListPendingUploads_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) FlushUploads(ctx context.Context, in *FlushUploadsRequest, opts ...grpc.CallOption) (*FlushUploadsResponse, error) {
+	out := new(FlushUploadsResponse)
+	err := c.cc.Invoke(ctx, Admin_FlushUploads_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AdminServer is the server API for Admin service.
+// All implementations must embed UnimplementedAdminServer
+// for forward compatibility
+type AdminServer interface {
+	// WarmCache loads objects into the cache, regardless of admission policy.
+	WarmCache(context.Context, *CacheKeysRequest) (*CacheKeysResponse, error)
+	// PurgeCache evicts objects, or everything, from the cache.
+	PurgeCache(context.Context, *CacheKeysRequest) (*CacheKeysResponse, error)
+	// ReloadConfig re-reads the config file and applies it.
+	ReloadConfig(context.Context, *ReloadConfigRequest) (*ReloadConfigResponse, error)
+	// BackendHealth reports whether the upstream can serve traffic.
+	BackendHealth(context.Context, *BackendHealthRequest) (*BackendHealthResponse, error)
+	// ListPendingUploads lists write-back uploads which haven't completed yet.
+	ListPendingUploads(context.Context, *ListPendingUploadsRequest) (*ListPendingUploadsResponse, error)
+	// FlushUploads waits for pending write-back uploads to complete.
+	FlushUploads(context.Context, *FlushUploadsRequest) (*FlushUploadsResponse, error)
+	mustEmbedUnimplementedAdminServer()
+}
+
+// UnimplementedAdminServer must be embedded to have forward compatible implementations.
+type UnimplementedAdminServer struct {
+}
+
+func (UnimplementedAdminServer) WarmCache(context.Context, *CacheKeysRequest) (*CacheKeysResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method WarmCache not implemented")
+}
+func (UnimplementedAdminServer) PurgeCache(context.Context, *CacheKeysRequest) (*CacheKeysResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PurgeCache not implemented")
+}
+func (UnimplementedAdminServer) ReloadConfig(context.Context, *ReloadConfigRequest) (*ReloadConfigResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReloadConfig not implemented")
+}
+func (UnimplementedAdminServer) BackendHealth(context.Context, *BackendHealthRequest) (*BackendHealthResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BackendHealth not implemented")
+}
+func (UnimplementedAdminServer) ListPendingUploads(context.Context, *ListPendingUploadsRequest) (*ListPendingUploadsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListPendingUploads not implemented")
+}
+func (UnimplementedAdminServer) FlushUploads(context.Context, *FlushUploadsRequest) (*FlushUploadsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FlushUploads not implemented")
+}
+func (UnimplementedAdminServer) mustEmbedUnimplementedAdminServer() {}
+
+// UnsafeAdminServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AdminServer will
+// result in compilation errors.
+type UnsafeAdminServer interface {
+	mustEmbedUnimplementedAdminServer()
+}
+
+func RegisterAdminServer(s grpc.ServiceRegistrar, srv AdminServer) {
+	s.RegisterService(&Admin_ServiceDesc, srv)
+}
+
+func _Admin_WarmCache_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CacheKeysRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).WarmCache(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_WarmCache_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).WarmCache(ctx, req.(*CacheKeysRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_PurgeCache_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CacheKeysRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).PurgeCache(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_PurgeCache_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).PurgeCache(ctx, req.(*CacheKeysRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_ReloadConfig_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReloadConfigRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ReloadConfig(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_ReloadConfig_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ReloadConfig(ctx, req.(*ReloadConfigRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_BackendHealth_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BackendHealthRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).BackendHealth(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_BackendHealth_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).BackendHealth(ctx, req.(*BackendHealthRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_ListPendingUploads_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListPendingUploadsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ListPendingUploads(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_ListPendingUploads_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ListPendingUploads(ctx, req.(*ListPendingUploadsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_FlushUploads_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FlushUploadsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).FlushUploads(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Admin_FlushUploads_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).FlushUploads(ctx, req.(*FlushUploadsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Admin_ServiceDesc is the grpc.ServiceDesc for Admin service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Admin_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "s3proxy.admin.v1.Admin",
+	HandlerType: (*AdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "WarmCache",
+			Handler:    _Admin_WarmCache_Handler,
+		},
+		{
+			MethodName: "PurgeCache",
+			Handler:    _Admin_PurgeCache_Handler,
+		},
+		{
+			MethodName: "ReloadConfig",
+			Handler:    _Admin_ReloadConfig_Handler,
+		},
+		{
+			MethodName: "BackendHealth",
+			Handler:    _Admin_BackendHealth_Handler,
+		},
+		{
+			MethodName: "ListPendingUploads",
+			Handler:    _Admin_ListPendingUploads_Handler,
+		},
+		{
+			MethodName: "FlushUploads",
+			Handler:    _Admin_FlushUploads_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "admin.proto",
+}
@@ -0,0 +1,91 @@
+package admin
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+
+	cloud_storage "github.com/rampage644/s3-overlay-proxy/cloud-storage"
+)
+
+type ReloadConfigRequest struct {
+}
+
+type BackendHealthRequest struct {
+}
+
+type BackendHealthResponse struct {
+	Ready  bool
+	Reason string
+}
+
+type PendingUploadsRequest struct {
+}
+
+type FlushUploadsRequest struct {
+	Timeout time.Duration
+}
+
+// Endpoints collects the admin API endpoints.
+type Endpoints struct {
+	WarmCache      endpoint.Endpoint
+	PurgeCache     endpoint.Endpoint
+	ReloadConfig   endpoint.Endpoint
+	BackendHealth  endpoint.Endpoint
+	PendingUploads endpoint.Endpoint
+	FlushUploads   endpoint.Endpoint
+}
+
+// MakeEndpoints returns the endpoints of svc.
+func MakeEndpoints(svc Service) Endpoints {
+	return Endpoints{
+		WarmCache:      MakeWarmCacheEndpoint(svc),
+		PurgeCache:     MakePurgeCacheEndpoint(svc),
+		ReloadConfig:   MakeReloadConfigEndpoint(svc),
+		BackendHealth:  MakeBackendHealthEndpoint(svc),
+		PendingUploads: MakePendingUploadsEndpoint(svc),
+		FlushUploads:   MakeFlushUploadsEndpoint(svc),
+	}
+}
+
+func MakeWarmCacheEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		return svc.WarmCache(ctx, request.(cloud_storage.CacheKeysRequest))
+	}
+}
+
+func MakePurgeCacheEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		return svc.PurgeCache(ctx, request.(cloud_storage.CacheKeysRequest))
+	}
+}
+
+func MakeReloadConfigEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, _ interface{}) (interface{}, error) {
+		return svc.ReloadConfig(ctx)
+	}
+}
+
+// MakeBackendHealthEndpoint reports an unhealthy backend in the response
+// rather than as an error, so that callers can tell it from a failed call.
+func MakeBackendHealthEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, _ interface{}) (interface{}, error) {
+		if err := svc.BackendHealth(ctx); err != nil {
+			return BackendHealthResponse{Reason: err.Error()}, nil
+		}
+		return BackendHealthResponse{Ready: true}, nil
+	}
+}
+
+func MakePendingUploadsEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, _ interface{}) (interface{}, error) {
+		return svc.PendingUploads(ctx)
+	}
+}
+
+func MakeFlushUploadsEndpoint(svc Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		return svc.FlushUploads(ctx, request.(FlushUploadsRequest).Timeout)
+	}
+}
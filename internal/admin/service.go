@@ -0,0 +1,123 @@
+// Package admin implements the admin gRPC API, letting a control plane
+// manage proxies programmatically. It offers the operations of the admin
+// HTTP endpoints.
+package admin
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	cloud_storage "github.com/rampage644/s3-overlay-proxy/cloud-storage"
+	"github.com/rampage644/s3-overlay-proxy/internal/config"
+)
+
+// defaultFlushTimeout matches the POST /cache/flush default.
+const defaultFlushTimeout = 30 * time.Second
+
+// Service is the admin API.
+type Service interface {
+	WarmCache(ctx context.Context, req cloud_storage.CacheKeysRequest) ([]cloud_storage.CacheKeyResult, error)
+	PurgeCache(ctx context.Context, req cloud_storage.CacheKeysRequest) ([]cloud_storage.CacheKeyResult, error)
+	ReloadConfig(ctx context.Context) ([]config.Change, error)
+	BackendHealth(ctx context.Context) error
+	PendingUploads(ctx context.Context) ([]string, error)
+	FlushUploads(ctx context.Context, timeout time.Duration) (int64, error)
+}
+
+type adminService struct {
+	cache    *cloud_storage.CachedCloudStorage
+	reloader *config.Reloader
+	checks   []cloud_storage.ReadinessCheck
+}
+
+// NewService returns the admin API of a proxy. cache may be nil if caching
+// is disabled, failing the cache operations.
+func NewService(cache *cloud_storage.CachedCloudStorage, reloader *config.Reloader, checks []cloud_storage.ReadinessCheck) Service {
+	return &adminService{cache: cache, reloader: reloader, checks: checks}
+}
+
+var errCacheDisabled = status.Error(codes.FailedPrecondition, "cache disabled")
+
+func validateCacheKeys(req cloud_storage.CacheKeysRequest) error {
+	if !req.All && (req.Bucket == "" || len(req.Keys) == 0) {
+		return status.Error(codes.InvalidArgument, "bucket and keys are required")
+	}
+	return nil
+}
+
+func (s *adminService) WarmCache(ctx context.Context, req cloud_storage.CacheKeysRequest) ([]cloud_storage.CacheKeyResult, error) {
+	if s.cache == nil {
+		return nil, errCacheDisabled
+	}
+	if err := validateCacheKeys(req); err != nil {
+		return nil, err
+	}
+	results := make([]cloud_storage.CacheKeyResult, len(req.Keys))
+	for i, key := range req.Keys {
+		results[i].Key = key
+		if err := s.cache.Warm(ctx, req.Bucket, key); err != nil {
+			results[i].Error = err.Error()
+		}
+	}
+	return results, nil
+}
+
+func (s *adminService) PurgeCache(_ context.Context, req cloud_storage.CacheKeysRequest) ([]cloud_storage.CacheKeyResult, error) {
+	if s.cache == nil {
+		return nil, errCacheDisabled
+	}
+	if err := validateCacheKeys(req); err != nil {
+		return nil, err
+	}
+	if req.All {
+		s.cache.PurgeAll()
+	}
+	results := make([]cloud_storage.CacheKeyResult, len(req.Keys))
+	for i, key := range req.Keys {
+		s.cache.Purge(req.Bucket, key)
+		results[i].Key = key
+	}
+	return results, nil
+}
+
+func (s *adminService) ReloadConfig(_ context.Context) ([]config.Change, error) {
+	changes, err := s.reloader.Reload()
+	if errors.Is(err, config.ErrNoConfigFile) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	} else if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return changes, nil
+}
+
+func (s *adminService) BackendHealth(_ context.Context) error {
+	for _, check := range s.checks {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *adminService) PendingUploads(_ context.Context) ([]string, error) {
+	if s.cache == nil {
+		return nil, errCacheDisabled
+	}
+	return s.cache.PendingUploads(), nil
+}
+
+func (s *adminService) FlushUploads(ctx context.Context, timeout time.Duration) (int64, error) {
+	if s.cache == nil {
+		return 0, errCacheDisabled
+	}
+	if timeout <= 0 {
+		timeout = defaultFlushTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return s.cache.Flush(ctx), nil
+}
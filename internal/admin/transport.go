@@ -0,0 +1,167 @@
+package admin
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/transport"
+	grpctransport "github.com/go-kit/kit/transport/grpc"
+
+	cloud_storage "github.com/rampage644/s3-overlay-proxy/cloud-storage"
+	"github.com/rampage644/s3-overlay-proxy/internal/admin/adminpb"
+	"github.com/rampage644/s3-overlay-proxy/internal/config"
+)
+
+type grpcServer struct {
+	adminpb.UnimplementedAdminServer
+
+	warmCache      grpctransport.Handler
+	purgeCache     grpctransport.Handler
+	reloadConfig   grpctransport.Handler
+	backendHealth  grpctransport.Handler
+	pendingUploads grpctransport.Handler
+	flushUploads   grpctransport.Handler
+}
+
+// NewGRPCServer makes the endpoints available as the adminpb.Admin gRPC
+// service.
+func NewGRPCServer(endpoints Endpoints, logger log.Logger) adminpb.AdminServer {
+	options := []grpctransport.ServerOption{
+		grpctransport.ServerErrorHandler(transport.NewLogErrorHandler(logger)),
+	}
+	logged := func(method string, e endpoint.Endpoint) endpoint.Endpoint {
+		return loggingMiddleware(log.With(logger, "method", method))(e)
+	}
+
+	return &grpcServer{
+		warmCache:      grpctransport.NewServer(logged("WarmCache", endpoints.WarmCache), decodeCacheKeysRequest, encodeCacheKeysResponse, options...),
+		purgeCache:     grpctransport.NewServer(logged("PurgeCache", endpoints.PurgeCache), decodeCacheKeysRequest, encodeCacheKeysResponse, options...),
+		reloadConfig:   grpctransport.NewServer(logged("ReloadConfig", endpoints.ReloadConfig), decodeReloadConfigRequest, encodeReloadConfigResponse, options...),
+		backendHealth:  grpctransport.NewServer(logged("BackendHealth", endpoints.BackendHealth), decodeBackendHealthRequest, encodeBackendHealthResponse, options...),
+		pendingUploads: grpctransport.NewServer(logged("ListPendingUploads", endpoints.PendingUploads), decodePendingUploadsRequest, encodePendingUploadsResponse, options...),
+		flushUploads:   grpctransport.NewServer(logged("FlushUploads", endpoints.FlushUploads), decodeFlushUploadsRequest, encodeFlushUploadsResponse, options...),
+	}
+}
+
+// loggingMiddleware logs the duration of each call and its error, if any.
+func loggingMiddleware(logger log.Logger) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			defer func(begin time.Time) {
+				logger.Log("took", time.Since(begin), "err", err)
+			}(time.Now())
+			return next(ctx, request)
+		}
+	}
+}
+
+func (s *grpcServer) WarmCache(ctx context.Context, req *adminpb.CacheKeysRequest) (*adminpb.CacheKeysResponse, error) {
+	_, resp, err := s.warmCache.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*adminpb.CacheKeysResponse), nil
+}
+
+func (s *grpcServer) PurgeCache(ctx context.Context, req *adminpb.CacheKeysRequest) (*adminpb.CacheKeysResponse, error) {
+	_, resp, err := s.purgeCache.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*adminpb.CacheKeysResponse), nil
+}
+
+func (s *grpcServer) ReloadConfig(ctx context.Context, req *adminpb.ReloadConfigRequest) (*adminpb.ReloadConfigResponse, error) {
+	_, resp, err := s.reloadConfig.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*adminpb.ReloadConfigResponse), nil
+}
+
+func (s *grpcServer) BackendHealth(ctx context.Context, req *adminpb.BackendHealthRequest) (*adminpb.BackendHealthResponse, error) {
+	_, resp, err := s.backendHealth.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*adminpb.BackendHealthResponse), nil
+}
+
+func (s *grpcServer) ListPendingUploads(ctx context.Context, req *adminpb.ListPendingUploadsRequest) (*adminpb.ListPendingUploadsResponse, error) {
+	_, resp, err := s.pendingUploads.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*adminpb.ListPendingUploadsResponse), nil
+}
+
+func (s *grpcServer) FlushUploads(ctx context.Context, req *adminpb.FlushUploadsRequest) (*adminpb.FlushUploadsResponse, error) {
+	_, resp, err := s.flushUploads.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*adminpb.FlushUploadsResponse), nil
+}
+
+func decodeCacheKeysRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*adminpb.CacheKeysRequest)
+	return cloud_storage.CacheKeysRequest{
+		Bucket: req.GetBucket(),
+		Keys:   req.GetKeys(),
+		All:    req.GetAll(),
+	}, nil
+}
+
+func encodeCacheKeysResponse(_ context.Context, response interface{}) (interface{}, error) {
+	results := response.([]cloud_storage.CacheKeyResult)
+	resp := &adminpb.CacheKeysResponse{Results: make([]*adminpb.CacheKeyResult, len(results))}
+	for i, result := range results {
+		resp.Results[i] = &adminpb.CacheKeyResult{Key: result.Key, Error: result.Error}
+	}
+	return resp, nil
+}
+
+func decodeReloadConfigRequest(_ context.Context, _ interface{}) (interface{}, error) {
+	return ReloadConfigRequest{}, nil
+}
+
+func encodeReloadConfigResponse(_ context.Context, response interface{}) (interface{}, error) {
+	changes := response.([]config.Change)
+	resp := &adminpb.ReloadConfigResponse{Changes: make([]*adminpb.ConfigChange, len(changes))}
+	for i, change := range changes {
+		resp.Changes[i] = &adminpb.ConfigChange{Path: change.Path, From: change.From, To: change.To}
+	}
+	return resp, nil
+}
+
+func decodeBackendHealthRequest(_ context.Context, _ interface{}) (interface{}, error) {
+	return BackendHealthRequest{}, nil
+}
+
+func encodeBackendHealthResponse(_ context.Context, response interface{}) (interface{}, error) {
+	resp := response.(BackendHealthResponse)
+	return &adminpb.BackendHealthResponse{Ready: resp.Ready, Reason: resp.Reason}, nil
+}
+
+func decodePendingUploadsRequest(_ context.Context, _ interface{}) (interface{}, error) {
+	return PendingUploadsRequest{}, nil
+}
+
+func encodePendingUploadsResponse(_ context.Context, response interface{}) (interface{}, error) {
+	return &adminpb.ListPendingUploadsResponse{Keys: response.([]string)}, nil
+}
+
+func decodeFlushUploadsRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*adminpb.FlushUploadsRequest)
+	var timeout time.Duration
+	if req.GetTimeout() != nil {
+		timeout = req.GetTimeout().AsDuration()
+	}
+	return FlushUploadsRequest{Timeout: timeout}, nil
+}
+
+func encodeFlushUploadsResponse(_ context.Context, response interface{}) (interface{}, error) {
+	return &adminpb.FlushUploadsResponse{Pending: response.(int64)}, nil
+}
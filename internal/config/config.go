@@ -0,0 +1,396 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	cloud_storage "github.com/rampage644/s3-overlay-proxy/cloud-storage"
+)
+
+// Config holds the settings which can be changed at runtime. Its initial
+// value is built from command line flags; settings present in the config
+// file override it.
+type Config struct {
+	// LogLevel is "info", logging everything, or "error", logging only the
+	// records with an error.
+	LogLevel string `json:"logLevel,omitempty"`
+
+	RateLimit   RateLimit   `json:"rateLimit"`
+	Bandwidth   Bandwidth   `json:"bandwidth"`
+	Compression Compression `json:"compression"`
+	Cache       Cache       `json:"cache"`
+
+	// BucketMappings maps client-facing bucket names to upstream ones.
+	BucketMappings map[string]string `json:"bucketMappings,omitempty"`
+
+	// VirtualBuckets defines buckets which only exist in the proxy, by name.
+	VirtualBuckets map[string]cloud_storage.VirtualBucket `json:"virtualBuckets,omitempty"`
+
+	// ArchiveRestore holds the policies restoring archived objects on GET,
+	// by upstream bucket.
+	ArchiveRestore map[string]cloud_storage.ArchiveRestore `json:"archiveRestore,omitempty"`
+
+	// BucketOperations restricts the operations allowed per upstream
+	// bucket.
+	BucketOperations map[string]cloud_storage.BucketOperations `json:"bucketOperations,omitempty"`
+
+	// PublicBuckets sets the HTTP caching headers of public buckets, by
+	// client-facing name.
+	PublicBuckets map[string]cloud_storage.PublicBucket `json:"publicBuckets,omitempty"`
+
+	// Transforms configures the GET transformations per bucket and prefix.
+	Transforms []cloud_storage.TransformRule `json:"transforms,omitempty"`
+
+	// UploadRules sets default Content-Types and metadata of uploads per
+	// bucket and prefix.
+	UploadRules []cloud_storage.UploadRule `json:"uploadRules,omitempty"`
+
+	// KeyRewrites rewrites the keys of object requests, the first matching
+	// rule applying.
+	KeyRewrites []cloud_storage.KeyRewriteRule `json:"keyRewrites,omitempty"`
+
+	// DryRun acknowledges uploads and deletes without sending them
+	// upstream, in some buckets or all of them.
+	DryRun cloud_storage.DryRun `json:"dryRun"`
+
+	// Credentials for the upstream; when empty the default AWS credential
+	// chain is used.
+	Credentials Credentials `json:"credentials"`
+
+	// TenantRoles maps client access keys to the upstream IAM roles their
+	// requests are made as.
+	TenantRoles map[string]string `json:"tenantRoles,omitempty"`
+
+	// TenantSecrets maps the access keys of TenantRoles to their secret
+	// keys, which the signatures of their requests are verified with.
+	TenantSecrets map[string]string `json:"tenantSecrets,omitempty"`
+
+	// TenantPriorities maps client access keys to the class their
+	// requests are scheduled in, "interactive" or "batch". Only requests
+	// whose signature was verified, with TenantSecrets, are classed.
+	TenantPriorities map[string]cloud_storage.PriorityClass `json:"tenantPriorities,omitempty"`
+}
+
+// RateLimit is the per-client request rate limit; RPS 0 disables it.
+type RateLimit struct {
+	RPS   float64 `json:"rps"`
+	Burst int     `json:"burst"`
+}
+
+// Bandwidth caps object body throughput in bytes per second; 0 disables
+// the corresponding cap.
+type Bandwidth struct {
+	ClientIngress int64 `json:"clientIngress"`
+	ClientEgress  int64 `json:"clientEgress"`
+	BucketIngress int64 `json:"bucketIngress"`
+	BucketEgress  int64 `json:"bucketEgress"`
+	BatchIngress  int64 `json:"batchIngress"`
+	BatchEgress   int64 `json:"batchEgress"`
+}
+
+// Compression lists the buckets whose GET responses may be compressed.
+type Compression struct {
+	Buckets []string `json:"buckets,omitempty"`
+}
+
+// Cache holds the hot-key caching policy, the rules overriding it, the
+// TTLs of cached entries and the write mode: "writeBack", uploads being
+// written back unless over the sync write threshold, or "sync", every
+// upload being written upstream before it is acknowledged.
+type Cache struct {
+	HotThreshold   float64                      `json:"hotThreshold"`
+	AdmitThreshold float64                      `json:"admitThreshold"`
+	PinnedBytes    int64                        `json:"pinnedBytes"`
+	TagRules       []cloud_storage.CacheTagRule `json:"tagRules,omitempty"`
+	Rules          []cloud_storage.CacheRule    `json:"rules,omitempty"`
+	HeadTTL        Duration                     `json:"headTTL"`
+	MaxAge         Duration                     `json:"maxAge"`
+	WriteMode      string                       `json:"writeMode,omitempty"`
+}
+
+// Duration is a time.Duration rendered in JSON as a string, e.g. "5m0s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Credentials are static upstream credentials.
+type Credentials struct {
+	AccessKeyID     string `json:"accessKeyId,omitempty"`
+	SecretAccessKey string `json:"secretAccessKey,omitempty"`
+	SessionToken    string `json:"sessionToken,omitempty"`
+}
+
+// secretPaths are redacted when a config is rendered or diffed.
+var secretPaths = map[string]bool{
+	"credentials.secretAccessKey": true,
+	"credentials.sessionToken":    true,
+}
+
+// secret reports whether the setting at path is secret: in secretPaths,
+// or a tenant's secret key.
+func secret(path string) bool {
+	return secretPaths[path] || strings.HasPrefix(path, "tenantSecrets.")
+}
+
+// tunablePaths are the settings which Update may change, or the prefixes
+// of their paths if ending with a dot.
+var tunablePaths = []string{
+	"logLevel",
+	"rateLimit.",
+	"cache.headTTL",
+	"cache.maxAge",
+	"cache.writeMode",
+}
+
+// tunable reports whether the setting at path may be changed by Update.
+func tunable(path string) bool {
+	for _, p := range tunablePaths {
+		if path == p || (strings.HasSuffix(p, ".") && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate reports the first invalid setting.
+func (c *Config) Validate() error {
+	switch c.LogLevel {
+	case "", "info", "error":
+	default:
+		return fmt.Errorf("logLevel: unknown level %q", c.LogLevel)
+	}
+	if c.RateLimit.RPS < 0 || c.RateLimit.Burst < 0 {
+		return errors.New("rateLimit: rps and burst must not be negative")
+	}
+	if c.RateLimit.RPS > 0 && c.RateLimit.Burst == 0 {
+		return errors.New("rateLimit: burst must be positive when rps is set")
+	}
+	b := c.Bandwidth
+	if b.ClientIngress < 0 || b.ClientEgress < 0 || b.BucketIngress < 0 || b.BucketEgress < 0 || b.BatchIngress < 0 || b.BatchEgress < 0 {
+		return errors.New("bandwidth: caps must not be negative")
+	}
+	if c.Cache.PinnedBytes < 0 {
+		return errors.New("cache: pinnedBytes must not be negative")
+	}
+	if c.Cache.HeadTTL < 0 || c.Cache.MaxAge < 0 {
+		return errors.New("cache: headTTL and maxAge must not be negative")
+	}
+	switch c.Cache.WriteMode {
+	case "", "writeBack", "sync":
+	default:
+		return fmt.Errorf("cache: unknown writeMode %q", c.Cache.WriteMode)
+	}
+	if err := cloud_storage.ValidateCacheTagRules(c.Cache.TagRules); err != nil {
+		return fmt.Errorf("cache: tagRules: %w", err)
+	}
+	if err := cloud_storage.ValidateCacheRules(c.Cache.Rules); err != nil {
+		return fmt.Errorf("cache: rules: %w", err)
+	}
+	if (c.Credentials.AccessKeyID == "") != (c.Credentials.SecretAccessKey == "") {
+		return errors.New("credentials: accessKeyId and secretAccessKey must be set together")
+	}
+	for from, to := range c.BucketMappings {
+		if from == "" || to == "" {
+			return fmt.Errorf("bucketMappings: invalid mapping %q -> %q", from, to)
+		}
+	}
+	if err := cloud_storage.ValidateTenantRoles(c.TenantRoles, c.TenantSecrets); err != nil {
+		return fmt.Errorf("tenantRoles: %w", err)
+	}
+	if err := cloud_storage.ValidateTenantPriorities(c.TenantPriorities); err != nil {
+		return fmt.Errorf("tenantPriorities: %w", err)
+	}
+	if err := cloud_storage.ValidateVirtualBuckets(c.VirtualBuckets); err != nil {
+		return fmt.Errorf("virtualBuckets: %w", err)
+	}
+	if err := cloud_storage.ValidateArchiveRestore(c.ArchiveRestore); err != nil {
+		return fmt.Errorf("archiveRestore: %w", err)
+	}
+	if err := cloud_storage.ValidateBucketOperations(c.BucketOperations); err != nil {
+		return fmt.Errorf("bucketOperations: %w", err)
+	}
+	if err := cloud_storage.ValidatePublicBuckets(c.PublicBuckets); err != nil {
+		return fmt.Errorf("publicBuckets: %w", err)
+	}
+	if err := cloud_storage.ValidateTransformRules(c.Transforms); err != nil {
+		return fmt.Errorf("transforms: %w", err)
+	}
+	if err := cloud_storage.ValidateUploadRules(c.UploadRules); err != nil {
+		return fmt.Errorf("uploadRules: %w", err)
+	}
+	if err := cloud_storage.ValidateKeyRewriteRules(c.KeyRewrites); err != nil {
+		return fmt.Errorf("keyRewrites: %w", err)
+	}
+	return nil
+}
+
+// Clone returns a deep copy of c.
+func (c *Config) Clone() *Config {
+	clone := *c
+	clone.Compression.Buckets = append([]string(nil), c.Compression.Buckets...)
+	clone.Transforms = append([]cloud_storage.TransformRule(nil), c.Transforms...)
+	clone.UploadRules = append([]cloud_storage.UploadRule(nil), c.UploadRules...)
+	clone.KeyRewrites = append([]cloud_storage.KeyRewriteRule(nil), c.KeyRewrites...)
+	clone.Cache.TagRules = append([]cloud_storage.CacheTagRule(nil), c.Cache.TagRules...)
+	clone.Cache.Rules = append([]cloud_storage.CacheRule(nil), c.Cache.Rules...)
+	clone.DryRun.Buckets = append([]string(nil), c.DryRun.Buckets...)
+	if c.BucketMappings != nil {
+		clone.BucketMappings = make(map[string]string, len(c.BucketMappings))
+		for k, v := range c.BucketMappings {
+			clone.BucketMappings[k] = v
+		}
+	}
+	if c.VirtualBuckets != nil {
+		clone.VirtualBuckets = make(map[string]cloud_storage.VirtualBucket, len(c.VirtualBuckets))
+		for k, v := range c.VirtualBuckets {
+			clone.VirtualBuckets[k] = v
+		}
+	}
+	if c.TenantRoles != nil {
+		clone.TenantRoles = make(map[string]string, len(c.TenantRoles))
+		for k, v := range c.TenantRoles {
+			clone.TenantRoles[k] = v
+		}
+	}
+	if c.TenantSecrets != nil {
+		clone.TenantSecrets = make(map[string]string, len(c.TenantSecrets))
+		for k, v := range c.TenantSecrets {
+			clone.TenantSecrets[k] = v
+		}
+	}
+	if c.TenantPriorities != nil {
+		clone.TenantPriorities = make(map[string]cloud_storage.PriorityClass, len(c.TenantPriorities))
+		for k, v := range c.TenantPriorities {
+			clone.TenantPriorities[k] = v
+		}
+	}
+	if c.ArchiveRestore != nil {
+		clone.ArchiveRestore = make(map[string]cloud_storage.ArchiveRestore, len(c.ArchiveRestore))
+		for k, v := range c.ArchiveRestore {
+			clone.ArchiveRestore[k] = v
+		}
+	}
+	if c.BucketOperations != nil {
+		clone.BucketOperations = make(map[string]cloud_storage.BucketOperations, len(c.BucketOperations))
+		for k, v := range c.BucketOperations {
+			clone.BucketOperations[k] = v
+		}
+	}
+	if c.PublicBuckets != nil {
+		clone.PublicBuckets = make(map[string]cloud_storage.PublicBucket, len(c.PublicBuckets))
+		for k, v := range c.PublicBuckets {
+			clone.PublicBuckets[k] = v
+		}
+	}
+	return &clone
+}
+
+// LoadFile overlays the JSON config file at path onto a copy of base.
+func LoadFile(path string, base *Config) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := base.Clone()
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("validating %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// flatten renders c as dotted paths to JSON-encoded values.
+func (c *Config) flatten() map[string]string {
+	data, _ := json.Marshal(c)
+	var tree map[string]interface{}
+	_ = json.Unmarshal(data, &tree)
+
+	flat := map[string]string{}
+	var walk func(prefix string, v interface{})
+	walk = func(prefix string, v interface{}) {
+		if m, ok := v.(map[string]interface{}); ok {
+			for k, child := range m {
+				path := k
+				if prefix != "" {
+					path = prefix + "." + k
+				}
+				walk(path, child)
+			}
+			return
+		}
+		value, _ := json.Marshal(v)
+		flat[prefix] = string(value)
+	}
+	walk("", tree)
+	return flat
+}
+
+// Redacted returns the flattened config with secrets masked.
+func (c *Config) Redacted() map[string]string {
+	flat := c.flatten()
+	for path := range flat {
+		if secret(path) {
+			flat[path] = `"<redacted>"`
+		}
+	}
+	return flat
+}
+
+// Change is a single setting which differs between two configs.
+type Change struct {
+	Path string `json:"path"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Diff lists the settings changed from old to new, sorted by path. Secret
+// values are never included.
+func Diff(old, new *Config) []Change {
+	from, to := old.flatten(), new.flatten()
+	paths := map[string]struct{}{}
+	for p := range from {
+		paths[p] = struct{}{}
+	}
+	for p := range to {
+		paths[p] = struct{}{}
+	}
+
+	var changes []Change
+	for p := range paths {
+		if from[p] == to[p] {
+			continue
+		}
+		change := Change{Path: p, From: from[p], To: to[p]}
+		if secret(p) {
+			change.From, change.To = `"<redacted>"`, `"<redacted>"`
+		}
+		changes = append(changes, change)
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
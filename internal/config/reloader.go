@@ -0,0 +1,161 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
+)
+
+// ErrNoConfigFile is returned by Reload when no config file is configured.
+var ErrNoConfigFile = errors.New("no config file configured")
+
+// Reloader re-reads the config file on demand and hands the new config to
+// the registered appliers. A config which fails to parse or validate is
+// rejected as a whole, leaving the current one in place.
+type Reloader struct {
+	path   string
+	base   *Config
+	logger log.Logger
+
+	mu       sync.Mutex
+	current  *Config
+	appliers []func(*Config)
+}
+
+// NewReloader returns a reloader overlaying the file at path (which may be
+// empty) onto base, and loads the initial config.
+func NewReloader(path string, base *Config, logger log.Logger) (*Reloader, error) {
+	r := &Reloader{
+		path:    path,
+		base:    base,
+		logger:  logger,
+		current: base.Clone(),
+	}
+	if path != "" {
+		c, err := LoadFile(path, base)
+		if err != nil {
+			return nil, err
+		}
+		r.current = c
+	}
+	return r, nil
+}
+
+// Current returns the config in effect. It must not be modified.
+func (r *Reloader) Current() *Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// OnReload registers fn to be called with every newly loaded config.
+func (r *Reloader) OnReload(fn func(*Config)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.appliers = append(r.appliers, fn)
+}
+
+// Reload re-reads the config file, logs what changed and applies it.
+func (r *Reloader) Reload() ([]Change, error) {
+	if r.path == "" {
+		return nil, ErrNoConfigFile
+	}
+	c, err := LoadFile(r.path, r.base)
+	if err != nil {
+		r.logger.Log("msg", "config reload failed", "err", err)
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changes := r.apply(c, r.path)
+	r.logger.Log("msg", "config reloaded", "path", r.path, "changes", len(changes))
+	return changes, nil
+}
+
+// Update overlays the JSON object patch, e.g. {"logLevel":"error"}, onto
+// the current config and applies it at once, recording source, such as the
+// address of the operator, with every change. Only the settings listed in
+// tunablePaths may change. Changes are lost on the next reload unless also
+// made in the config file.
+func (r *Reloader) Update(patch []byte, source string) ([]Change, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c := r.current.Clone()
+	dec := json.NewDecoder(bytes.NewReader(patch))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("parsing update: %w", err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("validating update: %w", err)
+	}
+	for _, change := range Diff(r.current, c) {
+		if !tunable(change.Path) {
+			return nil, fmt.Errorf("%s can't be changed at runtime", change.Path)
+		}
+	}
+	changes := r.apply(c, source)
+	r.logger.Log("msg", "config updated", "source", source, "changes", len(changes))
+	return changes, nil
+}
+
+// apply logs the changes from the current config to c, made by source,
+// hands c to the appliers and makes it current. r.mu must be held.
+func (r *Reloader) apply(c *Config, source string) []Change {
+	changes := Diff(r.current, c)
+	for _, change := range changes {
+		r.logger.Log("msg", "config changed", "setting", change.Path, "from", change.From, "to", change.To, "source", source)
+	}
+	for _, apply := range r.appliers {
+		apply(c)
+	}
+	r.current = c
+	return changes
+}
+
+// AdminRoutes mounts GET /config, rendering the current config with secrets
+// redacted, PATCH /config, updating tunable settings, and POST
+// /config/reload.
+func (r *Reloader) AdminRoutes(router *mux.Router) {
+	router.Methods("GET").Path("/config").HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.Current().Redacted())
+	})
+	router.Methods("PATCH").Path("/config").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		patch, err := io.ReadAll(io.LimitReader(req.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		changes, err := r.Update(patch, req.RemoteAddr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(changes)
+	})
+	router.Methods("POST").Path("/config/reload").HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		changes, err := r.Reload()
+		if err != nil {
+			status := http.StatusUnprocessableEntity
+			if errors.Is(err, ErrNoConfigFile) {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(changes)
+	})
+}
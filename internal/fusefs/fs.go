@@ -0,0 +1,470 @@
+//go:build linux || darwin
+
+// Package fusefs exposes a bucket of a CloudStorage as a FUSE filesystem.
+// Keys are mapped to paths by splitting them on "/"; directories are the
+// common prefixes of keys, and empty ones are kept as zero-length "dir/"
+// marker objects.
+//
+// Files are read with ranged GETs. Writes are buffered in memory and
+// uploaded as a whole when the file is flushed or closed.
+package fusefs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	cloud_storage "github.com/rampage644/s3-overlay-proxy/cloud-storage"
+)
+
+// listPageSize is the number of keys fetched per listing request.
+const listPageSize = 1000
+
+// FS is the state shared by the nodes of a mounted bucket.
+type FS struct {
+	storage cloud_storage.CloudStorage
+	bucket  string
+	uid     uint32
+	gid     uint32
+
+	// mounted is reported as the modification time of directories, which
+	// have none.
+	mounted time.Time
+}
+
+// NewRoot returns the root directory of bucket, to be passed to fs.Mount.
+func NewRoot(storage cloud_storage.CloudStorage, bucket string) fs.InodeEmbedder {
+	fsys := &FS{
+		storage: storage,
+		bucket:  bucket,
+		uid:     uint32(os.Getuid()),
+		gid:     uint32(os.Getgid()),
+		mounted: time.Now(),
+	}
+	return &dir{fsys: fsys}
+}
+
+// toErrno maps storage errors to errno values.
+func toErrno(err error) syscall.Errno {
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		switch ae.ErrorCode() {
+		case "NoSuchKey", "NotFound", "NoSuchBucket":
+			return syscall.ENOENT
+		case "AccessDenied":
+			return syscall.EACCES
+		case "InvalidRange":
+			return 0
+		}
+	}
+	return syscall.EIO
+}
+
+func (f *FS) setAttr(out *fuse.Attr, mode uint32, size int64, mtime time.Time) {
+	out.Mode = mode
+	out.Size = uint64(size)
+	out.Blocks = (out.Size + 511) / 512
+	out.Nlink = 1
+	out.Uid, out.Gid = f.uid, f.gid
+	out.SetTimes(nil, &mtime, &mtime)
+}
+
+// dir is a key prefix, "" for the root.
+type dir struct {
+	fs.Inode
+	fsys   *FS
+	prefix string
+}
+
+var (
+	_ fs.NodeGetattrer = (*dir)(nil)
+	_ fs.NodeLookuper  = (*dir)(nil)
+	_ fs.NodeReaddirer = (*dir)(nil)
+	_ fs.NodeMkdirer   = (*dir)(nil)
+	_ fs.NodeRmdirer   = (*dir)(nil)
+	_ fs.NodeCreater   = (*dir)(nil)
+	_ fs.NodeUnlinker  = (*dir)(nil)
+	_ fs.NodeRenamer   = (*dir)(nil)
+)
+
+func (d *dir) Getattr(_ context.Context, _ fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	d.fsys.setAttr(&out.Attr, syscall.S_IFDIR|0o755, 0, d.fsys.mounted)
+	return 0
+}
+
+func (d *dir) newDir(ctx context.Context, name string, out *fuse.EntryOut) *fs.Inode {
+	child := &dir{fsys: d.fsys, prefix: d.prefix + name + "/"}
+	d.fsys.setAttr(&out.Attr, syscall.S_IFDIR|0o755, 0, d.fsys.mounted)
+	return d.NewInode(ctx, child, fs.StableAttr{Mode: syscall.S_IFDIR})
+}
+
+func (d *dir) newFile(ctx context.Context, name string, size int64, mtime time.Time, out *fuse.EntryOut) (*file, *fs.Inode) {
+	child := &file{fsys: d.fsys, key: d.prefix + name, size: size, mtime: mtime}
+	d.fsys.setAttr(&out.Attr, syscall.S_IFREG|0o644, size, mtime)
+	return child, d.NewInode(ctx, child, fs.StableAttr{Mode: syscall.S_IFREG})
+}
+
+// hasChildren reports whether any key starts with prefix, other than the
+// directory marker itself.
+func (d *dir) hasChildren(ctx context.Context, prefix string) (bool, error) {
+	page, err := d.fsys.storage.ListObjects(ctx, d.fsys.bucket, cloud_storage.ListObjectsOptions{
+		Prefix:    prefix,
+		Delimiter: "/",
+		MaxKeys:   2,
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(page.CommonPrefixes) > 0 {
+		return true, nil
+	}
+	for _, object := range page.Objects {
+		if object.Key != prefix {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (d *dir) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	key := d.prefix + name
+	metadata, err := d.fsys.storage.HeadObject(ctx, d.fsys.bucket, key)
+	if err == nil {
+		mtime := time.Now()
+		if metadata.LastModified != nil {
+			mtime = *metadata.LastModified
+		}
+		_, inode := d.newFile(ctx, name, metadata.ContentLength, mtime, out)
+		return inode, 0
+	}
+	if errno := toErrno(err); errno != syscall.ENOENT {
+		return nil, errno
+	}
+
+	page, err := d.fsys.storage.ListObjects(ctx, d.fsys.bucket, cloud_storage.ListObjectsOptions{
+		Prefix:  key + "/",
+		MaxKeys: 1,
+	})
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	if len(page.Objects) == 0 && len(page.CommonPrefixes) == 0 {
+		return nil, syscall.ENOENT
+	}
+	return d.newDir(ctx, name, out), 0
+}
+
+func (d *dir) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	var entries []fuse.DirEntry
+	options := cloud_storage.ListObjectsOptions{Prefix: d.prefix, Delimiter: "/", MaxKeys: listPageSize}
+	for {
+		page, err := d.fsys.storage.ListObjects(ctx, d.fsys.bucket, options)
+		if err != nil {
+			return nil, toErrno(err)
+		}
+		for _, prefix := range page.CommonPrefixes {
+			name := prefix.Prefix[len(d.prefix) : len(prefix.Prefix)-1]
+			if name != "" {
+				entries = append(entries, fuse.DirEntry{Name: name, Mode: syscall.S_IFDIR})
+			}
+		}
+		for _, object := range page.Objects {
+			if name := object.Key[len(d.prefix):]; name != "" {
+				entries = append(entries, fuse.DirEntry{Name: name, Mode: syscall.S_IFREG})
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		options.ContinuationToken = page.NextContinuationToken
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+func (d *dir) Mkdir(ctx context.Context, name string, _ uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	marker := d.prefix + name + "/"
+	if err := d.fsys.storage.PutObject(ctx, d.fsys.bucket, marker, bytes.NewReader(nil), 0, "", "", "", cloud_storage.UploadHeaders{}); err != nil {
+		return nil, toErrno(err)
+	}
+	return d.newDir(ctx, name, out), 0
+}
+
+func (d *dir) Rmdir(ctx context.Context, name string) syscall.Errno {
+	marker := d.prefix + name + "/"
+	nonEmpty, err := d.hasChildren(ctx, marker)
+	if err != nil {
+		return toErrno(err)
+	}
+	if nonEmpty {
+		return syscall.ENOTEMPTY
+	}
+	if err := d.fsys.storage.DeleteObject(ctx, d.fsys.bucket, marker); err != nil && toErrno(err) != syscall.ENOENT {
+		return toErrno(err)
+	}
+	return 0
+}
+
+func (d *dir) Create(ctx context.Context, name string, _ uint32, _ uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	child, inode := d.newFile(ctx, name, 0, time.Now(), out)
+	h := &handle{buf: []byte{}, dirty: true}
+	// Upload right away so that the file is visible to other clients.
+	if errno := child.flush(ctx, h); errno != 0 {
+		return nil, nil, 0, errno
+	}
+	return inode, h, 0, 0
+}
+
+func (d *dir) Unlink(ctx context.Context, name string) syscall.Errno {
+	if err := d.fsys.storage.DeleteObject(ctx, d.fsys.bucket, d.prefix+name); err != nil {
+		return toErrno(err)
+	}
+	return 0
+}
+
+// Rename copies the object and deletes the original. Directories can't be
+// renamed atomically, so EXDEV makes tools such as mv fall back to copying.
+func (d *dir) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, _ uint32) syscall.Errno {
+	target, ok := newParent.(*dir)
+	if !ok {
+		return syscall.EXDEV
+	}
+	if child := d.GetChild(name); child != nil && child.IsDir() {
+		return syscall.EXDEV
+	}
+
+	from, to := d.prefix+name, target.prefix+newName
+	body, info, err := d.fsys.storage.GetObject(ctx, d.fsys.bucket, from, "")
+	if err != nil {
+		return toErrno(err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return syscall.EIO
+	}
+	if int64(len(data)) != info.ContentLength && info.ContentLength != 0 {
+		return syscall.EIO
+	}
+	if err := d.fsys.storage.PutObject(ctx, d.fsys.bucket, to, bytes.NewReader(data), int64(len(data)), "", "", "", cloud_storage.UploadHeaders{}); err != nil {
+		return toErrno(err)
+	}
+	if err := d.fsys.storage.DeleteObject(ctx, d.fsys.bucket, from); err != nil {
+		return toErrno(err)
+	}
+	return 0
+}
+
+// file is an object.
+type file struct {
+	fs.Inode
+	fsys *FS
+	key  string
+
+	mu    sync.Mutex
+	size  int64
+	mtime time.Time
+}
+
+var (
+	_ fs.NodeGetattrer = (*file)(nil)
+	_ fs.NodeSetattrer = (*file)(nil)
+	_ fs.NodeOpener    = (*file)(nil)
+	_ fs.NodeReader    = (*file)(nil)
+	_ fs.NodeWriter    = (*file)(nil)
+	_ fs.NodeFlusher   = (*file)(nil)
+	_ fs.NodeFsyncer   = (*file)(nil)
+)
+
+// handle is an open file. Handles opened for writing hold the whole
+// content in buf.
+type handle struct {
+	mu    sync.Mutex
+	buf   []byte
+	dirty bool
+}
+
+func (f *file) Getattr(_ context.Context, _ fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fsys.setAttr(&out.Attr, syscall.S_IFREG|0o644, f.size, f.mtime)
+	return 0
+}
+
+// load reads the whole object.
+func (f *file) load(ctx context.Context) ([]byte, syscall.Errno) {
+	body, _, err := f.fsys.storage.GetObject(ctx, f.fsys.bucket, f.key, "")
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	return data, 0
+}
+
+func (f *file) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) == 0 {
+		return &handle{}, 0, 0
+	}
+	h := &handle{buf: []byte{}}
+	if flags&syscall.O_TRUNC != 0 {
+		h.dirty = true
+	} else {
+		data, errno := f.load(ctx)
+		if errno != 0 {
+			return nil, 0, errno
+		}
+		h.buf = data
+	}
+	return h, fuse.FOPEN_DIRECT_IO, 0
+}
+
+func (f *file) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	if h, ok := fh.(*handle); ok && h.buf != nil {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if off >= int64(len(h.buf)) {
+			return fuse.ReadResultData(nil), 0
+		}
+		return fuse.ReadResultData(h.buf[off:min(off+int64(len(dest)), int64(len(h.buf)))]), 0
+	}
+
+	f.mu.Lock()
+	size := f.size
+	f.mu.Unlock()
+	if off >= size || len(dest) == 0 {
+		return fuse.ReadResultData(nil), 0
+	}
+	end := min(off+int64(len(dest)), size) - 1
+	body, _, err := f.fsys.storage.GetObject(ctx, f.fsys.bucket, f.key, fmt.Sprintf("bytes=%d-%d", off, end))
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	defer body.Close()
+	n, err := io.ReadFull(body, dest[:end-off+1])
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+func (f *file) Write(_ context.Context, fh fs.FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	h, ok := fh.(*handle)
+	if !ok || h.buf == nil {
+		return 0, syscall.EBADF
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if end := off + int64(len(data)); end > int64(len(h.buf)) {
+		h.buf = append(h.buf, make([]byte, end-int64(len(h.buf)))...)
+	}
+	copy(h.buf[off:], data)
+	h.dirty = true
+
+	f.mu.Lock()
+	f.size = int64(len(h.buf))
+	f.mtime = time.Now()
+	f.mu.Unlock()
+	return uint32(len(data)), 0
+}
+
+// flush uploads the content of h if it changed.
+func (f *file) flush(ctx context.Context, h *handle) syscall.Errno {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.dirty {
+		return 0
+	}
+	if err := f.fsys.storage.PutObject(ctx, f.fsys.bucket, f.key, bytes.NewReader(h.buf), int64(len(h.buf)), "", "", "", cloud_storage.UploadHeaders{}); err != nil {
+		return toErrno(err)
+	}
+	h.dirty = false
+
+	f.mu.Lock()
+	f.size = int64(len(h.buf))
+	f.mtime = time.Now()
+	f.mu.Unlock()
+	return 0
+}
+
+func (f *file) Flush(ctx context.Context, fh fs.FileHandle) syscall.Errno {
+	if h, ok := fh.(*handle); ok {
+		return f.flush(ctx, h)
+	}
+	return 0
+}
+
+func (f *file) Fsync(ctx context.Context, fh fs.FileHandle, _ uint32) syscall.Errno {
+	return f.Flush(ctx, fh)
+}
+
+// Setattr supports truncation; other attributes can't be stored and are
+// ignored.
+func (f *file) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if size, ok := in.GetSize(); ok {
+		h, ok := fh.(*handle)
+		if !ok || h.buf == nil {
+			// Truncating a file which isn't open for writing.
+			data, errno := []byte{}, syscall.Errno(0)
+			if size > 0 {
+				if data, errno = f.load(ctx); errno != 0 {
+					return errno
+				}
+			}
+			h = &handle{buf: data}
+			defer f.flush(ctx, h)
+		}
+
+		h.mu.Lock()
+		if int(size) <= len(h.buf) {
+			h.buf = h.buf[:size]
+		} else {
+			h.buf = append(h.buf, make([]byte, int(size)-len(h.buf))...)
+		}
+		h.dirty = true
+		h.mu.Unlock()
+
+		f.mu.Lock()
+		f.size = int64(size)
+		f.mtime = time.Now()
+		f.mu.Unlock()
+	}
+	return f.Getattr(ctx, fh, out)
+}
+
+// MountOptions configures Mount.
+type MountOptions struct {
+	// AllowOther lets users other than the one mounting access the
+	// filesystem.
+	AllowOther bool
+	// Debug logs every FUSE request.
+	Debug bool
+}
+
+// Mount mounts bucket at mountpoint. The returned server is unmounted with
+// its Unmount method; Wait returns once it is.
+func Mount(mountpoint string, storage cloud_storage.CloudStorage, bucket string, options MountOptions) (*fuse.Server, error) {
+	return fs.Mount(mountpoint, NewRoot(storage, bucket), &fs.Options{
+		MountOptions: fuse.MountOptions{
+			FsName:     "s3proxy:" + bucket,
+			Name:       "s3proxy",
+			AllowOther: options.AllowOther,
+			// Mount with the mount syscall when running as root, as
+			// fusermount may not be installed, e.g. in containers.
+			DirectMount: os.Geteuid() == 0,
+			Debug:       options.Debug,
+		},
+	})
+}
@@ -0,0 +1,319 @@
+package harness
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+
+	"github.com/rampage644/s3-overlay-proxy/repository"
+)
+
+// Check is a protocol check run with the SDK client of a harness, on keys
+// under prefix.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context, h *Harness, prefix string) error
+}
+
+// Checks are the checks of the harness.
+var Checks = []Check{
+	{"sdk_put_get_roundtrip", func(ctx context.Context, h *Harness, prefix string) error {
+		body := []byte("hello, harness")
+		put, err := h.Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(h.Bucket),
+			Key:         aws.String(prefix + "roundtrip"),
+			Body:        bytes.NewReader(body),
+			ContentType: aws.String("text/plain"),
+		})
+		if err != nil {
+			return err
+		}
+		sum := md5.Sum(body)
+		if etag := `"` + hex.EncodeToString(sum[:]) + `"`; aws.ToString(put.ETag) != "" && aws.ToString(put.ETag) != etag {
+			return fmt.Errorf("got ETag %s, want %s", aws.ToString(put.ETag), etag)
+		}
+		got, err := get(ctx, h, prefix+"roundtrip", "")
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got.body, body) {
+			return fmt.Errorf("got body %q, want %q", got.body, body)
+		}
+		if ct := aws.ToString(got.output.ContentType); ct != "text/plain" {
+			return fmt.Errorf("got Content-Type %q, want text/plain", ct)
+		}
+		return nil
+	}},
+	{"sdk_head_missing_not_found", func(ctx context.Context, h *Harness, prefix string) error {
+		_, err := h.Client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(h.Bucket), Key: aws.String(prefix + "missing")})
+		return expectError(err, 404, "NotFound")
+	}},
+	{"sdk_get_missing_no_such_key", func(ctx context.Context, h *Harness, prefix string) error {
+		_, err := get(ctx, h, prefix+"missing", "")
+		var noSuchKey *types.NoSuchKey
+		if err != nil && !errors.As(err, &noSuchKey) {
+			return fmt.Errorf("got %v, want a NoSuchKey error", err)
+		}
+		return expectError(err, 404, "NoSuchKey")
+	}},
+	{"sdk_range_get", func(ctx context.Context, h *Harness, prefix string) error {
+		if err := put(ctx, h, prefix+"range", []byte("0123456789")); err != nil {
+			return err
+		}
+		for r, want := range map[string]string{"bytes=2-4": "234", "bytes=7-": "789", "bytes=-2": "89"} {
+			got, err := get(ctx, h, prefix+"range", r)
+			if err != nil {
+				return fmt.Errorf("%s: %w", r, err)
+			}
+			if string(got.body) != want {
+				return fmt.Errorf("%s: got %q, want %q", r, got.body, want)
+			}
+			if cr := aws.ToString(got.output.ContentRange); !strings.HasSuffix(cr, "/10") {
+				return fmt.Errorf("%s: got Content-Range %q", r, cr)
+			}
+		}
+		return nil
+	}},
+	{"sdk_range_unsatisfiable", func(ctx context.Context, h *Harness, prefix string) error {
+		if err := put(ctx, h, prefix+"short", []byte("abc")); err != nil {
+			return err
+		}
+		_, err := get(ctx, h, prefix+"short", "bytes=10-")
+		return expectError(err, 416, "InvalidRange")
+	}},
+	{"sdk_list_v2_paginates", func(ctx context.Context, h *Harness, prefix string) error {
+		want := []string{prefix + "list/a", prefix + "list/b", prefix + "list/c", prefix + "list/d", prefix + "list/e"}
+		for _, key := range want {
+			if err := put(ctx, h, key, []byte(key)); err != nil {
+				return err
+			}
+		}
+		var got []string
+		paginator := s3.NewListObjectsV2Paginator(h.Client, &s3.ListObjectsV2Input{
+			Bucket:  aws.String(h.Bucket),
+			Prefix:  aws.String(prefix + "list/"),
+			MaxKeys: 2,
+		})
+		for pages := 0; paginator.HasMorePages(); pages++ {
+			if pages > len(want) {
+				return errors.New("listing doesn't end")
+			}
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return err
+			}
+			for _, object := range page.Contents {
+				got = append(got, aws.ToString(object.Key))
+			}
+		}
+		if !sort.StringsAreSorted(got) || strings.Join(got, ",") != strings.Join(want, ",") {
+			return fmt.Errorf("listed %v, want %v", got, want)
+		}
+		return nil
+	}},
+	{"sdk_list_v2_delimiter", func(ctx context.Context, h *Harness, prefix string) error {
+		for _, key := range []string{"tree/a/1", "tree/a/2", "tree/b/1", "tree/c"} {
+			if err := put(ctx, h, prefix+key, nil); err != nil {
+				return err
+			}
+		}
+		page, err := h.Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:    aws.String(h.Bucket),
+			Prefix:    aws.String(prefix + "tree/"),
+			Delimiter: aws.String("/"),
+		})
+		if err != nil {
+			return err
+		}
+		var prefixes []string
+		for _, p := range page.CommonPrefixes {
+			prefixes = append(prefixes, strings.TrimPrefix(aws.ToString(p.Prefix), prefix))
+		}
+		if strings.Join(prefixes, ",") != "tree/a/,tree/b/" {
+			return fmt.Errorf("got common prefixes %v, want [tree/a/ tree/b/]", prefixes)
+		}
+		if len(page.Contents) != 1 || aws.ToString(page.Contents[0].Key) != prefix+"tree/c" {
+			return fmt.Errorf("got %d objects, want tree/c only", len(page.Contents))
+		}
+		return nil
+	}},
+	{"sdk_multipart_roundtrip", func(ctx context.Context, h *Harness, prefix string) error {
+		key := aws.String(prefix + "multipart")
+		created, err := h.Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{Bucket: aws.String(h.Bucket), Key: key})
+		if err != nil {
+			return err
+		}
+		parts := [][]byte{bytes.Repeat([]byte("a"), 5<<20), []byte("tail")}
+		var completed []types.CompletedPart
+		for i, part := range parts {
+			uploaded, err := h.Client.UploadPart(ctx, &s3.UploadPartInput{
+				Bucket:     aws.String(h.Bucket),
+				Key:        key,
+				UploadId:   created.UploadId,
+				PartNumber: int32(i + 1),
+				Body:       bytes.NewReader(part),
+			})
+			if err != nil {
+				return fmt.Errorf("part %d: %w", i+1, err)
+			}
+			completed = append(completed, types.CompletedPart{PartNumber: int32(i + 1), ETag: uploaded.ETag})
+		}
+		done, err := h.Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(h.Bucket),
+			Key:             key,
+			UploadId:        created.UploadId,
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+		})
+		if err != nil {
+			return err
+		}
+		if !strings.HasSuffix(strings.Trim(aws.ToString(done.ETag), `"`), "-2") {
+			return fmt.Errorf("got ETag %s, want a multipart one of 2 parts", aws.ToString(done.ETag))
+		}
+		got, err := get(ctx, h, *key, "")
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got.body, bytes.Join(parts, nil)) {
+			return fmt.Errorf("got %d bytes, want %d", len(got.body), len(parts[0])+len(parts[1]))
+		}
+		return nil
+	}},
+	{"sdk_copy_object", func(ctx context.Context, h *Harness, prefix string) error {
+		body := []byte("copied")
+		_, err := h.Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(h.Bucket),
+			Key:         aws.String(prefix + "copy/source"),
+			Body:        bytes.NewReader(body),
+			ContentType: aws.String("text/plain"),
+			Metadata:    map[string]string{"origin": "harness"},
+		})
+		if err != nil {
+			return err
+		}
+		copied, err := h.Client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:     aws.String(h.Bucket),
+			Key:        aws.String(prefix + "copy/destination"),
+			CopySource: aws.String(h.Bucket + "/" + prefix + "copy/source"),
+		})
+		if err != nil {
+			return err
+		}
+		sum := md5.Sum(body)
+		if etag := `"` + hex.EncodeToString(sum[:]) + `"`; copied.CopyObjectResult == nil || aws.ToString(copied.CopyObjectResult.ETag) != etag {
+			return fmt.Errorf("got copy result %+v, want ETag %s", copied.CopyObjectResult, etag)
+		}
+		got, err := get(ctx, h, prefix+"copy/destination", "")
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got.body, body) {
+			return fmt.Errorf("got body %q, want %q", got.body, body)
+		}
+		if ct := aws.ToString(got.output.ContentType); ct != "text/plain" {
+			return fmt.Errorf("got Content-Type %q, want text/plain", ct)
+		}
+		return nil
+	}},
+	{"sdk_delete_then_missing", func(ctx context.Context, h *Harness, prefix string) error {
+		if err := put(ctx, h, prefix+"deleted", []byte("x")); err != nil {
+			return err
+		}
+		if _, err := h.Client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(h.Bucket), Key: aws.String(prefix + "deleted")}); err != nil {
+			return err
+		}
+		_, err := get(ctx, h, prefix+"deleted", "")
+		return expectError(err, 404, "NoSuchKey")
+	}},
+	{"sdk_writes_reach_upstream", func(ctx context.Context, h *Harness, prefix string) error {
+		if err := put(ctx, h, prefix+"upstream", []byte("written back")); err != nil {
+			return err
+		}
+		if err := h.Flush(ctx); err != nil {
+			return err
+		}
+		head, err := h.Upstream.HeadObject(ctx, &repository.HeadObjectInput{Bucket: aws.String(h.Bucket), Key: aws.String(prefix + "upstream")})
+		if err != nil {
+			return fmt.Errorf("upstream: %w", err)
+		}
+		if head.ContentLength != int64(len("written back")) {
+			return fmt.Errorf("upstream holds %d bytes, want %d", head.ContentLength, len("written back"))
+		}
+		return nil
+	}},
+}
+
+// Run runs the checks whose names contain filter, reporting each one, and
+// returns the numbers of checks passed and failed.
+func Run(ctx context.Context, h *Harness, prefix, filter string, report func(name string, err error)) (passed, failed int) {
+	for _, check := range Checks {
+		if !strings.Contains(check.Name, filter) {
+			continue
+		}
+		err := check.Run(ctx, h, prefix)
+		report(check.Name, err)
+		if err != nil {
+			failed++
+			continue
+		}
+		passed++
+	}
+	return passed, failed
+}
+
+func put(ctx context.Context, h *Harness, key string, body []byte) error {
+	_, err := h.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(h.Bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(body),
+	})
+	return err
+}
+
+type getResult struct {
+	output *s3.GetObjectOutput
+	body   []byte
+}
+
+// get reads key, or the byte range r of it if not empty.
+func get(ctx context.Context, h *Harness, key, r string) (getResult, error) {
+	input := &s3.GetObjectInput{Bucket: aws.String(h.Bucket), Key: aws.String(key)}
+	if r != "" {
+		input.Range = aws.String(r)
+	}
+	output, err := h.Client.GetObject(ctx, input)
+	if err != nil {
+		return getResult{}, err
+	}
+	defer output.Body.Close()
+	body, err := io.ReadAll(output.Body)
+	return getResult{output: output, body: body}, err
+}
+
+// expectError checks that err is an S3 error of code with HTTP status.
+func expectError(err error, status int, code string) error {
+	if err == nil {
+		return fmt.Errorf("succeeded, want %s", code)
+	}
+	var re *awshttp.ResponseError
+	if !errors.As(err, &re) || re.HTTPStatusCode() != status {
+		return fmt.Errorf("got %v, want status %d", err, status)
+	}
+	var ae smithy.APIError
+	if !errors.As(err, &ae) || ae.ErrorCode() != code {
+		return fmt.Errorf("got %v, want code %s", err, code)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+// Package harness runs the proxy end to end for integration checks: the
+// full S3 handler, with or without the write-back cache, in front of an
+// in-memory backend or a throwaway MinIO container, driven by
+// aws-sdk-go-v2 clients. The conformance command runs its Checks with
+// -harness.
+package harness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/dgraph-io/ristretto"
+	"github.com/go-kit/kit/log"
+
+	cloud_storage "github.com/rampage644/s3-overlay-proxy/cloud-storage"
+	"github.com/rampage644/s3-overlay-proxy/repository"
+)
+
+// Backend names the upstream of a harness.
+type Backend string
+
+const (
+	// Memory is a repository.MemoryStorage.
+	Memory Backend = "memory"
+
+	// MinIO is a MinIO container started with docker, and removed on Close.
+	MinIO Backend = "minio"
+)
+
+// minIO credentials of the containers started.
+const (
+	minIOUser     = "harness"
+	minIOPassword = "harness-secret"
+)
+
+// Options configures a harness.
+type Options struct {
+	Backend Backend
+
+	// Bucket is created in the backend.
+	Bucket string
+
+	// Cache puts the write-back cache in front of the backend.
+	Cache bool
+
+	// MinIOImage is the image of the MinIO backend, "minio/minio" if
+	// empty.
+	MinIOImage string
+
+	// Logger defaults to discarding the logs of the proxy.
+	Logger log.Logger
+}
+
+// Harness is a proxy served on a local port.
+type Harness struct {
+	// URL is the address of the proxy, and Client an SDK client of it.
+	URL    string
+	Client *s3.Client
+
+	// Bucket is the bucket created in Upstream, the backend of Proxy.
+	Bucket   string
+	Upstream repository.ObjectStorage
+	Proxy    *cloud_storage.Proxy
+
+	server  *http.Server
+	cleanup []func()
+}
+
+// Start starts a harness, which must be closed.
+func Start(ctx context.Context, options Options) (*Harness, error) {
+	if options.Bucket == "" {
+		return nil, errors.New("no bucket configured")
+	}
+	h := &Harness{Bucket: options.Bucket}
+	if err := h.start(ctx, options); err != nil {
+		h.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *Harness) start(ctx context.Context, options Options) error {
+	switch options.Backend {
+	case Memory, "":
+		h.Upstream = repository.NewMemoryStorage(options.Bucket)
+	case MinIO:
+		image := options.MinIOImage
+		if image == "" {
+			image = "minio/minio"
+		}
+		endpoint, stop, err := startMinIO(ctx, image)
+		if stop != nil {
+			h.cleanup = append(h.cleanup, stop)
+		}
+		if err != nil {
+			return err
+		}
+		h.Upstream = repository.MakeAWSS3(NewClient(endpoint, minIOUser, minIOPassword))
+		if _, err := h.Upstream.CreateBucket(ctx, &repository.CreateBucketInput{Bucket: aws.String(options.Bucket)}); err != nil {
+			return fmt.Errorf("creating bucket %s: %w", options.Bucket, err)
+		}
+	default:
+		return fmt.Errorf("unknown backend %q", options.Backend)
+	}
+
+	proxyOptions := cloud_storage.ProxyOptions{Backend: h.Upstream, Logger: options.Logger}
+	if options.Cache {
+		cache, err := ristretto.NewCache(&ristretto.Config{
+			NumCounters: 1e4,
+			MaxCost:     1 << 10,
+			BufferItems: 64,
+		})
+		if err != nil {
+			return err
+		}
+		proxyOptions.Cache = cache
+	}
+	var err error
+	if h.Proxy, err = cloud_storage.NewProxy(proxyOptions); err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	h.server = &http.Server{Handler: h.Proxy}
+	go h.server.Serve(ln)
+	h.URL = "http://" + ln.Addr().String()
+	h.Client = NewClient(h.URL, "harness", "harness")
+	return nil
+}
+
+// Flush waits for the write-back uploads of the proxy, if it caches.
+func (h *Harness) Flush(ctx context.Context) error {
+	if h.Proxy.Cache == nil {
+		return nil
+	}
+	if pending := h.Proxy.Cache.Flush(ctx); pending > 0 {
+		return fmt.Errorf("%d write-back uploads still pending", pending)
+	}
+	return nil
+}
+
+// Close stops the proxy, waiting for its write-back uploads for up to ten
+// seconds, and the backend.
+func (h *Harness) Close() {
+	if h.server != nil {
+		h.server.Close()
+	}
+	if h.Proxy != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		h.Flush(ctx)
+		cancel()
+	}
+	for i := len(h.cleanup) - 1; i >= 0; i-- {
+		h.cleanup[i]()
+	}
+}
+
+// NewClient returns a path-style SDK client of the S3 endpoint at url,
+// without retries so that checks see every failure.
+func NewClient(url, accessKey, secretKey string) *s3.Client {
+	return s3.New(s3.Options{
+		Region:       "us-east-1",
+		Credentials:  credentials.NewStaticCredentialsProvider(accessKey, secretKey, ""),
+		BaseEndpoint: aws.String(url),
+		UsePathStyle: true,
+		Retryer:      aws.NopRetryer{},
+	})
+}
+
+// startMinIO runs a MinIO container of image, returning its endpoint once
+// live, and a function removing it, if started.
+func startMinIO(ctx context.Context, image string) (string, func(), error) {
+	out, err := exec.CommandContext(ctx, "docker", "run", "--rm", "-d",
+		"-p", "127.0.0.1::9000",
+		"-e", "MINIO_ROOT_USER="+minIOUser,
+		"-e", "MINIO_ROOT_PASSWORD="+minIOPassword,
+		image, "server", "/data").Output()
+	if err != nil {
+		return "", nil, fmt.Errorf("starting MinIO: %w", err)
+	}
+	id := strings.TrimSpace(string(out))
+	stop := func() {
+		exec.Command("docker", "rm", "-f", id).Run()
+	}
+
+	out, err = exec.CommandContext(ctx, "docker", "port", id, "9000/tcp").Output()
+	if err != nil {
+		return "", stop, fmt.Errorf("finding the MinIO port: %w", err)
+	}
+	addr, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	endpoint := "http://" + addr
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		resp, err := http.Get(endpoint + "/minio/health/live")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return endpoint, stop, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return "", stop, errors.New("MinIO didn't become live in 30s")
+		}
+		select {
+		case <-ctx.Done():
+			return "", stop, ctx.Err()
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
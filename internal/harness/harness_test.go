@@ -0,0 +1,48 @@
+package harness
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestChecks(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+	}{
+		{"memory", Options{Backend: Memory, Bucket: "harness"}},
+		{"memory cache", Options{Backend: Memory, Bucket: "harness", Cache: true}},
+		{"minio", Options{Backend: MinIO, Bucket: "harness"}},
+		{"minio cache", Options{Backend: MinIO, Bucket: "harness", Cache: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.options.Backend == MinIO {
+				if testing.Short() {
+					t.Skip("starts a MinIO container")
+				}
+				if _, err := exec.LookPath("docker"); err != nil {
+					t.Skip("docker is not installed")
+				}
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+			defer cancel()
+			h, err := Start(ctx, tt.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer h.Close()
+
+			passed, failed := Run(ctx, h, "test/", "", func(name string, err error) {
+				if err != nil {
+					t.Errorf("%s: %v", name, err)
+				}
+			})
+			if passed == 0 || failed > 0 {
+				t.Errorf("%d checks passed, %d failed", passed, failed)
+			}
+		})
+	}
+}
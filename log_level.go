@@ -0,0 +1,37 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/go-kit/kit/log"
+)
+
+// levelLogger drops the records without an error while its level is
+// "error", so that the level can be changed at runtime.
+type levelLogger struct {
+	next       log.Logger
+	errorsOnly atomic.Bool
+}
+
+// SetLevel sets the level, "info" or "error"; anything else logs
+// everything.
+func (l *levelLogger) SetLevel(level string) {
+	l.errorsOnly.Store(level == "error")
+}
+
+func (l *levelLogger) Log(keyvals ...interface{}) error {
+	if l.errorsOnly.Load() && !hasError(keyvals) {
+		return nil
+	}
+	return l.next.Log(keyvals...)
+}
+
+// hasError reports whether keyvals hold a non-nil "err".
+func hasError(keyvals []interface{}) bool {
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if keyvals[i] == "err" && keyvals[i+1] != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -1,90 +1,69 @@
 package main
 
 import (
-	"context"
-	"flag"
 	"fmt"
-	"net/http"
 	"os"
-	"os/signal"
-	"syscall"
-
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/dgraph-io/ristretto"
-
-	"github.com/go-kit/kit/log"
-	cloud_storage "github.com/rampage644/s3-overlay-proxy/internal/cloud-storage"
-	"github.com/rampage644/s3-overlay-proxy/internal/repository"
+	"strings"
 )
 
-func main() {
-	var (
-		httpAddr         = flag.String("http.addr", ":8080", "HTTP listen address")
-		objectStorageUrl = flag.String("object-storage.url", "", "object storage url")
-	)
-	flag.Parse()
-
-	var logger log.Logger
-	{
-		logger = log.NewLogfmtLogger(os.Stderr)
-		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
-		logger = log.With(logger, "caller", log.DefaultCaller)
-	}
+// commands maps subcommand names to their implementations. Each one parses
+// its own flags and returns the process exit code.
+var commands = map[string]func(args []string) int{
+	"serve":       runServe,
+	"bench":       runBench,
+	"warm":        runWarm,
+	"purge":       runPurge,
+	"flush":       runFlush,
+	"export":      runExport,
+	"import":      runImport,
+	"freeze":      runFreeze,
+	"unfreeze":    runUnfreeze,
+	"inventory":   runInventory,
+	"validate":    runValidate,
+	"conformance": runConformance,
+	"mount":       runMount,
+	"migrate":     runMigrate,
+}
 
-	var aws_s3_storage repository.ObjectStorage
-	{
-		cfg, err := config.LoadDefaultConfig(context.TODO())
-		if err != nil {
-			logger.Log("err", err)
-			os.Exit(1)
-		}
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s <command> [flags]
 
-		optFns := []func(*s3.Options){func(o *s3.Options) {
-			o.Retryer = aws.NopRetryer{}
-		}}
+Commands:
+  serve        run the proxy (default when no command is given)
+  bench        drive a GET/PUT load against a running proxy
+  warm         load objects into a running proxy's cache
+  purge        evict objects from a running proxy's cache
+  flush        wait for a running proxy's pending write-back uploads
+  export       write a running proxy's cache to a tarball or bucket
+  import       seed a running proxy's cache from an export
+  freeze       reject writes to a bucket through a running proxy and pin its cache
+  unfreeze     lift a freeze
+  inventory    export an S3 Inventory style listing of a bucket
+  validate     check a config file without applying it
+  conformance  run S3 protocol checks against a running or in-process proxy
+  mount        mount a bucket of a running proxy as a FUSE filesystem
+  migrate      copy the objects of a bucket to another backend
 
-		if *objectStorageUrl != "" {
-			optFns = append(optFns, func(o *s3.Options) {
-				o.BaseEndpoint = aws.String(*objectStorageUrl)
-			})
-		}
+Run '%s <command> -h' for the flags of a command.
+`, os.Args[0], os.Args[0])
+}
 
-		client := s3.NewFromConfig(cfg, optFns...)
-		aws_s3_storage = repository.MakeAWSS3(client)
+func main() {
+	args := os.Args[1:]
+	name := "serve"
+	// Flags without a command keep running the proxy, as before there were
+	// subcommands.
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
 	}
 
-	var s cloud_storage.CloudStorage
-	{
-		cache, err := ristretto.NewCache(&ristretto.Config{
-			NumCounters: 1e5,     // number of keys to track frequency of (10M).
-			MaxCost:     1 << 35, // maximum cost of cache (1GB).
-			BufferItems: 64,      // number of keys per Get buffer.
-		})
-		if err != nil {
-			panic(err)
+	command, ok := commands[name]
+	if !ok {
+		if name != "help" {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
 		}
-		s = cloud_storage.NewCloudStorage(aws_s3_storage, log.With(logger, "component", "service"))
-		s = cloud_storage.NewCachedCloudStorage(s, log.With(logger, "component", "cache"), cache)
-	}
-
-	var h http.Handler
-	{
-		h = cloud_storage.MakeHTTPHandler(s, log.With(logger, "component", "HTTP"))
+		usage()
+		os.Exit(2)
 	}
-
-	errs := make(chan error)
-	go func() {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-		errs <- fmt.Errorf("%s", <-c)
-	}()
-
-	go func() {
-		logger.Log("transport", "HTTP", "addr", *httpAddr)
-		errs <- http.ListenAndServe(*httpAddr, h)
-	}()
-
-	logger.Log("exit", <-errs)
+	os.Exit(command(args))
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/go-kit/kit/log"
+
+	cloud_storage "github.com/rampage644/s3-overlay-proxy/cloud-storage"
+	"github.com/rampage644/s3-overlay-proxy/repository"
+)
+
+// runMigrate implements the migrate subcommand, copying the objects of a
+// bucket from one backend to another directly, without a running proxy.
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	var migrateConfig cloud_storage.MigrateConfig
+	fs.StringVar(&migrateConfig.Bucket, "bucket", "", "bucket to copy")
+	fs.StringVar(&migrateConfig.DestinationBucket, "destination-bucket", "", "bucket copied to (defaults to -bucket); objects encrypted by the proxy can only be copied to a bucket of the same name")
+	fs.StringVar(&migrateConfig.Prefix, "prefix", "", "only copy keys starting with prefix")
+	fs.IntVar(&migrateConfig.Concurrency, "concurrency", 16, "maximum number of objects copied at a time")
+	fs.StringVar(&migrateConfig.Checkpoint, "checkpoint", "", "file recording the progress of the copy, resumed from if it exists (empty disables)")
+	var (
+		sourceURL        = fs.String("source.url", "", "source object storage url (defaults to AWS)")
+		sourcePathStyle  = fs.Bool("source.path-style", false, "address source buckets as URL paths")
+		sourceProfile    = fs.String("source.profile", "", "shared config profile of the source credentials (defaults to the default credentials)")
+		destURL          = fs.String("destination.url", "", "destination object storage url (defaults to AWS)")
+		destPathStyle    = fs.Bool("destination.path-style", false, "address destination buckets as URL paths")
+		destProfile      = fs.String("destination.profile", "", "shared config profile of the destination credentials (defaults to the default credentials)")
+		upstreamCA       = fs.String("ca-file", "", "PEM bundle of CA certificates trusted for both backends, in addition to the system ones")
+		upstreamInsecure = fs.Bool("insecure-skip-verify", false, "testing only: don't verify the TLS certificates of the backends")
+	)
+	if err := parseFlags(fs, args); err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		return 2
+	}
+	if migrateConfig.Bucket == "" {
+		fmt.Fprintf(os.Stderr, "usage: %s migrate -bucket BUCKET -destination.url URL [flags]\n", os.Args[0])
+		return 2
+	}
+
+	logger := log.NewLogfmtLogger(os.Stderr)
+	logger = log.With(logger, "ts", log.DefaultTimestampUTC)
+
+	backend := func(url string, pathStyle bool, profile string) (cloud_storage.CloudStorage, error) {
+		var loadOptions []func(*config.LoadOptions) error
+		if profile != "" {
+			loadOptions = append(loadOptions, config.WithSharedConfigProfile(profile))
+		}
+		cfg, err := loadUpstreamConfig(*upstreamCA, *upstreamInsecure, loadOptions...)
+		if err != nil {
+			return nil, err
+		}
+		return cloud_storage.NewCloudStorage(repository.MakeAWSS3(newUpstreamClient(cfg, url, pathStyle)), log.NewNopLogger()), nil
+	}
+	source, err := backend(*sourceURL, *sourcePathStyle, *sourceProfile)
+	if err != nil {
+		logger.Log("err", err)
+		return 1
+	}
+	destination, err := backend(*destURL, *destPathStyle, *destProfile)
+	if err != nil {
+		logger.Log("err", err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	result, err := cloud_storage.Migrate(ctx, source, destination, migrateConfig, logger)
+	fmt.Printf("%d objects copied, %d bytes, %d already present\n", result.Copied, result.Bytes, result.Skipped)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		return 1
+	}
+	return 0
+}
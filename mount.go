@@ -0,0 +1,77 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/go-kit/kit/log"
+
+	cloud_storage "github.com/rampage644/s3-overlay-proxy/cloud-storage"
+	"github.com/rampage644/s3-overlay-proxy/internal/fusefs"
+	"github.com/rampage644/s3-overlay-proxy/repository"
+)
+
+// runMount implements the mount subcommand, exposing a bucket as a FUSE
+// filesystem until the process is interrupted or the filesystem is
+// unmounted. The filesystem is a client of a running proxy's S3 endpoint,
+// so that its reads and writes go through the proxy like any other: its
+// cache and write-back, bucket mapping, virtual buckets, freezes and
+// encryption. Requests are signed with the default AWS credentials.
+func runMount(args []string) int {
+	fs := flag.NewFlagSet("mount", flag.ExitOnError)
+	var (
+		bucket        = fs.String("bucket", "", "bucket to mount")
+		proxyURL      = fs.String("proxy.url", "http://localhost:8080", "S3 endpoint URL of the running proxy")
+		proxyCA       = fs.String("proxy.ca-file", "", "PEM bundle of CA certificates trusted for the proxy endpoint, in addition to the system ones")
+		proxyInsecure = fs.Bool("proxy.insecure-skip-verify", false, "testing only: don't verify the proxy TLS certificate")
+		allowOther    = fs.Bool("allow-other", false, "let other users access the filesystem")
+		debug         = fs.Bool("debug", false, "log FUSE requests")
+	)
+	if err := parseFlags(fs, args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *bucket == "" || fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s mount -bucket <bucket> [flags] <mountpoint>\n", os.Args[0])
+		return 2
+	}
+	mountpoint := fs.Arg(0)
+
+	logger := log.NewLogfmtLogger(os.Stderr)
+	logger = log.With(logger, "ts", log.DefaultTimestampUTC)
+
+	cfg, err := loadUpstreamConfig(*proxyCA, *proxyInsecure)
+	if err != nil {
+		logger.Log("err", err)
+		return 1
+	}
+	// The proxy serves path-style requests whatever its upstream.
+	backend := repository.MakeAWSS3(newUpstreamClient(cfg, *proxyURL, true))
+	storage := cloud_storage.NewCloudStorage(backend, logger)
+
+	server, err := fusefs.Mount(mountpoint, storage, *bucket, fusefs.MountOptions{
+		AllowOther: *allowOther,
+		Debug:      *debug,
+	})
+	if err != nil {
+		logger.Log("err", err)
+		return 1
+	}
+	logger.Log("msg", "mounted", "bucket", *bucket, "mountpoint", mountpoint)
+
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+		<-c
+		if err := server.Unmount(); err != nil {
+			logger.Log("msg", "unmount failed", "err", err)
+		}
+	}()
+	server.Wait()
+	return 0
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// runMount reports that FUSE mounts aren't supported on this platform.
+func runMount(args []string) int {
+	fmt.Fprintln(os.Stderr, "mount is only supported on Linux and macOS")
+	return 1
+}
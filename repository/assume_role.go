@@ -0,0 +1,149 @@
+package repository
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+)
+
+// AssumedRole is an IAM role to make upstream requests as, and the session
+// name recorded for them, e.g. in CloudTrail.
+type AssumedRole struct {
+	RoleARN     string
+	SessionName string
+}
+
+type assumedRoleKey struct{}
+
+// WithAssumedRole returns a context whose upstream requests are made as role
+// by AssumedRoleStorage.
+func WithAssumedRole(ctx context.Context, role AssumedRole) context.Context {
+	return context.WithValue(ctx, assumedRoleKey{}, role)
+}
+
+// AssumedRoleFromContext returns the role the upstream requests of ctx are
+// made as, if any.
+func AssumedRoleFromContext(ctx context.Context) (AssumedRole, bool) {
+	role, ok := ctx.Value(assumedRoleKey{}).(AssumedRole)
+	return role, ok && role.RoleARN != ""
+}
+
+// AssumedRoleStorage makes upstream requests with the credentials of the
+// role in their context, so that upstream attributes them to the principal
+// of the request instead of the proxy. Roles are assumed on first use and
+// their credentials cached and refreshed before they expire. Requests
+// without a role use the base storage.
+type AssumedRoleStorage struct {
+	base       ObjectStorage
+	client     stscreds.AssumeRoleAPIClient
+	duration   time.Duration
+	newStorage func(credentials aws.CredentialsProvider) ObjectStorage
+
+	mu      sync.Mutex
+	assumed map[AssumedRole]ObjectStorage
+}
+
+// NewAssumedRoleStorage returns a storage assuming roles with client for
+// duration; newStorage builds the storage of a role from its credentials.
+func NewAssumedRoleStorage(base ObjectStorage, client stscreds.AssumeRoleAPIClient, duration time.Duration, newStorage func(credentials aws.CredentialsProvider) ObjectStorage) *AssumedRoleStorage {
+	return &AssumedRoleStorage{
+		base:       base,
+		client:     client,
+		duration:   duration,
+		newStorage: newStorage,
+		assumed:    make(map[AssumedRole]ObjectStorage),
+	}
+}
+
+// storage returns the storage of the role of ctx.
+func (s *AssumedRoleStorage) storage(ctx context.Context) ObjectStorage {
+	role, ok := AssumedRoleFromContext(ctx)
+	if !ok {
+		return s.base
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	storage, ok := s.assumed[role]
+	if !ok {
+		provider := stscreds.NewAssumeRoleProvider(s.client, role.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = role.SessionName
+			if s.duration > 0 {
+				o.Duration = s.duration
+			}
+		})
+		storage = s.newStorage(aws.NewCredentialsCache(provider))
+		s.assumed[role] = storage
+	}
+	return storage
+}
+
+func (s *AssumedRoleStorage) ListBuckets(ctx context.Context, params *ListBucketsInput) (*ListBucketsOutput, error) {
+	return s.storage(ctx).ListBuckets(ctx, params)
+}
+
+func (s *AssumedRoleStorage) ListObjects(ctx context.Context, params *ListObjectsInput) (*ListObjectsOutput, error) {
+	return s.storage(ctx).ListObjects(ctx, params)
+}
+
+func (s *AssumedRoleStorage) HeadObject(ctx context.Context, params *HeadObjectInput) (*HeadObjectOutput, error) {
+	return s.storage(ctx).HeadObject(ctx, params)
+}
+
+func (s *AssumedRoleStorage) GetObject(ctx context.Context, params *GetObjectInput) (*GetObjectOutput, error) {
+	return s.storage(ctx).GetObject(ctx, params)
+}
+
+func (s *AssumedRoleStorage) PutObject(ctx context.Context, params *PutObjectInput) (*PutObjectOutput, error) {
+	return s.storage(ctx).PutObject(ctx, params)
+}
+
+func (s *AssumedRoleStorage) DeleteObject(ctx context.Context, params *DeleteObjectInput) (*DeleteObjectOutput, error) {
+	return s.storage(ctx).DeleteObject(ctx, params)
+}
+
+func (s *AssumedRoleStorage) GetObjectTagging(ctx context.Context, params *GetObjectTaggingInput) (*GetObjectTaggingOutput, error) {
+	return s.storage(ctx).GetObjectTagging(ctx, params)
+}
+
+func (s *AssumedRoleStorage) CreateMultipartUpload(ctx context.Context, params *CreateMultipartUploadInput) (*CreateMultipartUploadOutput, error) {
+	return s.storage(ctx).CreateMultipartUpload(ctx, params)
+}
+
+func (s *AssumedRoleStorage) UploadPart(ctx context.Context, params *UploadPartInput) (*UploadPartOutput, error) {
+	return s.storage(ctx).UploadPart(ctx, params)
+}
+
+func (s *AssumedRoleStorage) CompleteMultipartUpload(ctx context.Context, params *CompleteMultipartUploadInput) (*CompleteMultipartUploadOutput, error) {
+	return s.storage(ctx).CompleteMultipartUpload(ctx, params)
+}
+
+func (s *AssumedRoleStorage) AbortMultipartUpload(ctx context.Context, params *AbortMultipartUploadInput) (*AbortMultipartUploadOutput, error) {
+	return s.storage(ctx).AbortMultipartUpload(ctx, params)
+}
+
+func (s *AssumedRoleStorage) RestoreObject(ctx context.Context, params *RestoreObjectInput) (*RestoreObjectOutput, error) {
+	return s.storage(ctx).RestoreObject(ctx, params)
+}
+
+func (s *AssumedRoleStorage) ListObjectVersions(ctx context.Context, params *ListObjectVersionsInput) (*ListObjectVersionsOutput, error) {
+	return s.storage(ctx).ListObjectVersions(ctx, params)
+}
+
+func (s *AssumedRoleStorage) CreateBucket(ctx context.Context, params *CreateBucketInput) (*CreateBucketOutput, error) {
+	return s.storage(ctx).CreateBucket(ctx, params)
+}
+
+func (s *AssumedRoleStorage) DeleteBucket(ctx context.Context, params *DeleteBucketInput) (*DeleteBucketOutput, error) {
+	return s.storage(ctx).DeleteBucket(ctx, params)
+}
+
+func (s *AssumedRoleStorage) HeadBucket(ctx context.Context, params *HeadBucketInput) (*HeadBucketOutput, error) {
+	return s.storage(ctx).HeadBucket(ctx, params)
+}
+
+func (s *AssumedRoleStorage) GetBucketLocation(ctx context.Context, params *GetBucketLocationInput) (*GetBucketLocationOutput, error) {
+	return s.storage(ctx).GetBucketLocation(ctx, params)
+}
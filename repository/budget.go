@@ -0,0 +1,245 @@
+package repository
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Priority ranks the calls waiting for the upstream request budget.
+type Priority int
+
+const (
+	// PriorityInteractive calls serve client requests, and go first.
+	PriorityInteractive Priority = iota
+
+	// PriorityBatch calls serve bulk client requests, such as nightly
+	// syncs, and only go when no interactive call is waiting.
+	PriorityBatch
+
+	// PriorityBackground calls, such as write-back uploads and cache
+	// refreshes, only go when no client call is waiting.
+	PriorityBackground
+)
+
+type priorityKey struct{}
+
+// WithPriority has the upstream calls made with ctx wait for the budget of
+// BudgetStorage with priority. Calls are interactive by default.
+func WithPriority(ctx context.Context, priority Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// PriorityFromContext returns the priority of the calls made with ctx.
+func PriorityFromContext(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok && p >= PriorityInteractive && p <= PriorityBackground {
+		return p
+	}
+	return PriorityInteractive
+}
+
+// BudgetConfig is the upstream request budget: RequestsPerSecond, with
+// bursts of up to Burst calls. At most MaxQueue calls wait for it, further
+// ones failing right away, 0 disabling the limit.
+type BudgetConfig struct {
+	RequestsPerSecond float64
+	Burst             int
+	MaxQueue          int
+}
+
+// Enabled reports whether the budget limits anything.
+func (c BudgetConfig) Enabled() bool {
+	return c.RequestsPerSecond > 0
+}
+
+// budgetTicket is a call waiting for the budget, granted once ready is
+// closed. Its state is settled once, either way, by whoever comes first:
+// the dispatcher granting it, or the caller giving up.
+type budgetTicket struct {
+	ready chan struct{}
+	state atomic.Int32
+}
+
+const (
+	ticketWaiting int32 = iota
+	ticketGranted
+	ticketAbandoned
+)
+
+// BudgetStorage caps the rate of the calls to an ObjectStorage, whatever
+// the client rate limits, so that the proxy itself never has upstream
+// throttle it. Calls beyond the budget queue by Priority until their
+// context is done.
+type BudgetStorage struct {
+	next    ObjectStorage
+	config  BudgetConfig
+	limiter *rate.Limiter
+
+	mu     sync.Mutex
+	queues [PriorityBackground + 1][]*budgetTicket
+	queued int
+	wake   chan struct{}
+}
+
+func NewBudgetStorage(next ObjectStorage, config BudgetConfig) *BudgetStorage {
+	s := &BudgetStorage{
+		next:    next,
+		config:  config,
+		limiter: rate.NewLimiter(rate.Limit(config.RequestsPerSecond), max(config.Burst, 1)),
+		wake:    make(chan struct{}, 1),
+	}
+	go s.dispatch()
+	return s
+}
+
+// wait blocks until the call made with ctx fits in the budget.
+func (s *BudgetStorage) wait(ctx context.Context) error {
+	priority := PriorityFromContext(ctx)
+	s.mu.Lock()
+	// Nobody queued means nobody to let go first.
+	if s.queued == 0 && s.limiter.Allow() {
+		s.mu.Unlock()
+		return nil
+	}
+	if s.config.MaxQueue > 0 && s.queued >= s.config.MaxQueue {
+		s.mu.Unlock()
+		return ErrSlowDown.WithMessage("Upstream request budget exhausted, please reduce your request rate.")
+	}
+	t := &budgetTicket{ready: make(chan struct{})}
+	s.queues[priority] = append(s.queues[priority], t)
+	s.queued++
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-t.ready:
+		return nil
+	case <-ctx.Done():
+		if t.state.CompareAndSwap(ticketWaiting, ticketAbandoned) {
+			return ctx.Err()
+		}
+		// Granted meanwhile, the call might as well go.
+		return nil
+	}
+}
+
+// dispatch grants the queued calls one token at a time, each to the first
+// call waiting with the highest priority when the token is available.
+func (s *BudgetStorage) dispatch() {
+	for range s.wake {
+		for s.pending() {
+			r := s.limiter.Reserve()
+			time.Sleep(r.Delay())
+			s.grant()
+		}
+	}
+}
+
+// pending reports whether calls are queued.
+func (s *BudgetStorage) pending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queued > 0
+}
+
+// grant lets the first call still waiting go, skipping abandoned ones.
+func (s *BudgetStorage) grant() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.queues {
+		for len(s.queues[i]) > 0 {
+			t := s.queues[i][0]
+			s.queues[i][0] = nil
+			s.queues[i] = s.queues[i][1:]
+			s.queued--
+			if t.state.CompareAndSwap(ticketWaiting, ticketGranted) {
+				close(t.ready)
+				return
+			}
+		}
+	}
+}
+
+// budgeted runs fn once it fits in the budget.
+func budgeted[T any](s *BudgetStorage, ctx context.Context, fn func() (T, error)) (T, error) {
+	if err := s.wait(ctx); err != nil {
+		var zero T
+		return zero, err
+	}
+	return fn()
+}
+
+func (s *BudgetStorage) ListBuckets(ctx context.Context, params *ListBucketsInput) (*ListBucketsOutput, error) {
+	return budgeted(s, ctx, func() (*ListBucketsOutput, error) { return s.next.ListBuckets(ctx, params) })
+}
+
+func (s *BudgetStorage) ListObjects(ctx context.Context, params *ListObjectsInput) (*ListObjectsOutput, error) {
+	return budgeted(s, ctx, func() (*ListObjectsOutput, error) { return s.next.ListObjects(ctx, params) })
+}
+
+func (s *BudgetStorage) HeadObject(ctx context.Context, params *HeadObjectInput) (*HeadObjectOutput, error) {
+	return budgeted(s, ctx, func() (*HeadObjectOutput, error) { return s.next.HeadObject(ctx, params) })
+}
+
+func (s *BudgetStorage) GetObject(ctx context.Context, params *GetObjectInput) (*GetObjectOutput, error) {
+	return budgeted(s, ctx, func() (*GetObjectOutput, error) { return s.next.GetObject(ctx, params) })
+}
+
+func (s *BudgetStorage) PutObject(ctx context.Context, params *PutObjectInput) (*PutObjectOutput, error) {
+	return budgeted(s, ctx, func() (*PutObjectOutput, error) { return s.next.PutObject(ctx, params) })
+}
+
+func (s *BudgetStorage) DeleteObject(ctx context.Context, params *DeleteObjectInput) (*DeleteObjectOutput, error) {
+	return budgeted(s, ctx, func() (*DeleteObjectOutput, error) { return s.next.DeleteObject(ctx, params) })
+}
+
+func (s *BudgetStorage) GetObjectTagging(ctx context.Context, params *GetObjectTaggingInput) (*GetObjectTaggingOutput, error) {
+	return budgeted(s, ctx, func() (*GetObjectTaggingOutput, error) { return s.next.GetObjectTagging(ctx, params) })
+}
+
+func (s *BudgetStorage) CreateMultipartUpload(ctx context.Context, params *CreateMultipartUploadInput) (*CreateMultipartUploadOutput, error) {
+	return budgeted(s, ctx, func() (*CreateMultipartUploadOutput, error) { return s.next.CreateMultipartUpload(ctx, params) })
+}
+
+func (s *BudgetStorage) UploadPart(ctx context.Context, params *UploadPartInput) (*UploadPartOutput, error) {
+	return budgeted(s, ctx, func() (*UploadPartOutput, error) { return s.next.UploadPart(ctx, params) })
+}
+
+func (s *BudgetStorage) CompleteMultipartUpload(ctx context.Context, params *CompleteMultipartUploadInput) (*CompleteMultipartUploadOutput, error) {
+	return budgeted(s, ctx, func() (*CompleteMultipartUploadOutput, error) { return s.next.CompleteMultipartUpload(ctx, params) })
+}
+
+func (s *BudgetStorage) AbortMultipartUpload(ctx context.Context, params *AbortMultipartUploadInput) (*AbortMultipartUploadOutput, error) {
+	return budgeted(s, ctx, func() (*AbortMultipartUploadOutput, error) { return s.next.AbortMultipartUpload(ctx, params) })
+}
+
+func (s *BudgetStorage) RestoreObject(ctx context.Context, params *RestoreObjectInput) (*RestoreObjectOutput, error) {
+	return budgeted(s, ctx, func() (*RestoreObjectOutput, error) { return s.next.RestoreObject(ctx, params) })
+}
+
+func (s *BudgetStorage) ListObjectVersions(ctx context.Context, params *ListObjectVersionsInput) (*ListObjectVersionsOutput, error) {
+	return budgeted(s, ctx, func() (*ListObjectVersionsOutput, error) { return s.next.ListObjectVersions(ctx, params) })
+}
+
+func (s *BudgetStorage) CreateBucket(ctx context.Context, params *CreateBucketInput) (*CreateBucketOutput, error) {
+	return budgeted(s, ctx, func() (*CreateBucketOutput, error) { return s.next.CreateBucket(ctx, params) })
+}
+
+func (s *BudgetStorage) DeleteBucket(ctx context.Context, params *DeleteBucketInput) (*DeleteBucketOutput, error) {
+	return budgeted(s, ctx, func() (*DeleteBucketOutput, error) { return s.next.DeleteBucket(ctx, params) })
+}
+
+func (s *BudgetStorage) HeadBucket(ctx context.Context, params *HeadBucketInput) (*HeadBucketOutput, error) {
+	return budgeted(s, ctx, func() (*HeadBucketOutput, error) { return s.next.HeadBucket(ctx, params) })
+}
+
+func (s *BudgetStorage) GetBucketLocation(ctx context.Context, params *GetBucketLocationInput) (*GetBucketLocationOutput, error) {
+	return budgeted(s, ctx, func() (*GetBucketLocationOutput, error) { return s.next.GetBucketLocation(ctx, params) })
+}
@@ -0,0 +1,220 @@
+package repository
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"time"
+
+	"github.com/aws/smithy-go"
+)
+
+// ChaosConfig describes the faults injected by ChaosStorage.
+type ChaosConfig struct {
+	// Latency is added to every call, plus a random extra of up to Jitter.
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// ErrorRate is the probability (0..1) of a call failing with a
+	// retryable server error instead of reaching the backend.
+	ErrorRate float64
+
+	// TruncateRate is the probability (0..1) of a GetObject body being cut
+	// short at a random offset.
+	TruncateRate float64
+}
+
+// Enabled reports whether the config injects any fault at all.
+func (c ChaosConfig) Enabled() bool {
+	return c.Latency > 0 || c.Jitter > 0 || c.ErrorRate > 0 || c.TruncateRate > 0
+}
+
+// ChaosStorage injects latency, errors and truncated bodies in front of an
+// ObjectStorage, so that clients can validate their retry behavior. It is
+// meant for testing only.
+type ChaosStorage struct {
+	next   ObjectStorage
+	config ChaosConfig
+}
+
+func NewChaosStorage(next ObjectStorage, config ChaosConfig) *ChaosStorage {
+	return &ChaosStorage{
+		next:   next,
+		config: config,
+	}
+}
+
+var chaosErrors = []smithy.GenericAPIError{
+	{Code: "InternalError", Message: "We encountered an internal error. Please try again.", Fault: smithy.FaultServer},
+	{Code: "ServiceUnavailable", Message: "Please reduce your request rate.", Fault: smithy.FaultServer},
+	{Code: "SlowDown", Message: "Please reduce your request rate.", Fault: smithy.FaultServer},
+}
+
+// inject sleeps for the configured latency and returns the error to fail
+// the call with, if any.
+func (s *ChaosStorage) inject(ctx context.Context) error {
+	delay := s.config.Latency
+	if s.config.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(s.config.Jitter)))
+	}
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if rand.Float64() < s.config.ErrorRate {
+		err := chaosErrors[rand.Intn(len(chaosErrors))]
+		return &err
+	}
+	return nil
+}
+
+func (s *ChaosStorage) ListBuckets(ctx context.Context, params *ListBucketsInput) (*ListBucketsOutput, error) {
+	if err := s.inject(ctx); err != nil {
+		return nil, err
+	}
+	return s.next.ListBuckets(ctx, params)
+}
+
+func (s *ChaosStorage) ListObjects(ctx context.Context, params *ListObjectsInput) (*ListObjectsOutput, error) {
+	if err := s.inject(ctx); err != nil {
+		return nil, err
+	}
+	return s.next.ListObjects(ctx, params)
+}
+
+func (s *ChaosStorage) HeadObject(ctx context.Context, params *HeadObjectInput) (*HeadObjectOutput, error) {
+	if err := s.inject(ctx); err != nil {
+		return nil, err
+	}
+	return s.next.HeadObject(ctx, params)
+}
+
+func (s *ChaosStorage) GetObject(ctx context.Context, params *GetObjectInput) (*GetObjectOutput, error) {
+	if err := s.inject(ctx); err != nil {
+		return nil, err
+	}
+	output, err := s.next.GetObject(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if output.ContentLength > 0 && rand.Float64() < s.config.TruncateRate {
+		output.Body = &truncatedReadCloser{
+			Reader: io.LimitReader(output.Body, rand.Int63n(output.ContentLength)),
+			Closer: output.Body,
+		}
+	}
+	return output, nil
+}
+
+func (s *ChaosStorage) PutObject(ctx context.Context, params *PutObjectInput) (*PutObjectOutput, error) {
+	if err := s.inject(ctx); err != nil {
+		return nil, err
+	}
+	return s.next.PutObject(ctx, params)
+}
+
+func (s *ChaosStorage) DeleteObject(ctx context.Context, params *DeleteObjectInput) (*DeleteObjectOutput, error) {
+	if err := s.inject(ctx); err != nil {
+		return nil, err
+	}
+	return s.next.DeleteObject(ctx, params)
+}
+
+func (s *ChaosStorage) GetObjectTagging(ctx context.Context, params *GetObjectTaggingInput) (*GetObjectTaggingOutput, error) {
+	if err := s.inject(ctx); err != nil {
+		return nil, err
+	}
+	return s.next.GetObjectTagging(ctx, params)
+}
+
+func (s *ChaosStorage) CreateMultipartUpload(ctx context.Context, params *CreateMultipartUploadInput) (*CreateMultipartUploadOutput, error) {
+	if err := s.inject(ctx); err != nil {
+		return nil, err
+	}
+	return s.next.CreateMultipartUpload(ctx, params)
+}
+
+func (s *ChaosStorage) UploadPart(ctx context.Context, params *UploadPartInput) (*UploadPartOutput, error) {
+	if err := s.inject(ctx); err != nil {
+		return nil, err
+	}
+	return s.next.UploadPart(ctx, params)
+}
+
+func (s *ChaosStorage) CompleteMultipartUpload(ctx context.Context, params *CompleteMultipartUploadInput) (*CompleteMultipartUploadOutput, error) {
+	if err := s.inject(ctx); err != nil {
+		return nil, err
+	}
+	return s.next.CompleteMultipartUpload(ctx, params)
+}
+
+func (s *ChaosStorage) AbortMultipartUpload(ctx context.Context, params *AbortMultipartUploadInput) (*AbortMultipartUploadOutput, error) {
+	if err := s.inject(ctx); err != nil {
+		return nil, err
+	}
+	return s.next.AbortMultipartUpload(ctx, params)
+}
+
+func (s *ChaosStorage) RestoreObject(ctx context.Context, params *RestoreObjectInput) (*RestoreObjectOutput, error) {
+	if err := s.inject(ctx); err != nil {
+		return nil, err
+	}
+	return s.next.RestoreObject(ctx, params)
+}
+
+func (s *ChaosStorage) ListObjectVersions(ctx context.Context, params *ListObjectVersionsInput) (*ListObjectVersionsOutput, error) {
+	if err := s.inject(ctx); err != nil {
+		return nil, err
+	}
+	return s.next.ListObjectVersions(ctx, params)
+}
+
+// truncatedReadCloser fails with io.ErrUnexpectedEOF once its limit is hit,
+// like a connection dropped in the middle of a body would.
+type truncatedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (r *truncatedReadCloser) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (s *ChaosStorage) CreateBucket(ctx context.Context, params *CreateBucketInput) (*CreateBucketOutput, error) {
+	if err := s.inject(ctx); err != nil {
+		return nil, err
+	}
+	return s.next.CreateBucket(ctx, params)
+}
+
+func (s *ChaosStorage) DeleteBucket(ctx context.Context, params *DeleteBucketInput) (*DeleteBucketOutput, error) {
+	if err := s.inject(ctx); err != nil {
+		return nil, err
+	}
+	return s.next.DeleteBucket(ctx, params)
+}
+
+func (s *ChaosStorage) HeadBucket(ctx context.Context, params *HeadBucketInput) (*HeadBucketOutput, error) {
+	if err := s.inject(ctx); err != nil {
+		return nil, err
+	}
+	return s.next.HeadBucket(ctx, params)
+}
+
+func (s *ChaosStorage) GetBucketLocation(ctx context.Context, params *GetBucketLocationInput) (*GetBucketLocationOutput, error) {
+	if err := s.inject(ctx); err != nil {
+		return nil, err
+	}
+	return s.next.GetBucketLocation(ctx, params)
+}
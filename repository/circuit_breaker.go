@@ -0,0 +1,126 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+	"github.com/sony/gobreaker"
+)
+
+// CircuitBreakerStorage guards an ObjectStorage with a circuit breaker so
+// that sustained upstream failures fail fast locally instead of piling up
+// requests against a struggling backend.
+type CircuitBreakerStorage struct {
+	next ObjectStorage
+	cb   *gobreaker.CircuitBreaker
+}
+
+func NewCircuitBreakerStorage(next ObjectStorage, cb *gobreaker.CircuitBreaker) *CircuitBreakerStorage {
+	return &CircuitBreakerStorage{
+		next: next,
+		cb:   cb,
+	}
+}
+
+// IsUpstreamFailure reports whether err indicates that the upstream itself
+// is unhealthy, as opposed to a client error such as a missing key or a
+// request cancelled by the caller, or an API error of the proxy's own with
+// a client fault. Use it as gobreaker.Settings.IsSuccessful
+// (negated) so client errors never trip the breaker.
+func IsUpstreamFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var re *awshttp.ResponseError
+	if errors.As(err, &re) {
+		return re.HTTPStatusCode() >= 500
+	}
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Fault == smithy.FaultServer
+	}
+	return true
+}
+
+// execute runs fn through the breaker, translating a rejection into a
+// ServiceUnavailable API error.
+func execute[T any](s *CircuitBreakerStorage, fn func() (T, error)) (T, error) {
+	out, err := s.cb.Execute(func() (interface{}, error) {
+		return fn()
+	})
+	if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) {
+		var zero T
+		return zero, ErrServiceUnavailable.WithMessage("Upstream is unavailable: " + err.Error())
+	}
+	return out.(T), err
+}
+
+func (s *CircuitBreakerStorage) ListBuckets(ctx context.Context, params *ListBucketsInput) (*ListBucketsOutput, error) {
+	return execute(s, func() (*ListBucketsOutput, error) { return s.next.ListBuckets(ctx, params) })
+}
+
+func (s *CircuitBreakerStorage) ListObjects(ctx context.Context, params *ListObjectsInput) (*ListObjectsOutput, error) {
+	return execute(s, func() (*ListObjectsOutput, error) { return s.next.ListObjects(ctx, params) })
+}
+
+func (s *CircuitBreakerStorage) HeadObject(ctx context.Context, params *HeadObjectInput) (*HeadObjectOutput, error) {
+	return execute(s, func() (*HeadObjectOutput, error) { return s.next.HeadObject(ctx, params) })
+}
+
+func (s *CircuitBreakerStorage) GetObject(ctx context.Context, params *GetObjectInput) (*GetObjectOutput, error) {
+	return execute(s, func() (*GetObjectOutput, error) { return s.next.GetObject(ctx, params) })
+}
+
+func (s *CircuitBreakerStorage) PutObject(ctx context.Context, params *PutObjectInput) (*PutObjectOutput, error) {
+	return execute(s, func() (*PutObjectOutput, error) { return s.next.PutObject(ctx, params) })
+}
+
+func (s *CircuitBreakerStorage) DeleteObject(ctx context.Context, params *DeleteObjectInput) (*DeleteObjectOutput, error) {
+	return execute(s, func() (*DeleteObjectOutput, error) { return s.next.DeleteObject(ctx, params) })
+}
+
+func (s *CircuitBreakerStorage) GetObjectTagging(ctx context.Context, params *GetObjectTaggingInput) (*GetObjectTaggingOutput, error) {
+	return execute(s, func() (*GetObjectTaggingOutput, error) { return s.next.GetObjectTagging(ctx, params) })
+}
+
+func (s *CircuitBreakerStorage) CreateMultipartUpload(ctx context.Context, params *CreateMultipartUploadInput) (*CreateMultipartUploadOutput, error) {
+	return execute(s, func() (*CreateMultipartUploadOutput, error) { return s.next.CreateMultipartUpload(ctx, params) })
+}
+
+func (s *CircuitBreakerStorage) UploadPart(ctx context.Context, params *UploadPartInput) (*UploadPartOutput, error) {
+	return execute(s, func() (*UploadPartOutput, error) { return s.next.UploadPart(ctx, params) })
+}
+
+func (s *CircuitBreakerStorage) CompleteMultipartUpload(ctx context.Context, params *CompleteMultipartUploadInput) (*CompleteMultipartUploadOutput, error) {
+	return execute(s, func() (*CompleteMultipartUploadOutput, error) { return s.next.CompleteMultipartUpload(ctx, params) })
+}
+
+func (s *CircuitBreakerStorage) AbortMultipartUpload(ctx context.Context, params *AbortMultipartUploadInput) (*AbortMultipartUploadOutput, error) {
+	return execute(s, func() (*AbortMultipartUploadOutput, error) { return s.next.AbortMultipartUpload(ctx, params) })
+}
+
+func (s *CircuitBreakerStorage) RestoreObject(ctx context.Context, params *RestoreObjectInput) (*RestoreObjectOutput, error) {
+	return execute(s, func() (*RestoreObjectOutput, error) { return s.next.RestoreObject(ctx, params) })
+}
+
+func (s *CircuitBreakerStorage) ListObjectVersions(ctx context.Context, params *ListObjectVersionsInput) (*ListObjectVersionsOutput, error) {
+	return execute(s, func() (*ListObjectVersionsOutput, error) { return s.next.ListObjectVersions(ctx, params) })
+}
+
+func (s *CircuitBreakerStorage) CreateBucket(ctx context.Context, params *CreateBucketInput) (*CreateBucketOutput, error) {
+	return execute(s, func() (*CreateBucketOutput, error) { return s.next.CreateBucket(ctx, params) })
+}
+
+func (s *CircuitBreakerStorage) DeleteBucket(ctx context.Context, params *DeleteBucketInput) (*DeleteBucketOutput, error) {
+	return execute(s, func() (*DeleteBucketOutput, error) { return s.next.DeleteBucket(ctx, params) })
+}
+
+func (s *CircuitBreakerStorage) HeadBucket(ctx context.Context, params *HeadBucketInput) (*HeadBucketOutput, error) {
+	return execute(s, func() (*HeadBucketOutput, error) { return s.next.HeadBucket(ctx, params) })
+}
+
+func (s *CircuitBreakerStorage) GetBucketLocation(ctx context.Context, params *GetBucketLocationInput) (*GetBucketLocationOutput, error) {
+	return execute(s, func() (*GetBucketLocationOutput, error) { return s.next.GetBucketLocation(ctx, params) })
+}
@@ -0,0 +1,44 @@
+package repository
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// ReloadableCredentials serves static upstream credentials which can be
+// replaced at runtime, falling back to another provider (usually the
+// default credential chain) while none are set.
+type ReloadableCredentials struct {
+	fallback aws.CredentialsProvider
+	static   atomic.Pointer[aws.Credentials]
+}
+
+func NewReloadableCredentials(fallback aws.CredentialsProvider) *ReloadableCredentials {
+	return &ReloadableCredentials{
+		fallback: fallback,
+	}
+}
+
+// Set replaces the static credentials; an empty accessKeyID reverts to the
+// fallback provider.
+func (c *ReloadableCredentials) Set(accessKeyID, secretAccessKey, sessionToken string) {
+	if accessKeyID == "" {
+		c.static.Store(nil)
+		return
+	}
+	c.static.Store(&aws.Credentials{
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+		SessionToken:    sessionToken,
+		Source:          "ReloadableCredentials",
+	})
+}
+
+func (c *ReloadableCredentials) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	if creds := c.static.Load(); creds != nil {
+		return *creds, nil
+	}
+	return c.fallback.Retrieve(ctx)
+}
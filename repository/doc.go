@@ -0,0 +1,6 @@
+// Package repository provides the upstream object storage of the proxy: an
+// AWS SDK backed ObjectStorage, S3 Express One Zone session signing, and
+// decorators adding a circuit breaker, call timeouts, fault injection,
+// reloadable credentials and per-tenant assumed roles. Backend errors are
+// translated into the typed Errors of errors.go, such as ErrNoSuchKey.
+package repository
@@ -0,0 +1,922 @@
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// EncryptionAlgorithm is the algorithm of the bodies EncryptionStorage
+// writes, a STREAM construction: chunks of up to encryptionChunk bytes,
+// each sealed with AES-256-GCM under the object's data key and prefixed
+// with its random nonce and its position, the part number and the index of
+// the chunk in the part, whose top bit marks the last chunk of the part.
+// Chunks are authenticated along with their position, the bucket and key
+// of the object and its plaintext size, so that they can't be swapped
+// between objects, reordered or dropped.
+const EncryptionAlgorithm = "AES256-GCM-STREAM-64K"
+
+// The user metadata recording how an object is encrypted: the algorithm,
+// the ID of the master key, the data key wrapped with it, and the plaintext
+// size and ETag, unknown for multipart uploads.
+const (
+	encryptionMetaAlgorithm = "proxy-encryption"
+	encryptionMetaKeyID     = "proxy-encryption-key-id"
+	encryptionMetaDataKey   = "proxy-encryption-data-key"
+	encryptionMetaSize      = "proxy-encryption-size"
+	encryptionMetaETag      = "proxy-encryption-etag"
+)
+
+const (
+	encryptionChunk    = 64 << 10
+	encryptionNonce    = 12
+	encryptionHeader   = encryptionNonce + 8
+	encryptionOverhead = encryptionHeader + 16
+	encryptionSealed   = encryptionChunk + encryptionOverhead
+	// encryptionLastChunk is the bit of chunk indexes marking the last
+	// chunk of a part.
+	encryptionLastChunk = 1 << 31
+	// encryptionUnknownSize is the size chunks of multipart uploads are
+	// authenticated with.
+	encryptionUnknownSize = -1
+)
+
+// MasterKeys wraps the data keys of encrypted objects with master keys, so
+// that only the wrapped data keys are stored upstream. A KMS would
+// implement it with its Encrypt and Decrypt calls.
+type MasterKeys interface {
+	// Wrap encrypts dataKey with the current master key, returning its ID.
+	Wrap(ctx context.Context, dataKey []byte) (keyID string, wrapped []byte, err error)
+	// Unwrap decrypts a data key wrapped with the master key keyID.
+	Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// LocalMasterKeys are master keys held by the proxy.
+type LocalMasterKeys struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// LoadLocalMasterKeys reads master keys from path, one per line as an ID
+// and a base64 encoded 32 byte key separated by a space. The first key
+// wraps new data keys; the others, kept after a rotation, only unwrap the
+// data keys they wrapped. Blank lines and lines starting with # are
+// ignored.
+func LoadLocalMasterKeys(path string) (*LocalMasterKeys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := &LocalMasterKeys{keys: map[string]cipher.AEAD{}}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(text, " ")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected a key ID and a key", path, line)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%s:%d: key %s must be 32 bytes, base64 encoded", path, line, id)
+		}
+		if _, ok := keys.keys[id]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate key %s", path, line, id)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		keys.keys[id] = aead
+		if keys.current == "" {
+			keys.current = id
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if keys.current == "" {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	return keys, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrappedKeyData authenticates wrapped data keys.
+var wrappedKeyData = []byte("s3proxy data key")
+
+func (k *LocalMasterKeys) Wrap(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	nonce := make([]byte, encryptionNonce, encryptionNonce+len(dataKey)+16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	return k.current, k.keys[k.current].Seal(nonce, nonce, dataKey, wrappedKeyData), nil
+}
+
+func (k *LocalMasterKeys) Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown master key %q", keyID)
+	}
+	if len(wrapped) < encryptionNonce {
+		return nil, fmt.Errorf("invalid data key wrapped with %q", keyID)
+	}
+	return aead.Open(nil, wrapped[:encryptionNonce], wrapped[encryptionNonce:], wrappedKeyData)
+}
+
+// EncryptionConfig configures EncryptionStorage: Keys wraps the data keys,
+// and the objects written to Buckets, or to any bucket if empty, are
+// encrypted.
+type EncryptionConfig struct {
+	Keys    MasterKeys
+	Buckets []string
+}
+
+// EncryptionStorage encrypts the bodies of objects before they are written
+// to an ObjectStorage and decrypts them when read, so that they are opaque
+// to its provider: envelope encryption, with a random data key per object,
+// recorded wrapped with a master key in the object's metadata. Objects
+// without that metadata are read as they are, so that encryption can be
+// enabled on buckets with objects already.
+//
+// Ranged reads fetch the chunks covering the range, in the buckets which
+// are encrypted only: encryption must stay enabled on buckets with
+// encrypted objects for ranges of them to be read. Parts of multipart
+// uploads are encrypted on their own, so all but the last must be
+// multiples of 64 KiB, as parts of whole MiB are; reads of objects
+// uploaded otherwise fail to authenticate rather than return garbage. Their
+// part numbers must follow each other from 1, so that reads tell when a
+// part is missing; as their size isn't known when they are created,
+// reads can't tell when the last parts are, however, nor ranged reads of
+// them where they start. The data keys of multipart uploads are held in
+// memory until they complete, so uploads in progress when the proxy
+// restarts must be started again.
+//
+// HEAD and GET responses report the ETag of the plaintext, the MD5 the
+// client uploaded, and compare the ETags of If-Match and If-None-Match to
+// it, except for multipart uploads, which report the ETag upstream gives
+// them. It is recorded in the metadata, sent before the body: from
+// Content-MD5 if the upload has one, otherwise the body is read twice,
+// spooled to a temporary file unless it is seekable. Listings report the
+// encrypted sizes and ETags.
+type EncryptionStorage struct {
+	next    ObjectStorage
+	keys    MasterKeys
+	buckets map[string]bool
+
+	mu      sync.Mutex
+	uploads map[string][]byte
+}
+
+func NewEncryptionStorage(next ObjectStorage, config EncryptionConfig) *EncryptionStorage {
+	s := &EncryptionStorage{next: next, keys: config.Keys, uploads: map[string][]byte{}}
+	if len(config.Buckets) > 0 {
+		s.buckets = map[string]bool{}
+		for _, bucket := range config.Buckets {
+			s.buckets[bucket] = true
+		}
+	}
+	return s
+}
+
+// encrypts reports whether the objects written to bucket are encrypted.
+func (s *EncryptionStorage) encrypts(bucket string) bool {
+	return s.buckets == nil || s.buckets[bucket]
+}
+
+// newDataKey returns a new data key and the metadata recording it, along
+// with metadata.
+func (s *EncryptionStorage) newDataKey(ctx context.Context, metadata map[string]string) ([]byte, map[string]string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	keyID, wrapped, err := s.keys.Wrap(ctx, dataKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("wrapping data key: %w", err)
+	}
+	withKey := make(map[string]string, len(metadata)+3)
+	for name, value := range metadata {
+		withKey[name] = value
+	}
+	withKey[encryptionMetaAlgorithm] = EncryptionAlgorithm
+	withKey[encryptionMetaKeyID] = keyID
+	withKey[encryptionMetaDataKey] = base64.StdEncoding.EncodeToString(wrapped)
+	return dataKey, withKey, nil
+}
+
+// dataKey returns the data key recorded in the metadata of an object, nil
+// if it isn't encrypted.
+func (s *EncryptionStorage) dataKey(ctx context.Context, bucket, key string, metadata map[string]string) ([]byte, error) {
+	algorithm, ok := metadata[encryptionMetaAlgorithm]
+	if !ok {
+		return nil, nil
+	}
+	if algorithm != EncryptionAlgorithm {
+		return nil, fmt.Errorf("%s/%s: unsupported encryption %q", bucket, key, algorithm)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(metadata[encryptionMetaDataKey])
+	if err != nil {
+		return nil, fmt.Errorf("%s/%s: invalid data key: %w", bucket, key, err)
+	}
+	dataKey, err := s.keys.Unwrap(ctx, metadata[encryptionMetaKeyID], wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("%s/%s: unwrapping data key: %w", bucket, key, err)
+	}
+	return dataKey, nil
+}
+
+// withoutEncryption returns metadata without the encryption entries.
+// IsEncrypted reports whether metadata is that of an object encrypted by
+// EncryptionStorage. Its body can only be decrypted under its bucket and
+// key.
+func IsEncrypted(metadata map[string]string) bool {
+	_, ok := metadata[encryptionMetaAlgorithm]
+	return ok
+}
+
+func withoutEncryption(metadata map[string]string) map[string]string {
+	stripped := make(map[string]string, len(metadata))
+	for name, value := range metadata {
+		switch name {
+		case encryptionMetaAlgorithm, encryptionMetaKeyID, encryptionMetaDataKey, encryptionMetaSize, encryptionMetaETag:
+		default:
+			stripped[name] = value
+		}
+	}
+	return stripped
+}
+
+// encryptedSize returns the size of a body of size bytes once encrypted.
+func encryptedSize(size int64) int64 {
+	chunks := (size + encryptionChunk - 1) / encryptionChunk
+	return size + chunks*encryptionOverhead
+}
+
+// decryptedSize returns the size of a body of size bytes once decrypted.
+func decryptedSize(size int64) (int64, error) {
+	chunks, rest := size/encryptionSealed, size%encryptionSealed
+	if rest > 0 && rest <= encryptionOverhead {
+		return 0, fmt.Errorf("invalid encrypted size %d", size)
+	}
+	return chunks*encryptionChunk + max(rest-encryptionOverhead, 0), nil
+}
+
+// plaintextSize returns the size of an encrypted body of size bytes once
+// decrypted, and the size recorded in its metadata, checking that they
+// match.
+func plaintextSize(metadata map[string]string, size int64) (int64, int64, error) {
+	decrypted, err := decryptedSize(size)
+	if err != nil {
+		return 0, 0, err
+	}
+	recorded, err := metadataSize(metadata)
+	if err != nil {
+		return 0, 0, err
+	}
+	if recorded != encryptionUnknownSize && recorded != decrypted {
+		return 0, 0, fmt.Errorf("encrypted body of %d bytes, expected %d", decrypted, recorded)
+	}
+	return decrypted, recorded, nil
+}
+
+// objectData returns the data each chunk of an object is authenticated
+// with, along with its position, so that bodies can't be swapped between
+// objects nor their sizes changed.
+func objectData(bucket, key *string, size int64) []byte {
+	data := []byte(aws.ToString(bucket) + "/" + aws.ToString(key) + "\x00")
+	return binary.BigEndian.AppendUint64(data, uint64(size))
+}
+
+// metadataSize returns the plaintext size recorded in the metadata of an
+// encrypted object, encryptionUnknownSize if it isn't.
+func metadataSize(metadata map[string]string) (int64, error) {
+	value, ok := metadata[encryptionMetaSize]
+	if !ok {
+		return encryptionUnknownSize, nil
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid encrypted object size %q", value)
+	}
+	return size, nil
+}
+
+// chunkData returns the data a chunk is authenticated with: data and its
+// position in header.
+func chunkData(data, header []byte) []byte {
+	return append(data[:len(data):len(data)], header[encryptionNonce:encryptionHeader]...)
+}
+
+// sealingReader encrypts what it reads from src, the body of part of
+// size bytes, or of any size if encryptionUnknownSize, and of MD5 wantMD5
+// if set.
+type sealingReader struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	data    []byte
+	part    uint32
+	index   uint32
+	size    int64
+	read    int64
+	md5     hash.Hash
+	wantMD5 []byte
+	plain   []byte
+	sealed  []byte
+	out     []byte
+	err     error
+}
+
+func newSealingReader(src io.Reader, dataKey, data []byte, part int32, size int64) (*sealingReader, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &sealingReader{
+		src:    bufio.NewReader(src),
+		aead:   aead,
+		data:   data,
+		part:   uint32(part),
+		size:   size,
+		plain:  make([]byte, encryptionChunk),
+		sealed: make([]byte, encryptionSealed),
+	}, nil
+}
+
+func (r *sealingReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		n, err := io.ReadFull(r.src, r.plain)
+		if err == nil {
+			// The chunk is the last one if nothing follows it.
+			if _, err = r.src.Peek(1); err != nil && err != io.EOF {
+				return 0, err
+			}
+		} else if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		} else if err != io.EOF {
+			return 0, err
+		}
+		r.read += int64(n)
+		if r.wantMD5 != nil {
+			r.md5.Write(r.plain[:n])
+		}
+		// Failing before the last chunk, so that the upload fails.
+		if err == io.EOF && r.size != encryptionUnknownSize && r.read != r.size {
+			r.err = fmt.Errorf("read %d bytes of a body of %d", r.read, r.size)
+			return 0, r.err
+		}
+		if err == io.EOF && r.wantMD5 != nil && !bytes.Equal(r.md5.Sum(nil), r.wantMD5) {
+			r.err = errBadDigest
+			return 0, r.err
+		}
+		if n > 0 {
+			header := r.sealed[:encryptionHeader]
+			if _, err := rand.Read(header[:encryptionNonce]); err != nil {
+				return 0, err
+			}
+			index := r.index
+			if err == io.EOF {
+				index |= encryptionLastChunk
+			}
+			binary.BigEndian.PutUint32(header[encryptionNonce:], r.part)
+			binary.BigEndian.PutUint32(header[encryptionNonce+4:], index)
+			r.out = r.aead.Seal(header, header[:encryptionNonce], r.plain[:n], chunkData(r.data, header))
+			r.index++
+		}
+		r.err = err
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+var errBadDigest = &Error{Code: "BadDigest", Message: "The Content-MD5 you specified did not match what we received."}
+
+// plaintextMD5 returns the MD5 of the body of params, and the body to
+// upload then, along with a function removing the file it was spooled to,
+// if it was: the decoded Content-MD5 if any, which the body is checked
+// against as it is sealed, or else the MD5 read ahead.
+func plaintextMD5(params *PutObjectInput) ([]byte, io.Reader, func(), error) {
+	noop := func() {}
+	if contentMD5 := aws.ToString(params.ContentMD5); contentMD5 != "" {
+		sum, err := base64.StdEncoding.DecodeString(contentMD5)
+		if err != nil || len(sum) != md5.Size {
+			return nil, nil, nil, &Error{Code: "InvalidDigest", Message: "The Content-MD5 you specified was invalid."}
+		}
+		return sum, params.Body, noop, nil
+	}
+	hash := md5.New()
+	if seeker, ok := params.Body.(io.ReadSeeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err == nil {
+			_, err = io.Copy(hash, seeker)
+		}
+		if err == nil {
+			_, err = seeker.Seek(start, io.SeekStart)
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return hash.Sum(nil), seeker, noop, nil
+	}
+	f, err := os.CreateTemp("", "s3proxy-encrypt-*")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	remove := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	_, err = io.Copy(io.MultiWriter(f, hash), params.Body)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		remove()
+		return nil, nil, nil, err
+	}
+	return hash.Sum(nil), f, remove, nil
+}
+
+// plaintextETag returns the ETag of the plaintext of an object recorded in
+// its metadata, etag, its ETag upstream, if it isn't.
+func plaintextETag(metadata map[string]string, etag *string) *string {
+	if sum, ok := metadata[encryptionMetaETag]; ok {
+		return aws.String(`"` + sum + `"`)
+	}
+	return etag
+}
+
+// etagConditions are the If-Match and If-None-Match conditions of a read,
+// which upstream would compare to the ETags of the encrypted bodies.
+type etagConditions struct {
+	ifMatch, ifNoneMatch *string
+}
+
+// stripETagConditions removes the ETag conditions of a read, and the date
+// conditions they take precedence over, returning them.
+func stripETagConditions(ifMatch, ifNoneMatch **string, ifUnmodifiedSince, ifModifiedSince **time.Time) etagConditions {
+	c := etagConditions{ifMatch: *ifMatch, ifNoneMatch: *ifNoneMatch}
+	if *ifMatch != nil {
+		*ifMatch, *ifUnmodifiedSince = nil, nil
+	}
+	if *ifNoneMatch != nil {
+		*ifNoneMatch, *ifModifiedSince = nil, nil
+	}
+	return c
+}
+
+// check returns the error of a read of an object of etag the conditions
+// fail.
+func (c etagConditions) check(etag *string) error {
+	if c.ifMatch != nil && !etagMatches(*c.ifMatch, aws.ToString(etag)) {
+		return ErrPreconditionFailed
+	}
+	if c.ifNoneMatch != nil && etagMatches(*c.ifNoneMatch, aws.ToString(etag)) {
+		return ErrNotModified
+	}
+	return nil
+}
+
+// etagMatches reports whether etag is one of the ETags of an If-Match or
+// If-None-Match header, or the header is "*".
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || strings.Trim(candidate, `"`) == strings.Trim(etag, `"`) {
+			return true
+		}
+	}
+	return false
+}
+
+// openingReader decrypts what it reads from src, checking that chunks
+// follow each other: from the first chunk of the first part, or from any
+// chunk for ranges, in which case first, if not negative, is the index the
+// first chunk must have in an object of a single part, and up to the last
+// chunk of the last part if toEnd.
+type openingReader struct {
+	src    io.ReadCloser
+	aead   cipher.AEAD
+	data   []byte
+	toEnd  bool
+	sealed []byte
+	out    []byte
+	err    error
+
+	// The position of the previous chunk, or the expected one of the first
+	// chunk if started isn't set and checkFirst is.
+	started    bool
+	checkFirst bool
+	part       uint32
+	index      uint32
+	last       bool
+}
+
+func newOpeningReader(src io.ReadCloser, dataKey, data []byte, first int64, toEnd bool) (*openingReader, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	r := &openingReader{src: src, aead: aead, data: data, toEnd: toEnd, sealed: make([]byte, encryptionSealed)}
+	if first >= 0 {
+		r.checkFirst, r.part, r.index = true, 1, uint32(first)
+	}
+	return r, nil
+}
+
+// follows checks that the chunk at part and index follows the previous one.
+func (r *openingReader) follows(part, index uint32) error {
+	var wantPart, wantIndex uint32
+	switch {
+	case !r.started && !r.checkFirst:
+		return nil
+	case !r.started:
+		wantPart, wantIndex = r.part, r.index
+	case r.last:
+		wantPart, wantIndex = r.part+1, 0
+	default:
+		wantPart, wantIndex = r.part, r.index+1
+	}
+	if part != wantPart || index != wantIndex {
+		return fmt.Errorf("encrypted chunk %d of part %d found instead of chunk %d of part %d", index, part, wantIndex, wantPart)
+	}
+	return nil
+}
+
+func (r *openingReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		n, err := io.ReadFull(r.src, r.sealed)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		if n > 0 {
+			if n <= encryptionOverhead {
+				r.err = fmt.Errorf("truncated encrypted chunk of %d bytes", n)
+				return 0, r.err
+			}
+			header := r.sealed[:encryptionHeader]
+			part := binary.BigEndian.Uint32(header[encryptionNonce:])
+			index := binary.BigEndian.Uint32(header[encryptionNonce+4:])
+			if r.err = r.follows(part, index&^encryptionLastChunk); r.err != nil {
+				return 0, r.err
+			}
+			plain, openErr := r.aead.Open(r.sealed[encryptionHeader:encryptionHeader], header[:encryptionNonce], r.sealed[encryptionHeader:n], chunkData(r.data, header))
+			if openErr != nil {
+				r.err = fmt.Errorf("decrypting chunk: %w", openErr)
+				return 0, r.err
+			}
+			r.started, r.part, r.index, r.last = true, part, index&^encryptionLastChunk, index&encryptionLastChunk != 0
+			r.out = plain
+		}
+		if err == io.EOF && r.toEnd && r.started && !r.last {
+			err = fmt.Errorf("truncated encrypted body, chunk %d of part %d isn't the last", r.index, r.part)
+		}
+		r.err = err
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *openingReader) Close() error {
+	return r.src.Close()
+}
+
+func (s *EncryptionStorage) ListBuckets(ctx context.Context, params *ListBucketsInput) (*ListBucketsOutput, error) {
+	return s.next.ListBuckets(ctx, params)
+}
+
+func (s *EncryptionStorage) ListObjects(ctx context.Context, params *ListObjectsInput) (*ListObjectsOutput, error) {
+	return s.next.ListObjects(ctx, params)
+}
+
+func (s *EncryptionStorage) HeadObject(ctx context.Context, params *HeadObjectInput) (*HeadObjectOutput, error) {
+	input, conditions := *params, etagConditions{}
+	if s.encrypts(aws.ToString(params.Bucket)) {
+		conditions = stripETagConditions(&input.IfMatch, &input.IfNoneMatch, &input.IfUnmodifiedSince, &input.IfModifiedSince)
+	}
+	out, err := s.next.HeadObject(ctx, &input)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := out.Metadata[encryptionMetaAlgorithm]; !ok {
+		return out, conditions.check(out.ETag)
+	}
+	size, _, err := plaintextSize(out.Metadata, out.ContentLength)
+	if err != nil {
+		return nil, err
+	}
+	decrypted := *out
+	decrypted.ContentLength = size
+	decrypted.ETag = plaintextETag(out.Metadata, out.ETag)
+	if err := conditions.check(decrypted.ETag); err != nil {
+		return nil, err
+	}
+	decrypted.Metadata = withoutEncryption(out.Metadata)
+	decrypted.ChecksumCRC32, decrypted.ChecksumCRC32C, decrypted.ChecksumSHA1, decrypted.ChecksumSHA256 = nil, nil, nil, nil
+	return &decrypted, nil
+}
+
+func (s *EncryptionStorage) GetObject(ctx context.Context, params *GetObjectInput) (*GetObjectOutput, error) {
+	input, conditions := *params, etagConditions{}
+	if s.encrypts(aws.ToString(params.Bucket)) {
+		conditions = stripETagConditions(&input.IfMatch, &input.IfNoneMatch, &input.IfUnmodifiedSince, &input.IfModifiedSince)
+	}
+	out, err := s.getObject(ctx, &input)
+	if err != nil {
+		return nil, err
+	}
+	if err := conditions.check(out.ETag); err != nil {
+		out.Body.Close()
+		return nil, err
+	}
+	return out, nil
+}
+
+// getObject reads an object, decrypting it if it is encrypted.
+func (s *EncryptionStorage) getObject(ctx context.Context, params *GetObjectInput) (*GetObjectOutput, error) {
+	if params.Range != nil {
+		return s.getRange(ctx, params)
+	}
+	out, err := s.next.GetObject(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := s.dataKey(ctx, aws.ToString(params.Bucket), aws.ToString(params.Key), out.Metadata)
+	if err == nil && dataKey == nil {
+		return out, nil
+	}
+	var size, recorded int64
+	if err == nil {
+		size, recorded, err = plaintextSize(out.Metadata, out.ContentLength)
+	}
+	var body *openingReader
+	if err == nil {
+		body, err = newOpeningReader(out.Body, dataKey, objectData(params.Bucket, params.Key, recorded), 0, true)
+	}
+	if err != nil {
+		out.Body.Close()
+		return nil, err
+	}
+	decrypted := *out
+	decrypted.Body = body
+	decrypted.ContentLength = size
+	decrypted.ETag = plaintextETag(out.Metadata, out.ETag)
+	decrypted.Metadata = withoutEncryption(out.Metadata)
+	decrypted.ChecksumCRC32, decrypted.ChecksumCRC32C, decrypted.ChecksumSHA1, decrypted.ChecksumSHA256 = nil, nil, nil, nil
+	return &decrypted, nil
+}
+
+// getRange reads a range of an object, as the chunks covering it if it is
+// encrypted, which is only known once its metadata is. Ranges of the
+// buckets which aren't encrypted are read straight away, without it.
+func (s *EncryptionStorage) getRange(ctx context.Context, params *GetObjectInput) (*GetObjectOutput, error) {
+	if !s.encrypts(aws.ToString(params.Bucket)) {
+		return s.next.GetObject(ctx, params)
+	}
+	head, err := s.next.HeadObject(ctx, &HeadObjectInput{Bucket: params.Bucket, Key: params.Key, VersionId: params.VersionId})
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := s.dataKey(ctx, aws.ToString(params.Bucket), aws.ToString(params.Key), head.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	if dataKey == nil {
+		return s.next.GetObject(ctx, params)
+	}
+	size, recorded, err := plaintextSize(head.Metadata, head.ContentLength)
+	if err != nil {
+		return nil, err
+	}
+	first, last, ok, err := RangeBounds(aws.ToString(params.Range), size)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		whole := *params
+		whole.Range = nil
+		return s.getObject(ctx, &whole)
+	}
+
+	chunk := first / encryptionChunk
+	start := chunk * encryptionSealed
+	end := min((last/encryptionChunk+1)*encryptionSealed, head.ContentLength) - 1
+	input := *params
+	input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", start, end))
+	// The object must not change between both calls.
+	if input.IfMatch == nil {
+		input.IfMatch = head.ETag
+	}
+	out, err := s.next.GetObject(ctx, &input)
+	if err != nil {
+		return nil, err
+	}
+	// Where the chunks of objects of several parts start is unknown, but
+	// for the first.
+	index := int64(-1)
+	if recorded != encryptionUnknownSize || chunk == 0 {
+		index = chunk
+	}
+	body, err := newOpeningReader(out.Body, dataKey, objectData(params.Bucket, params.Key, recorded), index, end == head.ContentLength-1)
+	if err == nil {
+		_, err = io.CopyN(io.Discard, body, first-chunk*encryptionChunk)
+	}
+	if err != nil {
+		out.Body.Close()
+		return nil, err
+	}
+	decrypted := *out
+	decrypted.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(body, last-first+1), body}
+	decrypted.ContentLength = last - first + 1
+	decrypted.ETag = plaintextETag(out.Metadata, out.ETag)
+	decrypted.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/%d", first, last, size))
+	decrypted.Metadata = withoutEncryption(out.Metadata)
+	decrypted.ChecksumCRC32, decrypted.ChecksumCRC32C, decrypted.ChecksumSHA1, decrypted.ChecksumSHA256 = nil, nil, nil, nil
+	return &decrypted, nil
+}
+
+func (s *EncryptionStorage) PutObject(ctx context.Context, params *PutObjectInput) (*PutObjectOutput, error) {
+	if !s.encrypts(aws.ToString(params.Bucket)) {
+		return s.next.PutObject(ctx, params)
+	}
+	dataKey, metadata, err := s.newDataKey(ctx, params.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	sum, plain, remove, err := plaintextMD5(params)
+	if err != nil {
+		return nil, err
+	}
+	defer remove()
+	metadata[encryptionMetaSize] = strconv.FormatInt(params.ContentLength, 10)
+	metadata[encryptionMetaETag] = hex.EncodeToString(sum)
+	body, err := newSealingReader(plain, dataKey, objectData(params.Bucket, params.Key, params.ContentLength), 1, params.ContentLength)
+	if err != nil {
+		return nil, err
+	}
+	if aws.ToString(params.ContentMD5) != "" {
+		body.md5, body.wantMD5 = md5.New(), sum
+	}
+	input := *params
+	input.Body = body
+	input.ContentLength = encryptedSize(params.ContentLength)
+	input.Metadata = metadata
+	// The digests of the plaintext don't match what is sent; GCM
+	// authenticates it instead.
+	input.ContentMD5, input.ChecksumCRC32, input.ChecksumCRC32C, input.ChecksumSHA1, input.ChecksumSHA256 = nil, nil, nil, nil, nil
+	input.ChecksumAlgorithm = ""
+	out, err := s.next.PutObject(ctx, &input)
+	if err != nil {
+		return nil, err
+	}
+	encrypted := *out
+	encrypted.ETag = plaintextETag(metadata, out.ETag)
+	return &encrypted, nil
+}
+
+func (s *EncryptionStorage) DeleteObject(ctx context.Context, params *DeleteObjectInput) (*DeleteObjectOutput, error) {
+	return s.next.DeleteObject(ctx, params)
+}
+
+func (s *EncryptionStorage) GetObjectTagging(ctx context.Context, params *GetObjectTaggingInput) (*GetObjectTaggingOutput, error) {
+	return s.next.GetObjectTagging(ctx, params)
+}
+
+func (s *EncryptionStorage) CreateMultipartUpload(ctx context.Context, params *CreateMultipartUploadInput) (*CreateMultipartUploadOutput, error) {
+	if !s.encrypts(aws.ToString(params.Bucket)) {
+		return s.next.CreateMultipartUpload(ctx, params)
+	}
+	dataKey, metadata, err := s.newDataKey(ctx, params.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	input := *params
+	input.Metadata = metadata
+	input.ChecksumAlgorithm = ""
+	out, err := s.next.CreateMultipartUpload(ctx, &input)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.uploads[aws.ToString(out.UploadId)] = dataKey
+	s.mu.Unlock()
+	return out, nil
+}
+
+func (s *EncryptionStorage) UploadPart(ctx context.Context, params *UploadPartInput) (*UploadPartOutput, error) {
+	s.mu.Lock()
+	dataKey, ok := s.uploads[aws.ToString(params.UploadId)]
+	s.mu.Unlock()
+	if !ok {
+		if s.encrypts(aws.ToString(params.Bucket)) {
+			return nil, ErrNoSuchUpload.WithMessage("The data key of the upload is unknown, it may have been lost in a restart of the proxy. Start the upload again.")
+		}
+		return s.next.UploadPart(ctx, params)
+	}
+	body, err := newSealingReader(params.Body, dataKey, objectData(params.Bucket, params.Key, encryptionUnknownSize), params.PartNumber, params.ContentLength)
+	if err != nil {
+		return nil, err
+	}
+	input := *params
+	input.Body = body
+	input.ContentLength = encryptedSize(params.ContentLength)
+	input.ContentMD5, input.ChecksumCRC32, input.ChecksumCRC32C, input.ChecksumSHA1, input.ChecksumSHA256 = nil, nil, nil, nil, nil
+	input.ChecksumAlgorithm = ""
+	return s.next.UploadPart(ctx, &input)
+}
+
+// forgetUpload drops the data key of a multipart upload once it completed
+// or was aborted.
+func (s *EncryptionStorage) forgetUpload(uploadID *string, err error) {
+	if err == nil || errors.Is(err, ErrNoSuchUpload) {
+		s.mu.Lock()
+		delete(s.uploads, aws.ToString(uploadID))
+		s.mu.Unlock()
+	}
+}
+
+func (s *EncryptionStorage) CompleteMultipartUpload(ctx context.Context, params *CompleteMultipartUploadInput) (*CompleteMultipartUploadOutput, error) {
+	s.mu.Lock()
+	_, encrypted := s.uploads[aws.ToString(params.UploadId)]
+	s.mu.Unlock()
+	if encrypted && params.MultipartUpload != nil {
+		for i, part := range params.MultipartUpload.Parts {
+			if part.PartNumber != int32(i+1) {
+				return nil, &Error{Code: "InvalidPartOrder", Message: "The parts of encrypted uploads must be numbered from 1 without gaps."}
+			}
+		}
+	}
+	out, err := s.next.CompleteMultipartUpload(ctx, params)
+	s.forgetUpload(params.UploadId, err)
+	return out, err
+}
+
+func (s *EncryptionStorage) AbortMultipartUpload(ctx context.Context, params *AbortMultipartUploadInput) (*AbortMultipartUploadOutput, error) {
+	out, err := s.next.AbortMultipartUpload(ctx, params)
+	s.forgetUpload(params.UploadId, err)
+	return out, err
+}
+
+func (s *EncryptionStorage) RestoreObject(ctx context.Context, params *RestoreObjectInput) (*RestoreObjectOutput, error) {
+	return s.next.RestoreObject(ctx, params)
+}
+
+func (s *EncryptionStorage) ListObjectVersions(ctx context.Context, params *ListObjectVersionsInput) (*ListObjectVersionsOutput, error) {
+	return s.next.ListObjectVersions(ctx, params)
+}
+
+func (s *EncryptionStorage) CreateBucket(ctx context.Context, params *CreateBucketInput) (*CreateBucketOutput, error) {
+	return s.next.CreateBucket(ctx, params)
+}
+
+func (s *EncryptionStorage) DeleteBucket(ctx context.Context, params *DeleteBucketInput) (*DeleteBucketOutput, error) {
+	return s.next.DeleteBucket(ctx, params)
+}
+
+func (s *EncryptionStorage) HeadBucket(ctx context.Context, params *HeadBucketInput) (*HeadBucketOutput, error) {
+	return s.next.HeadBucket(ctx, params)
+}
+
+func (s *EncryptionStorage) GetBucketLocation(ctx context.Context, params *GetBucketLocationInput) (*GetBucketLocationOutput, error) {
+	return s.next.GetBucketLocation(ctx, params)
+}
@@ -0,0 +1,101 @@
+package repository
+
+import (
+	"errors"
+
+	"github.com/aws/smithy-go"
+)
+
+// Error is an S3 error, whatever the backend it came from. It implements
+// smithy.APIError, so that it is rendered as the S3 error XML of Code, and
+// matches with errors.Is the errors of the same code, such as ErrNoSuchKey.
+// Err is the backend error it was translated from, if any.
+type Error struct {
+	Code    string
+	Message string
+	Fault   smithy.ErrorFault
+	Err     error
+}
+
+// The errors the service layer acts on. Backends translate theirs into
+// them, see TranslateError, so that the cache and the transport handle
+// every backend alike.
+var (
+	ErrNoSuchKey          = &Error{Code: "NoSuchKey", Message: "The specified key does not exist."}
+	ErrNoSuchBucket       = &Error{Code: "NoSuchBucket", Message: "The specified bucket does not exist."}
+	ErrNoSuchVersion      = &Error{Code: "NoSuchVersion", Message: "The specified version does not exist."}
+	ErrNoSuchUpload       = &Error{Code: "NoSuchUpload", Message: "The specified upload does not exist. The upload ID may be invalid, or the upload may have been aborted or completed."}
+	ErrAccessDenied       = &Error{Code: "AccessDenied", Message: "Access Denied"}
+	ErrPreconditionFailed = &Error{Code: "PreconditionFailed", Message: "At least one of the pre-conditions you specified did not hold"}
+	ErrNotModified        = &Error{Code: "NotModified", Message: "Not Modified"}
+	ErrInvalidRange       = &Error{Code: "InvalidRange", Message: "The requested range is not satisfiable"}
+	ErrSlowDown           = &Error{Code: "SlowDown", Message: "Please reduce your request rate.", Fault: smithy.FaultServer}
+	ErrServiceUnavailable = &Error{Code: "ServiceUnavailable", Message: "Service is unable to handle request.", Fault: smithy.FaultServer}
+)
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func (e *Error) ErrorCode() string             { return e.Code }
+func (e *Error) ErrorMessage() string          { return e.Message }
+func (e *Error) ErrorFault() smithy.ErrorFault { return e.Fault }
+func (e *Error) Unwrap() error                 { return e.Err }
+
+// Is reports whether target is an Error of the same code.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// WithMessage returns a copy of e with message.
+func (e *Error) WithMessage(message string) *Error {
+	c := *e
+	c.Message = message
+	return &c
+}
+
+// errorCodes maps the codes of backend errors to the errors they are
+// translated into. HEAD responses have no body, so the SDK names their
+// errors after the HTTP status.
+var errorCodes = map[string]*Error{
+	"NoSuchKey":            ErrNoSuchKey,
+	"NotFound":             ErrNoSuchKey,
+	"NoSuchBucket":         ErrNoSuchBucket,
+	"NoSuchUpload":         ErrNoSuchUpload,
+	"NoSuchVersion":        ErrNoSuchVersion,
+	"AccessDenied":         ErrAccessDenied,
+	"Forbidden":            ErrAccessDenied,
+	"PreconditionFailed":   ErrPreconditionFailed,
+	"NotModified":          ErrNotModified,
+	"InvalidRange":         ErrInvalidRange,
+	"SlowDown":             ErrSlowDown,
+	"Throttling":           ErrSlowDown,
+	"RequestLimitExceeded": ErrSlowDown,
+	"ServiceUnavailable":   ErrServiceUnavailable,
+}
+
+// TranslateError turns the API errors of a backend into Errors, keeping
+// their messages. Other errors, such as network ones, are returned as is.
+func TranslateError(err error) error {
+	var ae smithy.APIError
+	if err == nil || !errors.As(err, &ae) {
+		return err
+	}
+	if _, ok := ae.(*Error); ok {
+		return err
+	}
+	translated := &Error{Code: ae.ErrorCode(), Message: ae.ErrorMessage(), Fault: ae.ErrorFault(), Err: err}
+	if known, ok := errorCodes[ae.ErrorCode()]; ok {
+		translated.Code, translated.Fault = known.Code, known.Fault
+		if translated.Message == "" || translated.Message == ae.ErrorCode() {
+			translated.Message = known.Message
+		}
+	}
+	return translated
+}
+
+// translate returns out with err translated, for the adapters of backends.
+func translate[T any](out T, err error) (T, error) {
+	return out, TranslateError(err)
+}
@@ -0,0 +1,194 @@
+package repository
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// expressBucketSuffix ends the names of S3 Express One Zone directory
+// buckets, e.g. "logs--usw2-az1--x-s3".
+const expressBucketSuffix = "--x-s3"
+
+// expressSessionRefresh is how long before they expire sessions are renewed.
+const expressSessionRefresh = time.Minute
+
+// emptyPayloadSHA256 is the SHA-256 of an empty payload.
+const emptyPayloadSHA256 = "e3b0c44298fc1c149afbfc8996fb92427ae41e4649b934ca495991b7852b855"
+
+// IsDirectoryBucket reports whether bucket is an S3 Express One Zone
+// directory bucket.
+func IsDirectoryBucket(bucket string) bool {
+	return strings.HasSuffix(bucket, expressBucketSuffix)
+}
+
+type expressBucketKey struct{}
+
+// addExpressBucket records the bucket of the operation for ExpressSigner.
+func addExpressBucket(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("ExpressBucket", func(
+		ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler,
+	) (middleware.InitializeOutput, middleware.Metadata, error) {
+		v := reflect.Indirect(reflect.ValueOf(in.Parameters))
+		if v.Kind() == reflect.Struct {
+			if field := v.FieldByName("Bucket"); field.IsValid() {
+				if bucket, ok := field.Interface().(*string); ok && bucket != nil {
+					ctx = middleware.WithStackValue(ctx, expressBucketKey{}, *bucket)
+				}
+			}
+		}
+		return next.HandleInitialize(ctx, in)
+	}), middleware.Before)
+}
+
+// expressSession holds the credentials of a CreateSession call.
+type expressSession struct {
+	credentials aws.Credentials
+	expires     time.Time
+}
+
+// ExpressSigner signs requests for directory buckets the way S3 Express One
+// Zone expects: with session credentials obtained from CreateSession with
+// the client's credentials, passing the session token in the
+// x-amz-s3session-token header. Sessions are cached per bucket and renewed
+// before they expire. Requests for other buckets are signed as usual.
+//
+// The SDK doesn't implement CreateSession yet, so the call is made here.
+type ExpressSigner struct {
+	signer     *v4.Signer
+	httpClient aws.HTTPClient
+
+	mu       sync.Mutex
+	sessions map[string]expressSession
+}
+
+func NewExpressSigner(httpClient aws.HTTPClient) *ExpressSigner {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &ExpressSigner{
+		signer: v4.NewSigner(func(o *v4.SignerOptions) {
+			o.DisableURIPathEscaping = true
+		}),
+		httpClient: httpClient,
+		sessions:   make(map[string]expressSession),
+	}
+}
+
+// ClientOptions configures an S3 client to sign with s.
+func (s *ExpressSigner) ClientOptions(o *s3.Options) {
+	o.HTTPSignerV4 = s
+	o.APIOptions = append(o.APIOptions, addExpressBucket)
+}
+
+func (s *ExpressSigner) SignHTTP(ctx context.Context, credentials aws.Credentials, r *http.Request, payloadHash string, service string, region string, signingTime time.Time, optFns ...func(*v4.SignerOptions)) error {
+	bucket, _ := middleware.GetStackValue(ctx, expressBucketKey{}).(string)
+	if !IsDirectoryBucket(bucket) {
+		return s.signer.SignHTTP(ctx, credentials, r, payloadHash, service, region, signingTime, optFns...)
+	}
+	session, err := s.session(ctx, credentials, r, bucket, region)
+	if err != nil {
+		return err
+	}
+	r.Header.Del("X-Amz-Security-Token")
+	r.Header.Set("x-amz-s3session-token", session.SessionToken)
+	session.SessionToken = ""
+	return s.signer.SignHTTP(ctx, session, r, payloadHash, "s3express", region, signingTime, optFns...)
+}
+
+// session returns the session credentials for bucket, creating a session if
+// there is none about to stay valid.
+func (s *ExpressSigner) session(ctx context.Context, credentials aws.Credentials, r *http.Request, bucket, region string) (aws.Credentials, error) {
+	key := credentials.AccessKeyID + "/" + bucket
+	s.mu.Lock()
+	session, ok := s.sessions[key]
+	s.mu.Unlock()
+	if ok && time.Until(session.expires) > expressSessionRefresh {
+		return session.credentials, nil
+	}
+
+	session, err := s.createSession(ctx, credentials, r, bucket, region)
+	if err != nil {
+		return aws.Credentials{}, err
+	}
+	s.mu.Lock()
+	s.sessions[key] = session
+	s.mu.Unlock()
+	return session.credentials, nil
+}
+
+type createSessionResult struct {
+	Credentials struct {
+		SessionToken    string
+		SecretAccessKey string
+		AccessKeyId     string
+		Expiration      time.Time
+	}
+}
+
+type createSessionError struct {
+	Code    string
+	Message string
+}
+
+// createSession calls CreateSession on the endpoint r is sent to, addressing
+// the bucket as r does: in the host name or in the path.
+func (s *ExpressSigner) createSession(ctx context.Context, credentials aws.Credentials, r *http.Request, bucket, region string) (expressSession, error) {
+	url := *r.URL
+	url.Path, url.RawPath = "/", ""
+	if !strings.HasPrefix(url.Host, bucket+".") {
+		url.Path = "/" + bucket
+	}
+	url.RawQuery = "session"
+	req, err := http.NewRequestWithContext(ctx, "GET", url.String(), nil)
+	if err != nil {
+		return expressSession{}, err
+	}
+	req.Header.Set("x-amz-content-sha256", emptyPayloadSHA256)
+	if err := s.signer.SignHTTP(ctx, credentials, req, emptyPayloadSHA256, "s3express", region, time.Now()); err != nil {
+		return expressSession{}, err
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return expressSession{}, fmt.Errorf("CreateSession %s: %w", bucket, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return expressSession{}, fmt.Errorf("CreateSession %s: %w", bucket, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr createSessionError
+		if xml.Unmarshal(body, &apiErr) != nil || apiErr.Code == "" {
+			apiErr.Code, apiErr.Message = "InternalError", resp.Status
+		}
+		return expressSession{}, &smithy.GenericAPIError{Code: apiErr.Code, Message: "CreateSession: " + apiErr.Message}
+	}
+
+	var result createSessionResult
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return expressSession{}, fmt.Errorf("CreateSession %s: %w", bucket, err)
+	}
+	return expressSession{
+		credentials: aws.Credentials{
+			AccessKeyID:     result.Credentials.AccessKeyId,
+			SecretAccessKey: result.Credentials.SecretAccessKey,
+			SessionToken:    result.Credentials.SessionToken,
+			Source:          "CreateSession",
+		},
+		expires: result.Credentials.Expiration,
+	}, nil
+}
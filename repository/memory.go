@@ -0,0 +1,483 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// MemoryStorage is an ObjectStorage holding buckets in memory, for tests
+// and local runs. It implements the subset of S3 the proxy uses: objects
+// with their Content-Type, user metadata and tags, single ranges, V2
+// listings and multipart uploads. Archived objects aren't modelled, so
+// RestoreObject fails with InvalidObjectState, nor is versioning: objects
+// have the single version "null", as in unversioned S3 buckets.
+type MemoryStorage struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+	uploads map[string]*memoryUpload
+}
+
+type memoryBucket struct {
+	created time.Time
+	objects map[string]*memoryObject
+}
+
+type memoryObject struct {
+	body         []byte
+	etag         string
+	contentType  string
+	metadata     map[string]string
+	tags         map[string]string
+	lastModified time.Time
+}
+
+type memoryUpload struct {
+	bucket, key string
+	object      memoryObject
+	parts       map[int32][]byte
+}
+
+// NewMemoryStorage returns a MemoryStorage holding buckets, created empty.
+func NewMemoryStorage(buckets ...string) *MemoryStorage {
+	s := &MemoryStorage{buckets: map[string]*memoryBucket{}, uploads: map[string]*memoryUpload{}}
+	for _, bucket := range buckets {
+		s.buckets[bucket] = &memoryBucket{created: time.Now(), objects: map[string]*memoryObject{}}
+	}
+	return s
+}
+
+// bucket returns the bucket name, with s.mu held.
+func (s *MemoryStorage) bucket(name *string) (*memoryBucket, error) {
+	b, ok := s.buckets[aws.ToString(name)]
+	if !ok {
+		return nil, ErrNoSuchBucket
+	}
+	return b, nil
+}
+
+// object returns the object key of bucket, with s.mu held.
+func (s *MemoryStorage) object(bucket, key *string) (*memoryObject, error) {
+	b, err := s.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	o, ok := b.objects[aws.ToString(key)]
+	if !ok {
+		return nil, ErrNoSuchKey
+	}
+	return o, nil
+}
+
+// version returns the object of key with versionID, which is "null" if set.
+func (s *MemoryStorage) version(bucket, key, versionID *string) (*memoryObject, error) {
+	if v := aws.ToString(versionID); v != "" && v != "null" {
+		if _, err := s.bucket(bucket); err != nil {
+			return nil, err
+		}
+		return nil, ErrNoSuchVersion
+	}
+	return s.object(bucket, key)
+}
+
+func (s *MemoryStorage) CreateBucket(ctx context.Context, params *CreateBucketInput) (*CreateBucketOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := aws.ToString(params.Bucket)
+	if _, ok := s.buckets[name]; ok {
+		return nil, &Error{Code: "BucketAlreadyOwnedByYou", Message: "Your previous request to create the named bucket succeeded and you already own it."}
+	}
+	s.buckets[name] = &memoryBucket{created: time.Now(), objects: map[string]*memoryObject{}}
+	return &CreateBucketOutput{Location: aws.String("/" + name)}, nil
+}
+
+func (s *MemoryStorage) DeleteBucket(ctx context.Context, params *DeleteBucketInput) (*DeleteBucketOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.bucket(params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if len(b.objects) > 0 {
+		return nil, &Error{Code: "BucketNotEmpty", Message: "The bucket you tried to delete is not empty"}
+	}
+	delete(s.buckets, aws.ToString(params.Bucket))
+	return &DeleteBucketOutput{}, nil
+}
+
+func (s *MemoryStorage) HeadBucket(ctx context.Context, params *HeadBucketInput) (*HeadBucketOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.bucket(params.Bucket); err != nil {
+		return nil, err
+	}
+	return &HeadBucketOutput{}, nil
+}
+
+func (s *MemoryStorage) GetBucketLocation(ctx context.Context, params *GetBucketLocationInput) (*GetBucketLocationOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.bucket(params.Bucket); err != nil {
+		return nil, err
+	}
+	return &GetBucketLocationOutput{}, nil
+}
+
+func (s *MemoryStorage) ListBuckets(ctx context.Context, params *ListBucketsInput) (*ListBucketsOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	output := &ListBucketsOutput{}
+	for name, b := range s.buckets {
+		output.Buckets = append(output.Buckets, types.Bucket{Name: aws.String(name), CreationDate: aws.Time(b.created)})
+	}
+	sort.Slice(output.Buckets, func(i, j int) bool {
+		return aws.ToString(output.Buckets[i].Name) < aws.ToString(output.Buckets[j].Name)
+	})
+	return output, nil
+}
+
+// ListObjects lists in key order. Continuation tokens are the last key or
+// common prefix returned.
+func (s *MemoryStorage) ListObjects(ctx context.Context, params *ListObjectsInput) (*ListObjectsOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.bucket(params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	prefix, delimiter := aws.ToString(params.Prefix), aws.ToString(params.Delimiter)
+	after := aws.ToString(params.StartAfter)
+	if params.ContinuationToken != nil {
+		after = aws.ToString(params.ContinuationToken)
+	}
+	maxKeys := params.MaxKeys
+	if maxKeys <= 0 || maxKeys > 1000 {
+		maxKeys = 1000
+	}
+
+	keys := make([]string, 0, len(b.objects))
+	for key := range b.objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	output := &ListObjectsOutput{
+		Name:              params.Bucket,
+		Prefix:            params.Prefix,
+		Delimiter:         params.Delimiter,
+		MaxKeys:           maxKeys,
+		StartAfter:        params.StartAfter,
+		ContinuationToken: params.ContinuationToken,
+	}
+	last := ""
+	for _, key := range keys {
+		entry := key
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				entry = key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if entry == last || (entry != key && entry <= after) {
+			continue
+		}
+		if output.KeyCount == maxKeys {
+			output.IsTruncated = true
+			output.NextContinuationToken = aws.String(last)
+			break
+		}
+		last = entry
+		output.KeyCount++
+		if entry != key {
+			output.CommonPrefixes = append(output.CommonPrefixes, types.CommonPrefix{Prefix: aws.String(entry)})
+			continue
+		}
+		o := b.objects[key]
+		output.Contents = append(output.Contents, types.Object{
+			Key:          aws.String(key),
+			ETag:         aws.String(o.etag),
+			Size:         int64(len(o.body)),
+			LastModified: aws.Time(o.lastModified),
+			StorageClass: types.ObjectStorageClassStandard,
+		})
+	}
+	return output, nil
+}
+
+func (s *MemoryStorage) HeadObject(ctx context.Context, params *HeadObjectInput) (*HeadObjectOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, err := s.version(params.Bucket, params.Key, params.VersionId)
+	if err != nil {
+		return nil, err
+	}
+	return &HeadObjectOutput{
+		ContentLength: int64(len(o.body)),
+		ContentType:   aws.String(o.contentType),
+		ETag:          aws.String(o.etag),
+		LastModified:  aws.Time(o.lastModified),
+		Metadata:      o.metadata,
+	}, nil
+}
+
+func (s *MemoryStorage) GetObject(ctx context.Context, params *GetObjectInput) (*GetObjectOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, err := s.version(params.Bucket, params.Key, params.VersionId)
+	if err != nil {
+		return nil, err
+	}
+	output := &GetObjectOutput{
+		ContentType:  aws.String(o.contentType),
+		ETag:         aws.String(o.etag),
+		LastModified: aws.Time(o.lastModified),
+		Metadata:     o.metadata,
+		TagCount:     int32(len(o.tags)),
+	}
+	body := o.body
+	if r := aws.ToString(params.Range); r != "" {
+		start, end, ok, err := RangeBounds(r, int64(len(body)))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			body = body[start : end+1]
+			output.ContentRange = aws.String(fmt.Sprintf("bytes %d-%d/%d", start, end, len(o.body)))
+		}
+	}
+	output.ContentLength = int64(len(body))
+	output.Body = io.NopCloser(bytes.NewReader(body))
+	return output, nil
+}
+
+func (s *MemoryStorage) PutObject(ctx context.Context, params *PutObjectInput) (*PutObjectOutput, error) {
+	var body []byte
+	if params.Body != nil {
+		var err error
+		if body, err = io.ReadAll(params.Body); err != nil {
+			return nil, err
+		}
+	}
+	tags, err := url.ParseQuery(aws.ToString(params.Tagging))
+	if err != nil {
+		return nil, &Error{Code: "InvalidArgument", Message: "The tagging is not URL encoded query parameters."}
+	}
+	sum := md5.Sum(body)
+	o := &memoryObject{
+		body:         body,
+		etag:         `"` + hex.EncodeToString(sum[:]) + `"`,
+		contentType:  aws.ToString(params.ContentType),
+		metadata:     params.Metadata,
+		tags:         map[string]string{},
+		lastModified: time.Now().UTC().Truncate(time.Second),
+	}
+	for k := range tags {
+		o.tags[k] = tags.Get(k)
+	}
+	if o.contentType == "" {
+		o.contentType = "binary/octet-stream"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.bucket(params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	b.objects[aws.ToString(params.Key)] = o
+	return &PutObjectOutput{ETag: aws.String(o.etag)}, nil
+}
+
+func (s *MemoryStorage) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.bucket(params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	delete(b.objects, aws.ToString(params.Key))
+	return &DeleteObjectOutput{}, nil
+}
+
+func (s *MemoryStorage) GetObjectTagging(ctx context.Context, params *GetObjectTaggingInput) (*GetObjectTaggingOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, err := s.object(params.Bucket, params.Key)
+	if err != nil {
+		return nil, err
+	}
+	output := &GetObjectTaggingOutput{TagSet: []types.Tag{}}
+	for k, v := range o.tags {
+		output.TagSet = append(output.TagSet, types.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	return output, nil
+}
+
+func (s *MemoryStorage) CreateMultipartUpload(ctx context.Context, params *CreateMultipartUploadInput) (*CreateMultipartUploadOutput, error) {
+	tags, err := url.ParseQuery(aws.ToString(params.Tagging))
+	if err != nil {
+		return nil, &Error{Code: "InvalidArgument", Message: "The tagging is not URL encoded query parameters."}
+	}
+	upload := &memoryUpload{
+		bucket: aws.ToString(params.Bucket),
+		key:    aws.ToString(params.Key),
+		object: memoryObject{
+			contentType: aws.ToString(params.ContentType),
+			metadata:    params.Metadata,
+			tags:        map[string]string{},
+		},
+		parts: map[int32][]byte{},
+	}
+	for k := range tags {
+		upload.object.tags[k] = tags.Get(k)
+	}
+	if upload.object.contentType == "" {
+		upload.object.contentType = "binary/octet-stream"
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	uploadID := hex.EncodeToString(id)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.bucket(params.Bucket); err != nil {
+		return nil, err
+	}
+	s.uploads[uploadID] = upload
+	return &CreateMultipartUploadOutput{Bucket: params.Bucket, Key: params.Key, UploadId: aws.String(uploadID)}, nil
+}
+
+// upload returns the multipart upload of params, with s.mu held.
+func (s *MemoryStorage) upload(bucket, key, uploadID *string) (*memoryUpload, error) {
+	upload, ok := s.uploads[aws.ToString(uploadID)]
+	if !ok || upload.bucket != aws.ToString(bucket) || upload.key != aws.ToString(key) {
+		return nil, ErrNoSuchUpload
+	}
+	return upload, nil
+}
+
+func (s *MemoryStorage) UploadPart(ctx context.Context, params *UploadPartInput) (*UploadPartOutput, error) {
+	var body []byte
+	if params.Body != nil {
+		var err error
+		if body, err = io.ReadAll(params.Body); err != nil {
+			return nil, err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	upload, err := s.upload(params.Bucket, params.Key, params.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	upload.parts[params.PartNumber] = body
+	sum := md5.Sum(body)
+	return &UploadPartOutput{ETag: aws.String(`"` + hex.EncodeToString(sum[:]) + `"`)}, nil
+}
+
+// CompleteMultipartUpload assembles the listed parts, which must be in
+// ascending order and match the ETags of the parts uploaded. Part sizes
+// aren't checked.
+func (s *MemoryStorage) CompleteMultipartUpload(ctx context.Context, params *CompleteMultipartUploadInput) (*CompleteMultipartUploadOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	upload, err := s.upload(params.Bucket, params.Key, params.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	b, err := s.bucket(params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	var parts []types.CompletedPart
+	if params.MultipartUpload != nil {
+		parts = params.MultipartUpload.Parts
+	}
+	var body []byte
+	hash := md5.New()
+	for i, part := range parts {
+		if i > 0 && part.PartNumber <= parts[i-1].PartNumber {
+			return nil, &Error{Code: "InvalidPartOrder", Message: "The list of parts was not in ascending order. Parts must be ordered by part number."}
+		}
+		data, ok := upload.parts[part.PartNumber]
+		sum := md5.Sum(data)
+		if !ok || strings.Trim(aws.ToString(part.ETag), `"`) != hex.EncodeToString(sum[:]) {
+			return nil, &Error{Code: "InvalidPart", Message: "One or more of the specified parts could not be found. The part may not have been uploaded, or the specified entity tag may not match the part's entity tag."}
+		}
+		body = append(body, data...)
+		hash.Write(sum[:])
+	}
+	o := upload.object
+	o.body = body
+	o.etag = fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(hash.Sum(nil)), len(parts))
+	o.lastModified = time.Now().UTC().Truncate(time.Second)
+	b.objects[upload.key] = &o
+	delete(s.uploads, aws.ToString(params.UploadId))
+	return &CompleteMultipartUploadOutput{Bucket: params.Bucket, Key: params.Key, ETag: aws.String(o.etag)}, nil
+}
+
+func (s *MemoryStorage) AbortMultipartUpload(ctx context.Context, params *AbortMultipartUploadInput) (*AbortMultipartUploadOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.upload(params.Bucket, params.Key, params.UploadId); err != nil {
+		return nil, err
+	}
+	delete(s.uploads, aws.ToString(params.UploadId))
+	return &AbortMultipartUploadOutput{}, nil
+}
+
+func (s *MemoryStorage) RestoreObject(ctx context.Context, params *RestoreObjectInput) (*RestoreObjectOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.object(params.Bucket, params.Key); err != nil {
+		return nil, err
+	}
+	return nil, &Error{Code: "InvalidObjectState", Message: "Restore is not allowed for the object's current storage class"}
+}
+
+// ListObjectVersions lists the single version of every object under the
+// prefix, in one page.
+func (s *MemoryStorage) ListObjectVersions(ctx context.Context, params *ListObjectVersionsInput) (*ListObjectVersionsOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.bucket(params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	prefix := aws.ToString(params.Prefix)
+	keys := make([]string, 0, len(b.objects))
+	for key := range b.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	output := &ListObjectVersionsOutput{Name: params.Bucket, Prefix: params.Prefix}
+	for _, key := range keys {
+		o := b.objects[key]
+		output.Versions = append(output.Versions, types.ObjectVersion{
+			Key:          aws.String(key),
+			VersionId:    aws.String("null"),
+			IsLatest:     true,
+			ETag:         aws.String(o.etag),
+			Size:         int64(len(o.body)),
+			LastModified: aws.Time(o.lastModified),
+		})
+	}
+	return output, nil
+}
@@ -0,0 +1,54 @@
+package repository
+
+import (
+	"strconv"
+	"strings"
+)
+
+// RangeBounds returns the first and last byte of header, the value of a
+// Range header such as "bytes=0-99", "bytes=100-" or the suffix
+// "bytes=-100", in an object of size bytes, as S3 interprets it. Headers S3
+// ignores, serving the whole object, return ok false: malformed ones,
+// several ranges, and ranges whose last byte is before their first. Ranges
+// starting at or beyond the end of the object fail with ErrInvalidRange.
+func RangeBounds(header string, size int64) (first, last int64, ok bool, err error) {
+	spec, prefixed := strings.CutPrefix(header, "bytes=")
+	start, end, cut := strings.Cut(spec, "-")
+	if !prefixed || !cut || strings.Contains(end, "-") || strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+	if start == "" {
+		suffix, valid := rangeByte(end)
+		if !valid {
+			return 0, 0, false, nil
+		}
+		if suffix == 0 || size == 0 {
+			return 0, 0, false, ErrInvalidRange
+		}
+		return max(size-suffix, 0), size - 1, true, nil
+	}
+
+	first, valid := rangeByte(start)
+	if !valid {
+		return 0, 0, false, nil
+	}
+	last = size - 1
+	if end != "" {
+		if last, valid = rangeByte(end); !valid || last < first {
+			return 0, 0, false, nil
+		}
+	}
+	if first >= size {
+		return 0, 0, false, ErrInvalidRange
+	}
+	return first, min(last, size-1), true, nil
+}
+
+// rangeByte parses a byte position of a Range header: digits only.
+func rangeByte(s string) (int64, bool) {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
@@ -0,0 +1,48 @@
+package repository
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRangeBounds(t *testing.T) {
+	tests := []struct {
+		header      string
+		size        int64
+		first, last int64
+		ok          bool
+		err         error
+	}{
+		{"bytes=0-99", 1000, 0, 99, true, nil},
+		{"bytes=100-", 1000, 100, 999, true, nil},
+		{"bytes=-100", 1000, 900, 999, true, nil},
+		{"bytes=-2000", 1000, 0, 999, true, nil},
+		{"bytes=900-2000", 1000, 900, 999, true, nil},
+		{"bytes=999-999", 1000, 999, 999, true, nil},
+
+		// Unsatisfiable.
+		{"bytes=1000-", 1000, 0, 0, false, ErrInvalidRange},
+		{"bytes=1000-2000", 1000, 0, 0, false, ErrInvalidRange},
+		{"bytes=0-", 0, 0, 0, false, ErrInvalidRange},
+		{"bytes=-0", 1000, 0, 0, false, ErrInvalidRange},
+		{"bytes=-10", 0, 0, 0, false, ErrInvalidRange},
+
+		// Ignored.
+		{"bytes=0-1,5-6", 1000, 0, 0, false, nil},
+		{"bytes=5-2", 1000, 0, 0, false, nil},
+		{"bytes=2000-1000", 1000, 0, 0, false, nil},
+		{"bytes=a-b", 1000, 0, 0, false, nil},
+		{"bytes=+1-2", 1000, 0, 0, false, nil},
+		{"bytes=1--2", 1000, 0, 0, false, nil},
+		{"bytes=-", 1000, 0, 0, false, nil},
+		{"bytes=5", 1000, 0, 0, false, nil},
+		{"items=0-1", 1000, 0, 0, false, nil},
+		{"0-1", 1000, 0, 0, false, nil},
+	}
+	for _, tt := range tests {
+		first, last, ok, err := RangeBounds(tt.header, tt.size)
+		if first != tt.first || last != tt.last || ok != tt.ok || !errors.Is(err, tt.err) || (err == nil) != (tt.err == nil) {
+			t.Errorf("RangeBounds(%q, %d) = %d, %d, %v, %v, want %d, %d, %v, %v", tt.header, tt.size, first, last, ok, err, tt.first, tt.last, tt.ok, tt.err)
+		}
+	}
+}
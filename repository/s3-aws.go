@@ -0,0 +1,90 @@
+package repository
+
+import (
+	"context"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// AWSS3 is the ObjectStorage of an S3 compatible endpoint. Its errors are
+// translated into Errors.
+type AWSS3 struct {
+	client *s3.Client
+}
+
+func MakeAWSS3(client *s3.Client) *AWSS3 {
+	return &AWSS3{
+		client: client,
+	}
+}
+
+func (s *AWSS3) ListBuckets(ctx context.Context, params *s3.ListBucketsInput) (*s3.ListBucketsOutput, error) {
+	return translate(s.client.ListBuckets(ctx, params))
+}
+
+func (s *AWSS3) ListObjects(ctx context.Context, params *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	return translate(s.client.ListObjectsV2(ctx, params))
+}
+
+func (s *AWSS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return translate(s.client.HeadObject(ctx, params))
+}
+func (s *AWSS3) GetObject(ctx context.Context, params *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return translate(s.client.GetObject(ctx, params))
+}
+func (s *AWSS3) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	return translate(s.client.DeleteObject(ctx, params))
+}
+
+func (s *AWSS3) GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput) (*s3.GetObjectTaggingOutput, error) {
+	return translate(s.client.GetObjectTagging(ctx, params))
+}
+
+func (s *AWSS3) PutObject(ctx context.Context, params *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	return translate(s.client.PutObject(ctx, params, s3.WithAPIOptions(
+		v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware,
+	)))
+}
+
+func (s *AWSS3) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	return translate(s.client.CreateMultipartUpload(ctx, params))
+}
+
+func (s *AWSS3) UploadPart(ctx context.Context, params *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	return translate(s.client.UploadPart(ctx, params, s3.WithAPIOptions(
+		v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware,
+	)))
+}
+
+func (s *AWSS3) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	return translate(s.client.CompleteMultipartUpload(ctx, params))
+}
+
+func (s *AWSS3) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	return translate(s.client.AbortMultipartUpload(ctx, params))
+}
+
+func (s *AWSS3) RestoreObject(ctx context.Context, params *s3.RestoreObjectInput) (*s3.RestoreObjectOutput, error) {
+	return translate(s.client.RestoreObject(ctx, params))
+}
+
+func (s *AWSS3) ListObjectVersions(ctx context.Context, params *s3.ListObjectVersionsInput) (*s3.ListObjectVersionsOutput, error) {
+	return translate(s.client.ListObjectVersions(ctx, params))
+}
+
+func (s *AWSS3) CreateBucket(ctx context.Context, params *s3.CreateBucketInput) (*s3.CreateBucketOutput, error) {
+	return translate(s.client.CreateBucket(ctx, params))
+}
+
+func (s *AWSS3) DeleteBucket(ctx context.Context, params *s3.DeleteBucketInput) (*s3.DeleteBucketOutput, error) {
+	return translate(s.client.DeleteBucket(ctx, params))
+}
+
+func (s *AWSS3) HeadBucket(ctx context.Context, params *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+	return translate(s.client.HeadBucket(ctx, params))
+}
+
+func (s *AWSS3) GetBucketLocation(ctx context.Context, params *s3.GetBucketLocationInput) (*s3.GetBucketLocationOutput, error) {
+	return translate(s.client.GetBucketLocation(ctx, params))
+}
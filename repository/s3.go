@@ -0,0 +1,69 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// TODO: too coupled with underlying aws-sdk-go-v2!
+type ListBucketsInput = s3.ListBucketsInput
+type ListBucketsOutput = s3.ListBucketsOutput
+type ListObjectsInput = s3.ListObjectsV2Input
+type ListObjectsOutput = s3.ListObjectsV2Output
+type HeadObjectInput = s3.HeadObjectInput
+type HeadObjectOutput = s3.HeadObjectOutput
+type GetObjectInput = s3.GetObjectInput
+type GetObjectOutput = s3.GetObjectOutput
+type PutObjectInput = s3.PutObjectInput
+type PutObjectOutput = s3.PutObjectOutput
+type DeleteObjectInput = s3.DeleteObjectInput
+type DeleteObjectOutput = s3.DeleteObjectOutput
+type GetObjectTaggingInput = s3.GetObjectTaggingInput
+type GetObjectTaggingOutput = s3.GetObjectTaggingOutput
+type CreateMultipartUploadInput = s3.CreateMultipartUploadInput
+type CreateMultipartUploadOutput = s3.CreateMultipartUploadOutput
+type UploadPartInput = s3.UploadPartInput
+type UploadPartOutput = s3.UploadPartOutput
+type CompleteMultipartUploadInput = s3.CompleteMultipartUploadInput
+type CompleteMultipartUploadOutput = s3.CompleteMultipartUploadOutput
+type AbortMultipartUploadInput = s3.AbortMultipartUploadInput
+type AbortMultipartUploadOutput = s3.AbortMultipartUploadOutput
+type RestoreObjectInput = s3.RestoreObjectInput
+type RestoreObjectOutput = s3.RestoreObjectOutput
+type ListObjectVersionsInput = s3.ListObjectVersionsInput
+type ListObjectVersionsOutput = s3.ListObjectVersionsOutput
+type CreateBucketInput = s3.CreateBucketInput
+type CreateBucketOutput = s3.CreateBucketOutput
+type DeleteBucketInput = s3.DeleteBucketInput
+type DeleteBucketOutput = s3.DeleteBucketOutput
+type HeadBucketInput = s3.HeadBucketInput
+type HeadBucketOutput = s3.HeadBucketOutput
+type GetBucketLocationInput = s3.GetBucketLocationInput
+type GetBucketLocationOutput = s3.GetBucketLocationOutput
+
+type ObjectStorage interface {
+	BucketStorage
+
+	ListBuckets(ctx context.Context, params *ListBucketsInput) (*ListBucketsOutput, error)
+	ListObjects(ctx context.Context, params *ListObjectsInput) (*ListObjectsOutput, error)
+	HeadObject(ctx context.Context, params *HeadObjectInput) (*HeadObjectOutput, error)
+	GetObject(ctx context.Context, params *GetObjectInput) (*GetObjectOutput, error)
+	PutObject(ctx context.Context, params *PutObjectInput) (*PutObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error)
+	GetObjectTagging(ctx context.Context, params *GetObjectTaggingInput) (*GetObjectTaggingOutput, error)
+	CreateMultipartUpload(ctx context.Context, params *CreateMultipartUploadInput) (*CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *UploadPartInput) (*UploadPartOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *CompleteMultipartUploadInput) (*CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *AbortMultipartUploadInput) (*AbortMultipartUploadOutput, error)
+	RestoreObject(ctx context.Context, params *RestoreObjectInput) (*RestoreObjectOutput, error)
+	ListObjectVersions(ctx context.Context, params *ListObjectVersionsInput) (*ListObjectVersionsOutput, error)
+}
+
+// BucketStorage holds the bucket-level operations of an ObjectStorage.
+type BucketStorage interface {
+	CreateBucket(ctx context.Context, params *CreateBucketInput) (*CreateBucketOutput, error)
+	DeleteBucket(ctx context.Context, params *DeleteBucketInput) (*DeleteBucketOutput, error)
+	HeadBucket(ctx context.Context, params *HeadBucketInput) (*HeadBucketOutput, error)
+	GetBucketLocation(ctx context.Context, params *GetBucketLocationInput) (*GetBucketLocationOutput, error)
+}
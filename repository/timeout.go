@@ -0,0 +1,223 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// TimeoutConfig holds the upstream call timeouts: Operations by operation
+// name, e.g. "GetObject", falling back to Default. Zero means no timeout.
+// MaxRequest bounds the timeouts requested per request, see
+// WithRequestTimeout, which are ignored if it is zero.
+type TimeoutConfig struct {
+	Default    time.Duration
+	Operations map[string]time.Duration
+	MaxRequest time.Duration
+}
+
+// For returns the timeout of operation.
+func (c TimeoutConfig) For(operation string) time.Duration {
+	if d, ok := c.Operations[operation]; ok {
+		return d
+	}
+	return c.Default
+}
+
+// Enabled reports whether any operation has a timeout, or requests may set
+// theirs.
+func (c TimeoutConfig) Enabled() bool {
+	if c.Default > 0 || c.MaxRequest > 0 {
+		return true
+	}
+	for _, d := range c.Operations {
+		if d > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+type requestTimeoutKey struct{}
+
+// WithRequestTimeout has the upstream calls made with ctx time out after
+// timeout, if shorter than their configured timeout and if TimeoutStorage
+// allows requests to set timeouts, bounded by its MaxRequest.
+func WithRequestTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, requestTimeoutKey{}, timeout)
+}
+
+// timeout returns the timeout of operation called with ctx.
+func (s *TimeoutStorage) timeout(ctx context.Context, operation string) time.Duration {
+	timeout := s.config.For(operation)
+	requested, ok := ctx.Value(requestTimeoutKey{}).(time.Duration)
+	if !ok || requested <= 0 || s.config.MaxRequest <= 0 {
+		return timeout
+	}
+	requested = min(requested, s.config.MaxRequest)
+	if timeout <= 0 || requested < timeout {
+		return requested
+	}
+	return timeout
+}
+
+// TimeoutStorage bounds the duration of the calls to an ObjectStorage, so
+// that a hung upstream fails requests and frees their goroutines instead of
+// holding them forever. The GetObject timeout covers the time until the
+// response starts; the body then streams until it is closed.
+type TimeoutStorage struct {
+	next   ObjectStorage
+	config TimeoutConfig
+}
+
+func NewTimeoutStorage(next ObjectStorage, config TimeoutConfig) *TimeoutStorage {
+	return &TimeoutStorage{
+		next:   next,
+		config: config,
+	}
+}
+
+// withTimeout runs fn with the timeout of operation, translating its expiry
+// into a ServiceUnavailable API error.
+func withTimeout[T any](s *TimeoutStorage, ctx context.Context, operation string, fn func(ctx context.Context) (T, error)) (T, error) {
+	timeout := s.timeout(ctx, operation)
+	if timeout <= 0 {
+		return fn(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	out, err := fn(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return out, errTimedOut(operation, timeout)
+	}
+	return out, err
+}
+
+func errTimedOut(operation string, timeout time.Duration) error {
+	return ErrServiceUnavailable.WithMessage(fmt.Sprintf("Upstream %s timed out after %s", operation, timeout))
+}
+
+// cancelOnClose cancels the context of a streamed body once it is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+func (s *TimeoutStorage) ListBuckets(ctx context.Context, params *ListBucketsInput) (*ListBucketsOutput, error) {
+	return withTimeout(s, ctx, "ListBuckets", func(ctx context.Context) (*ListBucketsOutput, error) { return s.next.ListBuckets(ctx, params) })
+}
+
+func (s *TimeoutStorage) ListObjects(ctx context.Context, params *ListObjectsInput) (*ListObjectsOutput, error) {
+	return withTimeout(s, ctx, "ListObjects", func(ctx context.Context) (*ListObjectsOutput, error) { return s.next.ListObjects(ctx, params) })
+}
+
+func (s *TimeoutStorage) HeadObject(ctx context.Context, params *HeadObjectInput) (*HeadObjectOutput, error) {
+	return withTimeout(s, ctx, "HeadObject", func(ctx context.Context) (*HeadObjectOutput, error) { return s.next.HeadObject(ctx, params) })
+}
+
+func (s *TimeoutStorage) GetObject(ctx context.Context, params *GetObjectInput) (*GetObjectOutput, error) {
+	timeout := s.timeout(ctx, "GetObject")
+	if timeout <= 0 {
+		return s.next.GetObject(ctx, params)
+	}
+	// The context outlives the call for the body to stream, so it is only
+	// cancelled by the timer until the response starts.
+	ctx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(timeout, cancel)
+	out, err := s.next.GetObject(ctx, params)
+	if !timer.Stop() {
+		// The timer fired, even if the response made it in time its body
+		// is unusable.
+		if err == nil {
+			out.Body.Close()
+		}
+		cancel()
+		return nil, errTimedOut("GetObject", timeout)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	out.Body = &cancelOnClose{ReadCloser: out.Body, cancel: cancel}
+	return out, nil
+}
+
+func (s *TimeoutStorage) PutObject(ctx context.Context, params *PutObjectInput) (*PutObjectOutput, error) {
+	return withTimeout(s, ctx, "PutObject", func(ctx context.Context) (*PutObjectOutput, error) { return s.next.PutObject(ctx, params) })
+}
+
+func (s *TimeoutStorage) DeleteObject(ctx context.Context, params *DeleteObjectInput) (*DeleteObjectOutput, error) {
+	return withTimeout(s, ctx, "DeleteObject", func(ctx context.Context) (*DeleteObjectOutput, error) { return s.next.DeleteObject(ctx, params) })
+}
+
+func (s *TimeoutStorage) GetObjectTagging(ctx context.Context, params *GetObjectTaggingInput) (*GetObjectTaggingOutput, error) {
+	return withTimeout(s, ctx, "GetObjectTagging", func(ctx context.Context) (*GetObjectTaggingOutput, error) {
+		return s.next.GetObjectTagging(ctx, params)
+	})
+}
+
+func (s *TimeoutStorage) CreateMultipartUpload(ctx context.Context, params *CreateMultipartUploadInput) (*CreateMultipartUploadOutput, error) {
+	return withTimeout(s, ctx, "CreateMultipartUpload", func(ctx context.Context) (*CreateMultipartUploadOutput, error) {
+		return s.next.CreateMultipartUpload(ctx, params)
+	})
+}
+
+func (s *TimeoutStorage) UploadPart(ctx context.Context, params *UploadPartInput) (*UploadPartOutput, error) {
+	return withTimeout(s, ctx, "UploadPart", func(ctx context.Context) (*UploadPartOutput, error) { return s.next.UploadPart(ctx, params) })
+}
+
+func (s *TimeoutStorage) CompleteMultipartUpload(ctx context.Context, params *CompleteMultipartUploadInput) (*CompleteMultipartUploadOutput, error) {
+	return withTimeout(s, ctx, "CompleteMultipartUpload", func(ctx context.Context) (*CompleteMultipartUploadOutput, error) {
+		return s.next.CompleteMultipartUpload(ctx, params)
+	})
+}
+
+func (s *TimeoutStorage) AbortMultipartUpload(ctx context.Context, params *AbortMultipartUploadInput) (*AbortMultipartUploadOutput, error) {
+	return withTimeout(s, ctx, "AbortMultipartUpload", func(ctx context.Context) (*AbortMultipartUploadOutput, error) {
+		return s.next.AbortMultipartUpload(ctx, params)
+	})
+}
+
+func (s *TimeoutStorage) RestoreObject(ctx context.Context, params *RestoreObjectInput) (*RestoreObjectOutput, error) {
+	return withTimeout(s, ctx, "RestoreObject", func(ctx context.Context) (*RestoreObjectOutput, error) {
+		return s.next.RestoreObject(ctx, params)
+	})
+}
+
+func (s *TimeoutStorage) ListObjectVersions(ctx context.Context, params *ListObjectVersionsInput) (*ListObjectVersionsOutput, error) {
+	return withTimeout(s, ctx, "ListObjectVersions", func(ctx context.Context) (*ListObjectVersionsOutput, error) {
+		return s.next.ListObjectVersions(ctx, params)
+	})
+}
+
+func (s *TimeoutStorage) CreateBucket(ctx context.Context, params *CreateBucketInput) (*CreateBucketOutput, error) {
+	return withTimeout(s, ctx, "CreateBucket", func(ctx context.Context) (*CreateBucketOutput, error) {
+		return s.next.CreateBucket(ctx, params)
+	})
+}
+
+func (s *TimeoutStorage) DeleteBucket(ctx context.Context, params *DeleteBucketInput) (*DeleteBucketOutput, error) {
+	return withTimeout(s, ctx, "DeleteBucket", func(ctx context.Context) (*DeleteBucketOutput, error) {
+		return s.next.DeleteBucket(ctx, params)
+	})
+}
+
+func (s *TimeoutStorage) HeadBucket(ctx context.Context, params *HeadBucketInput) (*HeadBucketOutput, error) {
+	return withTimeout(s, ctx, "HeadBucket", func(ctx context.Context) (*HeadBucketOutput, error) {
+		return s.next.HeadBucket(ctx, params)
+	})
+}
+
+func (s *TimeoutStorage) GetBucketLocation(ctx context.Context, params *GetBucketLocationInput) (*GetBucketLocationOutput, error) {
+	return withTimeout(s, ctx, "GetBucketLocation", func(ctx context.Context) (*GetBucketLocationOutput, error) {
+		return s.next.GetBucketLocation(ctx, params)
+	})
+}
@@ -0,0 +1,1019 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/dgraph-io/ristretto"
+	"github.com/pires/go-proxyproto"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/sony/gobreaker"
+	"google.golang.org/grpc"
+
+	"github.com/go-kit/kit/log"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	cloud_storage "github.com/rampage644/s3-overlay-proxy/cloud-storage"
+	"github.com/rampage644/s3-overlay-proxy/internal/admin"
+	"github.com/rampage644/s3-overlay-proxy/internal/admin/adminpb"
+	proxy_config "github.com/rampage644/s3-overlay-proxy/internal/config"
+	"github.com/rampage644/s3-overlay-proxy/repository"
+)
+
+// runServe implements the serve subcommand, running the proxy until it is
+// interrupted.
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var (
+		httpAddr         = fs.String("http.addr", ":8080", "HTTP listen address")
+		logLevel         = fs.String("log.level", "info", "log level: info, or error to log only failures; can be changed at runtime with PATCH /config")
+		proxyProtocol    = fs.Bool("http.proxy-protocol", false, "accept PROXY protocol v1/v2 headers on the HTTP listener, e.g. behind an AWS NLB or HAProxy in TCP mode")
+		proxyTrusted     = fs.String("http.proxy-protocol-trusted", "", "comma-separated IPs/CIDRs allowed to send PROXY headers, required with -http.proxy-protocol; headers from other sources are ignored")
+		adminAddr        = fs.String("admin.addr", ":9090", "admin HTTP listen address (metrics, health checks)")
+		adminUI          = fs.Bool("admin.ui", false, "serve a browser UI for browsing, uploading and deleting objects at /ui on the admin listener, to the holders of -admin.token-file tokens")
+		adminTokenFile   = fs.String("admin.token-file", "", "file of the admin tokens, one \"<name> <token>\" per line, required as bearer tokens by the admin endpoints changing state, the holder's name being audit logged")
+		adminGRPCAddr    = fs.String("admin.grpc-addr", "", "admin gRPC listen address for cache, config and write-back management (empty disables)")
+		configFile       = fs.String("config.file", "", "JSON config file with runtime-reloadable settings, overriding the corresponding flags; reloaded on SIGHUP")
+		objectStorageUrl = fs.String("object-storage.url", "", "object storage url")
+		upstreamCA       = fs.String("object-storage.ca-file", "", "PEM bundle of CA certificates trusted for the upstream endpoint, in addition to the system ones")
+		upstreamInsecure = fs.Bool("object-storage.insecure-skip-verify", false, "testing only: don't verify the upstream TLS certificate")
+		upstreamTimeout  = fs.Duration("object-storage.timeout", 0, "timeout of upstream calls; for GetObject it covers the time until the response starts (0 disables)")
+		upstreamTimeouts = fs.String("object-storage.operation-timeouts", "", "comma-separated operation=duration overrides of -object-storage.timeout, e.g. HeadObject=5s,PutObject=10m")
+		upstreamMaxReqTO = fs.Duration("object-storage.max-request-timeout", 0, "upper bound of the upstream timeouts clients may request with the x-proxy-timeout-ms header (0 ignores the header)")
+		upstreamRPS      = fs.Float64("object-storage.requests-per-second", 0, "budget of upstream requests per second, interactive requests going ahead of batch ones, then background work, beyond it (0 disables)")
+		upstreamBurst    = fs.Int("object-storage.burst", 100, "upstream requests allowed in a burst over -object-storage.requests-per-second")
+		upstreamMaxQueue = fs.Int("object-storage.max-queue", 1000, "upstream requests waiting for the budget, further ones failing with SlowDown (0 disables the limit)")
+		assumeRoleTTL    = fs.Duration("object-storage.assume-role-duration", time.Hour, "lifetime of the credentials of the upstream roles assumed for tenants")
+		shutdownTimeout  = fs.Duration("shutdown.timeout", 30*time.Second, "how long pending write-back uploads are waited for on shutdown before being cancelled")
+		usePathStyle     = fs.Bool("object-storage.path-style", false, "address upstream buckets as URL paths instead of virtual-host subdomains, as required by MinIO and Ceph RGW")
+		rateLimitRPS     = fs.Float64("rate-limit.rps", 0, "per-client request rate limit in requests per second (0 disables)")
+		rateLimitBurst   = fs.Int("rate-limit.burst", 100, "per-client request burst size")
+		clientIngress    = fs.Int64("bandwidth.client-ingress", 0, "per-client upload bandwidth in bytes per second (0 disables)")
+		clientEgress     = fs.Int64("bandwidth.client-egress", 0, "per-client download bandwidth in bytes per second (0 disables)")
+		bucketIngress    = fs.Int64("bandwidth.bucket-ingress", 0, "per-bucket upload bandwidth in bytes per second (0 disables)")
+		bucketEgress     = fs.Int64("bandwidth.bucket-egress", 0, "per-bucket download bandwidth in bytes per second (0 disables)")
+		batchIngress     = fs.Int64("bandwidth.batch-ingress", 0, "upload bandwidth of all batch requests in bytes per second (0 disables)")
+		batchEgress      = fs.Int64("bandwidth.batch-egress", 0, "download bandwidth of all batch requests, and so of the cache fills they cause, in bytes per second (0 disables)")
+		maxReads         = fs.Int("concurrency.reads", 0, "maximum concurrent object reads (0 disables)")
+		maxWrites        = fs.Int("concurrency.writes", 0, "maximum concurrent object writes (0 disables)")
+		queueTimeout     = fs.Duration("concurrency.queue-timeout", time.Second, "how long requests over the concurrency limit wait for a slot")
+		maxSkew          = fs.Duration("signature.max-skew", 15*time.Minute, "how far the time SigV4 requests were signed at may be from the proxy's clock before they fail with RequestTimeTooSkewed (0 disables)")
+		maxExpires       = fs.Duration("signature.max-expires", 7*24*time.Hour, "longest validity of SigV4 presigned URLs (0 disables)")
+		sigRegions       = fs.String("signature.regions", "", "comma-separated regions SigV4 requests may be signed for (empty allows any)")
+		presignURL       = fs.String("presign.url", "", "base URL clients reach the S3 API at, of the presigned URLs generated with POST /presign on the admin listener (empty disables the endpoint)")
+		presignToken     = fs.String("presign.token", "", "bearer token required to generate presigned URLs")
+		presignKey       = fs.String("presign.access-key", "", "access key presigned URLs are signed with")
+		presignSecret    = fs.String("presign.secret-key", "", "secret key presigned URLs are signed with")
+		presignRegion    = fs.String("presign.region", "us-east-1", "region presigned URLs are signed for")
+		presignExpires   = fs.Duration("presign.expires", time.Hour, "validity of presigned URLs requested without one")
+		sigServices      = fs.String("signature.services", "s3,s3express", "comma-separated services SigV4 requests may be signed for (empty allows any)")
+		maxObjectSize    = fs.Int64("max-object-size", 5<<30, "largest object or part upload accepted, larger ones fail with EntityTooLarge (0 disables)")
+		xmlMode          = fs.String("s3.xml-mode", "default", "how XML responses are rendered: default, or aws to follow the layout of S3 responses (declaration, element order, escaping) for strict clients")
+		probeStubs       = fs.String("probe-stubs", strings.Join(cloud_storage.ProbeStubNames(), ","), "comma-separated bucket sub-resources answered with a stub response for client probes (empty disables)")
+		transformMaxSize = fs.Int64("transforms.max-size", 256<<20, "largest output of object transformations, including decompressed gunzip output, in bytes; larger ones fail with EntityTooLarge (0 disables)")
+		compressBuckets  = fs.String("compression.buckets", "", "comma-separated buckets whose GET responses may be compressed on the fly (\"*\" for all)")
+		chaosLatency     = fs.Duration("chaos.latency", 0, "testing only: latency added to every upstream call")
+		chaosJitter      = fs.Duration("chaos.jitter", 0, "testing only: random extra latency added to every upstream call")
+		chaosErrorRate   = fs.Float64("chaos.error-rate", 0, "testing only: probability of failing an upstream call with a retryable error")
+		chaosTruncate    = fs.Float64("chaos.truncate-rate", 0, "testing only: probability of truncating a GetObject body")
+		hotKeys          = fs.Bool("hot-keys.enabled", false, "track per-key request rates, cache objects only once requested again and pin hot ones")
+		hotKeyHalfLife   = fs.Duration("hot-keys.half-life", time.Minute, "time for a key's request score to halve")
+		hotKeyThreshold  = fs.Float64("hot-keys.hot-threshold", 50, "request score above which a key is pinned")
+		hotKeyAdmit      = fs.Float64("hot-keys.admit-threshold", 2, "request score at which an object body gets cached")
+		hotKeyTracked    = fs.Int("hot-keys.max-tracked", 100000, "maximum number of tracked keys")
+		hotKeyPinned     = fs.Int64("hot-keys.pinned-bytes", 1<<30, "memory budget for pinned hot objects in bytes")
+		cacheBypassTags  = fs.String("cache.bypass-tags", "", "comma-separated key=value object tags, or keys, whose objects are never cached, e.g. cache=never")
+		writeBackBytes   = fs.Int64("cache.write-back-max-bytes", 0, "size of the write-back uploads not yet upstream, and of the multipart upload parts held in memory, above which writes are no longer absorbed by the cache (0 disables)")
+		writeBackUploads = fs.Int64("cache.write-back-max-uploads", 0, "number of write-back uploads not yet upstream above which writes are no longer absorbed by the cache (0 disables)")
+		writeBackReject  = fs.Bool("cache.write-back-reject", false, "reject writes over the write-back limits with SlowDown instead of writing them through to upstream")
+		cachePartitions  = fs.String("cache.partitions", "", "comma-separated bucket=bytes cache budgets of buckets cached apart from the others, e.g. logs=1073741824")
+		scrubInterval    = fs.Duration("cache.scrub-interval", 0, "how often a batch of cached objects is verified against upstream, evicting those modified behind the proxy's back (0 disables)")
+		scrubBatch       = fs.Int("cache.scrub-batch", 100, "number of cached objects verified every -cache.scrub-interval")
+		scrubSample      = fs.Int("cache.scrub-sample", 10000, "number of recently cached objects verified objects are picked from")
+		indexSize        = fs.Int("cache.index-size", 0, "number of recent cache updates served on the admin listener for standbys to follow (0 disables)")
+		standbyOf        = fs.String("cache.standby-of", "", "admin API URL of a primary whose cache index is followed to keep this cache warm for failover (empty disables)")
+		standbyInterval  = fs.Duration("cache.standby-interval", 5*time.Second, "how often the primary of -cache.standby-of is asked for updates")
+		spoolThreshold   = fs.Int64("cache.spool-threshold", 64<<20, "uploads larger than this many bytes are kept in temporary files rather than memory until written back (0 disables)")
+		cacheMaxAge      = fs.Duration("cache.max-age", 0, "how long objects read from upstream are served from the cache before being read again (0 keeps them until evicted)")
+		serveStale       = fs.Bool("cache.serve-stale", false, "serve cached objects, expired ones included, with a Warning header when upstream GET or HEAD fails with a server error or a timeout")
+		bucketListTTL    = fs.Duration("cache.bucket-list-ttl", time.Hour, "how long the bucket list is kept for -cache.serve-stale to answer ListBuckets with when upstream fails (0 disables)")
+		syncThreshold    = fs.Int64("cache.sync-write-threshold", 0, "uploads larger than this many bytes are written to upstream as multipart uploads before being acknowledged rather than written back (0 disables)")
+		syncPartSize     = fs.Int64("cache.sync-write-part-size", 64<<20, "part size of the multipart uploads of -cache.sync-write-threshold")
+		headTTL          = fs.Duration("cache.head-ttl", 5*time.Minute, "how long HEAD responses are cached (0 keeps them until evicted)")
+		metadataBytes    = fs.Int64("cache.metadata-max-bytes", 64<<20, "size of the cache of HEAD responses, separate from the cached objects (0 keeps them in the main cache)")
+		refreshRate      = fs.Float64("cache.refresh-rate", 10, "background reads of whole objects after range misses per second (0 disables the limit)")
+		refreshBurst     = fs.Int("cache.refresh-burst", 10, "burst of -cache.refresh-rate")
+		bgWorkers        = fs.Int("cache.background-workers", 64, "maximum number of write-back uploads and refreshes running at a time (0 disables the limit)")
+		bgQueue          = fs.Int("cache.background-queue", 256, "refreshes waiting for a background worker beyond which more are rejected")
+		verifyContent    = fs.Bool("cache.verify-content", false, "store a checksum with every cached body and verify it on every hit, evicting and refetching corrupted ones")
+		spoolDir         = fs.String("cache.spool-dir", "", "directory of the temporary files of -cache.spool-threshold (defaults to the system temporary directory)")
+		dedupUploads     = fs.Bool("cache.dedup-uploads", false, "acknowledge uploads of the same content, Content-Type and metadata as the object upstream without writing them back, at the cost of a HEAD request upstream per upload")
+		multipartDir     = fs.String("cache.multipart-dir", "", "directory persisting the multipart uploads assembled in the cache, so that clients can resume them after a restart (empty keeps them in memory only)")
+		authzURL         = fs.String("authz.url", "", "authorization webhook URL, asked to allow or deny every request; the principal is the access key of the request if its signature is verified, with a secret key of the config's tenantSecrets, and empty otherwise (empty disables)")
+		authzTimeout     = fs.Duration("authz.timeout", time.Second, "authorization webhook request timeout")
+		authzCacheTTL    = fs.Duration("authz.cache-ttl", time.Minute, "how long authorization decisions are cached (0 disables)")
+		authzFailOpen    = fs.Bool("authz.fail-open", false, "allow requests when the authorization webhook is unavailable instead of failing them")
+		luaScript        = fs.String("hooks.lua-script", "", "Lua script rewriting or denying requests, see cloud_storage.LuaHook (empty disables)")
+		luaTimeout       = fs.Duration("hooks.lua-timeout", 50*time.Millisecond, "maximum run time of each Lua hook call")
+		luaMaxStack      = fs.Int("hooks.lua-max-stack", 64*1024, "maximum Lua stack size of each Lua hook call in slots")
+		luaMaxMemory     = fs.Int64("hooks.lua-max-memory", 16<<20, "approximate maximum memory allocated by each Lua hook call in bytes")
+		metadataPath     = fs.String("metadata.path", "", "bbolt database file persisting object metadata to answer HEAD requests locally (empty disables)")
+		metadataWindow   = fs.Duration("metadata.window", 30*time.Second, "how long persisted object metadata is trusted before asking upstream again")
+		offlineListings  = fs.Bool("metadata.offline-listings", false, "compute listings from the persisted metadata when upstream fails, so that browsing works while it is down; they only hold the objects the proxy has seen")
+		metadataBuckets  = fs.String("metadata.bucket-windows", "", "comma-separated bucket=duration overrides of -metadata.window, e.g. logs=1h,live=0 (0 disables the store for the bucket)")
+		inventoryBuckets = fs.String("inventory.buckets", "", "comma-separated buckets whose inventory is exported every -inventory.interval")
+		inventoryDest    = fs.String("inventory.destination", "", "bucket[/prefix] scheduled inventories are written to")
+		inventoryEvery   = fs.Duration("inventory.interval", 24*time.Hour, "how often scheduled inventories are exported")
+		peersSelf        = fs.String("peers.self", "", "host:port other replicas reach this one's admin listener at; with -peers.static or -peers.dns, replicas share their caches, each object being cached by one of them")
+		peersStatic      = fs.String("peers.static", "", "comma-separated host:port admin addresses of all replicas, including this one")
+		peersDNS         = fs.String("peers.dns", "", "DNS name resolving to the addresses of all replicas, e.g. a headless Kubernetes service; overrides -peers.static")
+		peersCache       = fs.Bool("peers.cache", true, "fetch objects other replicas own from them instead of upstream")
+		peersHints       = fs.Bool("peers.routing-hints", false, "send the address of the replica owning the object in the x-proxy-key-owner header of object responses, for load balancers to route requests by key")
+		peersPort        = fs.String("peers.port", "", "admin port of the replicas found with -peers.dns (defaults to the -admin.addr port)")
+		peersInterval    = fs.Duration("peers.interval", 30*time.Second, "how often the peers are resolved again")
+		leaderLock       = fs.String("leader-election.lock", "", "bucket/key of the upstream lock object electing the replica which runs background work such as scheduled inventories (empty runs it on every replica)")
+		leaderID         = fs.String("leader-election.id", "", "identity of this replica in the lock (defaults to the hostname)")
+		leaderLease      = fs.Duration("leader-election.lease-duration", 30*time.Second, "how long the lock is held without being renewed")
+		leaderRetry      = fs.Duration("leader-election.retry-period", 5*time.Second, "how often the lock is renewed or tried")
+		breakerFailures  = fs.Uint("circuit-breaker.failures", 5, "consecutive upstream failures which open the circuit breaker (0 disables)")
+		breakerTimeout   = fs.Duration("circuit-breaker.timeout", 30*time.Second, "how long the circuit breaker stays open before probing upstream again")
+		rangeRate        = fs.Float64("range-samples.rate", 0, "fraction of GET requests whose byte range is sampled, with anonymized keys, to tune block sizes and prefetching (0 disables)")
+		rangeFile        = fs.String("range-samples.file", "", "file the range samples are appended to as JSON lines (empty only records them in the s3proxy_range_* histograms)")
+		rangeMaxSize     = fs.Int64("range-samples.max-size", 64<<20, "size in bytes beyond which -range-samples.file is rotated")
+		rangeMaxFiles    = fs.Int("range-samples.max-files", 5, "rotated range sample files kept")
+		rangeSalt        = fs.String("range-samples.salt", "", "secret keying the hashes which anonymize sampled keys, so that they can't be matched against guessed key names (empty uses a random one, so hashes only match within a run)")
+		encryptionKeys   = fs.String("encryption.key-file", "", "file of the master keys, one \"<id> <base64 32 byte key>\" per line, the first wrapping new data keys, with which object bodies are encrypted before being written upstream and decrypted when read (empty disables)")
+		encryptBuckets   = fs.String("encryption.buckets", "", "comma-separated upstream buckets whose objects are encrypted, with -encryption.key-file (empty encrypts all)")
+		freezeState      = fs.String("freeze.state-file", "", "file persisting the buckets frozen through the admin API, so that they stay frozen after a restart (empty keeps them in memory only)")
+	)
+	fs.Usage = usageWithEnv(fs, envPrefix)
+	if err := setFlagsFromEnv(fs, envPrefix); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	fs.Parse(args)
+
+	var logger log.Logger
+	levels := &levelLogger{next: log.NewLogfmtLogger(os.Stderr)}
+	{
+		logger = levels
+		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
+		logger = log.With(logger, "caller", log.DefaultCaller)
+	}
+
+	// Trusting PROXY headers from anyone would let clients spoof the source
+	// addresses rate limits are keyed by.
+	if *proxyProtocol && *proxyTrusted == "" {
+		logger.Log("err", "-http.proxy-protocol requires -http.proxy-protocol-trusted")
+		return 1
+	}
+	// Scores decay by elapsed/half-life, which a zero or negative half-life
+	// turns into NaN or ever growing scores.
+	if *hotKeyHalfLife <= 0 {
+		logger.Log("err", "-hot-keys.half-life must be positive")
+		return 1
+	}
+
+	// ctx is cancelled on shutdown, stopping all background work.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var reloader *proxy_config.Reloader
+	{
+		var compressionBuckets []string
+		if *compressBuckets != "" {
+			compressionBuckets = strings.Split(*compressBuckets, ",")
+		}
+		var tagRules []cloud_storage.CacheTagRule
+		if *cacheBypassTags != "" {
+			for _, tag := range strings.Split(*cacheBypassTags, ",") {
+				key, value, _ := strings.Cut(tag, "=")
+				tagRules = append(tagRules, cloud_storage.CacheTagRule{Key: key, Value: value, Action: cloud_storage.CacheNever})
+			}
+		}
+		base := &proxy_config.Config{
+			LogLevel: *logLevel,
+			RateLimit: proxy_config.RateLimit{
+				RPS:   *rateLimitRPS,
+				Burst: *rateLimitBurst,
+			},
+			Bandwidth: proxy_config.Bandwidth{
+				ClientIngress: *clientIngress,
+				ClientEgress:  *clientEgress,
+				BucketIngress: *bucketIngress,
+				BucketEgress:  *bucketEgress,
+				BatchIngress:  *batchIngress,
+				BatchEgress:   *batchEgress,
+			},
+			Compression: proxy_config.Compression{
+				Buckets: compressionBuckets,
+			},
+			Cache: proxy_config.Cache{
+				HotThreshold:   *hotKeyThreshold,
+				AdmitThreshold: *hotKeyAdmit,
+				PinnedBytes:    *hotKeyPinned,
+				TagRules:       tagRules,
+				HeadTTL:        proxy_config.Duration(*headTTL),
+				MaxAge:         proxy_config.Duration(*cacheMaxAge),
+				WriteMode:      "writeBack",
+			},
+		}
+
+		var err error
+		reloader, err = proxy_config.NewReloader(*configFile, base, log.With(logger, "component", "config"))
+		if err != nil {
+			logger.Log("err", err)
+			return 1
+		}
+	}
+	conf := reloader.Current()
+	levels.SetLevel(conf.LogLevel)
+	reloader.OnReload(func(c *proxy_config.Config) {
+		levels.SetLevel(c.LogLevel)
+	})
+
+	var aws_s3_storage repository.ObjectStorage
+	var encryption *repository.EncryptionConfig
+	{
+		if *upstreamInsecure {
+			logger.Log("msg", "upstream TLS certificate verification disabled")
+		}
+		cfg, err := loadUpstreamConfig(*upstreamCA, *upstreamInsecure)
+		if err != nil {
+			logger.Log("err", err)
+			return 1
+		}
+
+		credentials := repository.NewReloadableCredentials(cfg.Credentials)
+		credentials.Set(conf.Credentials.AccessKeyID, conf.Credentials.SecretAccessKey, conf.Credentials.SessionToken)
+		reloader.OnReload(func(c *proxy_config.Config) {
+			credentials.Set(c.Credentials.AccessKeyID, c.Credentials.SecretAccessKey, c.Credentials.SessionToken)
+		})
+		cfg.Credentials = credentials
+
+		aws_s3_storage = repository.MakeAWSS3(newUpstreamClient(cfg, *objectStorageUrl, *usePathStyle))
+
+		// Tenants with a role in the config make upstream requests as it.
+		aws_s3_storage = repository.NewAssumedRoleStorage(aws_s3_storage, sts.NewFromConfig(cfg), *assumeRoleTTL, func(provider aws.CredentialsProvider) repository.ObjectStorage {
+			roleCfg := cfg.Copy()
+			roleCfg.Credentials = provider
+			return repository.MakeAWSS3(newUpstreamClient(roleCfg, *objectStorageUrl, *usePathStyle))
+		})
+
+		if *encryptionKeys != "" {
+			keys, err := repository.LoadLocalMasterKeys(*encryptionKeys)
+			if err != nil {
+				logger.Log("err", err)
+				return 1
+			}
+			encryption = &repository.EncryptionConfig{Keys: keys}
+			if *encryptBuckets != "" {
+				encryption.Buckets = strings.Split(*encryptBuckets, ",")
+			}
+		}
+
+		chaos := repository.ChaosConfig{
+			Latency:      *chaosLatency,
+			Jitter:       *chaosJitter,
+			ErrorRate:    *chaosErrorRate,
+			TruncateRate: *chaosTruncate,
+		}
+		if chaos.Enabled() {
+			logger.Log("msg", "chaos mode enabled, upstream faults will be injected", "latency", chaos.Latency, "jitter", chaos.Jitter, "errorRate", chaos.ErrorRate, "truncateRate", chaos.TruncateRate)
+			aws_s3_storage = repository.NewChaosStorage(aws_s3_storage, chaos)
+		}
+
+		// Inside of the circuit breaker, so that timeouts count as failures.
+		operations, err := parseDurations(*upstreamTimeouts)
+		if err != nil {
+			logger.Log("err", fmt.Errorf("-object-storage.operation-timeouts: %w", err))
+			return 1
+		}
+		timeouts := repository.TimeoutConfig{Default: *upstreamTimeout, Operations: operations, MaxRequest: *upstreamMaxReqTO}
+		if timeouts.Enabled() {
+			aws_s3_storage = repository.NewTimeoutStorage(aws_s3_storage, timeouts)
+		}
+	}
+
+	var readinessChecks []cloud_storage.ReadinessCheck
+	if *breakerFailures > 0 {
+		state := kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "s3proxy",
+			Subsystem: "upstream",
+			Name:      "circuit_breaker_state",
+			Help:      "State of the upstream circuit breaker: 0 closed, 1 half-open, 2 open.",
+		}, []string{})
+
+		cb := gobreaker.NewCircuitBreaker(gobreaker.Settings{
+			Name:    "upstream",
+			Timeout: *breakerTimeout,
+			ReadyToTrip: func(counts gobreaker.Counts) bool {
+				return counts.ConsecutiveFailures >= uint32(*breakerFailures)
+			},
+			IsSuccessful: func(err error) bool {
+				return !repository.IsUpstreamFailure(err)
+			},
+			OnStateChange: func(name string, from, to gobreaker.State) {
+				logger.Log("breaker", name, "from", from, "to", to)
+				state.Set(float64(to))
+			},
+		})
+		aws_s3_storage = repository.NewCircuitBreakerStorage(aws_s3_storage, cb)
+
+		readinessChecks = append(readinessChecks, func() error {
+			if cb.State() == gobreaker.StateOpen {
+				return fmt.Errorf("upstream circuit breaker is open")
+			}
+			return nil
+		})
+	}
+
+	// Outside of the circuit breaker, so that waiting for the budget never
+	// counts as a failure, and calls it rejects use none.
+	budget := repository.BudgetConfig{RequestsPerSecond: *upstreamRPS, Burst: *upstreamBurst, MaxQueue: *upstreamMaxQueue}
+	if budget.Enabled() {
+		aws_s3_storage = repository.NewBudgetStorage(aws_s3_storage, budget)
+	}
+
+	// Outside of the circuit breaker, so that decryption and the other local
+	// errors of encryption never count as failures, and of the budget, which
+	// each of the upstream calls it makes goes through.
+	if encryption != nil {
+		aws_s3_storage = repository.NewEncryptionStorage(aws_s3_storage, *encryption)
+	}
+
+	options := cloud_storage.ProxyOptions{
+		Backend: aws_s3_storage,
+		Logger:  logger,
+	}
+	if *metadataPath != "" {
+		windows, err := parseDurations(*metadataBuckets)
+		if err != nil {
+			logger.Log("err", fmt.Errorf("-metadata.bucket-windows: %w", err))
+			return 1
+		}
+		options.Metadata, err = cloud_storage.OpenMetadataStore(*metadataPath, *metadataWindow, windows)
+		if err != nil {
+			logger.Log("err", err)
+			return 1
+		}
+		defer options.Metadata.Close()
+		options.Metadata.SetOfflineListings(*offlineListings)
+	}
+	var adminTokens *cloud_storage.AdminTokens
+	if *adminTokenFile != "" {
+		tokens, err := cloud_storage.LoadAdminTokens(*adminTokenFile)
+		if err != nil {
+			logger.Log("err", err)
+			return 1
+		}
+		adminTokens = tokens
+	}
+	if *adminUI && adminTokens == nil {
+		logger.Log("err", "-admin.ui requires -admin.token-file")
+		return 1
+	}
+	freezes, err := cloud_storage.NewBucketFreezes(*freezeState, adminTokens, log.With(logger, "component", "audit"))
+	if err != nil {
+		logger.Log("err", err)
+		return 1
+	}
+	var hotKeyTracker *cloud_storage.HotKeyTracker
+	var scrubber *cloud_storage.CacheScrubber
+	var standby *cloud_storage.CacheStandby
+	{
+		cache, err := ristretto.NewCache(&ristretto.Config{
+			NumCounters: 1e5,     // number of keys to track frequency of (10M).
+			MaxCost:     1 << 35, // maximum cost of cache (1GB).
+			BufferItems: 64,      // number of keys per Get buffer.
+		})
+		if err != nil {
+			panic(err)
+		}
+		options.Cache = cache
+		options.CacheRequests = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "s3proxy",
+			Subsystem: "cache",
+			Name:      "requests_total",
+			Help:      "Number of cache lookups, partitioned by operation and result.",
+		}, []string{"operation", "result"})
+		if *hotKeys {
+			hotKeyTracker = cloud_storage.NewHotKeyTracker(cloud_storage.HotKeyConfig{
+				HalfLife:       *hotKeyHalfLife,
+				HotThreshold:   conf.Cache.HotThreshold,
+				AdmitThreshold: conf.Cache.AdmitThreshold,
+				MaxTrackedKeys: *hotKeyTracked,
+				PinnedBytes:    conf.Cache.PinnedBytes,
+			})
+			reloader.OnReload(func(c *proxy_config.Config) {
+				hotKeyTracker.SetPolicy(c.Cache.HotThreshold, c.Cache.AdmitThreshold, c.Cache.PinnedBytes)
+			})
+			options.CacheOptions = append(options.CacheOptions, cloud_storage.WithHotKeyTracker(hotKeyTracker))
+		}
+
+		if *peersSelf != "" && (*peersStatic != "" || *peersDNS != "") {
+			port := *peersPort
+			if port == "" {
+				_, port, _ = net.SplitHostPort(*adminAddr)
+			}
+			var static []string
+			if *peersStatic != "" {
+				static = strings.Split(*peersStatic, ",")
+			}
+			ring := cloud_storage.NewPeerRing(*peersSelf)
+			discovery := cloud_storage.NewPeerDiscovery(cloud_storage.PeerDiscoveryConfig{
+				Static:   static,
+				DNSName:  *peersDNS,
+				Port:     port,
+				Interval: *peersInterval,
+			}, ring, log.With(logger, "component", "peers"))
+			go discovery.Run(ctx)
+			if *peersCache {
+				options.CacheOptions = append(options.CacheOptions, cloud_storage.WithPeers(ring, &http.Client{}))
+			}
+			if *peersHints {
+				options.Middlewares = append(options.Middlewares, cloud_storage.RoutingHintMiddleware(ring))
+			}
+		}
+
+		options.CacheOptions = append(options.CacheOptions, cloud_storage.WithContext(ctx))
+		if *scrubInterval > 0 {
+			divergences := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+				Namespace: "s3proxy",
+				Subsystem: "cache",
+				Name:      "divergences_total",
+				Help:      "Number of cached objects evicted because they changed upstream, partitioned by reason.",
+			}, []string{"reason"})
+			scrubber = cloud_storage.NewCacheScrubber(cloud_storage.ScrubberConfig{
+				SampleSize: *scrubSample,
+				Batch:      *scrubBatch,
+				Interval:   *scrubInterval,
+			}, divergences, log.With(logger, "component", "scrubber"))
+			options.CacheOptions = append(options.CacheOptions, cloud_storage.WithScrubber(scrubber))
+		}
+		if *verifyContent {
+			corrupted := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+				Namespace: "s3proxy",
+				Subsystem: "cache",
+				Name:      "corrupted_total",
+				Help:      "Number of cached objects evicted because their content no longer matched its checksum.",
+			}, []string{})
+			options.CacheOptions = append(options.CacheOptions, cloud_storage.WithContentVerification(corrupted))
+		}
+		options.CacheOptions = append(options.CacheOptions, cloud_storage.WithCacheIndex(*indexSize))
+		options.CacheOptions = append(options.CacheOptions, cloud_storage.WithFreezes(freezes))
+		options.CacheOptions = append(options.CacheOptions, cloud_storage.WithUploadDeduplication(*dedupUploads))
+		if *standbyOf != "" {
+			standby = cloud_storage.NewCacheStandby(cloud_storage.CacheStandbyConfig{
+				Primary:  *standbyOf,
+				Interval: *standbyInterval,
+			}, &http.Client{Timeout: time.Minute}, log.With(logger, "component", "standby"))
+			options.CacheOptions = append(options.CacheOptions, cloud_storage.WithStandby(standby))
+		}
+		if *cachePartitions != "" {
+			budgets, err := parseSizes(*cachePartitions)
+			if err != nil {
+				logger.Log("err", fmt.Errorf("-cache.partitions: %w", err))
+				return 1
+			}
+			partitions, err := cloud_storage.NewCachePartitions(budgets)
+			if err != nil {
+				logger.Log("err", err)
+				return 1
+			}
+			for _, bucket := range partitions.Buckets() {
+				bucket := bucket
+				stdprometheus.MustRegister(stdprometheus.NewGaugeFunc(stdprometheus.GaugeOpts{
+					Namespace:   "s3proxy",
+					Subsystem:   "cache",
+					Name:        "partition_used_bytes",
+					Help:        "Bytes used by the cache partition of a bucket.",
+					ConstLabels: stdprometheus.Labels{"bucket": bucket},
+				}, func() float64 {
+					used, _ := partitions.Usage(bucket)
+					return float64(used)
+				}))
+				stdprometheus.MustRegister(stdprometheus.NewGaugeFunc(stdprometheus.GaugeOpts{
+					Namespace:   "s3proxy",
+					Subsystem:   "cache",
+					Name:        "partition_budget_bytes",
+					Help:        "Budget of the cache partition of a bucket in bytes.",
+					ConstLabels: stdprometheus.Labels{"bucket": bucket},
+				}, func() float64 {
+					_, budget := partitions.Usage(bucket)
+					return float64(budget)
+				}))
+			}
+			options.CacheOptions = append(options.CacheOptions, cloud_storage.WithCachePartitions(partitions))
+		}
+		options.CacheOptions = append(options.CacheOptions, cloud_storage.WithStale(cloud_storage.StaleConfig{
+			MaxAge:        *cacheMaxAge,
+			ServeStale:    *serveStale,
+			BucketListTTL: *bucketListTTL,
+		}))
+		metadataCache, err := cloud_storage.NewMetadataCache(*metadataBytes)
+		if err != nil {
+			logger.Log("err", err)
+			return 1
+		}
+		if metadataCache != nil {
+			stdprometheus.MustRegister(stdprometheus.NewGaugeFunc(stdprometheus.GaugeOpts{
+				Namespace: "s3proxy",
+				Subsystem: "cache",
+				Name:      "metadata_used_bytes",
+				Help:      "Bytes used by the cache of HEAD responses.",
+			}, func() float64 {
+				return float64(metadataCache.Metrics.CostAdded() - metadataCache.Metrics.CostEvicted())
+			}))
+		}
+		options.CacheOptions = append(options.CacheOptions, cloud_storage.WithMetadataCache(metadataCache, *headTTL))
+		if *bgWorkers > 0 {
+			rejected := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+				Namespace: "s3proxy",
+				Subsystem: "cache",
+				Name:      "background_rejected_total",
+				Help:      "Number of background tasks rejected because the background queue was full, partitioned by task.",
+			}, []string{"task"})
+			pool := cloud_storage.NewBackgroundPool(*bgWorkers, *bgQueue, rejected)
+			stdprometheus.MustRegister(stdprometheus.NewGaugeFunc(stdprometheus.GaugeOpts{
+				Namespace: "s3proxy",
+				Subsystem: "cache",
+				Name:      "background_tasks",
+				Help:      "Number of optional background tasks running or waiting for a worker.",
+			}, func() float64 {
+				return float64(pool.Tasks())
+			}))
+			options.CacheOptions = append(options.CacheOptions, cloud_storage.WithBackgroundPool(pool))
+		}
+		options.CacheOptions = append(options.CacheOptions, cloud_storage.WithRefreshLimit(*refreshRate, *refreshBurst))
+		options.CacheOptions = append(options.CacheOptions, cloud_storage.WithSyncWrites(cloud_storage.SyncWriteConfig{
+			Threshold: *syncThreshold,
+			PartSize:  *syncPartSize,
+		}))
+		options.CacheOptions = append(options.CacheOptions, cloud_storage.WithSpool(cloud_storage.SpoolConfig{
+			Dir:       *spoolDir,
+			Threshold: *spoolThreshold,
+		}))
+		if *multipartDir != "" {
+			options.CacheOptions = append(options.CacheOptions, cloud_storage.WithMultipartDir(*multipartDir))
+		}
+		options.CacheOptions = append(options.CacheOptions, cloud_storage.WithWriteBackLimits(cloud_storage.WriteBackLimits{
+			MaxBytes:   *writeBackBytes,
+			MaxUploads: *writeBackUploads,
+			Reject:     *writeBackReject,
+		}))
+
+		tagPolicy := cloud_storage.NewCacheTagPolicy(conf.Cache.TagRules)
+		rulePolicy := cloud_storage.NewCacheRulePolicy(conf.Cache.Rules)
+		reloader.OnReload(func(c *proxy_config.Config) {
+			tagPolicy.SetRules(c.Cache.TagRules)
+			rulePolicy.SetRules(c.Cache.Rules)
+		})
+		options.CacheOptions = append(options.CacheOptions, cloud_storage.WithCacheTagPolicy(tagPolicy))
+		options.CacheOptions = append(options.CacheOptions, cloud_storage.WithCacheRulePolicy(rulePolicy))
+	}
+
+	// The operation policy HEADs objects through the cache, once built.
+	operations := cloud_storage.NewOperationPolicy(conf.BucketOperations)
+	{
+		// Rate and bandwidth limits, compression and bucket mappings can be
+		// enabled by a config reload, so their middlewares are always in
+		// place; they are no-ops while disabled.
+		signature := cloud_storage.SignatureConfig{MaxSkew: *maxSkew, MaxExpires: *maxExpires}
+		if *sigRegions != "" {
+			signature.Regions = strings.Split(*sigRegions, ",")
+		}
+		if *sigServices != "" {
+			signature.Services = strings.Split(*sigServices, ",")
+		}
+		// The URLs presigned by POST /presign are verified, so that their
+		// expiry can't be changed, and the requests of tenants, so that
+		// nobody else gets their roles.
+		signingKeys := func(c *proxy_config.Config) map[string]string {
+			keys := map[string]string{}
+			for accessKey, secretKey := range c.TenantSecrets {
+				keys[accessKey] = secretKey
+			}
+			if *presignKey != "" && *presignSecret != "" {
+				keys[*presignKey] = *presignSecret
+			}
+			return keys
+		}
+		signature.Keys = cloud_storage.NewSigningKeys(signingKeys(conf))
+		options.Authentication = cloud_storage.SignatureMiddleware(signature)
+
+		limiter := cloud_storage.NewClientRateLimiter(conf.RateLimit.RPS, conf.RateLimit.Burst)
+		options.Middlewares = append(options.Middlewares, cloud_storage.RateLimitingMiddleware(limiter))
+
+		if *maxObjectSize > 0 {
+			options.Middlewares = append(options.Middlewares, cloud_storage.ObjectSizeMiddleware(*maxObjectSize))
+		}
+
+		var reads, writes *cloud_storage.ConcurrencyLimiter
+		if *maxReads > 0 {
+			reads = cloud_storage.NewConcurrencyLimiter(*maxReads, *queueTimeout)
+		}
+		if *maxWrites > 0 {
+			writes = cloud_storage.NewConcurrencyLimiter(*maxWrites, *queueTimeout)
+		}
+		if reads != nil || writes != nil {
+			options.Middlewares = append(options.Middlewares, cloud_storage.ConcurrencyMiddleware(reads, writes))
+		}
+
+		// Outside of the bandwidth limits, so that revalidated bodies aren't
+		// counted.
+		publicBuckets := cloud_storage.NewPublicCachePolicy(conf.PublicBuckets)
+		options.Middlewares = append(options.Middlewares, cloud_storage.PublicCacheMiddleware(publicBuckets))
+
+		// Outside of the bandwidth limits, which throttle batch requests.
+		tenantPriorities := cloud_storage.NewTenantPriorities(conf.TenantPriorities)
+		options.Middlewares = append(options.Middlewares, cloud_storage.TenantPriorityMiddleware(tenantPriorities))
+
+		ingress := cloud_storage.NewBandwidthLimiter(conf.Bandwidth.ClientIngress, conf.Bandwidth.BucketIngress, conf.Bandwidth.BatchIngress)
+		egress := cloud_storage.NewBandwidthLimiter(conf.Bandwidth.ClientEgress, conf.Bandwidth.BucketEgress, conf.Bandwidth.BatchEgress)
+		options.Middlewares = append(options.Middlewares, cloud_storage.BandwidthMiddleware(ingress, egress))
+
+		compression := cloud_storage.NewCompressionPolicy(conf.Compression.Buckets)
+		options.Middlewares = append(options.Middlewares, cloud_storage.CompressionMiddleware(compression))
+
+		// Inside of compression, so that transformed objects get compressed.
+		transforms := cloud_storage.NewTransformPolicy(conf.Transforms)
+		options.Middlewares = append(options.Middlewares, cloud_storage.TransformMiddleware(transforms, options.Cache, *transformMaxSize))
+
+		uploads := cloud_storage.NewUploadPolicy(conf.UploadRules)
+		options.Middlewares = append(options.Middlewares, cloud_storage.UploadRulesMiddleware(uploads))
+
+		keyRewriter := cloud_storage.NewKeyRewriter(conf.KeyRewrites)
+		options.Middlewares = append(options.Middlewares, cloud_storage.KeyRewriteMiddleware(keyRewriter, log.With(logger, "component", "rewrite")))
+
+		bucketMapping := cloud_storage.NewBucketMapping(conf.BucketMappings)
+		options.Middlewares = append(options.Middlewares, cloud_storage.BucketMappingMiddleware(bucketMapping))
+
+		tenantRoles := cloud_storage.NewTenantRoles(conf.TenantRoles)
+		options.Middlewares = append(options.Middlewares, cloud_storage.TenantRoleMiddleware(tenantRoles))
+
+		virtualBuckets := cloud_storage.NewVirtualBuckets(conf.VirtualBuckets)
+		options.Middlewares = append(options.Middlewares, cloud_storage.VirtualBucketMiddleware(virtualBuckets))
+
+		// After mappings and rewrites, so that upstream objects are sampled.
+		if *rangeRate > 0 {
+			sampler, err := cloud_storage.NewRangeSampler(cloud_storage.RangeSampleConfig{
+				Rate:     *rangeRate,
+				Path:     *rangeFile,
+				MaxSize:  *rangeMaxSize,
+				MaxFiles: *rangeMaxFiles,
+				Salt:     *rangeSalt,
+			}, kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+				Namespace: "s3proxy",
+				Subsystem: "range",
+				Name:      "length_bytes",
+				Help:      "Lengths of the sampled GET requests.",
+				Buckets:   stdprometheus.ExponentialBuckets(1<<10, 4, 10),
+			}, []string{}), kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+				Namespace: "s3proxy",
+				Subsystem: "range",
+				Name:      "offset_ratio",
+				Help:      "Offsets of the sampled GET requests, as fractions of the object sizes.",
+				Buckets:   stdprometheus.LinearBuckets(0, 0.1, 10),
+			}, []string{}), log.With(logger, "component", "range-samples"))
+			if err != nil {
+				logger.Log("err", err)
+				return 1
+			}
+			defer sampler.Close()
+			options.Middlewares = append(options.Middlewares, cloud_storage.RangeSamplingMiddleware(sampler))
+		}
+
+		// Innermost, so that policies apply to upstream buckets.
+		archive := cloud_storage.NewArchivePolicy(conf.ArchiveRestore)
+		options.Middlewares = append(options.Middlewares, cloud_storage.ArchiveRestoreMiddleware(archive, aws_s3_storage, log.With(logger, "component", "archive")))
+		options.Middlewares = append(options.Middlewares, cloud_storage.OperationPolicyMiddleware(operations, aws_s3_storage))
+		// After every check, so that dry runs fail as writes would.
+		options.Middlewares = append(options.Middlewares, cloud_storage.FreezeMiddleware(freezes))
+		dryRun := cloud_storage.NewDryRunPolicy(conf.DryRun)
+		options.Middlewares = append(options.Middlewares, cloud_storage.DryRunMiddleware(dryRun, options.Cache, log.With(logger, "component", "dry-run")))
+		// Innermost too, so that versions are read from upstream buckets.
+		options.Middlewares = append(options.Middlewares, cloud_storage.TimeTravelMiddleware(aws_s3_storage))
+
+		reloader.OnReload(func(c *proxy_config.Config) {
+			limiter.SetLimit(c.RateLimit.RPS, c.RateLimit.Burst)
+			ingress.SetLimits(c.Bandwidth.ClientIngress, c.Bandwidth.BucketIngress, c.Bandwidth.BatchIngress)
+			egress.SetLimits(c.Bandwidth.ClientEgress, c.Bandwidth.BucketEgress, c.Bandwidth.BatchEgress)
+			publicBuckets.SetBuckets(c.PublicBuckets)
+			compression.SetBuckets(c.Compression.Buckets)
+			transforms.SetRules(c.Transforms)
+			uploads.SetRules(c.UploadRules)
+			keyRewriter.SetRules(c.KeyRewrites)
+			bucketMapping.Set(c.BucketMappings)
+			virtualBuckets.Set(c.VirtualBuckets)
+			signature.Keys.Set(signingKeys(c))
+			tenantRoles.Set(c.TenantRoles)
+			tenantPriorities.Set(c.TenantPriorities)
+			archive.SetPolicies(c.ArchiveRestore)
+			operations.SetPolicies(c.BucketOperations)
+			dryRun.SetConfig(c.DryRun)
+		})
+	}
+
+	// The authorizer runs first once requests are authenticated, seeing them
+	// as sent by clients.
+	if *authzURL != "" {
+		authorizer, err := cloud_storage.NewWebhookAuthorizer(*authzURL, *authzTimeout, *authzCacheTTL, *authzFailOpen)
+		if err != nil {
+			logger.Log("err", err)
+			return 1
+		}
+		options.Hooks = append(options.Hooks, authorizer)
+	}
+	if *luaScript != "" {
+		hook, err := cloud_storage.NewLuaHook(*luaScript, *luaTimeout, *luaMaxStack, *luaMaxMemory)
+		if err != nil {
+			logger.Log("err", err)
+			return 1
+		}
+		options.Hooks = append(options.Hooks, hook)
+	}
+
+	mode, err := cloud_storage.ParseXMLMode(*xmlMode)
+	if err != nil {
+		logger.Log("err", fmt.Errorf("-s3.xml-mode: %w", err))
+		return 1
+	}
+	options.XMLMode = mode
+	if *probeStubs != "" {
+		options.ProbeStubs = strings.Split(*probeStubs, ",")
+	}
+	proxy, err := cloud_storage.NewProxy(options)
+	if err != nil {
+		logger.Log("err", err)
+		return 1
+	}
+	if proxy.Cache != nil {
+		operations.SetCache(proxy.Cache)
+		tune := func(c *proxy_config.Config) {
+			proxy.Cache.SetTuning(cloud_storage.CacheTuning{
+				HeadTTL: time.Duration(c.Cache.HeadTTL),
+				MaxAge:  time.Duration(c.Cache.MaxAge),
+				SyncAll: c.Cache.WriteMode == "sync",
+			})
+		}
+		tune(conf)
+		reloader.OnReload(tune)
+	}
+
+	if scrubber != nil {
+		go scrubber.Run(ctx)
+	}
+	if standby != nil {
+		go standby.Run(ctx)
+	}
+
+	errs := make(chan error)
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+		errs <- fmt.Errorf("%s", <-c)
+	}()
+
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGHUP)
+		for range c {
+			if _, err := reloader.Reload(); err != nil {
+				logger.Log("signal", "SIGHUP", "err", err)
+			}
+		}
+	}()
+
+	go func() {
+		ln, err := net.Listen("tcp", *httpAddr)
+		if err != nil {
+			errs <- err
+			return
+		}
+		if *proxyProtocol {
+			pln := &proxyproto.Listener{
+				Listener:          ln,
+				ReadHeaderTimeout: 5 * time.Second,
+			}
+			pln.Policy, err = proxyproto.LaxWhiteListPolicy(strings.Split(*proxyTrusted, ","))
+			if err != nil {
+				errs <- err
+				return
+			}
+			ln = pln
+		}
+		logger.Log("transport", "HTTP", "addr", *httpAddr, "proxyProtocol", *proxyProtocol)
+		errs <- http.Serve(ln, proxy)
+	}()
+
+	// Background work which must run on one replica only; it is gated by
+	// leader election when enabled.
+	var backgroundWork []func(ctx context.Context)
+
+	inventory := cloud_storage.NewInventoryExporter(proxy.Storage, proxy.Cache, log.With(logger, "component", "inventory"))
+	if *inventoryBuckets != "" {
+		destination, prefix, _ := strings.Cut(*inventoryDest, "/")
+		if destination == "" {
+			logger.Log("err", "-inventory.destination is required with -inventory.buckets")
+			return 1
+		}
+		var configs []cloud_storage.InventoryConfig
+		for _, bucket := range strings.Split(*inventoryBuckets, ",") {
+			configs = append(configs, cloud_storage.InventoryConfig{Bucket: bucket, Destination: destination, DestinationPrefix: prefix})
+		}
+		backgroundWork = append(backgroundWork, func(ctx context.Context) {
+			inventory.Schedule(ctx, *inventoryEvery, configs)
+		})
+	}
+
+	adminRoutes := []cloud_storage.AdminRoutes{reloader.AdminRoutes, proxy.AdminRoutes, inventory.AdminRoutes, freezes.AdminRoutes}
+	if *presignURL != "" {
+		if *presignToken == "" || *presignKey == "" || *presignSecret == "" {
+			logger.Log("err", "-presign.url requires -presign.token, -presign.access-key and -presign.secret-key")
+			return 1
+		}
+		if *maxExpires > 0 && *presignExpires > *maxExpires {
+			logger.Log("err", "-presign.expires must be at most -signature.max-expires")
+			return 1
+		}
+		presigner := cloud_storage.NewPresigner(cloud_storage.PresignConfig{
+			URL:         *presignURL,
+			Credentials: aws.Credentials{AccessKeyID: *presignKey, SecretAccessKey: *presignSecret},
+			Region:      *presignRegion,
+			Expires:     *presignExpires,
+			MaxExpires:  *maxExpires,
+			Token:       *presignToken,
+		}, log.With(logger, "component", "presign"))
+		adminRoutes = append(adminRoutes, presigner.AdminRoutes)
+	}
+	{
+		if *leaderLock != "" {
+			bucket, key, _ := strings.Cut(*leaderLock, "/")
+			if key == "" {
+				logger.Log("err", "-leader-election.lock must be bucket/key")
+				return 1
+			}
+			identity := *leaderID
+			if identity == "" {
+				identity, _ = os.Hostname()
+			}
+			elector := cloud_storage.NewLeaderElector(cloud_storage.LeaderElectionConfig{
+				Bucket:        bucket,
+				Key:           key,
+				Identity:      identity,
+				LeaseDuration: *leaderLease,
+				RetryPeriod:   *leaderRetry,
+			}, aws_s3_storage, log.With(logger, "component", "leader"))
+			for _, work := range backgroundWork {
+				elector.AddWorker(work)
+			}
+			adminRoutes = append(adminRoutes, elector.AdminRoutes)
+			go elector.Run(ctx)
+		} else {
+			for _, work := range backgroundWork {
+				go work(ctx)
+			}
+		}
+	}
+
+	go func() {
+		if hotKeyTracker != nil {
+			adminRoutes = append(adminRoutes, hotKeyTracker.AdminRoutes)
+		}
+		if *adminUI {
+			adminRoutes = append(adminRoutes, proxy.UIRoutes(adminTokens))
+		}
+		adminHandler := cloud_storage.MakeAdminHTTPHandler(log.With(logger, "component", "admin"), readinessChecks, adminRoutes...)
+		logger.Log("transport", "admin", "addr", *adminAddr)
+		errs <- http.ListenAndServe(*adminAddr, adminHandler)
+	}()
+
+	if *adminGRPCAddr != "" {
+		go func() {
+			ln, err := net.Listen("tcp", *adminGRPCAddr)
+			if err != nil {
+				errs <- err
+				return
+			}
+			svc := admin.NewService(proxy.Cache, reloader, readinessChecks)
+			server := grpc.NewServer()
+			adminpb.RegisterAdminServer(server, admin.NewGRPCServer(admin.MakeEndpoints(svc), log.With(logger, "component", "grpc-admin")))
+			logger.Log("transport", "gRPC", "addr", *adminGRPCAddr)
+			errs <- server.Serve(ln)
+		}()
+	}
+
+	logger.Log("exit", <-errs)
+	if proxy.Cache != nil {
+		flushCtx, flushCancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer flushCancel()
+		if pending := proxy.Cache.Flush(flushCtx); pending > 0 {
+			logger.Log("msg", "cancelling pending write-back uploads", "pending", pending)
+		}
+	}
+	return 0
+}
+
+// loadUpstreamConfig loads the AWS config for the upstream, trusting the CAs
+// in caFile in addition to the system ones, with loadOptions.
+func loadUpstreamConfig(caFile string, insecure bool, loadOptions ...func(*config.LoadOptions) error) (aws.Config, error) {
+	if caFile != "" || insecure {
+		tlsConfig, err := upstreamTLSConfig(caFile, insecure)
+		if err != nil {
+			return aws.Config{}, err
+		}
+		loadOptions = append(loadOptions, config.WithHTTPClient(awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+			tr.TLSClientConfig = tlsConfig
+		})))
+	}
+	return config.LoadDefaultConfig(context.TODO(), loadOptions...)
+}
+
+// newUpstreamClient returns an S3 client for the upstream at url, or AWS if
+// url is empty. Requests for S3 Express One Zone directory buckets use
+// session authentication.
+func newUpstreamClient(cfg aws.Config, url string, pathStyle bool) *s3.Client {
+	return s3.NewFromConfig(cfg, repository.NewExpressSigner(cfg.HTTPClient).ClientOptions, func(o *s3.Options) {
+		o.Retryer = aws.NopRetryer{}
+		o.UsePathStyle = pathStyle
+		if url != "" {
+			o.BaseEndpoint = aws.String(url)
+		}
+	})
+}
+
+// parseDurations parses comma-separated name=duration pairs.
+func parseDurations(s string) (map[string]time.Duration, error) {
+	durations := map[string]time.Duration{}
+	if s == "" {
+		return durations, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid duration %q", pair)
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		durations[name] = d
+	}
+	return durations, nil
+}
+
+// parseSizes parses comma-separated name=bytes pairs.
+func parseSizes(s string) (map[string]int64, error) {
+	sizes := map[string]int64{}
+	for _, pair := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid size %q", pair)
+		}
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("%s: invalid size %q", name, value)
+		}
+		sizes[name] = size
+	}
+	return sizes, nil
+}
+
+// upstreamTLSConfig returns the TLS config for upstream connections, trusting
+// the system CAs plus those in caFile, if any.
+func upstreamTLSConfig(caFile string, insecure bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: insecure}
+	if caFile == "" {
+		return tlsConfig, nil
+	}
+
+	bundle, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	tlsConfig.RootCAs = pool
+	return tlsConfig, nil
+}